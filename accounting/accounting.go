@@ -0,0 +1,148 @@
+// Package accounting exports the usage of the clients of IPSEC packet
+// forwarders, for providers that bill or audit the users they forward: a
+// record of each session when it starts, stops and optionally in between,
+// with the bytes and packets forwarded each way. Records go to a RADIUS
+// accounting server, a CSV file, a webhook or an audit log, see
+// ipsec.Forwarder.SetAccounting.
+package accounting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// WebhookTimeout bounds each request of a Webhook.
+const WebhookTimeout = 10 * time.Second
+
+// csvHeader names the columns written by CSV.
+var csvHeader = []string{
+	"type", "session", "client", "destination", "start", "time", "duration",
+	"packets_to_server", "bytes_to_server", "packets_to_client", "bytes_to_client",
+	"reason",
+}
+
+// CSVWriter writes accounting records as CSV, one line each, after a header.
+type CSVWriter struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	closer io.Closer
+	header bool // whether the header is still to be written
+}
+
+// CSV returns a CSVWriter writing to w. Times are in RFC 3339 and durations
+// in seconds.
+func CSV(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w), header: true}
+}
+
+// OpenCSV returns a CSVWriter appending to the file at path, which is
+// created if needed. The header is only written to an empty file.
+func OpenCSV(path string) (*CSVWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	c := CSV(file)
+	c.closer = file
+	c.header = info.Size() == 0
+	return c, nil
+}
+
+// Export writes record and flushes it.
+func (c *CSVWriter) Export(record ipsec.AccountingRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.header {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.header = false
+	}
+	c.w.Write([]string{
+		record.Type,
+		record.Session,
+		record.Client,
+		record.Destination,
+		record.Start.UTC().Format(time.RFC3339),
+		record.Time.UTC().Format(time.RFC3339),
+		strconv.FormatFloat(record.Duration.Seconds(), 'f', 3, 64),
+		strconv.FormatInt(record.PacketsToServer, 10),
+		strconv.FormatInt(record.BytesToServer, 10),
+		strconv.FormatInt(record.PacketsToClient, 10),
+		strconv.FormatInt(record.BytesToClient, 10),
+		record.Reason,
+	})
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// Close closes the file opened by OpenCSV, if any.
+func (c *CSVWriter) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// Webhook returns an accounter posting each record as JSON to url, failing
+// unless it answers with a 2xx status.
+func Webhook(url string) ipsec.Accounter {
+	return &webhook{url: url, client: &http.Client{Timeout: WebhookTimeout}}
+}
+
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (h *webhook) Export(record ipsec.AccountingRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("accounting: %s: %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// Parse returns the accounter described by spec: radius:host[:port] for a
+// RADIUS accounting server sharing secret, an http or https URL for a
+// Webhook, or a path, optionally prefixed with csv:, for OpenCSV. Accounters
+// that hold resources implement io.Closer.
+func Parse(spec, secret string) (ipsec.Accounter, error) {
+	switch {
+	case strings.HasPrefix(spec, "radius:"):
+		return NewRADIUS(strings.TrimPrefix(spec, "radius:"), secret)
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return Webhook(spec), nil
+	case spec == "":
+		return nil, errors.New("accounting: empty exporter")
+	default:
+		return OpenCSV(strings.TrimPrefix(spec, "csv:"))
+	}
+}
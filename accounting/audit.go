@@ -0,0 +1,148 @@
+package accounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// AuditLog appends a JSON line for each session start and stop to a file,
+// for compliance records of VPN access kept apart from the log of the
+// forwarder: the client, the destination it was forwarded to, the bytes and
+// packets each way and why it was disconnected. Interim records are left
+// out. Each line is synced to disk before the next is written.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// OpenAuditLog returns an AuditLog appending to the file at path, which is
+// created if needed. Once the file exceeds maxSize bytes it is renamed to
+// path.1, the older files moving up to path.2 and so on, keeping at most
+// maxFiles of them, or the oldest records are deleted if maxFiles is zero. A
+// maxSize of zero never rotates the file.
+func OpenAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	l := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at l.path for appending.
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Export appends record unless it is an interim record.
+func (l *AuditLog) Export(record ipsec.AccountingRecord) error {
+	if record.Type == ipsec.AccountingInterim {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil && l.file == nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// rotate moves the full file aside and starts a new one. Should moving it
+// fail, records go on being appended to it.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	var err error
+	if l.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+	if e := l.open(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Close closes the file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Multi returns an accounter exporting each record to every accounter in
+// turn, such as to an AuditLog and a RADIUS server, returning the first
+// error. It closes those that implement io.Closer when closed.
+func Multi(accounters ...ipsec.Accounter) ipsec.Accounter {
+	return multi(accounters)
+}
+
+type multi []ipsec.Accounter
+
+func (m multi) Export(record ipsec.AccountingRecord) error {
+	var err error
+	for _, accounter := range m {
+		if e := accounter.Export(record); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m multi) Close() error {
+	var err error
+	for _, accounter := range m {
+		if closer, ok := accounter.(io.Closer); ok {
+			if e := closer.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+package accounting
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// DefaultRADIUSPort is the port of RADIUS accounting servers unless given.
+const DefaultRADIUSPort = "1813"
+
+// Defaults of RADIUS.
+const (
+	DefaultRADIUSTimeout = 3 * time.Second
+	DefaultRADIUSRetries = 2
+	DefaultNASIdentifier = "ipsecfwd"
+)
+
+// RADIUS codes and attributes used, see RFC 2865 and RFC 2866.
+const (
+	codeAccountingRequest  = 4
+	codeAccountingResponse = 5
+
+	attrUserName            = 1
+	attrFramedIPAddress     = 8
+	attrCalledStationID     = 30
+	attrCallingStationID    = 31
+	attrNASIdentifier       = 32
+	attrAcctStatusType      = 40
+	attrAcctDelayTime       = 41
+	attrAcctInputOctets     = 42
+	attrAcctOutputOctets    = 43
+	attrAcctSessionID       = 44
+	attrAcctSessionTime     = 46
+	attrAcctInputPackets    = 47
+	attrAcctOutputPackets   = 48
+	attrAcctTerminateCause  = 49
+	attrAcctInputGigawords  = 52
+	attrAcctOutputGigawords = 53
+	attrEventTimestamp      = 55
+)
+
+// statusTypes maps the types of records to Acct-Status-Type.
+var statusTypes = map[string]uint32{
+	ipsec.AccountingStart:   1,
+	ipsec.AccountingStop:    2,
+	ipsec.AccountingInterim: 3,
+}
+
+// terminateCauses maps the reasons clients are disconnected to
+// Acct-Terminate-Cause. Other reasons are reported as NAS Request.
+var terminateCauses = map[string]uint32{
+	"timeout":          4,  // Idle Timeout
+	"read error":       3,  // Lost Service
+	"failover":         3,  // Lost Service
+	"disconnected":     6,  // Admin Reset
+	"drained":          6,  // Admin Reset
+	"pinned":           6,  // Admin Reset
+	"forwarder closed": 11, // NAS Reboot
+}
+
+const causeNASRequest = 10
+
+// RADIUS is an accounter sending RADIUS Accounting-Request packets. The
+// client's IP is its User-Name and Framed-IP-Address, its address its
+// Calling-Station-Id and the destination the Called-Station-Id. The bytes
+// from the client are input and those to it output.
+type RADIUS struct {
+	// NASIdentifier is sent in every request, DefaultNASIdentifier unless
+	// set before the first Export.
+	NASIdentifier string
+	// Timeout is how long to wait for a response before retrying, up to
+	// Retries times.
+	Timeout time.Duration
+	Retries int
+
+	conn   *net.UDPConn
+	secret []byte
+
+	mu sync.Mutex // one request at a time, as the responses are read in turn
+	id uint8
+}
+
+// NewRADIUS returns a RADIUS accounter for the server at addr, whose port
+// defaults to DefaultRADIUSPort, sharing secret with it.
+func NewRADIUS(addr, secret string) (*RADIUS, error) {
+	if secret == "" {
+		return nil, errors.New("accounting: RADIUS needs a shared secret")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultRADIUSPort)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &RADIUS{
+		NASIdentifier: DefaultNASIdentifier,
+		Timeout:       DefaultRADIUSTimeout,
+		Retries:       DefaultRADIUSRetries,
+		conn:          conn,
+		secret:        []byte(secret),
+		id:            randomID(),
+	}, nil
+}
+
+// Export sends record and waits for the server to acknowledge it, retrying
+// after Timeout. Forwarders sharing a RADIUS wait for each other's requests.
+func (r *RADIUS) Export(record ipsec.AccountingRecord) error {
+	status, ok := statusTypes[record.Type]
+	if !ok {
+		return fmt.Errorf("accounting: unknown record type %q", record.Type)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id++
+	request := r.request(r.id, status, record)
+
+	response := make([]byte, 4096)
+	for try := 0; try <= r.Retries; try++ {
+		if _, err := r.conn.Write(request); err != nil {
+			return err
+		}
+		r.conn.SetReadDeadline(time.Now().Add(r.Timeout))
+		for {
+			n, err := r.conn.Read(response)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if r.acknowledges(response[:n], request) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("accounting: no response from RADIUS server %s", r.conn.RemoteAddr())
+}
+
+// Close closes the socket to the server.
+func (r *RADIUS) Close() error {
+	return r.conn.Close()
+}
+
+// request returns the Accounting-Request of record with identifier id.
+func (r *RADIUS) request(id uint8, status uint32, record ipsec.AccountingRecord) []byte {
+	var attrs bytes.Buffer
+	str := func(typ uint8, value string) {
+		if len(value) > 253 {
+			value = value[:253]
+		}
+		attrs.WriteByte(typ)
+		attrs.WriteByte(uint8(2 + len(value)))
+		attrs.WriteString(value)
+	}
+	integer := func(typ uint8, value uint32) {
+		var b [6]byte
+		b[0], b[1] = typ, 6
+		binary.BigEndian.PutUint32(b[2:], value)
+		attrs.Write(b[:])
+	}
+
+	if r.NASIdentifier != "" {
+		str(attrNASIdentifier, r.NASIdentifier)
+	}
+	integer(attrAcctStatusType, status)
+	str(attrAcctSessionID, record.Session)
+	host := record.Client
+	if h, _, err := net.SplitHostPort(record.Client); err == nil {
+		host = h
+	}
+	str(attrUserName, host)
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		integer(attrFramedIPAddress, binary.BigEndian.Uint32(ip))
+	}
+	str(attrCallingStationID, record.Client)
+	str(attrCalledStationID, record.Destination)
+	integer(attrEventTimestamp, uint32(record.Time.Unix()))
+	integer(attrAcctDelayTime, uint32(time.Since(record.Time)/time.Second))
+	if status != statusTypes[ipsec.AccountingStart] {
+		integer(attrAcctSessionTime, uint32(record.Duration/time.Second))
+		integer(attrAcctInputOctets, uint32(record.BytesToServer))
+		integer(attrAcctInputGigawords, uint32(record.BytesToServer>>32))
+		integer(attrAcctOutputOctets, uint32(record.BytesToClient))
+		integer(attrAcctOutputGigawords, uint32(record.BytesToClient>>32))
+		integer(attrAcctInputPackets, uint32(record.PacketsToServer))
+		integer(attrAcctOutputPackets, uint32(record.PacketsToClient))
+	}
+	if status == statusTypes[ipsec.AccountingStop] {
+		cause, ok := terminateCauses[record.Reason]
+		if !ok {
+			cause = causeNASRequest
+		}
+		integer(attrAcctTerminateCause, cause)
+	}
+
+	// The Request Authenticator is the MD5 of the packet with a zero
+	// authenticator followed by the secret, see RFC 2866 section 3.
+	packet := make([]byte, 20, 20+attrs.Len())
+	packet[0] = codeAccountingRequest
+	packet[1] = id
+	packet = append(packet, attrs.Bytes()...)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	sum := md5.Sum(append(append([]byte(nil), packet...), r.secret...))
+	copy(packet[4:20], sum[:])
+	return packet
+}
+
+// acknowledges reports whether response is the Accounting-Response to
+// request, authenticated with the secret.
+func (r *RADIUS) acknowledges(response, request []byte) bool {
+	if len(response) < 20 || response[0] != codeAccountingResponse || response[1] != request[1] {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(response[2:]))
+	if length < 20 || length > len(response) {
+		return false
+	}
+	h := md5.New()
+	h.Write(response[:4])
+	h.Write(request[4:20])
+	h.Write(response[20:length])
+	h.Write(r.secret)
+	return bytes.Equal(h.Sum(nil), response[4:20])
+}
+
+// randomID returns a random first identifier, so that a restarted forwarder
+// does not repeat the identifiers of requests the server may still remember.
+func randomID() uint8 {
+	var b [1]byte
+	rand.Read(b[:])
+	return b[0]
+}
@@ -0,0 +1,317 @@
+// Package admin contains an HTTP API for inspecting and controlling a running
+// IPSEC packet forwarder.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Target is what the admin API inspects and controls, an *ipsec.Forwarder or
+// an *ipsec.Pair.
+type Target interface {
+	ClientStats() []ipsec.ClientStat
+	Disconnect(addr string) error
+	Destinations() []ipsec.WeightedDest
+	SetDestinations(dsts []ipsec.WeightedDest) error
+	Timeout() time.Duration
+	SetTimeout(timeout time.Duration)
+	Health() ipsec.Health
+	Drain(addr string, timeout time.Duration) (ipsec.DrainStatus, error)
+	Undrain(addr string) error
+	Draining() []ipsec.DrainStatus
+	Bans() []ipsec.Ban
+	Unban(ip string) error
+	RTT() []ipsec.DestinationRTT
+	Snapshot() ipsec.Snapshot
+}
+
+// timeout is the JSON form of a timeout.
+type timeout struct {
+	Timeout string `json:"timeout"`
+}
+
+// Handler returns an http.Handler serving the admin API of f:
+//
+//	GET    /clients        lists the connected clients as JSON, those in
+//	                       ?network=10.0.0.0/8, of ?destination= or idle
+//	                       ?idle=5m or more if given, see ipsec.ClientFilter
+//	DELETE /clients/{addr} disconnects the client at addr
+//	GET    /sessions       lists the clients as text, see WriteConntrack
+//	GET    /destinations   lists the destinations as JSON
+//	PUT    /destinations   replaces the destinations
+//	GET    /timeout        returns the client timeout, e.g. {"timeout":"10s"}
+//	PUT    /timeout        sets the client timeout
+//	GET    /healthz        returns the health as JSON, with status 503 if
+//	                       the listeners failed or no destination is reachable
+//	GET    /drain          lists the destinations being drained as JSON
+//	PUT    /drain/{addr}   drains the destination at addr, disconnecting its
+//	                       clients after the timeout given as in /timeout, if
+//	                       any, and returns its remaining clients as JSON
+//	DELETE /drain/{addr}   stops draining the destination at addr
+//	GET    /bans           lists the banned source addresses as JSON
+//	DELETE /bans/{ip}      lifts the ban of ip
+//	GET    /rtt            lists the round trip time and jitter measured to
+//	                       each destination as JSON, in nanoseconds
+//	GET    /status         returns the uptime, listeners, health, clients,
+//	                       traffic and destinations as JSON, see
+//	                       ipsec.Snapshot, with the version of its format
+func Handler(f Target) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := clientFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, ipsec.FilterClients(f.ClientStats(), filter))
+	})
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		addr, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/clients/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.Disconnect(addr); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteConntrack(w, f.ClientStats())
+	})
+	mux.HandleFunc("/destinations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, f.Destinations())
+		case http.MethodPut:
+			var dsts []ipsec.WeightedDest
+			if err := json.NewDecoder(r.Body).Decode(&dsts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := f.SetDestinations(dsts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/timeout", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, timeout{Timeout: f.Timeout().String()})
+		case http.MethodPut:
+			var t timeout
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d, err := time.ParseDuration(t.Timeout)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			f.SetTimeout(d)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		health := f.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !health.OK() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		draining := f.Draining()
+		if draining == nil {
+			draining = []ipsec.DrainStatus{}
+		}
+		writeJSON(w, draining)
+	})
+	mux.HandleFunc("/drain/", func(w http.ResponseWriter, r *http.Request) {
+		addr, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/drain/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var t timeout
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil && err != io.EOF {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var d time.Duration
+			if t.Timeout != "" {
+				d, err = time.ParseDuration(t.Timeout)
+				if err != nil || d < 0 {
+					http.Error(w, "invalid timeout", http.StatusBadRequest)
+					return
+				}
+			}
+			status, err := f.Drain(addr, d)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			writeJSON(w, status)
+		case http.MethodDelete:
+			if err := f.Undrain(addr); err != nil {
+				httpError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		bans := f.Bans()
+		if bans == nil {
+			bans = []ipsec.Ban{}
+		}
+		writeJSON(w, bans)
+	})
+	mux.HandleFunc("/bans/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ip, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/bans/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.Unban(ip); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/rtt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, f.RTT())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, f.Snapshot())
+	})
+	return mux
+}
+
+// ListenAndServe serves the admin API of f on addr, see Listen.
+func ListenAndServe(addr string, f Target) error {
+	l, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, Handler(f))
+}
+
+// Listen returns a listener for the admin API on addr, a TCP address or
+// unix:path for a Unix socket, whose file permissions restrict access to the
+// API. A socket left over at path by a process that is gone is replaced.
+func Listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func clientFilter(query url.Values) (ipsec.ClientFilter, error) {
+	filter := ipsec.ClientFilter{Destination: query.Get("destination")}
+	if network := query.Get("network"); network != "" {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return filter, err
+		}
+		filter.Network = ipNet
+	}
+	if idle := query.Get("idle"); idle != "" {
+		d, err := time.ParseDuration(idle)
+		if err != nil {
+			return filter, err
+		}
+		filter.IdleFor = d
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ipsec.ErrUnknownClient), errors.Is(err, ipsec.ErrUnknownDestination), errors.Is(err, ipsec.ErrUnknownProfile):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ipsec.ErrClosed):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
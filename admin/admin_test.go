@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+	"github.com/bytejedi/ipsec-forward/ipsectest"
+)
+
+func TestListAndKickClients(t *testing.T) {
+	h, err := ipsectest.Start(ipsec.Config{Timeout: time.Minute}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var clients []*ipsectest.Client
+	for i := 0; i < 2; i++ {
+		c, err := h.NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	server := httptest.NewServer(Handler(h.Forwarder))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats []ipsec.ClientStat
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, stat := range stats {
+		listed[stat.Addr] = true
+	}
+	if len(stats) != len(clients) || !listed[clients[0].Addr().String()] || !listed[clients[1].Addr().String()] {
+		t.Fatalf("listed %+v, want the %d clients", stats, len(clients))
+	}
+
+	kick := func(addr string) int {
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/clients/"+url.PathEscape(addr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	kicked := clients[0].Addr().String()
+	if status := kick(kicked); status != http.StatusNoContent {
+		t.Errorf("kicking a client returned status %d, want %d", status, http.StatusNoContent)
+	}
+	if h.Connected(clients[0]) {
+		t.Error("kicked client still connected")
+	}
+	if !h.Connected(clients[1]) {
+		t.Error("other client kicked too")
+	}
+	if status := kick(kicked); status != http.StatusNotFound {
+		t.Errorf("kicking an unknown client returned status %d, want %d", status, http.StatusNotFound)
+	}
+
+	resp, err = http.Post(server.URL+"/clients", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("posting to /clients returned status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
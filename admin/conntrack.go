@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// WriteConntrack writes stats to w one client per line in the format of
+// conntrack -L, for correlating the clients with the state of firewalls:
+//
+//	udp      17 27 src=CLIENT dst=LISTENER sport=.. dport=.. packets=.. bytes=.. src=DESTINATION dst=LOCAL sport=.. dport=.. packets=.. bytes=.. [ASSURED] mark=0 use=1 age=33
+//
+// The third field is the number of seconds left before the client times out
+// and the last its age in seconds. The reply tuple has a local address of ?
+// while the destination is being dialed, and clients that have not had a
+// reply yet are [UNREPLIED] instead of [ASSURED].
+func WriteConntrack(w io.Writer, stats []ipsec.ClientStat) error {
+	now := time.Now()
+	for _, stat := range stats {
+		left := stat.Timeout - now.Sub(stat.LastActive)
+		if left < 0 {
+			left = 0
+		}
+		cliHost, cliPort := splitAddr(stat.Addr)
+		lisHost, lisPort := splitAddr(stat.Listener)
+		dstHost, dstPort := splitAddr(stat.Destination)
+		locHost, locPort := splitAddr(stat.LocalAddr)
+
+		status := "[ASSURED]"
+		if stat.PacketsToClient == 0 {
+			status = "[UNREPLIED]"
+		}
+		_, err := fmt.Fprintf(w, "udp      17 %d src=%s dst=%s sport=%s dport=%s packets=%d bytes=%d src=%s dst=%s sport=%s dport=%s packets=%d bytes=%d %s mark=0 use=1 age=%d\n",
+			int64(left/time.Second),
+			cliHost, lisHost, cliPort, lisPort, stat.PacketsToServer, stat.BytesToServer,
+			dstHost, locHost, dstPort, locPort, stat.PacketsToClient, stat.BytesToClient,
+			status, int64(now.Sub(stat.Start)/time.Second))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitAddr splits addr into its host and port, which are ? if unknown.
+func splitAddr(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "?", "?"
+	}
+	return host, port
+}
@@ -0,0 +1,192 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// profile is the JSON form of a profile run by an ipsec.Manager.
+type profile struct {
+	Name         string               `json:"name"`
+	Listen       string               `json:"listen"`
+	ListenIKE    string               `json:"listen_ike,omitempty"`
+	Device       string               `json:"device,omitempty"` // the listeners are bound to
+	Destinations []ipsec.WeightedDest `json:"destinations"`
+	Timeout      string               `json:"timeout,omitempty"`
+	Allow        []string             `json:"allow,omitempty"`
+	Deny         []string             `json:"deny,omitempty"`
+	MaxClients   int                  `json:"max_clients,omitempty"`
+	Clients      int                  `json:"clients"` // connected, ignored when set
+}
+
+// HandlerWithProfiles is like Handler, also managing the profiles run by m,
+// such as one per tenant, under /profiles:
+//
+//	GET    /profiles            lists the profiles as JSON
+//	GET    /profiles/{name}     returns the profile as JSON
+//	PUT    /profiles/{name}     starts the profile given as JSON, or updates
+//	                            it as ipsec.Manager.Set does, keeping the
+//	                            settings the JSON form lacks, such as client
+//	                            timeouts
+//	DELETE /profiles/{name}     stops the profile
+//	       /profiles/{name}/... serves the API above for the profile, e.g.
+//	                            GET /profiles/partner/clients
+//
+// Profiles set through the API are replaced by those of the config file when
+// it is reloaded.
+func HandlerWithProfiles(f Target, m *ipsec.Manager) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", Handler(f))
+	mux.HandleFunc("/profiles", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		profiles := []profile{}
+		for _, name := range m.Names() {
+			if p, ok := profileOf(m, name); ok {
+				profiles = append(profiles, p)
+			}
+		}
+		writeJSON(w, profiles)
+	})
+	mux.HandleFunc("/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		escaped := strings.TrimPrefix(r.URL.EscapedPath(), "/profiles/")
+		api := false
+		if i := strings.IndexByte(escaped, '/'); i >= 0 {
+			escaped, api = escaped[:i], true
+		}
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if api {
+			target := profileTarget(m, name)
+			if target == nil {
+				httpError(w, ipsec.ErrUnknownProfile)
+				return
+			}
+			http.StripPrefix("/profiles/"+name, Handler(target)).ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			p, ok := profileOf(m, name)
+			if !ok {
+				httpError(w, ipsec.ErrUnknownProfile)
+				return
+			}
+			writeJSON(w, p)
+		case http.MethodPut:
+			var p profile
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			running, _, _ := m.Running(name)
+			cfg, err := p.config(running.Config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := m.Set(ipsec.Profile{Name: name, Config: cfg}); err != nil {
+				httpError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if err := m.Remove(name); err != nil {
+				httpError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// profileTarget returns what serves the API of the named profile, or nil if
+// it is not running.
+func profileTarget(m *ipsec.Manager, name string) Target {
+	_, pair, ok := m.Running(name)
+	if !ok {
+		return nil
+	}
+	if pair != nil {
+		return pair
+	}
+	if forwarders := m.Profile(name); len(forwarders) > 0 {
+		return forwarders[0]
+	}
+	return nil
+}
+
+// profileOf returns the named profile as JSON, or false if it is not running.
+func profileOf(m *ipsec.Manager, name string) (profile, bool) {
+	running, _, ok := m.Running(name)
+	target := profileTarget(m, name)
+	if !ok || target == nil {
+		return profile{}, false
+	}
+	cfg := running.Config
+	return profile{
+		Name:         name,
+		Listen:       cfg.Listen,
+		ListenIKE:    cfg.ListenIKE,
+		Device:       cfg.ListenerOptions.Device,
+		Destinations: target.Destinations(),
+		Timeout:      target.Timeout().String(),
+		Allow:        networks(cfg.Allow),
+		Deny:         networks(cfg.Deny),
+		MaxClients:   cfg.MaxClients,
+		Clients:      len(target.ClientStats()),
+	}, true
+}
+
+// config returns cfg with the settings of p.
+func (p profile) config(cfg ipsec.Config) (ipsec.Config, error) {
+	if p.Listen == "" {
+		return cfg, errors.New("listen address required")
+	}
+	allow, err := ipsec.ParseCIDRs(p.Allow)
+	if err != nil {
+		return cfg, err
+	}
+	deny, err := ipsec.ParseCIDRs(p.Deny)
+	if err != nil {
+		return cfg, err
+	}
+	var d time.Duration
+	if p.Timeout != "" {
+		if d, err = time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+			return cfg, errors.New("invalid timeout")
+		}
+	}
+	cfg.Listen, cfg.ListenIKE = p.Listen, p.ListenIKE
+	cfg.ListenerOptions.Device = p.Device
+	cfg.Destinations = p.Destinations
+	cfg.Timeout = d
+	cfg.Allow, cfg.Deny = allow, deny
+	cfg.MaxClients = p.MaxClients
+	return cfg, nil
+}
+
+// networks returns nets as strings.
+func networks(nets []net.IPNet) []string {
+	var result []string
+	for _, n := range nets {
+		result = append(result, n.String())
+	}
+	return result
+}
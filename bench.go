@@ -0,0 +1,53 @@
+package main
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/spf13/cobra"
+
+    "github.com/bytejedi/ipsec-forward/bench"
+    "github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// benchCommand returns the command measuring the packet rate and latency of
+// the forwarder on the loopback interface, with simulated clients and
+// gateways, so that releases can be compared on the same machine.
+func benchCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "bench",
+        Short: "Measure the packet rate and latency of the forwarder on this machine",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            var cfg bench.Config
+            cfg.Clients, _ = flags.GetInt("clients")
+            cfg.Packets, _ = flags.GetInt("packets")
+            cfg.PayloadSize, _ = flags.GetInt("payload-size")
+            cfg.Gateways, _ = flags.GetInt("gateways")
+            cfg.Direct, _ = flags.GetBool("direct")
+            cfg.Forwarder = ipsec.Config{Logger: ipsec.NewStdLogger(nil, ipsec.LevelWarn)}
+            cfg.Forwarder.BatchSize, _ = flags.GetInt(flagBatchSize)
+            cfg.Forwarder.PoolSize, _ = flags.GetInt(flagPoolSize)
+            cfg.Forwarder.Validate, _ = flags.GetBool(flagValidate)
+            cfg.Forwarder.TrackIKESessions, _ = flags.GetBool(flagTrackIKE)
+
+            result, err := bench.Run(cfg)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintln(os.Stdout, result)
+            return nil
+        },
+    }
+    cmd.Flags().Int("clients", 8, "Number of concurrent clients")
+    cmd.Flags().Int("packets", bench.DefaultPackets, "ESP packets each client sends, one at a time")
+    cmd.Flags().Int("payload-size", bench.DefaultPayloadSize, "Bytes of payload in each ESP packet")
+    cmd.Flags().Int("gateways", bench.DefaultGateways, "Number of simulated gateways")
+    cmd.Flags().Bool("direct", false, "Send the clients straight to the gateways, as a baseline")
+    cmd.Flags().Int(flagBatchSize, 0, "Read and write up to this many packets per system call on Linux")
+    cmd.Flags().Int(flagPoolSize, 0, "Share this many sockets per destination among the clients")
+    cmd.Flags().Bool(flagValidate, false, "Validate the packets from clients")
+    cmd.Flags().Bool(flagTrackIKE, false, "Track IKE sessions")
+    return cmd
+}
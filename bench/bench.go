@@ -0,0 +1,192 @@
+// Package bench measures the forwarding hot path: the packet rate and round
+// trip latency of a number of concurrent clients exchanging ESP-in-UDP with
+// simulated gateways through a forwarder, see package ipsectest. Runs are
+// reproducible: every client sends the same packets in lockstep, each waiting
+// for the previous one to come back. Comparing a run against a Direct one
+// shows the cost of the forwarder itself.
+//
+// The fuzz targets in fuzz.go are built with the gofuzz tag, for go-fuzz:
+//
+//	go-fuzz-build -func FuzzParseIKE github.com/bytejedi/ipsec-forward/bench
+//	go-fuzz -bin bench-fuzz.zip
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+	"github.com/bytejedi/ipsec-forward/ipsectest"
+)
+
+// Default values of Config.
+const (
+	DefaultClients     = 1
+	DefaultPackets     = 1000
+	DefaultPayloadSize = 1024
+	DefaultGateways    = 1
+)
+
+// Config describes a run.
+type Config struct {
+	Clients     int // concurrent clients, DefaultClients if zero
+	Packets     int // ESP packets sent by each client, DefaultPackets if zero
+	PayloadSize int // bytes of ESP payload, DefaultPayloadSize if zero
+	Gateways    int // simulated gateways, DefaultGateways if zero
+
+	// Timeout is how long a packet may take to come back before it counts
+	// as lost, ipsectest.DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// Forwarder configures the forwarder under test. Its destinations are
+	// replaced by the gateways.
+	Forwarder ipsec.Config
+
+	// Direct sends the clients straight to the gateways, for a baseline.
+	Direct bool
+}
+
+// Latency summarises the round trip times of the packets that came back.
+type Latency struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Clients  int
+	Sent     int           // ESP packets sent
+	Lost     int           // packets that did not come back in time
+	Duration time.Duration // from the first packet to the last reply
+	PPS      float64       // packets forwarded per second, both directions
+	Latency  Latency
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d clients: %d packets, %d lost in %v, %.0f pps, latency p50 %v p90 %v p99 %v max %v",
+		r.Clients, r.Sent, r.Lost, r.Duration.Round(time.Millisecond), r.PPS,
+		r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+}
+
+// Run starts the gateways and the forwarder described by cfg, connects the
+// clients with an IKEv2 handshake each and then measures their ESP traffic.
+func Run(cfg Config) (Result, error) {
+	if cfg.Clients <= 0 {
+		cfg.Clients = DefaultClients
+	}
+	if cfg.Packets <= 0 {
+		cfg.Packets = DefaultPackets
+	}
+	if cfg.PayloadSize <= 0 {
+		cfg.PayloadSize = DefaultPayloadSize
+	}
+	if cfg.Gateways <= 0 {
+		cfg.Gateways = DefaultGateways
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = ipsectest.DefaultTimeout
+	}
+
+	h, err := ipsectest.Start(cfg.Forwarder, cfg.Gateways)
+	if err != nil {
+		return Result{}, err
+	}
+	defer h.Close()
+
+	clients := make([]*ipsectest.Client, cfg.Clients)
+	for i := range clients {
+		server := h.Forwarder.LocalAddr().(*net.UDPAddr)
+		if cfg.Direct {
+			server = h.Gateways[i%len(h.Gateways)].Addr()
+		}
+		c, err := ipsectest.NewClient(server, true)
+		if err != nil {
+			return Result{}, err
+		}
+		defer c.Close()
+		c.SetTimeout(cfg.Timeout)
+		if err := c.Handshake(); err != nil {
+			return Result{}, fmt.Errorf("bench: client %d: %w", i, err)
+		}
+		clients[i] = c
+	}
+
+	payload := make([]byte, cfg.PayloadSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		lost      int
+		failed    error
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *ipsectest.Client) {
+			defer wg.Done()
+			times := make([]time.Duration, 0, cfg.Packets)
+			var missed int
+			var err error
+			for i := 0; i < cfg.Packets; i++ {
+				sent := time.Now()
+				if err = c.RoundTrip(payload); errors.Is(err, ipsectest.ErrTimeout) {
+					missed++
+					continue
+				} else if err != nil {
+					break
+				}
+				times = append(times, time.Since(sent))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, times...)
+			lost += missed
+			if failed == nil && err != nil && !errors.Is(err, ipsectest.ErrTimeout) {
+				failed = err
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if failed != nil {
+		return Result{}, failed
+	}
+
+	r := Result{
+		Clients:  cfg.Clients,
+		Sent:     cfg.Clients * cfg.Packets,
+		Lost:     lost,
+		Duration: elapsed,
+		PPS:      float64(2*len(latencies)) / elapsed.Seconds(),
+		Latency:  summarise(latencies),
+	}
+	return r, nil
+}
+
+// summarise returns the percentiles of latencies, which it sorts.
+func summarise(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return Latency{
+		P50: at(0.5),
+		P90: at(0.9),
+		P99: at(0.99),
+		Max: latencies[len(latencies)-1],
+	}
+}
@@ -0,0 +1,96 @@
+package bench
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+	"github.com/bytejedi/ipsec-forward/ipsectest"
+)
+
+// BenchmarkClients connects 1000 clients, each with a socket of its own to
+// the gateway and pooled, reporting the sockets and goroutines they take.
+// Pooled clients share the readers of their sockets but keep a goroutine
+// each sending their packets.
+func BenchmarkClients(b *testing.B) {
+	for _, poolSize := range []int{0, 1, 4} {
+		b.Run("pool="+strconv.Itoa(poolSize), func(b *testing.B) {
+			benchmarkClients(b, 1000, poolSize)
+		})
+	}
+}
+
+func benchmarkClients(b *testing.B, clients, poolSize int) {
+	var sockets int64
+	var goroutines int
+	for i := 0; i < b.N; i++ {
+		before := runtime.NumGoroutine()
+		h, err := ipsectest.Start(ipsec.Config{Timeout: time.Minute, PoolSize: poolSize}, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < clients; j++ {
+			c, err := h.NewClient()
+			if err != nil {
+				h.Close()
+				b.Fatal(err)
+			}
+			if err := c.Handshake(); err != nil {
+				h.Close()
+				b.Fatalf("client %d: %v", j, err)
+			}
+		}
+		sockets, _ = h.Forwarder.OutboundSockets()
+		goroutines = runtime.NumGoroutine() - before
+		h.Close()
+	}
+	b.ReportMetric(float64(sockets), "sockets")
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+// BenchmarkRoundTrip runs bench.Run with b.N packets, each forwarded to the
+// gateway and its reply back to the client, through the paths replies can
+// take: a socket per client, read in batches, or shared by pooled clients.
+// The direct run is the baseline without the forwarder.
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, run := range []struct {
+		name    string
+		cfg     Config
+		clients []int
+	}{
+		{"direct", Config{Direct: true}, []int{1, 8}},
+		{"forward", Config{}, []int{1, 8}},
+		{"batched", Config{Forwarder: ipsec.Config{BatchSize: 32}}, []int{1, 8}},
+		// The ESP replies of pooled clients are told apart by the order
+		// in which the clients finished their handshakes, so only one
+		// may start sending at a time, unlike those of Run.
+		{"pooled", Config{Forwarder: ipsec.Config{PoolSize: 1}}, []int{1}},
+	} {
+		for _, clients := range run.clients {
+			cfg := run.cfg
+			cfg.Clients = clients
+			b.Run(run.name+"/clients="+strconv.Itoa(clients), func(b *testing.B) {
+				benchmarkRoundTrip(b, cfg)
+			})
+		}
+	}
+}
+
+func benchmarkRoundTrip(b *testing.B, cfg Config) {
+	cfg.Packets = (b.N + cfg.Clients - 1) / cfg.Clients
+	cfg.Forwarder.Timeout = time.Minute
+	cfg.Forwarder.Logger = ipsec.NewStdLogger(nil, ipsec.LevelWarn)
+	b.SetBytes(DefaultPayloadSize)
+	b.ResetTimer()
+	r, err := Run(cfg)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(r.PPS, "pps")
+	b.ReportMetric(float64(r.Latency.P50.Microseconds()), "p50-µs")
+	b.ReportMetric(float64(r.Latency.P99.Microseconds()), "p99-µs")
+	b.ReportMetric(float64(r.Lost), "lost")
+}
@@ -0,0 +1,64 @@
+//go:build gofuzz
+// +build gofuzz
+
+package bench
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+	"github.com/bytejedi/ipsec-forward/ipsectest"
+)
+
+// FuzzParseIKE checks that ParseIKE neither panics nor misreads the IKEv2
+// headers it accepts, with or without the non-ESP marker.
+func FuzzParseIKE(data []byte) int {
+	h, ok := ipsec.ParseIKE(data)
+	if !ok {
+		return 0
+	}
+	for _, marker := range []bool{false, true} {
+		again, ok := ipsec.ParseIKE(ipsectest.IKEMessage(h, marker))
+		again.Length = h.Length
+		if !ok || again != h {
+			panic("ParseIKE misread a header it accepted")
+		}
+	}
+	return 1
+}
+
+var (
+	fuzzOnce    sync.Once
+	fuzzHarness *ipsectest.Harness
+	fuzzClient  *ipsectest.Client
+)
+
+// FuzzForward sends data through a forwarder that validates packets, tracks
+// IKE sessions and diagnoses handshakes, so that every parser on the path of
+// a client packet sees it, and the gateway's reply on the way back.
+func FuzzForward(data []byte) int {
+	fuzzOnce.Do(func() {
+		var err error
+		fuzzHarness, err = ipsectest.Start(ipsec.Config{
+			Validate:         true,
+			TrackIKESessions: true,
+			Diagnose:         true,
+			Logger:           ipsec.NewStdLogger(log.New(ioutil.Discard, "", 0), ipsec.LevelDebug),
+		}, 1)
+		if err != nil {
+			panic(err)
+		}
+		if fuzzClient, err = fuzzHarness.NewClient(); err != nil {
+			panic(err)
+		}
+	})
+	if err := fuzzClient.Send(data); err != nil {
+		return 0
+	}
+	if _, ok := ipsec.ParseIKE(data); ok {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+// Package capture records the packets forwarded by IPSEC packet forwarders in
+// the pcapng format, for debugging clients that fail to establish their
+// tunnels with tools such as Wireshark.
+package capture
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// queueSize is the number of packets that may wait to be written before
+// further packets are dropped rather than slowing down forwarding.
+const queueSize = 4096
+
+// Filter selects the packets to capture. An empty field matches every
+// packet.
+type Filter struct {
+	Clients      []net.IPNet // networks of the clients
+	Destinations []string    // addresses of the destinations, host:port
+}
+
+// match reports whether a packet between client and dst is selected.
+func (f Filter) match(client, dst *net.UDPAddr) bool {
+	if len(f.Clients) > 0 {
+		found := false
+		for _, n := range f.Clients {
+			if n.Contains(client.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Destinations) > 0 {
+		for _, addr := range f.Destinations {
+			if addr == dst.String() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Capture writes the packets passed to Tap in the pcapng format.
+type Capture struct {
+	dropped int64 // accessed atomically
+
+	filter  Filter
+	packets chan []byte
+	done    chan struct{}
+	mu      sync.RWMutex // held for writing once packets is closed
+	closed  bool
+
+	// The output is w, which is file or conn if the Capture opened them.
+	w        io.Writer
+	file     *os.File
+	conn     net.Conn
+	path     string
+	size     int64
+	maxSize  int64
+	maxFiles int
+
+	closeOnce sync.Once
+	err       error // the first write error, set by the writing goroutine
+}
+
+// New returns a Capture writing the packets matching filter to w, such as a
+// connection to a remote collector.
+func New(w io.Writer, filter Filter) (*Capture, error) {
+	if err := writeHeader(w); err != nil {
+		return nil, err
+	}
+	c := newCapture(filter)
+	c.w = w
+	go c.run()
+	return c, nil
+}
+
+// Dial returns a Capture streaming the packets matching filter over TCP to
+// the collector at addr, for instance `nc -l 5555 | wireshark -k -i -`.
+func Dial(addr string, filter Filter) (*Capture, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(conn, filter)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn = conn
+	return c, nil
+}
+
+// Create returns a Capture writing the packets matching filter to the file
+// at path. Once the file exceeds maxSize bytes it is renamed to path.1, the
+// older files moving up to path.2 and so on, keeping at most maxFiles of
+// them, or the file is started over if maxFiles is zero. A maxSize of zero
+// never rotates the file.
+func Create(path string, maxSize int64, maxFiles int, filter Filter) (*Capture, error) {
+	c := newCapture(filter)
+	c.path, c.maxSize, c.maxFiles = path, maxSize, maxFiles
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+func newCapture(filter Filter) *Capture {
+	return &Capture{
+		filter:  filter,
+		packets: make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// Tap records p if it matches the filter. It is meant to be passed to
+// ipsec.Forwarder.SetTap, and does nothing once the Capture is closed.
+func (c *Capture) Tap(p ipsec.TappedPacket) {
+	client, dst, comment := p.Src, p.Dst, "to client"
+	if p.ToServer {
+		comment = "to server"
+	} else {
+		client, dst = p.Dst, p.Src
+	}
+	if !c.filter.match(client, dst) {
+		return
+	}
+
+	block := packetBlock(p.Time, p.Src, p.Dst, p.Data, comment)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.packets <- block:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// Dropped returns the number of packets that could not be written fast
+// enough and were left out of the capture.
+func (c *Capture) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Close writes the packets waiting to be written and closes the output, if
+// the Capture opened it. It returns the first error writing packets.
+func (c *Capture) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		close(c.packets)
+		c.mu.Unlock()
+		<-c.done
+
+		var err error
+		if c.file != nil {
+			err = c.file.Close()
+		} else if c.conn != nil {
+			err = c.conn.Close()
+		}
+		if c.err == nil {
+			c.err = err
+		}
+	})
+	return c.err
+}
+
+// run writes the packets until Close is called, stopping at the first error.
+func (c *Capture) run() {
+	defer close(c.done)
+	for block := range c.packets {
+		if c.err != nil {
+			continue
+		}
+		if c.file != nil && c.maxSize > 0 && c.size >= c.maxSize {
+			if c.err = c.rotate(); c.err != nil {
+				continue
+			}
+		}
+		n, err := c.w.Write(block)
+		c.size += int64(n)
+		c.err = err
+	}
+}
+
+// open creates the capture file and writes its header.
+func (c *Capture) open() error {
+	file, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	if err := writeHeader(file); err != nil {
+		file.Close()
+		return err
+	}
+	c.file, c.w, c.size = file, file, 0
+	return nil
+}
+
+// rotate moves the full capture file aside and starts a new one.
+func (c *Capture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	if c.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+		for i := c.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+		}
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return err
+		}
+	}
+	return c.open()
+}
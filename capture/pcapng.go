@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// pcapng block types.
+const (
+	sectionHeaderBlock   = 0x0a0d0d0a
+	interfaceDescription = 0x00000001
+	enhancedPacketBlock  = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+	optComment     = 1
+
+	// linkTypeRaw is LINKTYPE_RAW, packets beginning with an IPv4 or IPv6
+	// header.
+	linkTypeRaw = 101
+)
+
+var le = binary.LittleEndian
+
+// writeHeader writes the section header and the description of the single
+// interface all packets are recorded on.
+func writeHeader(w io.Writer) error {
+	b := make([]byte, 28+20)
+	le.PutUint32(b, sectionHeaderBlock)
+	le.PutUint32(b[4:], 28)
+	le.PutUint32(b[8:], byteOrderMagic)
+	le.PutUint16(b[12:], 1) // version 1.0
+	le.PutUint64(b[16:], ^uint64(0))
+	le.PutUint32(b[24:], 28)
+
+	idb := b[28:]
+	le.PutUint32(idb, interfaceDescription)
+	le.PutUint32(idb[4:], 20)
+	le.PutUint16(idb[8:], linkTypeRaw)
+	le.PutUint32(idb[16:], 20)
+	_, err := w.Write(b)
+	return err
+}
+
+// packetBlock returns an enhanced packet block recording data sent from src
+// to dst at t, with made up IP and UDP headers so that analysers decode the
+// IKE and ESP within. comment is attached to it.
+func packetBlock(t time.Time, src, dst *net.UDPAddr, data []byte, comment string) []byte {
+	pkt := datagram(src, dst, data)
+	commentLen := 0
+	if comment != "" {
+		commentLen = 4 + pad(len(comment)) + 4
+	}
+	total := 28 + pad(len(pkt)) + commentLen + 4
+
+	b := make([]byte, total)
+	le.PutUint32(b, enhancedPacketBlock)
+	le.PutUint32(b[4:], uint32(total))
+	usec := uint64(t.UnixNano() / int64(time.Microsecond))
+	le.PutUint32(b[12:], uint32(usec>>32))
+	le.PutUint32(b[16:], uint32(usec))
+	le.PutUint32(b[20:], uint32(len(pkt)))
+	le.PutUint32(b[24:], uint32(len(pkt)))
+	copy(b[28:], pkt)
+	if comment != "" {
+		opt := b[28+pad(len(pkt)):]
+		le.PutUint16(opt, optComment)
+		le.PutUint16(opt[2:], uint16(len(comment)))
+		copy(opt[4:], comment)
+		// The end of options is left zeroed.
+	}
+	le.PutUint32(b[total-4:], uint32(total))
+	return b
+}
+
+// pad rounds n up to a multiple of four.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// datagram returns data as a UDP datagram from src to dst.
+func datagram(src, dst *net.UDPAddr, data []byte) []byte {
+	be := binary.BigEndian
+	var pkt, udp []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		pkt = make([]byte, 20+8+len(data))
+		pkt[0] = 0x45
+		be.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8], pkt[9] = 64, 17
+		copy(pkt[12:], src4)
+		copy(pkt[16:], dst4)
+		be.PutUint16(pkt[10:], checksum(pkt[:20]))
+		udp = pkt[20:]
+	} else {
+		pkt = make([]byte, 40+8+len(data))
+		pkt[0] = 0x60
+		be.PutUint16(pkt[4:], uint16(8+len(data)))
+		pkt[6], pkt[7] = 17, 64
+		copy(pkt[8:], src.IP.To16())
+		copy(pkt[24:], dst.IP.To16())
+		udp = pkt[40:]
+	}
+	be.PutUint16(udp, uint16(src.Port))
+	be.PutUint16(udp[2:], uint16(dst.Port))
+	be.PutUint16(udp[4:], uint16(8+len(data)))
+	copy(udp[8:], data)
+	return pkt
+}
+
+// checksum returns the Internet checksum of an IPv4 header.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "time"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+
+    "github.com/bytejedi/ipsec-forward/admin"
+    "github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// probeTimeout is how long check --probe waits for each destination to
+// refuse a packet.
+const probeTimeout = time.Second
+
+// checkCommand returns the command validating the configuration without
+// forwarding anything, for CI pipelines and checks before a deployment. It
+// should run with the privileges of the forwarder, as settings such as
+// --relay-icmp fail without them.
+func checkCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "check",
+        Short: "Validate the configuration and print it without forwarding",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            configPath, _ := flags.GetString(flagConfig)
+            probe, _ := flags.GetBool("probe")
+            return check(os.Stdout, configPath, probe)
+        },
+    }
+    cmd.Flags().String(flagConfig, "", "Config file to check (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    cmd.Flags().Bool("probe", false, "Also check that no destination refuses packets, as the health checks do")
+    return cmd
+}
+
+// check parses the configuration at path, applies it to a forwarder nothing
+// is sent to, checks that the listen addresses can be bound and, if probe is
+// set, that the destinations are reachable, and writes the effective
+// settings to w as JSON. Problems are listed on stderr.
+func check(w io.Writer, path string, probe bool) error {
+    if err := readConfig(path); err != nil {
+        return err
+    }
+    logger, err := newLogger()
+    if err != nil {
+        return err
+    }
+    source, err := discoverySource()
+    if err != nil {
+        return err
+    }
+    var dsts []ipsec.WeightedDest
+    if source != nil && len(viper.GetStringSlice(flagDestination)) == 0 {
+        dsts, err = discoveredDestinations(source)
+    } else {
+        dsts, err = destinations()
+    }
+    if err != nil {
+        return err
+    }
+    cfg, err := config(dsts)
+    if err != nil {
+        return err
+    }
+    cfg.Logger = logger
+    if cfg.ListenIKE != "" {
+        cfg.Destinations = hostsOf(dsts)
+    }
+    profiles, err := profiles(logger)
+    if err != nil {
+        return err
+    }
+    if _, err := ipsec.ParseCIDRs(viper.GetStringSlice(flagCaptureClient)); err != nil {
+        return fmt.Errorf("invalid %s: %w", flagCaptureClient, err)
+    }
+
+    var problems []string
+    if err := trial(cfg); err != nil {
+        problems = append(problems, err.Error())
+    }
+    for _, p := range profiles {
+        if err := trial(p.Config); err != nil {
+            problems = append(problems, fmt.Sprintf("profile %q: %v", p.Name, err))
+        }
+    }
+
+    udp := []string{cfg.Listen, cfg.ListenIKE}
+    for _, p := range profiles {
+        udp = append(udp, p.Config.Listen, p.Config.ListenIKE)
+    }
+    for _, addr := range udp {
+        if addr == "" {
+            continue
+        }
+        if conn, err := net.ListenPacket("udp", addr); err != nil {
+            problems = append(problems, fmt.Sprintf("cannot listen on %s: %v", addr, err))
+        } else {
+            conn.Close()
+        }
+    }
+    adminAddr := viper.GetString(flagAdminListen)
+    if adminAddr == "" {
+        adminAddr = viper.GetString(flagAdminAddr)
+    }
+    if adminAddr != "" {
+        if l, err := admin.Listen(adminAddr); err != nil {
+            problems = append(problems, fmt.Sprintf("cannot listen on %s: %v", adminAddr, err))
+        } else {
+            l.Close()
+        }
+    }
+    tcp := []string{viper.GetString(flagMetrics), viper.GetString(flagGRPC), viper.GetString(flagDebug), viper.GetString("cluster.listen")}
+    for _, addr := range tcp {
+        if addr == "" {
+            continue
+        }
+        if l, err := net.Listen("tcp", addr); err != nil {
+            problems = append(problems, fmt.Sprintf("cannot listen on %s: %v", addr, err))
+        } else {
+            l.Close()
+        }
+    }
+
+    if probe {
+        for _, dst := range dsts {
+            raddr, err := net.ResolveUDPAddr("udp", dst.Addr)
+            if err == nil {
+                err = ipsec.Probe(raddr, probeTimeout)
+            }
+            if err != nil {
+                problems = append(problems, fmt.Sprintf("destination %s unreachable: %v", dst.Addr, err))
+            }
+        }
+    }
+
+    settings := viper.AllSettings()
+    if secret, _ := settings[flagAccountingSecret].(string); secret != "" {
+        settings[flagAccountingSecret] = "REDACTED"
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(jsonable(settings)); err != nil {
+        return err
+    }
+
+    if len(problems) > 0 {
+        for _, problem := range problems {
+            fmt.Fprintln(os.Stderr, problem)
+        }
+        return fmt.Errorf("%d problems found", len(problems))
+    }
+    return nil
+}
+
+// trial applies cfg to a forwarder, or a pair if cfg.ListenIKE is set,
+// listening on ephemeral loopback ports, which nothing sends to, in place of
+// the listen addresses, and closes it.
+func trial(cfg ipsec.Config) error {
+    cfg.Listen, cfg.Listeners = "127.0.0.1:0", 1
+    cfg.ListenConns, cfg.ListenIKEConns = nil, nil
+    if cfg.ListenIKE != "" {
+        cfg.ListenIKE = "127.0.0.1:0"
+        pair, err := ipsec.ForwardPairContext(context.Background(), cfg)
+        if err != nil {
+            return err
+        }
+        return pair.Close()
+    }
+    f, err := ipsec.New(cfg)
+    if err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+// jsonable converts the maps viper reads from the config file, keyed by
+// interface{} inside lists, into maps encoding/json takes.
+func jsonable(v interface{}) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for key, value := range v {
+            v[key] = jsonable(value)
+        }
+        return v
+    case map[interface{}]interface{}:
+        m := make(map[string]interface{}, len(v))
+        for key, value := range v {
+            m[fmt.Sprint(key)] = jsonable(value)
+        }
+        return m
+    case []interface{}:
+        for i, value := range v {
+            v[i] = jsonable(value)
+        }
+        return v
+    }
+    return v
+}
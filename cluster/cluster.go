@@ -0,0 +1,176 @@
+// Package cluster keeps the clients of IPSEC packet forwarders on several
+// nodes in sync, so that any node can take over the traffic of another, e.g.
+// when a VRRP address moves to it, without the clients having to renegotiate
+// their tunnels.
+//
+// Every node periodically sends the destination of each of its clients to
+// its peers over TCP, and routes the clients it learns about from them to the
+// same destinations once they send. The connections are neither authenticated
+// nor encrypted, so nodes should only listen on a private network.
+package cluster
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// DefaultInterval is how often the state is sent to the peers unless
+// configured otherwise.
+const DefaultInterval = time.Second
+
+const (
+	// ioTimeout limits the time taken to send or receive the state.
+	ioTimeout = 5 * time.Second
+
+	// maxStateSize limits the size of the state accepted from a peer.
+	maxStateSize = 64 << 20
+)
+
+// State is what is kept in sync, an *ipsec.Forwarder or an *ipsec.Pair.
+type State interface {
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// Config configures a Node.
+type Config struct {
+	Listen   string        // TCP address to receive the state of peers on
+	Peers    []string      // TCP addresses of the peers
+	Interval time.Duration // how often to send the state, DefaultInterval if zero
+	Logger   ipsec.Logger  // defaults to logging to the standard logger
+}
+
+// Node exchanges the state of a forwarder with its peers.
+type Node struct {
+	state    State
+	cfg      Config
+	logger   ipsec.Logger
+	listener net.Listener
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Start listens for the state of peers on cfg.Listen, if set, and starts
+// sending the state to cfg.Peers.
+func Start(state State, cfg Config) (*Node, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	n := &Node{
+		state:  state,
+		cfg:    cfg,
+		logger: cfg.Logger,
+		done:   make(chan struct{}),
+	}
+	if n.logger == nil {
+		n.logger = ipsec.NewStdLogger(nil, ipsec.LevelInfo)
+	}
+
+	if cfg.Listen != "" {
+		listener, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+		n.listener = listener
+		n.wg.Add(1)
+		go n.serve()
+	}
+	if len(cfg.Peers) > 0 {
+		n.wg.Add(1)
+		go n.push()
+	}
+	return n, nil
+}
+
+// serve receives the state of peers until the node is closed.
+func (n *Node) serve() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			n.logger.Log(ipsec.LevelError, "cluster listener failed", "err", err)
+			return
+		}
+		n.wg.Add(1)
+		go n.receive(conn)
+	}
+}
+
+// receive loads the state sent by a peer on conn.
+func (n *Node) receive(conn net.Conn) {
+	defer n.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := n.state.LoadState(io.LimitReader(conn, maxStateSize)); err != nil {
+		n.logger.Log(ipsec.LevelWarn, "failed to load state from peer", "peer", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// push sends the state to every peer each interval until the node is closed.
+func (n *Node) push() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+
+	failing := make(map[string]bool)
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		for _, peer := range n.cfg.Peers {
+			err := n.send(peer)
+			switch {
+			case err != nil && !failing[peer]:
+				n.logger.Log(ipsec.LevelWarn, "failed to send state to peer", "peer", peer, "err", err)
+				failing[peer] = true
+			case err == nil && failing[peer]:
+				n.logger.Log(ipsec.LevelInfo, "sending state to peer again", "peer", peer)
+				delete(failing, peer)
+			}
+		}
+	}
+}
+
+// send sends the state to peer.
+func (n *Node) send(peer string) error {
+	conn, err := net.DialTimeout("tcp", peer, ioTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(ioTimeout))
+	err = n.state.SaveState(conn)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops exchanging state with the peers.
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.done)
+		if n.listener != nil {
+			err = n.listener.Close()
+		}
+	})
+	n.wg.Wait()
+	return err
+}
@@ -0,0 +1,218 @@
+// Package control serves a gRPC API for managing IPSEC packet forwarders from
+// orchestration systems. The service is described by control.proto.
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// subscriberBufferSize is the number of events buffered for each stream of
+// StreamEvents. Events are dropped for streams too slow to keep up.
+const subscriberBufferSize = 64
+
+// Target is what the API manages, an *ipsec.Forwarder or an *ipsec.Pair.
+type Target interface {
+	ClientStats() []ipsec.ClientStat
+	Disconnect(addr string) error
+	Destinations() []ipsec.WeightedDest
+	SetDestinations(dsts []ipsec.WeightedDest) error
+}
+
+// Server implements the Control service of control.proto.
+type Server struct {
+	target Target
+
+	dstMu sync.Mutex // serialises changes to the destinations
+
+	subsMu sync.Mutex
+	subs   map[chan *Event]struct{}
+}
+
+// NewServer returns a Server managing target and streaming the events
+// received from events, typically the channels returned by
+// ipsec.Forwarder.Events.
+func NewServer(target Target, events ...<-chan ipsec.Event) *Server {
+	s := &Server{target: target, subs: make(map[chan *Event]struct{})}
+	for _, ch := range events {
+		go s.broadcast(ch)
+	}
+	return s
+}
+
+// Register registers the service on gs.
+func (s *Server) Register(gs *grpc.Server) {
+	gs.RegisterService(&serviceDesc, s)
+}
+
+// ListenAndServe serves the API of NewServer(target, events...) on addr
+// until listening fails.
+func ListenAndServe(addr string, target Target, events ...<-chan ipsec.Event) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	gs := grpc.NewServer()
+	NewServer(target, events...).Register(gs)
+	return gs.Serve(lis)
+}
+
+// ListSessions lists the connected clients.
+func (s *Server) ListSessions(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error) {
+	resp := &ListSessionsResponse{}
+	for _, stat := range s.target.ClientStats() {
+		resp.Sessions = append(resp.Sessions, &Session{
+			Client:             stat.Addr,
+			Destination:        stat.Destination,
+			StartUnixNano:      stat.Start.UnixNano(),
+			LastActiveUnixNano: stat.LastActive.UnixNano(),
+			PacketsToServer:    stat.PacketsToServer,
+			BytesToServer:      stat.BytesToServer,
+			PacketsToClient:    stat.PacketsToClient,
+			BytesToClient:      stat.BytesToClient,
+		})
+	}
+	return resp, nil
+}
+
+// KickSession disconnects a client.
+func (s *Server) KickSession(ctx context.Context, req *KickSessionRequest) (*KickSessionResponse, error) {
+	if err := s.target.Disconnect(req.Client); err != nil {
+		return nil, statusError(err)
+	}
+	return &KickSessionResponse{}, nil
+}
+
+// ListBackends lists the destinations.
+func (s *Server) ListBackends(ctx context.Context, req *ListBackendsRequest) (*ListBackendsResponse, error) {
+	return backends(s.target.Destinations()), nil
+}
+
+// AddBackend adds a destination.
+func (s *Server) AddBackend(ctx context.Context, req *AddBackendRequest) (*ListBackendsResponse, error) {
+	if req.Backend == nil || req.Backend.Addr == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing backend address")
+	}
+	weight := int(req.Backend.Weight)
+	if weight == 0 {
+		weight = 1
+	}
+
+	s.dstMu.Lock()
+	defer s.dstMu.Unlock()
+	dsts := s.target.Destinations()
+	for _, dst := range dsts {
+		if dst.Addr == req.Backend.Addr {
+			return nil, status.Errorf(codes.AlreadyExists, "backend %s already exists", dst.Addr)
+		}
+	}
+	dsts = append(dsts, ipsec.WeightedDest{Addr: req.Backend.Addr, Weight: weight})
+	if err := s.target.SetDestinations(dsts); err != nil {
+		return nil, statusError(err)
+	}
+	return backends(dsts), nil
+}
+
+// RemoveBackend removes a destination.
+func (s *Server) RemoveBackend(ctx context.Context, req *RemoveBackendRequest) (*ListBackendsResponse, error) {
+	s.dstMu.Lock()
+	defer s.dstMu.Unlock()
+	dsts := s.target.Destinations()
+	kept := dsts[:0]
+	for _, dst := range dsts {
+		if dst.Addr != req.Addr {
+			kept = append(kept, dst)
+		}
+	}
+	if len(kept) == len(dsts) {
+		return nil, status.Errorf(codes.NotFound, "unknown backend %s", req.Addr)
+	}
+	if len(kept) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "cannot remove the last backend")
+	}
+	if err := s.target.SetDestinations(kept); err != nil {
+		return nil, statusError(err)
+	}
+	return backends(kept), nil
+}
+
+// StreamEvents sends the events of the forwarder to stream until the client
+// goes away.
+func (s *Server) StreamEvents(req *StreamEventsRequest, stream grpc.ServerStream) error {
+	ch := make(chan *Event, subscriberBufferSize)
+	s.subsMu.Lock()
+	s.subs[ch] = struct{}{}
+	s.subsMu.Unlock()
+	defer func() {
+		s.subsMu.Lock()
+		delete(s.subs, ch)
+		s.subsMu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-ch:
+			if err := stream.SendMsg(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// broadcast hands the events received from ch to every stream of
+// StreamEvents until ch is closed.
+func (s *Server) broadcast(ch <-chan ipsec.Event) {
+	for event := range ch {
+		msg := &Event{
+			Type:           event.Type.String(),
+			TimeUnixNano:   event.Time.UnixNano(),
+			Client:         event.Client,
+			OldClient:      event.OldClient,
+			Destination:    event.Destination,
+			OldDestination: event.OldDestination,
+		}
+		if event.Err != nil {
+			msg.Error = event.Err.Error()
+		}
+
+		s.subsMu.Lock()
+		for sub := range s.subs {
+			select {
+			case sub <- msg:
+			default:
+			}
+		}
+		s.subsMu.Unlock()
+	}
+}
+
+// backends converts dsts to their protobuf form.
+func backends(dsts []ipsec.WeightedDest) *ListBackendsResponse {
+	resp := &ListBackendsResponse{}
+	for _, dst := range dsts {
+		resp.Backends = append(resp.Backends, &Backend{Addr: dst.Addr, Weight: int64(dst.Weight)})
+	}
+	return resp
+}
+
+// statusError converts an error of the forwarder to a gRPC status.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, ipsec.ErrUnknownClient), errors.Is(err, ipsec.ErrUnknownDestination):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ipsec.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
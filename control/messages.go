@@ -0,0 +1,108 @@
+package control
+
+import "github.com/golang/protobuf/proto"
+
+// The messages of control.proto. The struct tags are all the protobuf
+// runtime needs to encode them.
+
+type ListSessionsRequest struct{}
+
+func (m *ListSessionsRequest) Reset()         { *m = ListSessionsRequest{} }
+func (m *ListSessionsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListSessionsRequest) ProtoMessage()    {}
+
+type Session struct {
+	Client             string `protobuf:"bytes,1,opt,name=client,proto3" json:"client,omitempty"`
+	Destination        string `protobuf:"bytes,2,opt,name=destination,proto3" json:"destination,omitempty"`
+	StartUnixNano      int64  `protobuf:"varint,3,opt,name=start_unix_nano,json=startUnixNano,proto3" json:"start_unix_nano,omitempty"`
+	LastActiveUnixNano int64  `protobuf:"varint,4,opt,name=last_active_unix_nano,json=lastActiveUnixNano,proto3" json:"last_active_unix_nano,omitempty"`
+	PacketsToServer    int64  `protobuf:"varint,5,opt,name=packets_to_server,json=packetsToServer,proto3" json:"packets_to_server,omitempty"`
+	BytesToServer      int64  `protobuf:"varint,6,opt,name=bytes_to_server,json=bytesToServer,proto3" json:"bytes_to_server,omitempty"`
+	PacketsToClient    int64  `protobuf:"varint,7,opt,name=packets_to_client,json=packetsToClient,proto3" json:"packets_to_client,omitempty"`
+	BytesToClient      int64  `protobuf:"varint,8,opt,name=bytes_to_client,json=bytesToClient,proto3" json:"bytes_to_client,omitempty"`
+}
+
+func (m *Session) Reset()         { *m = Session{} }
+func (m *Session) String() string { return proto.CompactTextString(m) }
+func (*Session) ProtoMessage()    {}
+
+type ListSessionsResponse struct {
+	Sessions []*Session `protobuf:"bytes,1,rep,name=sessions,proto3" json:"sessions,omitempty"`
+}
+
+func (m *ListSessionsResponse) Reset()         { *m = ListSessionsResponse{} }
+func (m *ListSessionsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListSessionsResponse) ProtoMessage()    {}
+
+type KickSessionRequest struct {
+	Client string `protobuf:"bytes,1,opt,name=client,proto3" json:"client,omitempty"`
+}
+
+func (m *KickSessionRequest) Reset()         { *m = KickSessionRequest{} }
+func (m *KickSessionRequest) String() string { return proto.CompactTextString(m) }
+func (*KickSessionRequest) ProtoMessage()    {}
+
+type KickSessionResponse struct{}
+
+func (m *KickSessionResponse) Reset()         { *m = KickSessionResponse{} }
+func (m *KickSessionResponse) String() string { return proto.CompactTextString(m) }
+func (*KickSessionResponse) ProtoMessage()    {}
+
+type Backend struct {
+	Addr   string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	Weight int64  `protobuf:"varint,2,opt,name=weight,proto3" json:"weight,omitempty"`
+}
+
+func (m *Backend) Reset()         { *m = Backend{} }
+func (m *Backend) String() string { return proto.CompactTextString(m) }
+func (*Backend) ProtoMessage()    {}
+
+type ListBackendsRequest struct{}
+
+func (m *ListBackendsRequest) Reset()         { *m = ListBackendsRequest{} }
+func (m *ListBackendsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListBackendsRequest) ProtoMessage()    {}
+
+type ListBackendsResponse struct {
+	Backends []*Backend `protobuf:"bytes,1,rep,name=backends,proto3" json:"backends,omitempty"`
+}
+
+func (m *ListBackendsResponse) Reset()         { *m = ListBackendsResponse{} }
+func (m *ListBackendsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListBackendsResponse) ProtoMessage()    {}
+
+type AddBackendRequest struct {
+	Backend *Backend `protobuf:"bytes,1,opt,name=backend,proto3" json:"backend,omitempty"`
+}
+
+func (m *AddBackendRequest) Reset()         { *m = AddBackendRequest{} }
+func (m *AddBackendRequest) String() string { return proto.CompactTextString(m) }
+func (*AddBackendRequest) ProtoMessage()    {}
+
+type RemoveBackendRequest struct {
+	Addr string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+}
+
+func (m *RemoveBackendRequest) Reset()         { *m = RemoveBackendRequest{} }
+func (m *RemoveBackendRequest) String() string { return proto.CompactTextString(m) }
+func (*RemoveBackendRequest) ProtoMessage()    {}
+
+type StreamEventsRequest struct{}
+
+func (m *StreamEventsRequest) Reset()         { *m = StreamEventsRequest{} }
+func (m *StreamEventsRequest) String() string { return proto.CompactTextString(m) }
+func (*StreamEventsRequest) ProtoMessage()    {}
+
+type Event struct {
+	Type           string `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	TimeUnixNano   int64  `protobuf:"varint,2,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"time_unix_nano,omitempty"`
+	Client         string `protobuf:"bytes,3,opt,name=client,proto3" json:"client,omitempty"`
+	OldClient      string `protobuf:"bytes,4,opt,name=old_client,json=oldClient,proto3" json:"old_client,omitempty"`
+	Destination    string `protobuf:"bytes,5,opt,name=destination,proto3" json:"destination,omitempty"`
+	Error          string `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	OldDestination string `protobuf:"bytes,7,opt,name=old_destination,json=oldDestination,proto3" json:"old_destination,omitempty"`
+}
+
+func (m *Event) Reset()         { *m = Event{} }
+func (m *Event) String() string { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()    {}
@@ -0,0 +1,82 @@
+package control
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// serviceName is the full name of the Control service of control.proto.
+const serviceName = "ipsecfwd.control.v1.Control"
+
+// controlServer is the interface the methods of serviceDesc call.
+type controlServer interface {
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	KickSession(context.Context, *KickSessionRequest) (*KickSessionResponse, error)
+	ListBackends(context.Context, *ListBackendsRequest) (*ListBackendsResponse, error)
+	AddBackend(context.Context, *AddBackendRequest) (*ListBackendsResponse, error)
+	RemoveBackend(context.Context, *RemoveBackendRequest) (*ListBackendsResponse, error)
+	StreamEvents(*StreamEventsRequest, grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*controlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("ListSessions", func() interface{} { return new(ListSessionsRequest) },
+			func(s controlServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.ListSessions(ctx, req.(*ListSessionsRequest))
+			}),
+		unary("KickSession", func() interface{} { return new(KickSessionRequest) },
+			func(s controlServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.KickSession(ctx, req.(*KickSessionRequest))
+			}),
+		unary("ListBackends", func() interface{} { return new(ListBackendsRequest) },
+			func(s controlServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.ListBackends(ctx, req.(*ListBackendsRequest))
+			}),
+		unary("AddBackend", func() interface{} { return new(AddBackendRequest) },
+			func(s controlServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.AddBackend(ctx, req.(*AddBackendRequest))
+			}),
+		unary("RemoveBackend", func() interface{} { return new(RemoveBackendRequest) },
+			func(s controlServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.RemoveBackend(ctx, req.(*RemoveBackendRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "StreamEvents",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(StreamEventsRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(controlServer).StreamEvents(req, stream)
+		},
+		ServerStreams: true,
+	}},
+	Metadata: "control.proto",
+}
+
+// unary returns the description of the unary method named method, decoding
+// its requests into newRequest() and passing them to call through the
+// interceptor of the server, if any.
+func unary(method string, newRequest func() interface{}, call func(s controlServer, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(controlServer), ctx, req)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
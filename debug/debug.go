@@ -0,0 +1,69 @@
+// Package debug serves runtime profiles and internal state of IPSEC packet
+// forwarders for diagnosing them in production.
+package debug
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Handler returns an http.Handler serving:
+//
+//	/debug/pprof/     the profiles of net/http/pprof
+//	/debug/goroutines the stack of every goroutine as text
+//	/debug/sessions   the client sessions of the forwarders as a text table
+//
+// It exposes internal details and should only be reachable by operators.
+func Handler(forwarders ...*ipsec.Forwarder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%d goroutines\n\n", runtime.NumGoroutine())
+		rpprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.HandleFunc("/debug/sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteSessions(w, forwarders...)
+	})
+	return mux
+}
+
+// ListenAndServe serves Handler on addr.
+func ListenAndServe(addr string, forwarders ...*ipsec.Forwarder) error {
+	return http.ListenAndServe(addr, Handler(forwarders...))
+}
+
+// WriteSessions writes the client sessions of each forwarder to w as a
+// table.
+func WriteSessions(w io.Writer, forwarders ...*ipsec.Forwarder) {
+	now := time.Now()
+	for i, f := range forwarders {
+		clients := f.ClientStats()
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "listener %s: %d clients\n", f.LocalAddr(), len(clients))
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CLIENT\tDESTINATION\tAGE\tIDLE\tPACKETS IN/OUT\tBYTES IN/OUT\tRATE LIMITED")
+		for _, c := range clients {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%d/%d\t%d\n", c.Addr, c.Destination,
+				now.Sub(c.Start).Truncate(time.Second), now.Sub(c.LastActive).Truncate(time.Second),
+				c.PacketsToServer, c.PacketsToClient, c.BytesToServer, c.BytesToClient, c.RateLimited)
+		}
+		tw.Flush()
+	}
+}
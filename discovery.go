@@ -0,0 +1,62 @@
+package main
+
+import (
+    "context"
+    "errors"
+
+    "github.com/bytejedi/ipsec-forward/discovery"
+    "github.com/bytejedi/ipsec-forward/ipsec"
+
+    "github.com/spf13/viper"
+)
+
+// discoverySource returns the source of --discovery, or nil if it is unset.
+func discoverySource() (discovery.Source, error) {
+    spec := viper.GetString(flagDiscovery)
+    if spec == "" {
+        return nil, nil
+    }
+    return discovery.Parse(spec)
+}
+
+// discoveredDestinations returns the destinations source lists now, used in
+// place of --destination when it is unset.
+func discoveredDestinations(source discovery.Source) ([]ipsec.WeightedDest, error) {
+    timeout := viper.GetDuration(flagDiscoveryInterval)
+    if timeout <= 0 {
+        timeout = discovery.DefaultInterval
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    dsts, err := source.Destinations(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if len(dsts) == 0 {
+        return nil, errors.New("no destinations discovered")
+    }
+    return dsts, nil
+}
+
+// startDiscovery keeps the destinations of the forwarder, or of pair if set,
+// in step with source.
+func startDiscovery(source discovery.Source, forwarder *ipsec.Forwarder, pair *ipsec.Pair, logger ipsec.Logger) (*discovery.Watcher, error) {
+    var target discovery.Target = forwarder
+    if pair != nil {
+        target = pairTarget{pair}
+    }
+    return discovery.Start(target, source, discovery.Config{
+        Interval: viper.GetDuration(flagDiscoveryInterval),
+        Logger:   logger,
+    })
+}
+
+// pairTarget applies discovered destinations to a pair, which takes hosts
+// and forwards to them on the IKE and NAT-T ports.
+type pairTarget struct {
+    pair *ipsec.Pair
+}
+
+func (t pairTarget) SetDestinations(dsts []ipsec.WeightedDest) error {
+    return t.pair.SetDestinations(hostsOf(dsts))
+}
@@ -0,0 +1,241 @@
+// Package discovery keeps the destinations of IPSEC packet forwarders in step
+// with a changing set of gateways, such as an autoscaling deployment on
+// Kubernetes, by polling a source of their addresses: a file, an HTTP
+// endpoint serving a JSON list, or the EndpointSlices of a Kubernetes
+// service.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// DefaultInterval is how often the source is polled unless configured
+// otherwise.
+const DefaultInterval = 10 * time.Second
+
+// maxListSize limits the size of a list of destinations read from a source.
+const maxListSize = 16 << 20
+
+// Source returns the current destinations.
+type Source interface {
+	Destinations(ctx context.Context) ([]ipsec.WeightedDest, error)
+}
+
+// Target is what the destinations are applied to, an *ipsec.Forwarder or the
+// like.
+type Target interface {
+	SetDestinations(dsts []ipsec.WeightedDest) error
+}
+
+// Config configures a Watcher.
+type Config struct {
+	Interval time.Duration // how often to poll the source, DefaultInterval if zero
+	Logger   ipsec.Logger  // defaults to logging to the standard logger
+}
+
+// Watcher polls a source and applies its destinations to a target whenever
+// they change. An empty or failing source leaves the destinations as they
+// are.
+type Watcher struct {
+	target Target
+	source Source
+	cfg    Config
+	logger ipsec.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start applies the destinations of source to target and keeps polling it
+// until the watcher is closed. It fails if the first poll does.
+func Start(target Target, source Source, cfg Config) (*Watcher, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	w := &Watcher{
+		target: target,
+		source: source,
+		cfg:    cfg,
+		logger: cfg.Logger,
+	}
+	if w.logger == nil {
+		w.logger = ipsec.NewStdLogger(nil, ipsec.LevelInfo)
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	last, err := w.poll(nil)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	w.wg.Add(1)
+	go w.run(last)
+	return w, nil
+}
+
+// run polls the source every interval until the watcher is closed.
+func (w *Watcher) run(last []ipsec.WeightedDest) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dsts, err := w.poll(last)
+		if err != nil {
+			if w.ctx.Err() == nil {
+				w.logger.Log(ipsec.LevelWarn, "destination discovery failed, keeping destinations", "err", err)
+			}
+			continue
+		}
+		last = dsts
+	}
+}
+
+// poll applies the destinations of the source to the target unless they are
+// the same as last, returning them.
+func (w *Watcher) poll(last []ipsec.WeightedDest) ([]ipsec.WeightedDest, error) {
+	ctx, cancel := context.WithTimeout(w.ctx, w.cfg.Interval)
+	defer cancel()
+	dsts, err := w.source.Destinations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(dsts) == 0 {
+		return nil, errors.New("no destinations found")
+	}
+	sort.Slice(dsts, func(i, j int) bool {
+		return dsts[i].Addr < dsts[j].Addr
+	})
+	if reflect.DeepEqual(dsts, last) {
+		return last, nil
+	}
+	if err := w.target.SetDestinations(dsts); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(dsts))
+	for i, dst := range dsts {
+		addrs[i] = dst.Addr
+	}
+	w.logger.Log(ipsec.LevelInfo, "discovered destinations", "destinations", strings.Join(addrs, ","))
+	return dsts, nil
+}
+
+// Close stops polling.
+func (w *Watcher) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+// File returns a source reading the JSON file at path, which lists the
+// destinations as the admin API does, e.g.
+//
+//	[{"addr": "192.0.2.10:4500", "weight": 1}, {"addr": "192.0.2.11"}]
+//
+// The port defaults to ipsec.DefaultPort and the weight to 1.
+func File(path string) Source {
+	return fileSource(path)
+}
+
+type fileSource string
+
+func (path fileSource) Destinations(ctx context.Context) ([]ipsec.WeightedDest, error) {
+	data, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return nil, err
+	}
+	return parseList(data)
+}
+
+// HTTP returns a source fetching the JSON list of destinations, as read by
+// File, from url.
+func HTTP(url string) Source {
+	return httpSource(url)
+}
+
+type httpSource string
+
+func (url httpSource) Destinations(ctx context.Context) ([]ipsec.WeightedDest, error) {
+	req, err := http.NewRequest(http.MethodGet, string(url), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseList(data)
+}
+
+// parseList parses a JSON list of destinations, validating the addresses.
+func parseList(data []byte) ([]ipsec.WeightedDest, error) {
+	var dsts []ipsec.WeightedDest
+	if err := json.Unmarshal(data, &dsts); err != nil {
+		return nil, fmt.Errorf("discovery: invalid list of destinations: %w", err)
+	}
+	for i := range dsts {
+		addrs, err := ipsec.ValidateDestinations([]string{dsts[i].Addr})
+		if err != nil {
+			return nil, fmt.Errorf("discovery: %w", err)
+		}
+		dsts[i].Addr = addrs[0]
+		if dsts[i].Weight == 0 {
+			dsts[i].Weight = 1
+		}
+	}
+	return dsts, nil
+}
+
+// Parse returns the source described by spec: a path or file: URL for File,
+// an http: or https: URL for HTTP, or kubernetes:namespace/service:port for
+// Kubernetes, where the namespace defaults to the pod's own and port, a
+// name or number, may be omitted if the service has a single port.
+func Parse(spec string) (Source, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return HTTP(spec), nil
+	case strings.HasPrefix(spec, "kubernetes:"):
+		ref := strings.TrimPrefix(spec, "kubernetes:")
+		var namespace, port string
+		if i := strings.Index(ref, "/"); i >= 0 {
+			namespace, ref = ref[:i], ref[i+1:]
+		}
+		if i := strings.Index(ref, ":"); i >= 0 {
+			ref, port = ref[:i], ref[i+1:]
+		}
+		if ref == "" {
+			return nil, fmt.Errorf("discovery: missing service in %q", spec)
+		}
+		return Kubernetes(namespace, ref, port)
+	case spec == "":
+		return nil, errors.New("discovery: empty source")
+	default:
+		return File(strings.TrimPrefix(spec, "file:")), nil
+	}
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// serviceAccountDir holds the credentials of the pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetes is a source listing the ready endpoints of a service.
+type kubernetes struct {
+	client    *http.Client
+	server    string
+	namespace string
+	service   string
+	port      string
+}
+
+// Kubernetes returns a source listing the ready endpoints of service in
+// namespace, read from its EndpointSlices with the credentials of the pod's
+// service account, which needs to be allowed to list endpointslices in the
+// discovery.k8s.io API group. The namespace defaults to the pod's own. port,
+// the name or number of a port of the service, may be empty if the service
+// has a single port.
+func Kubernetes(namespace, service, port string) (Source, error) {
+	host, hostPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || hostPort == "" {
+		return nil, errors.New("discovery: not running in a Kubernetes cluster")
+	}
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("discovery: no namespace given: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("discovery: invalid service account CA certificate")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &kubernetes{
+		client:    &http.Client{Transport: transport},
+		server:    "https://" + net.JoinHostPort(host, hostPort),
+		namespace: namespace,
+		service:   service,
+		port:      port,
+	}, nil
+}
+
+// endpointSliceList is the part of a discovery.k8s.io/v1 EndpointSliceList
+// the source uses.
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+		Ports []struct {
+			Name *string `json:"name"`
+			Port *int32  `json:"port"`
+		} `json:"ports"`
+	} `json:"items"`
+}
+
+func (k *kubernetes) Destinations(ctx context.Context) ([]ipsec.WeightedDest, error) {
+	// The token is read every time as it is rotated.
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		k.server, url.PathEscape(k.namespace), url.QueryEscape("kubernetes.io/service-name="+k.service))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: listing endpoints of %s/%s: %s", k.namespace, k.service, resp.Status)
+	}
+	var list endpointSliceList
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxListSize)).Decode(&list); err != nil {
+		return nil, fmt.Errorf("discovery: invalid endpoint slices: %w", err)
+	}
+
+	var dsts []ipsec.WeightedDest
+	seen := make(map[string]bool)
+	for _, slice := range list.Items {
+		port := ""
+		for _, p := range slice.Ports {
+			if p.Port == nil {
+				continue
+			}
+			number := strconv.Itoa(int(*p.Port))
+			if k.port == "" && len(slice.Ports) == 1 || k.port == number || p.Name != nil && k.port == *p.Name {
+				port = number
+				break
+			}
+		}
+		if port == "" {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Endpoints of unknown readiness are to be taken as ready.
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				dst := net.JoinHostPort(addr, port)
+				if !seen[dst] {
+					seen[dst] = true
+					dsts = append(dsts, ipsec.WeightedDest{Addr: dst, Weight: 1})
+				}
+			}
+		}
+	}
+	return dsts, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+)
+
+// drainCommand returns the command draining a destination of a running
+// forwarder through its admin API, for taking a gateway down for
+// maintenance: new clients go elsewhere while its clients stay until they
+// disconnect or the timeout passes. It prints the clients remaining, and
+// without a destination lists the destinations being drained.
+func drainCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "drain [destination]",
+        Short: "Stop sending new clients to a destination of a running forwarder",
+        Args:  cobra.MaximumNArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            configPath, _ := flags.GetString(flagConfig)
+            if err := readConfig(configPath); err != nil {
+                return err
+            }
+            addr, _ := flags.GetString(flagAdminListen)
+            if addr == "" {
+                addr = viper.GetString(flagAdminListen)
+            }
+            if len(args) == 0 {
+                return adminGet(os.Stdout, addr, "/drain")
+            }
+            path := "/drain/" + url.PathEscape(args[0])
+            if undo, _ := flags.GetBool("undo"); undo {
+                return adminRequest(os.Stdout, addr, http.MethodDelete, path, nil)
+            }
+            timeout, _ := flags.GetDuration(flagTimeout)
+            body := "{}"
+            if timeout > 0 {
+                body = fmt.Sprintf(`{"timeout":%q}`, timeout)
+            }
+            return adminRequest(os.Stdout, addr, http.MethodPut, path, strings.NewReader(body))
+        },
+    }
+    cmd.Flags().String(flagConfig, "", "Config file to read the admin API address from (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    cmd.Flags().String(flagAdminListen, "", "Address of the admin API of the forwarder (default is admin-listen of the config file)")
+    cmd.Flags().Duration(flagTimeout, 0, "Disconnect the clients remaining after this long, 0 lets them stay until they disconnect")
+    cmd.Flags().Bool("undo", false, "Send new clients to the destination again")
+    return cmd
+}
@@ -3,6 +3,8 @@ module github.com/bytejedi/ipsec-forward
 go 1.15
 
 require (
+	github.com/golang/protobuf v1.3.2
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.0
+	google.golang.org/grpc v1.21.1
 )
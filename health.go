@@ -0,0 +1,35 @@
+package main
+
+import (
+    "os"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+)
+
+// healthCommand returns the command checking the health of a running
+// forwarder through its admin API, for the exec health checks of container
+// runtimes, e.g. HEALTHCHECK CMD ["ipsecfwd", "health"] in a Dockerfile. It
+// fails unless the listeners work and a destination is reachable.
+func healthCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "health",
+        Short: "Check that a running forwarder listens and reaches a destination",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            configPath, _ := flags.GetString(flagConfig)
+            if err := readConfig(configPath); err != nil {
+                return err
+            }
+            addr, _ := flags.GetString(flagAdminListen)
+            if addr == "" {
+                addr = viper.GetString(flagAdminListen)
+            }
+            return adminGet(os.Stdout, addr, "/healthz")
+        },
+    }
+    cmd.Flags().String(flagConfig, "", "Config file to read the admin API address from (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    cmd.Flags().String(flagAdminListen, "", "Address of the admin API of the forwarder (default is admin-listen of the config file)")
+    return cmd
+}
@@ -0,0 +1,198 @@
+package ipsec
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// AccountingQueueSize is the number of accounting records waiting to be
+// exported. Records that do not fit are dropped and counted in Stats.
+const AccountingQueueSize = 1024
+
+// Types of AccountingRecord.
+const (
+	AccountingStart   = "start"   // the client connected to its destination
+	AccountingInterim = "interim" // the client is still connected
+	AccountingStop    = "stop"    // the client was disconnected
+)
+
+// AccountingRecord reports the usage of a client session, for billing or
+// auditing, see SetAccounting. The counters are totals since the start of
+// the session.
+type AccountingRecord struct {
+	Type        string        `json:"type"`
+	Session     string        `json:"session"` // unique to the session
+	Client      string        `json:"client"`
+	Destination string        `json:"destination"`
+	Start       time.Time     `json:"start"`
+	Time        time.Time     `json:"time"`
+	Duration    time.Duration `json:"duration"`         // in nanoseconds in JSON
+	Reason      string        `json:"reason,omitempty"` // why a client was disconnected
+
+	PacketsToServer int64 `json:"packets_to_server"`
+	BytesToServer   int64 `json:"bytes_to_server"`
+	PacketsToClient int64 `json:"packets_to_client"`
+	BytesToClient   int64 `json:"bytes_to_client"`
+}
+
+// Accounter exports accounting records, such as to a RADIUS accounting
+// server. Each forwarder exports one record at a time, but an Accounter
+// shared by several forwarders, such as those of a Pair, must be safe for
+// concurrent use.
+type Accounter interface {
+	Export(record AccountingRecord) error
+}
+
+// accounting is the state of SetAccounting.
+type accounting struct {
+	seq uint64 // sessions started, numbering their IDs
+
+	accounter Accounter
+	interval  time.Duration
+	prefix    string // random, so that session IDs differ across restarts
+	queue     chan AccountingRecord
+}
+
+// SetAccounting makes the forwarder export an AccountingRecord when each
+// client connects to its destination and when it is disconnected, and every
+// interval in between if interval is positive. The clients still connected
+// when the forwarder is closed are reported as stopped. Records are exported
+// in order from a goroutine of their own; start and stop records that do not
+// fit in a queue of AccountingQueueSize while the accounter is slow are
+// dropped, while interim records and those of closing are never dropped. A nil
+// accounter, the default, disables accounting. It must be set before the
+// forwarder is used and cannot be changed.
+func (f *Forwarder) SetAccounting(accounter Accounter, interval time.Duration) {
+	if accounter == nil || f.accounting != nil || f.isClosed() {
+		return
+	}
+	var prefix [4]byte
+	rand.Read(prefix[:])
+	f.accounting = &accounting{
+		accounter: accounter,
+		interval:  interval,
+		prefix:    hex.EncodeToString(prefix[:]),
+		queue:     make(chan AccountingRecord, AccountingQueueSize),
+	}
+	f.wg.Add(1)
+	go f.accountant(f.accounting)
+}
+
+// accountStart reports that client at cliAddr connected.
+func (f *Forwarder) accountStart(cliAddr string, client *connection) {
+	a := f.accounting
+	if a == nil {
+		return
+	}
+	client.mu.Lock()
+	client.session = a.prefix + "-" + strconv.FormatUint(atomic.AddUint64(&a.seq, 1), 16)
+	client.mu.Unlock()
+	atomic.StoreInt32(&client.accounted, 1)
+	f.account(client.record(AccountingStart, cliAddr, ""))
+}
+
+// accountStop reports that the client at cliAddr was disconnected for
+// reason, unless it never connected or has already been reported.
+func (f *Forwarder) accountStop(cliAddr string, client *connection, reason string) {
+	if f.accounting == nil || !atomic.CompareAndSwapInt32(&client.accounted, 1, 2) {
+		return
+	}
+	f.account(client.record(AccountingStop, cliAddr, reason))
+}
+
+// account queues record for export, dropping it if the queue is full.
+func (f *Forwarder) account(record AccountingRecord) {
+	select {
+	case f.accounting.queue <- record:
+	default:
+		atomic.AddInt64(&f.accountingDropped, 1)
+	}
+}
+
+// record returns an accounting record of type typ of the client at cliAddr.
+func (c *connection) record(typ, cliAddr, reason string) AccountingRecord {
+	raddr, _ := c.backend()
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	now := time.Now()
+	return AccountingRecord{
+		Type:            typ,
+		Session:         session,
+		Client:          cliAddr,
+		Destination:     raddr.String(),
+		Start:           c.started,
+		Time:            now,
+		Duration:        now.Sub(c.started),
+		Reason:          reason,
+		PacketsToServer: atomic.LoadInt64(&c.packetsToServer),
+		BytesToServer:   atomic.LoadInt64(&c.bytesToServer),
+		PacketsToClient: atomic.LoadInt64(&c.packetsToClient),
+		BytesToClient:   atomic.LoadInt64(&c.bytesToClient),
+	}
+}
+
+// accountant exports the records queued by account, and the interim
+// records, until the forwarder is closed. The clients still connected then
+// are reported as stopped. Interim and those stop records are exported
+// directly rather than queued, so that none is dropped however many clients
+// there are, after the records queued before them.
+func (f *Forwarder) accountant(a *accounting) {
+	defer f.wg.Done()
+
+	var interim <-chan time.Time
+	if a.interval > 0 {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		interim = ticker.C
+	}
+	for {
+		select {
+		case record := <-a.queue:
+			f.export(a, record)
+		case <-interim:
+			f.flushAccounting(a)
+			f.clients.Range(func(key, value interface{}) bool {
+				client := value.(*connection)
+				if atomic.LoadInt32(&client.accounted) == 1 {
+					f.export(a, client.record(AccountingInterim, key.(string), ""))
+				}
+				return true
+			})
+		case <-f.done:
+			f.flushAccounting(a)
+			f.clients.Range(func(key, value interface{}) bool {
+				client := value.(*connection)
+				if atomic.CompareAndSwapInt32(&client.accounted, 1, 2) {
+					f.export(a, client.record(AccountingStop, key.(string), "forwarder closed"))
+				}
+				return true
+			})
+			f.flushAccounting(a)
+			return
+		}
+	}
+}
+
+// flushAccounting exports the records queued so far.
+func (f *Forwarder) flushAccounting(a *accounting) {
+	for {
+		select {
+		case record := <-a.queue:
+			f.export(a, record)
+		default:
+			return
+		}
+	}
+}
+
+// export hands record to the accounter, logging failures.
+func (f *Forwarder) export(a *accounting, record AccountingRecord) {
+	if err := a.accounter.Export(record); err != nil {
+		atomic.AddInt64(&f.accountingFailures, 1)
+		f.logger.Log(LevelWarn, "error exporting accounting record", "client", record.Client, "type", record.Type, "err", err)
+	}
+}
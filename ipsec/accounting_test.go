@@ -0,0 +1,75 @@
+package ipsec
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAccounter collects the records exported to it.
+type recordingAccounter struct {
+	mu      sync.Mutex
+	records []AccountingRecord
+}
+
+func (a *recordingAccounter) Export(record AccountingRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, record)
+	return nil
+}
+
+// count returns the number of records of type typ exported.
+func (a *recordingAccounter) count(typ string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, r := range a.records {
+		if r.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+// addAccountedClients adds n clients that connected as far as accounting is
+// concerned, without traffic.
+func addAccountedClients(f *Forwarder, n int) {
+	for i := 0; i < n; i++ {
+		client := f.newConnection(nil, nil)
+		client.accounted = 1
+		f.clients.Store("192.0.2.1:"+strconv.Itoa(1024+i), client)
+	}
+}
+
+func TestAccountingRecordsNotDroppedWithManyClients(t *testing.T) {
+	const clients = 3 * AccountingQueueSize
+	accounter := new(recordingAccounter)
+	f, err := New(Config{
+		Listen:             "127.0.0.1:0",
+		Destinations:       []WeightedDest{{Addr: "127.0.0.1:9", Weight: 1}},
+		Accounting:         accounter,
+		AccountingInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addAccountedClients(f, clients)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for accounter.count(AccountingInterim) < clients {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d interim records exported, want %d", accounter.count(AccountingInterim), clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.Close()
+	if got := accounter.count(AccountingStop); got != clients {
+		t.Errorf("%d stop records exported on close, want %d", got, clients)
+	}
+	if got := f.Stats().AccountingDropped; got != 0 {
+		t.Errorf("%d records dropped, want none", got)
+	}
+}
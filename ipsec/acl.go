@@ -0,0 +1,85 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// acl decides which client addresses may use the forwarder.
+type acl struct {
+	allow []net.IPNet
+	deny  []net.IPNet
+}
+
+// permits reports whether ip is in none of the denied networks and, unless
+// there are none, in one of the allowed networks.
+func (a *acl) permits(ip net.IP) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted reports whether packets from addr may be forwarded, counting the
+// drop if not.
+func (f *Forwarder) permitted(addr *net.UDPAddr) bool {
+	a, _ := f.acl.Load().(*acl)
+	if a == nil || a.permits(addr.IP) {
+		return true
+	}
+	atomic.AddInt64(&f.aclDenied, 1)
+	f.emit(Event{Type: EventACLDrop, Client: addr.String()})
+	f.offend(addr, BanACL)
+	return false
+}
+
+// SetACL restricts the clients that may use the forwarder by source address.
+// Packets from addresses in one of the deny networks are dropped, and so are
+// packets from addresses outside all of the allow networks unless allow is
+// empty. Drops are counted in DropStats. It may be called at any time and
+// applies to the next packet of every client, including those forwarded by
+// a FastPath, see SetFastPath.
+func (f *Forwarder) SetACL(allow, deny []net.IPNet) {
+	if len(allow) == 0 && len(deny) == 0 {
+		f.acl.Store((*acl)(nil))
+		return
+	}
+	a := &acl{
+		allow: append([]net.IPNet(nil), allow...),
+		deny:  append([]net.IPNet(nil), deny...),
+	}
+	f.acl.Store(a)
+	f.stopFastPaths(func(ip net.IP) bool { return !a.permits(ip) })
+}
+
+// ParseCIDRs parses networks in CIDR notation, such as 192.0.2.0/24. A bare IP
+// address stands for itself alone.
+func ParseCIDRs(cidrs []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
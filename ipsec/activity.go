@@ -0,0 +1,41 @@
+package ipsec
+
+import "fmt"
+
+// Refresh policies naming which packets keep a client from timing out, see
+// SetRefreshPolicy.
+const (
+	RefreshBoth   = "both"   // packets in either direction, the default
+	RefreshClient = "client" // packets from the client
+	RefreshServer = "server" // packets from the destination
+)
+
+// SetRefreshPolicy sets which packets count as activity that keeps a client
+// from timing out: those from the client, those the destination sends back
+// or, by default, both. Counting only the client's packets disconnects
+// clients that have gone away even while the destination keeps retransmitting
+// to them. NAT-T keepalives count only as set with
+// SetKeepalivesExtendTimeout. An empty policy selects the default.
+func (f *Forwarder) SetRefreshPolicy(policy string) error {
+	switch policy {
+	case RefreshBoth, "":
+		f.refreshFromClient, f.refreshFromServer = true, true
+	case RefreshClient:
+		f.refreshFromClient, f.refreshFromServer = true, false
+	case RefreshServer:
+		f.refreshFromClient, f.refreshFromServer = false, true
+	default:
+		return fmt.Errorf("ipsec: unknown refresh policy %q", policy)
+	}
+	return nil
+}
+
+// refreshes reports whether the packet data, received from the client if
+// fromClient is set and from the destination otherwise, counts as activity
+// of the client.
+func (f *Forwarder) refreshes(data []byte, fromClient bool) bool {
+	if fromClient && !f.refreshFromClient || !fromClient && !f.refreshFromServer {
+		return false
+	}
+	return !f.keepalivesIdle || !isNATKeepalive(data)
+}
@@ -0,0 +1,254 @@
+package ipsec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// WeightedDest is a destination and the share of new clients it receives
+// relative to the other destinations.
+type WeightedDest struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+
+	// Timeout, if positive, overrides the timeout of the forwarder for the
+	// clients of the destination. It is given in nanoseconds in JSON.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Source, if set, is the local IP address connections to the
+	// destination are made from, overriding SetOutboundAddr, so that the
+	// return path of each destination is deterministic on hosts with several
+	// addresses or uplinks. It must be of the family of the destination.
+	Source string `json:"source,omitempty"`
+}
+
+// destination is one of the addresses clients are forwarded to.
+type destination struct {
+	// Counters are accessed atomically and kept first for 64-bit alignment.
+	selected      int64
+	clients       int64
+	bytesToServer int64
+	bytesToClient int64
+	timeout       int64 // in nanoseconds, zero to use the forwarder's
+	family        int32 // 4 or 6 once it answered on that family, see SetHappyEyeballs
+
+	addr   string // as given, possibly a hostname
+	raddr  *net.UDPAddr
+	alt    *net.UDPAddr // of the other family, see SetHappyEyeballs
+	laddr  *net.UDPAddr // to dial from, see WeightedDest.Source
+	weight int
+
+	// Health check state, guarded by dstMu.
+	down     bool
+	failures int
+
+	// Drain state, guarded by dstMu, see Forwarder.Drain.
+	drained       bool
+	drainDeadline time.Time
+	drainTimer    *time.Timer
+
+	rtt rttEstimator // see SetRTTMeasurement
+}
+
+// DestinationStats describes how new clients are spread over a destination.
+type DestinationStats struct {
+	Addr     string
+	Weight   int
+	Selected int64 // number of clients assigned to the destination
+	Clients  int64 // number of clients currently forwarded to the destination
+	Healthy  bool  // false while the destination fails its health checks
+	Draining bool  // set while the destination is drained, see Forwarder.Drain
+
+	// Smoothed round trip time and jitter, zero unless measured, see
+	// SetRTTMeasurement.
+	RTT    time.Duration
+	Jitter time.Duration
+
+	// Bytes forwarded to and received from the destination.
+	BytesToServer int64
+	BytesToClient int64
+}
+
+func (dst *destination) stats() DestinationStats {
+	rtt, jitter := dst.rtt.get()
+	return DestinationStats{
+		Addr:     dst.raddr.String(),
+		Weight:   dst.weight,
+		Selected: atomic.LoadInt64(&dst.selected),
+		Clients:  atomic.LoadInt64(&dst.clients),
+		Healthy:  !dst.down,
+		Draining: dst.drained,
+		RTT:      rtt,
+		Jitter:   jitter,
+
+		BytesToServer: atomic.LoadInt64(&dst.bytesToServer),
+		BytesToClient: atomic.LoadInt64(&dst.bytesToClient),
+	}
+}
+
+// newDestinations validates and resolves dsts.
+func (f *Forwarder) newDestinations(dsts []WeightedDest) ([]*destination, error) {
+	if len(dsts) == 0 {
+		return nil, errors.New("ipsec: no destinations")
+	}
+
+	var resolved []*destination
+	for _, dst := range dsts {
+		if dst.Weight <= 0 {
+			return nil, fmt.Errorf("ipsec: destination %s has non-positive weight %d", dst.Addr, dst.Weight)
+		}
+		raddr, err := f.resolveUDPAddr("udp", dst.Addr)
+		if err != nil {
+			return nil, err
+		}
+		var laddr *net.UDPAddr
+		if dst.Source != "" {
+			laddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(dst.Source, "0"))
+			if err != nil {
+				return nil, err
+			}
+			if (laddr.IP.To4() != nil) != (raddr.IP.To4() != nil) {
+				return nil, fmt.Errorf("ipsec: source address %s of destination %s is of another family", dst.Source, dst.Addr)
+			}
+		}
+		resolved = append(resolved, &destination{
+			timeout: int64(dst.Timeout),
+			addr:    dst.Addr,
+			raddr:   raddr,
+			alt:     f.alternate(dst.Addr, raddr),
+			laddr:   laddr,
+			weight:  dst.Weight,
+		})
+	}
+	return resolved, nil
+}
+
+// SetDestinations replaces the destinations new clients are spread over.
+// Existing clients stay with their destination until they disconnect, even
+// if it was removed. Destinations that are kept retain their statistics and
+// health. Nothing changes if any of dsts is invalid.
+func (f *Forwarder) SetDestinations(dsts []WeightedDest) error {
+	resolved, err := f.newDestinations(dsts)
+	if err != nil {
+		return err
+	}
+
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	old := make(map[string]*destination, len(f.dsts))
+	for _, dst := range f.dsts {
+		old[dst.addr] = dst
+	}
+	for i, dst := range resolved {
+		if kept, ok := old[dst.addr]; ok {
+			kept.raddr, kept.alt, kept.laddr = dst.raddr, dst.alt, dst.laddr
+			kept.weight = dst.weight
+			atomic.StoreInt64(&kept.timeout, dst.timeout)
+			resolved[i] = kept
+		}
+	}
+	f.dsts = resolved
+	f.timeoutChanged()
+	return nil
+}
+
+// SetWeight changes the weight of the destination given as addr to
+// SetDestinations, so that it receives a share of new clients proportional
+// to weight. Existing clients keep their destination.
+func (f *Forwarder) SetWeight(addr string, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("ipsec: destination %s has non-positive weight %d", addr, weight)
+	}
+
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	for _, dst := range f.dsts {
+		if dst.addr == addr {
+			dst.weight = weight
+			return nil
+		}
+	}
+	return ErrUnknownDestination
+}
+
+// Destinations returns the destinations new clients are spread over, as
+// given to the forwarder.
+func (f *Forwarder) Destinations() []WeightedDest {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	dsts := make([]WeightedDest, len(f.dsts))
+	for i, dst := range f.dsts {
+		dsts[i] = WeightedDest{Addr: dst.addr, Weight: dst.weight, Timeout: time.Duration(atomic.LoadInt64(&dst.timeout))}
+		if dst.laddr != nil {
+			dsts[i].Source = dst.laddr.IP.String()
+		}
+	}
+	return dsts
+}
+
+// destination picks the destination for a new client at addr. Clients of a
+// Pair go to the destination their other flow was sent to.
+func (f *Forwarder) destination(addr *net.UDPAddr) *destination {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	pick := func() int {
+		return f.pick(addr)
+	}
+	var i int
+	if f.pairing != nil {
+		i = f.pairing.index(addr.IP, pick, f.healthy)
+	} else {
+		i = pick()
+	}
+	dst := f.dsts[i]
+	atomic.AddInt64(&dst.selected, 1)
+	return dst
+}
+
+// lookupDestination returns the destination currently at raddr, or nil if
+// there is none. dstMu must not be held.
+func (f *Forwarder) lookupDestination(raddr *net.UDPAddr) *destination {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	for _, dst := range f.dsts {
+		if dst.raddr.IP.Equal(raddr.IP) && dst.raddr.Port == raddr.Port {
+			return dst
+		}
+	}
+	return nil
+}
+
+// pick returns the index of the destination chosen by the balancer for a new
+// client at addr. Destinations that are down or drained are skipped, see
+// healthy. dstMu must be held.
+func (f *Forwarder) pick(addr *net.UDPAddr) int {
+	var indexes []int
+	var candidates []DestinationStats
+	for i, dst := range f.dsts {
+		if f.healthy(i) {
+			indexes = append(indexes, i)
+			candidates = append(candidates, dst.stats())
+		}
+	}
+	return indexes[f.balancer.Pick(addr, candidates)]
+}
+
+// destinationStats returns the weight and selection count of each destination.
+func (f *Forwarder) destinationStats() []DestinationStats {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	stats := make([]DestinationStats, 0, len(f.dsts))
+	for _, dst := range f.dsts {
+		stats = append(stats, dst.stats())
+	}
+	return stats
+}
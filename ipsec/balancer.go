@@ -0,0 +1,126 @@
+package ipsec
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+)
+
+// Balancer chooses the destination of each new client.
+type Balancer interface {
+	// Pick returns the index in dsts of the destination for a new client
+	// at addr. dsts holds the healthy destinations, or all of them when
+	// none is healthy, and is never empty. The Weight of each is as
+	// given to SetDestinations or SetWeight, and balancers should give
+	// destinations a share of new clients proportional to it. Pick is
+	// never called concurrently by a forwarder.
+	Pick(addr *net.UDPAddr, dsts []DestinationStats) int
+}
+
+// Load balancing strategies understood by NewBalancer.
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategySourceHash       = "source-hash"
+)
+
+// NewBalancer returns the built-in balancer implementing strategy.
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case StrategyRoundRobin:
+		return NewRoundRobin(), nil
+	case StrategyLeastConnections:
+		return NewLeastConnections(), nil
+	case StrategySourceHash:
+		return NewSourceHash(), nil
+	default:
+		return nil, fmt.Errorf("ipsec: unknown load balancing strategy %q", strategy)
+	}
+}
+
+type roundRobin struct {
+	current map[string]int // keyed by destination address
+}
+
+// NewRoundRobin returns a Balancer using smooth weighted round-robin, which
+// interleaves destinations in proportion to their weights. It is the default.
+func NewRoundRobin() Balancer {
+	return &roundRobin{current: make(map[string]int)}
+}
+
+func (b *roundRobin) Pick(addr *net.UDPAddr, dsts []DestinationStats) int {
+	best, total := 0, 0
+	for i, dst := range dsts {
+		b.current[dst.Addr] += dst.Weight
+		total += dst.Weight
+		if b.current[dst.Addr] > b.current[dsts[best].Addr] {
+			best = i
+		}
+	}
+	b.current[dsts[best].Addr] -= total
+	return best
+}
+
+type leastConnections struct{}
+
+// NewLeastConnections returns a Balancer sending new clients to the
+// destination with the fewest clients relative to its weight.
+func NewLeastConnections() Balancer {
+	return leastConnections{}
+}
+
+func (leastConnections) Pick(addr *net.UDPAddr, dsts []DestinationStats) int {
+	best := 0
+	for i, dst := range dsts {
+		// Compare Clients/Weight without dividing.
+		if dst.Clients*int64(dsts[best].Weight) < dsts[best].Clients*int64(dst.Weight) {
+			best = i
+		}
+	}
+	return best
+}
+
+type sourceHash struct{}
+
+// NewSourceHash returns a Balancer sending every client IP address to the same
+// destination, whatever its source port, so that a reconnecting client reaches
+// the gateway still holding its IKE SA. It uses weighted rendezvous hashing:
+// when a destination goes away only its own clients move.
+func NewSourceHash() Balancer {
+	return sourceHash{}
+}
+
+func (sourceHash) Pick(addr *net.UDPAddr, dsts []DestinationStats) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, dst := range dsts {
+		h := fnv.New64a()
+		h.Write(addr.IP.To16())
+		h.Write([]byte(dst.Addr))
+		// Map the hash to (0, 1) and weigh it so that each destination
+		// wins in proportion to its weight.
+		u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+		if score := float64(dst.Weight) / -math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix scrambles the bits of h, whose high bits FNV leaves poorly mixed for
+// inputs differing only in their last bytes (the splitmix64 finalizer).
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// SetBalancer sets how new clients are spread over the destinations. It
+// defaults to NewRoundRobin. Clients already assigned keep their destination.
+func (f *Forwarder) SetBalancer(balancer Balancer) {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+	f.balancer = balancer
+}
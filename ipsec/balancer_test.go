@@ -0,0 +1,88 @@
+package ipsec
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// weights are those of the destinations in the distribution tests.
+var weights = []int{1, 2, 5}
+
+// distribute picks a destination for n new clients with b, counting the
+// clients of each as it goes.
+func distribute(b Balancer, n int) []int {
+	dsts := make([]DestinationStats, len(weights))
+	for i, w := range weights {
+		dsts[i] = DestinationStats{Addr: "192.0.2.1:" + strconv.Itoa(4500+i), Weight: w}
+	}
+	counts := make([]int, len(dsts))
+	for i := 0; i < n; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 4500}
+		j := b.Pick(addr, dsts)
+		counts[j]++
+		dsts[j].Clients++
+	}
+	return counts
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	const clients = 8000
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	for _, test := range []struct {
+		strategy  string
+		tolerance float64 // of the share of each destination
+	}{
+		{StrategyRoundRobin, 0},
+		{StrategyLeastConnections, 0},
+		{StrategySourceHash, 0.1},
+	} {
+		b, err := NewBalancer(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := distribute(b, clients)
+		for i, w := range weights {
+			want := float64(clients * w / total)
+			if got := float64(counts[i]); got < want*(1-test.tolerance)-1 || got > want*(1+test.tolerance)+1 {
+				t.Errorf("%s sent %d of %d clients to the destination of weight %d of %d, want %.0f", test.strategy, counts[i], clients, w, total, want)
+			}
+		}
+	}
+}
+
+func TestWeightedDistributionOfClients(t *testing.T) {
+	const clients = 40
+	var dsts []WeightedDest
+	for i, w := range []int{1, 3} {
+		dsts = append(dsts, WeightedDest{Addr: "127.0.0.1:" + strconv.Itoa(7+i), Weight: w})
+	}
+	f, err := New(Config{Listen: "127.0.0.1:0", Destinations: dsts, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < clients; i++ {
+		conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.Connected()) < clients {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d clients connected", len(f.Connected()), clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := f.destinationStats()
+	if stats[0].Selected != clients/4 || stats[1].Selected != clients*3/4 {
+		t.Errorf("%d and %d clients sent to the destinations of weights 1 and 3, want %d and %d", stats[0].Selected, stats[1].Selected, clients/4, clients*3/4)
+	}
+}
@@ -0,0 +1,225 @@
+package ipsec
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBanSources bounds the sources tracked for banning, so that a flood of
+// spoofed addresses cannot exhaust memory. Further sources are not tracked
+// until older ones expire.
+const maxBanSources = 65536
+
+// Defaults of SetBanPolicy.
+const (
+	DefaultBanWindow   = time.Minute
+	DefaultBanDuration = 10 * time.Minute
+)
+
+// Reasons sources are banned, see SetBanPolicy.
+const (
+	BanInvalid = "invalid" // packets failing validation, see SetValidation
+	BanChurn   = "churn"   // new clients over the per-source rate limit
+	BanACL     = "acl"     // packets from networks denied by the ACL
+)
+
+// Ban is a source address banned from the forwarder.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"` // the last offence, such as BanInvalid
+	Until  time.Time `json:"until"`
+}
+
+// offences counts the offences of a source within the ban window.
+type offences struct {
+	count int
+	since time.Time
+}
+
+// banList tracks the offences of sources and bans those with too many.
+type banList struct {
+	banned int32 // number of bans, to skip the lock while there are none
+
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	mu       sync.Mutex
+	offences map[string]*offences
+	bans     map[string]Ban
+}
+
+// offend counts an offence of ip, returning the ban if it is now banned.
+func (b *banList) offend(ip net.IP, reason string) (Ban, bool) {
+	key := ip.String()
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.bans[key]; ok {
+		return Ban{}, false
+	}
+	o, ok := b.offences[key]
+	if !ok || now.Sub(o.since) > b.window {
+		if !ok && len(b.offences) >= maxBanSources {
+			return Ban{}, false
+		}
+		o = &offences{since: now}
+		b.offences[key] = o
+	}
+	o.count++
+	if o.count < b.threshold {
+		return Ban{}, false
+	}
+	delete(b.offences, key)
+	ban := Ban{IP: key, Reason: reason, Until: now.Add(b.duration)}
+	b.bans[key] = ban
+	atomic.StoreInt32(&b.banned, int32(len(b.bans)))
+	return ban, true
+}
+
+// isBanned reports whether ip is banned.
+func (b *banList) isBanned(ip net.IP) bool {
+	if atomic.LoadInt32(&b.banned) == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[ip.String()]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// expire lifts the bans that ran out and forgets offences outside the
+// window.
+func (b *banList) expire() {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, key)
+		}
+	}
+	for key, o := range b.offences {
+		if now.Sub(o.since) > b.window {
+			delete(b.offences, key)
+		}
+	}
+	atomic.StoreInt32(&b.banned, int32(len(b.bans)))
+}
+
+// SetBanPolicy bans source addresses that offend threshold times within
+// window for duration, dropping all of their packets, as fail2ban does for
+// log files. Offences are packets failing validation, see SetValidation, new
+// clients over the per-source rate limit, see SetNewConnRatePerSource, and
+// packets denied by the ACL, see SetACL. Banned packets are counted in
+// DropStats, and each ban is logged, emitted as EventBan and passed to the
+// OnBan callback, such as to block the address in a firewall. A window or
+// duration of zero selects DefaultBanWindow or DefaultBanDuration. A
+// threshold of zero or less, the default, disables banning. It should be set
+// before the forwarder is used.
+func (f *Forwarder) SetBanPolicy(threshold int, window, duration time.Duration) {
+	if threshold <= 0 {
+		f.bans = nil
+		return
+	}
+	if window <= 0 {
+		window = DefaultBanWindow
+	}
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+	f.bans = &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		offences:  make(map[string]*offences),
+		bans:      make(map[string]Ban),
+	}
+}
+
+// OnBan can be called with a callback function to be called whenever a
+// source address is banned, see SetBanPolicy. It has no effect on a closed
+// forwarder.
+func (f *Forwarder) OnBan(callback func(ban Ban)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.ban = callback
+	f.callbackMu.Unlock()
+}
+
+// Bans returns the source addresses currently banned, ordered by address.
+func (f *Forwarder) Bans() []Ban {
+	b := f.bans
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Unban lifts the ban of the source address ip. It returns ErrUnknownClient
+// if ip is not banned.
+func (f *Forwarder) Unban(ip string) error {
+	b := f.bans
+	if b == nil {
+		return ErrUnknownClient
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.bans[ip]; !ok {
+		return ErrUnknownClient
+	}
+	delete(b.bans, ip)
+	atomic.StoreInt32(&b.banned, int32(len(b.bans)))
+	return nil
+}
+
+// banned reports whether packets from addr are dropped by a ban, counting the
+// drop if so.
+func (f *Forwarder) banned(addr *net.UDPAddr) bool {
+	if f.bans == nil || !f.bans.isBanned(addr.IP) {
+		return false
+	}
+	atomic.AddInt64(&f.bannedDrops, 1)
+	return true
+}
+
+// offend counts an offence of the source at addr, banning it once it has
+// offended too often.
+func (f *Forwarder) offend(addr *net.UDPAddr, reason string) {
+	if f.bans == nil {
+		return
+	}
+	ban, ok := f.bans.offend(addr.IP, reason)
+	if !ok {
+		return
+	}
+	f.logger.Log(LevelWarn, "banning source", "ip", ban.IP, "reason", reason, "until", ban.Until.Format(time.RFC3339))
+	f.stopFastPaths(addr.IP.Equal)
+	f.callback().ban(ban)
+	f.emit(Event{Type: EventBan, Client: addr.String()})
+}
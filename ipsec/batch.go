@@ -0,0 +1,73 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// message is a datagram read as part of a batch.
+type message struct {
+	buf     []byte
+	oob     []byte // for the GRO segment size, see SetUDPOffload
+	n       int
+	flags   int
+	segment int // size of the datagrams coalesced in buf, if any
+	dscp    int // of the datagram, see SetDSCPPassthrough
+	addr    *net.UDPAddr
+}
+
+// readMessages reads into msgs, batching the reads when there is room for
+// more than one datagram.
+func readMessages(conn *net.UDPConn, msgs []message) (int, error) {
+	if len(msgs) > 1 {
+		return readBatch(conn, msgs)
+	}
+	n, oobn, flags, addr, err := readMsg(conn, msgs[0].buf, msgs[0].oob)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].n, msgs[0].flags, msgs[0].addr = n, flags, addr
+	msgs[0].segment = groSegment(msgs[0].oob[:oobn])
+	msgs[0].dscp = dscpFromOOB(msgs[0].oob[:oobn])
+	return 1, nil
+}
+
+// runBatch reads up to batchSize datagrams from the listener conn at once and
+// passes them on to be forwarded.
+func (f *Forwarder) runBatch(conn *net.UDPConn, batchSize int) error {
+	passDSCP := f.passingDSCP()
+	msgs := make([]message, batchSize)
+	for i := range msgs {
+		msgs[i].buf = f.getBuffer()
+		if passDSCP {
+			msgs[i].oob = newOOB()
+		}
+	}
+
+	n, err := readMessages(conn, msgs)
+	if err != nil {
+		n = 0
+	}
+	for _, msg := range msgs[:n] {
+		f.receive(msg.buf[:msg.n], msg.flags, msg.dscp, msg.addr)
+	}
+	for _, msg := range msgs[n:] {
+		f.putBuffer(msg.buf)
+	}
+	return err
+}
+
+// SetBatchSize switches the forwarder to reading up to batchSize datagrams
+// per system call, where the platform supports it, for busy relays. It
+// applies to the listener and to the replies of destinations, which are also
+// sent on to the client in batches. A batchSize of one or less, the default,
+// uses the portable path and handles one datagram at a time. Destination
+// readers pick up the batch size when the client connects.
+func (f *Forwarder) SetBatchSize(batchSize int) {
+	atomic.StoreInt32(&f.batchSize, int32(batchSize))
+}
+
+// batch returns the batch size set with SetBatchSize.
+func (f *Forwarder) batch() int {
+	return int(atomic.LoadInt32(&f.batchSize))
+}
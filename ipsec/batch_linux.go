@@ -0,0 +1,197 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package ipsec
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr on 64-bit Linux.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// readBatch reads up to len(msgs) datagrams from conn with a single recvmmsg
+// system call, returning the number read.
+func readBatch(conn *net.UDPConn, msgs []message) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	hdrs := make([]mmsghdr, len(msgs))
+	iovs := make([]syscall.Iovec, len(msgs))
+	names := make([]syscall.RawSockaddrAny, len(msgs))
+	for i := range msgs {
+		iovs[i].Base = &msgs[i].buf[0]
+		iovs[i].SetLen(len(msgs[i].buf))
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+		if len(msgs[i].oob) > 0 {
+			hdrs[i].hdr.Control = &msgs[i].oob[0]
+			hdrs[i].hdr.SetControllen(len(msgs[i].oob))
+		}
+	}
+
+	var n int
+	var errno syscall.Errno
+	err = rawConn.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+				uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	})
+	runtime.KeepAlive(iovs)
+	runtime.KeepAlive(names)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].n = int(hdrs[i].len)
+		msgs[i].flags = int(hdrs[i].hdr.Flags)
+		msgs[i].addr = sockaddrToUDPAddr(&names[i])
+		msgs[i].segment = groSegment(msgs[i].oob[:hdrs[i].hdr.Controllen])
+		msgs[i].dscp = dscpFromOOB(msgs[i].oob[:hdrs[i].hdr.Controllen])
+	}
+	return n, nil
+}
+
+// sockaddrToUDPAddr converts a raw socket address filled in by the kernel.
+func sockaddrToUDPAddr(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: networkPort(&sa.Port)}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: networkPort(&sa.Port)}
+	}
+	return &net.UDPAddr{}
+}
+
+// networkPort reads a port stored in network byte order.
+func networkPort(port *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+// writeBatch sends every buffer in bufs to addr over conn with as few sendmmsg
+// system calls as possible, returning the number sent.
+func writeBatch(conn *net.UDPConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	// Sockets listening on a wildcard address are usually dual-stack IPv6
+	// sockets, which need IPv4 addresses in their mapped form.
+	var ipv6 bool
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		var sa syscall.Sockaddr
+		if sa, sockErr = syscall.Getsockname(int(fd)); sockErr == nil {
+			_, ipv6 = sa.(*syscall.SockaddrInet6)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, os.NewSyscallError("getsockname", sockErr)
+	}
+
+	var sa4 syscall.RawSockaddrInet4
+	var sa6 syscall.RawSockaddrInet6
+	var name unsafe.Pointer
+	var namelen uint32
+	if ipv6 {
+		sa6.Family = syscall.AF_INET6
+		copy(sa6.Addr[:], addr.IP.To16())
+		putNetworkPort(&sa6.Port, addr.Port)
+		name, namelen = unsafe.Pointer(&sa6), syscall.SizeofSockaddrInet6
+	} else {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, &net.AddrError{Err: "non-IPv4 address", Addr: addr.String()}
+		}
+		sa4.Family = syscall.AF_INET
+		copy(sa4.Addr[:], ip)
+		putNetworkPort(&sa4.Port, addr.Port)
+		name, namelen = unsafe.Pointer(&sa4), syscall.SizeofSockaddrInet4
+	}
+
+	hdrs := make([]mmsghdr, len(bufs))
+	iovs := make([]syscall.Iovec, len(bufs))
+	for i, buf := range bufs {
+		if len(buf) > 0 {
+			iovs[i].Base = &buf[0]
+			iovs[i].SetLen(len(buf))
+		}
+		hdrs[i].hdr.Name = (*byte)(name)
+		hdrs[i].hdr.Namelen = namelen
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+	}
+
+	var sent int
+	var errno syscall.Errno
+	err = rawConn.Write(func(fd uintptr) bool {
+		for sent < len(hdrs) {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(len(hdrs)-sent), 0, 0, 0)
+			switch e {
+			case 0:
+				sent += int(r)
+			case syscall.EINTR:
+			case syscall.EAGAIN:
+				return false
+			default:
+				errno = e
+				return true
+			}
+		}
+		return true
+	})
+	runtime.KeepAlive(iovs)
+	runtime.KeepAlive(bufs)
+	runtime.KeepAlive(&sa4)
+	runtime.KeepAlive(&sa6)
+	if err != nil {
+		return sent, err
+	}
+	if errno != 0 {
+		return sent, os.NewSyscallError("sendmmsg", errno)
+	}
+	return sent, nil
+}
+
+// putNetworkPort stores port in network byte order.
+func putNetworkPort(dst *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(dst))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
@@ -0,0 +1,30 @@
+//go:build !linux || (linux && !amd64 && !arm64)
+// +build !linux linux,!amd64,!arm64
+
+package ipsec
+
+import "net"
+
+// readBatch reads a single datagram into msgs, as batched reads are not
+// supported on this platform.
+func readBatch(conn *net.UDPConn, msgs []message) (int, error) {
+	n, oobn, flags, addr, err := readMsg(conn, msgs[0].buf, msgs[0].oob)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].n, msgs[0].flags, msgs[0].addr = n, flags, addr
+	msgs[0].segment = groSegment(msgs[0].oob[:oobn])
+	msgs[0].dscp = dscpFromOOB(msgs[0].oob[:oobn])
+	return 1, nil
+}
+
+// writeBatch sends every buffer in bufs to addr over conn one at a time, as
+// batched writes are not supported on this platform.
+func writeBatch(conn *net.UDPConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	for i, buf := range bufs {
+		if _, err := conn.WriteToUDP(buf, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
@@ -0,0 +1,82 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchWindow is the number of packets a benchmark client has in flight.
+const benchWindow = 64
+
+// BenchmarkForward measures the packets per second forwarded for a client
+// sending windows of packets to an echoing destination, one at a time and
+// in batches.
+func BenchmarkForward(b *testing.B) {
+	for _, batchSize := range []int{1, 8, 32} {
+		b.Run("batch="+strconv.Itoa(batchSize), func(b *testing.B) {
+			benchmarkForward(b, batchSize)
+		})
+	}
+}
+
+func benchmarkForward(b *testing.B, batchSize int) {
+	dst := echoServer(b)
+	dst.SetReadBuffer(4 << 20)
+	dst.SetWriteBuffer(4 << 20)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+		BatchSize:    batchSize,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(4 << 20)
+
+	packet := make([]byte, espHeaderSize+1024)
+	binary.BigEndian.PutUint32(packet, 0x1000)
+	buf := make([]byte, 2048)
+	// Connect the client before timing.
+	conn.Write(packet)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	start := time.Now()
+	lost := 0
+	for sent := 0; sent < b.N; {
+		window := b.N - sent
+		if window > benchWindow {
+			window = benchWindow
+		}
+		for i := 0; i < window; i++ {
+			sent++
+			binary.BigEndian.PutUint32(packet[4:], uint32(sent))
+			conn.Write(packet)
+		}
+		for i := 0; i < window; i++ {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(buf); err != nil {
+				lost += window - i
+				break
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(2*(b.N-lost))/elapsed.Seconds(), "pps")
+	b.ReportMetric(float64(lost), "lost")
+}
@@ -0,0 +1,40 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// truncationLogInterval limits how often datagrams dropped for not fitting in
+// the buffers are logged.
+const truncationLogInterval = time.Minute
+
+// getBuffer returns a packet buffer of the current buffer size, reusing one
+// returned with putBuffer when possible.
+func (f *Forwarder) getBuffer() []byte {
+	size := f.readBufferSize()
+	if buf, ok := f.buffers.Get().(*[]byte); ok && cap(*buf) == size {
+		return (*buf)[:size]
+	}
+	return make([]byte, size)
+}
+
+// putBuffer makes buf, obtained from getBuffer and possibly resliced, available
+// for reuse. buf must not be used afterwards.
+func (f *Forwarder) putBuffer(buf []byte) {
+	buf = buf[:cap(buf)]
+	f.buffers.Put(&buf)
+}
+
+// dropTruncated counts a datagram from src that did not fit in its buffer,
+// logging it unless another one was logged recently.
+func (f *Forwarder) dropTruncated(src *net.UDPAddr) {
+	total := atomic.AddInt64(&f.truncated, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&f.truncationLogged)
+	if now-last < int64(truncationLogInterval) || !atomic.CompareAndSwapInt64(&f.truncationLogged, last, now) {
+		return
+	}
+	f.logger.Log(LevelWarn, "dropped datagram larger than the buffer size", "from", src, "buffer_size", f.readBufferSize(), "total", total)
+}
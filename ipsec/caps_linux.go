@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the capability to bind ports below 1024.
+const capNetBindService = 10
+
+// canBindPrivileged reports whether the process may listen on ports below
+// 1024, from its effective capabilities. It reports true if they cannot be
+// read.
+func canBindPrivileged() bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return true
+		}
+		return caps&(1<<capNetBindService) != 0
+	}
+	return true
+}
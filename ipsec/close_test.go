@@ -0,0 +1,67 @@
+package ipsec
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	dst := echoServer(t)
+	before := runtime.NumGoroutine()
+
+	f, err := New(Config{
+		Listen:         "127.0.0.1:0",
+		Destinations:   []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:        time.Minute,
+		HealthInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	for i := 0; i < 10; i++ {
+		conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, byte(i)})
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Fatal("forwarder started no goroutines")
+	}
+	f.Close()
+
+	// Close waits for the goroutines of the forwarder, so none may be left
+	// once it returns but those of the runtime winding down.
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			stack := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines after Close, %d before New:\n%s", runtime.NumGoroutine(), before, stack[:runtime.Stack(stack, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: "127.0.0.1:9", Weight: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	if err := f.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v, want ErrClosed", err)
+	}
+}
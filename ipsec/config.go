@@ -0,0 +1,279 @@
+package ipsec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Config describes a Forwarder. Zero values leave the corresponding setting
+// at its default; see the setter of each setting for details.
+type Config struct {
+	// Listen is the address to listen on for clients.
+	Listen string
+
+	// ListenIKE is the address to listen on for the IKE flows of clients
+	// when forwarding a Pair, see ForwardPairContext.
+	ListenIKE string
+
+	// Listeners is the number of sockets opened on Listen, each with its
+	// own read loop, to spread the load of receiving over several cores.
+	// More than one requires SO_REUSEPORT, which is only used on Linux.
+	Listeners int
+
+	// ListenConns are sockets already listening for clients, such as those
+	// passed by systemd socket activation, to use instead of opening
+	// Listen. The forwarder takes ownership of them.
+	ListenConns []*net.UDPConn
+
+	// ListenIKEConns are to ListenIKE what ListenConns are to Listen.
+	ListenIKEConns []*net.UDPConn
+
+	// Destinations are the addresses new clients are spread over.
+	Destinations []WeightedDest
+
+	// Timeout is the period of inactivity after which clients are
+	// disconnected. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// ExpiryResolution bounds how late after their timeout clients are
+	// disconnected, see SetExpiryResolution.
+	ExpiryResolution time.Duration
+
+	MaxClients    int           // see SetMaxClients
+	SocketLimit   int           // see SetSocketLimit
+	BufferSize    int           // see SetBufferSize
+	WriteTimeout  time.Duration // see SetWriteTimeout
+	MaxReadErrors int           // see SetMaxReadErrors
+	BatchSize     int           // see SetBatchSize
+	QueueSize     int           // see SetQueueSize
+	PoolSize      int           // see SetPooledMode
+	UDPOffload    bool          // see SetUDPOffload
+
+	DialTimeout                  time.Duration // see SetDialTimeout
+	DialRetries                  int           // see SetDialRetries
+	DialFallback                 bool          // see SetDialFallback
+	SourcePortMin, SourcePortMax int           // see SetSourcePortRange
+	OutboundAddr                 string        // see SetOutboundAddr
+	Transparent                  bool          // see SetTransparent
+	Transport                    Transport     // see SetTransport
+	HappyEyeballs                time.Duration // delay before falling back, see SetHappyEyeballs
+
+	ListenerOptions SocketOptions // see SetListenerOptions
+	OutboundOptions SocketOptions // see SetOutboundOptions
+
+	DSCP            string // class forced on every packet, see ParseDSCP and SetDSCP
+	DSCPPassthrough bool   // see SetDSCPPassthrough
+	MTU             int    // see SetMTU
+	RelayICMP       bool   // see SetICMPRelay
+
+	Impairment Impairment // see SetImpairment
+
+	BackendKeepalive time.Duration // see SetBackendKeepalive
+	Goodbye          []byte        // see SetGoodbye
+	AnswerKeepalives bool          // see SetAnswerKeepalives
+	KeepalivesIdle   bool          // keepalives do not extend the timeout, see SetKeepalivesExtendTimeout
+	TrackIKESessions bool          // see SetTrackIKESessions
+	RefreshPolicy    string        // see SetRefreshPolicy
+	Diagnose         bool          // see SetDiagnose
+	Validate         bool          // see SetValidation
+
+	ProxyProtocol            bool   // see SetProxyProtocol
+	ProxyProtocolEveryPacket bool   // see SetProxyProtocolEveryPacket
+	MetadataAddr             string // see SetMetadataAddr
+
+	MirrorAddr      string // see SetMirror
+	MirrorDirection string
+	MirrorRatio     float64
+
+	Accounting         Accounter // see SetAccounting
+	AccountingInterval time.Duration
+
+	NewConnRate    float64 // see SetNewConnRate
+	NewConnBurst   int
+	RateLimit      int // see SetRateLimit
+	RateBurst      int
+	Bandwidth      int // see SetBandwidthLimit
+	BandwidthBurst int
+
+	NewConnRatePerSource  float64 // see SetNewConnRatePerSource
+	NewConnBurstPerSource int
+
+	BanThreshold int // see SetBanPolicy
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+
+	IKECookies int // threshold of IKE_SA_INIT requests per second, see SetIKECookies
+
+	// Strategy names the built-in balancer to use, see NewBalancer.
+	// Balancer takes precedence over it.
+	Strategy string
+
+	// Steering, if set, sends new clients to the nearest destination
+	// measured every SteeringInterval. It takes precedence over Balancer
+	// and Strategy, see SetSteering.
+	Steering         Steering
+	SteeringInterval time.Duration
+
+	Allow, Deny     []net.IPNet     // see SetACL
+	ClientTimeouts  []ClientTimeout // see SetClientTimeouts
+	Logger          Logger          // see SetLogger
+	Tracer          Tracer          // see SetTracer
+	Balancer        Balancer        // see SetBalancer
+	HealthInterval  time.Duration   // see SetHealthCheck
+	RTTInterval     time.Duration   // see SetRTTMeasurement
+	ResolveInterval time.Duration   // see SetResolveInterval
+}
+
+// ForwardContext starts a forwarder described by cfg, applying opts before
+// any packet is read. The forwarder is closed when ctx is cancelled, as if
+// Close had been called.
+func ForwardContext(ctx context.Context, cfg Config, opts ...Option) (*Forwarder, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return forward(ctx, cfg, nil, opts...)
+}
+
+// apply applies the settings of cfg other than the listen address,
+// destinations and timeout.
+func (f *Forwarder) apply(cfg Config) error {
+	f.SetACL(cfg.Allow, cfg.Deny)
+	f.SetClientTimeouts(cfg.ClientTimeouts)
+	f.SetExpiryResolution(cfg.ExpiryResolution)
+	if cfg.Logger != nil {
+		f.SetLogger(cfg.Logger)
+	}
+	if cfg.Tracer != nil {
+		f.SetTracer(cfg.Tracer)
+	}
+	if cfg.OutboundAddr != "" {
+		if err := f.SetOutboundAddr(cfg.OutboundAddr); err != nil {
+			return err
+		}
+	}
+	if cfg.Transparent {
+		// Forwarding from the wrong addresses is no fallback.
+		if err := f.SetTransparent(true); err != nil {
+			return err
+		}
+	}
+	f.SetTransport(cfg.Transport)
+	if err := f.SetListenerOptions(cfg.ListenerOptions); err != nil && !f.unsupported(err) {
+		return err
+	}
+	if err := f.SetOutboundOptions(cfg.OutboundOptions); err != nil && !f.unsupported(err) {
+		return err
+	}
+	f.SetHappyEyeballs(cfg.HappyEyeballs)
+	if cfg.DSCP != "" {
+		class, err := ParseDSCP(cfg.DSCP)
+		if err != nil {
+			return err
+		}
+		if err := f.SetDSCP(class); err != nil && !f.unsupported(err) {
+			return err
+		}
+	}
+	if cfg.DSCPPassthrough {
+		if err := f.SetDSCPPassthrough(true); err != nil && !f.unsupported(err) {
+			return err
+		}
+	}
+	if cfg.MTU > 0 {
+		if err := f.SetMTU(cfg.MTU); err != nil && !f.unsupported(err) {
+			return err
+		}
+	}
+	if cfg.RelayICMP {
+		if err := f.SetICMPRelay(true); err != nil && !f.unsupported(err) {
+			return err
+		}
+	}
+	if err := f.SetImpairment(cfg.Impairment); err != nil {
+		return err
+	}
+	if cfg.BufferSize > MaxBufferSize {
+		return fmt.Errorf("ipsec: buffer size %d exceeds %d", cfg.BufferSize, MaxBufferSize)
+	}
+	if cfg.BufferSize > 0 {
+		f.SetBufferSize(cfg.BufferSize)
+	}
+	if cfg.QueueSize > 0 {
+		f.SetQueueSize(cfg.QueueSize)
+	}
+	if cfg.MaxReadErrors > 0 {
+		f.SetMaxReadErrors(cfg.MaxReadErrors)
+	}
+	if cfg.Balancer != nil {
+		f.SetBalancer(cfg.Balancer)
+	} else if cfg.Strategy != "" {
+		balancer, err := NewBalancer(cfg.Strategy)
+		if err != nil {
+			return err
+		}
+		f.SetBalancer(balancer)
+	}
+	if cfg.Steering != nil {
+		f.SetSteering(cfg.Steering, cfg.SteeringInterval)
+	}
+	f.SetMaxClients(cfg.MaxClients)
+	f.SetSocketLimit(cfg.SocketLimit)
+	f.SetWriteTimeout(cfg.WriteTimeout)
+	f.SetBatchSize(cfg.BatchSize)
+	f.SetPooledMode(cfg.PoolSize)
+	if cfg.UDPOffload {
+		f.SetUDPOffload(true)
+	}
+	f.SetDialTimeout(cfg.DialTimeout)
+	f.SetDialRetries(cfg.DialRetries)
+	f.SetDialFallback(cfg.DialFallback)
+	if err := f.SetSourcePortRange(cfg.SourcePortMin, cfg.SourcePortMax); err != nil {
+		return err
+	}
+	f.SetBackendKeepalive(cfg.BackendKeepalive)
+	f.SetGoodbye(cfg.Goodbye)
+	f.SetAnswerKeepalives(cfg.AnswerKeepalives)
+	f.SetKeepalivesExtendTimeout(!cfg.KeepalivesIdle)
+	if err := f.SetRefreshPolicy(cfg.RefreshPolicy); err != nil {
+		return err
+	}
+	f.SetTrackIKESessions(cfg.TrackIKESessions)
+	f.SetDiagnose(cfg.Diagnose)
+	f.SetValidation(cfg.Validate)
+	f.SetProxyProtocol(cfg.ProxyProtocol)
+	f.SetProxyProtocolEveryPacket(cfg.ProxyProtocolEveryPacket)
+	if err := f.SetMetadataAddr(cfg.MetadataAddr); err != nil {
+		return err
+	}
+	if err := f.SetMirror(cfg.MirrorAddr, cfg.MirrorDirection, cfg.MirrorRatio); err != nil {
+		return err
+	}
+	f.SetAccounting(cfg.Accounting, cfg.AccountingInterval)
+	f.SetNewConnRate(cfg.NewConnRate, cfg.NewConnBurst)
+	f.SetNewConnRatePerSource(cfg.NewConnRatePerSource, cfg.NewConnBurstPerSource)
+	f.SetBanPolicy(cfg.BanThreshold, cfg.BanWindow, cfg.BanDuration)
+	f.SetIKECookies(cfg.IKECookies)
+	if cfg.RateLimit > 0 {
+		f.SetRateLimit(cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.Bandwidth > 0 {
+		f.SetBandwidthLimit(cfg.Bandwidth, cfg.BandwidthBurst)
+	}
+	f.SetHealthCheck(cfg.HealthInterval, nil)
+	f.SetRTTMeasurement(cfg.RTTInterval, nil)
+	f.SetResolveInterval(cfg.ResolveInterval)
+	return nil
+}
+
+// unsupported reports whether err means that a setting is not supported on
+// the platform, logging that the forwarder goes on without it if so.
+func (f *Forwarder) unsupported(err error) bool {
+	if !errors.Is(err, ErrUnsupported) {
+		return false
+	}
+	f.logger.Log(LevelWarn, "ignoring unsupported setting", "err", err)
+	return true
+}
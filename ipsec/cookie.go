@@ -0,0 +1,181 @@
+package ipsec
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cookieSecretLifetime is how long the secret cookies are derived from is
+// used. Cookies of the secret before stay valid, so that clients answering
+// just after it changed are not challenged again.
+const cookieSecretLifetime = 2 * time.Minute
+
+const (
+	payloadNotify = 41    // IKEv2 payload type of a Notify payload
+	notifyCookie  = 16390 // IKEv2 notify message type of a COOKIE
+	cookieMACSize = 16    // bytes of the HMAC kept in a cookie
+)
+
+// ikeCookies derives and checks the cookies of SetIKECookies.
+type ikeCookies struct {
+	// Counters are accessed atomically and kept first for 64-bit alignment.
+	window    int64 // Unix second requests are counted in
+	requests  int64 // IKE_SA_INIT requests of new clients in window
+	threshold int64
+
+	mu      sync.Mutex
+	secrets [2][]byte // the current secret and the one before
+	version byte      // of secrets[0], the first byte of its cookies
+	rotated time.Time
+}
+
+// busy counts an IKE_SA_INIT request of a new client and reports whether
+// more than the threshold arrived in the current second.
+func (c *ikeCookies) busy(now time.Time) bool {
+	sec := now.Unix()
+	if window := atomic.LoadInt64(&c.window); window != sec && atomic.CompareAndSwapInt64(&c.window, window, sec) {
+		atomic.StoreInt64(&c.requests, 0)
+	}
+	return atomic.AddInt64(&c.requests, 1) > atomic.LoadInt64(&c.threshold)
+}
+
+// cookie returns the cookie of the IKE SA of a client at ip with the given
+// initiator SPI: the version of the secret and an HMAC of both with it.
+func (c *ikeCookies) cookie(ip net.IP, spi uint64) []byte {
+	c.mu.Lock()
+	if time.Since(c.rotated) > cookieSecretLifetime || c.secrets[0] == nil {
+		secret := make([]byte, sha256.Size)
+		rand.Read(secret)
+		c.secrets[0], c.secrets[1] = secret, c.secrets[0]
+		c.version++
+		c.rotated = time.Now()
+	}
+	version, secret := c.version, c.secrets[0]
+	c.mu.Unlock()
+	return append([]byte{version}, cookieMAC(secret, ip, spi)...)
+}
+
+// valid reports whether cookie is one returned by cookie for ip and spi with
+// the current or previous secret.
+func (c *ikeCookies) valid(ip net.IP, spi uint64, cookie []byte) bool {
+	if len(cookie) != 1+cookieMACSize {
+		return false
+	}
+	c.mu.Lock()
+	var secret []byte
+	switch cookie[0] {
+	case c.version:
+		secret = c.secrets[0]
+	case c.version - 1:
+		secret = c.secrets[1]
+	}
+	c.mu.Unlock()
+	return secret != nil && hmac.Equal(cookie[1:], cookieMAC(secret, ip, spi))
+}
+
+// cookieMAC returns the truncated HMAC of ip and spi with secret.
+func cookieMAC(secret []byte, ip net.IP, spi uint64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(ip.To16())
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], spi)
+	mac.Write(b[:])
+	return mac.Sum(nil)[:cookieMACSize]
+}
+
+// cookieNotify returns the cookie of the IKEv2 message msg, without the
+// non-ESP marker, if its first payload is a COOKIE notification.
+func cookieNotify(msg []byte, h IKEHeader) []byte {
+	if h.NextPayload != payloadNotify || len(msg) < ikeHeaderSize+8 {
+		return nil
+	}
+	payload := msg[ikeHeaderSize:]
+	size := int(binary.BigEndian.Uint16(payload[2:]))
+	spiSize := int(payload[5])
+	if size < 8+spiSize || size > len(payload) || binary.BigEndian.Uint16(payload[6:]) != notifyCookie {
+		return nil
+	}
+	return payload[8+spiSize : size]
+}
+
+// cookieResponse returns the IKE_SA_INIT response asking the initiator of
+// the IKE SA with the given SPI to repeat its request with cookie, preceded
+// by the non-ESP marker if marker is set.
+func cookieResponse(marker bool, spi uint64, cookie []byte) []byte {
+	var msg []byte
+	if marker {
+		msg = make([]byte, nonESPMarkerSize)
+	}
+	length := ikeHeaderSize + 8 + len(cookie)
+	var hdr [ikeHeaderSize + 8]byte
+	binary.BigEndian.PutUint64(hdr[0:], spi)
+	hdr[16] = payloadNotify
+	hdr[17] = 0x20 // version 2.0
+	hdr[18] = ExchangeIKESAInit
+	hdr[19] = ikeFlagResponse
+	binary.BigEndian.PutUint32(hdr[24:], uint32(length))
+	binary.BigEndian.PutUint16(hdr[ikeHeaderSize+2:], uint16(8+len(cookie)))
+	binary.BigEndian.PutUint16(hdr[ikeHeaderSize+6:], notifyCookie)
+	return append(append(msg, hdr[:]...), cookie...)
+}
+
+// SetIKECookies makes the forwarder answer the IKE_SA_INIT requests of new
+// clients with an IKEv2 COOKIE notification itself, as a gateway under
+// attack would (RFC 7296 section 2.6), once more than threshold of them
+// arrive within a second, such as during a flood from spoofed sources. Only
+// clients repeating their request with the cookie, proving they receive
+// packets at their address, are then forwarded, so that the flood neither
+// fills the client table nor reaches the destinations. Cookies are derived
+// from the address and SPI of the client with a secret that changes every
+// few minutes, keeping no state per client. Requests returning a cookie are
+// forwarded unchanged, cookie included, as the initiator signs the request
+// it sent in IKE_AUTH, and responders ignore cookies they did not ask for.
+// Requests answered with a cookie are counted in DropStats. A threshold of
+// zero or less, the default, disables cookies. It may be called at any time.
+func (f *Forwarder) SetIKECookies(threshold int) {
+	if threshold <= 0 {
+		f.cookies.Store((*ikeCookies)(nil))
+		return
+	}
+	f.cookies.Store(&ikeCookies{threshold: int64(threshold)})
+}
+
+// checkCookie reports whether the packet data from addr is forwarded, or
+// false if it is the IKE_SA_INIT request of a new client that was answered
+// with a cookie instead, see SetIKECookies.
+func (f *Forwarder) checkCookie(addr *net.UDPAddr, data []byte) bool {
+	c, _ := f.cookies.Load().(*ikeCookies)
+	if c == nil {
+		return true
+	}
+	h, ok := ParseIKE(data)
+	if !ok || h.ExchangeType != ExchangeIKESAInit || h.Response() || h.ResponderSPI != 0 || h.MessageID != 0 {
+		return true
+	}
+	if _, known := f.clients.Load(addr.String()); known {
+		return true
+	}
+
+	offset := 0
+	if binary.BigEndian.Uint32(data) == 0 {
+		offset = nonESPMarkerSize
+	}
+	if !c.busy(time.Now()) {
+		return true
+	}
+	if cookie := cookieNotify(data[offset:], h); cookie == nil || !c.valid(addr.IP, h.InitiatorSPI, cookie) {
+		atomic.AddInt64(&f.cookieDrops, 1)
+		reply := cookieResponse(offset > 0, h.InitiatorSPI, c.cookie(addr.IP, h.InitiatorSPI))
+		if err := f.write(f.listener(), reply, addr); err != nil {
+			f.logError(LevelDebug, OpCookie, addr.String(), err, "error sending IKE cookie", "client", addr)
+		}
+		return false
+	}
+	return true
+}
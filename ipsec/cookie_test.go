@@ -0,0 +1,111 @@
+package ipsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// ikeSAInit returns an IKE_SA_INIT request of the IKE SA with the given
+// initiator SPI, starting with a COOKIE notification if cookie is not nil.
+func ikeSAInit(spi uint64, cookie []byte) []byte {
+	msg := make([]byte, ikeHeaderSize)
+	binary.BigEndian.PutUint64(msg, spi)
+	msg[16] = 33 // SA
+	msg[17] = 0x20
+	msg[18] = ExchangeIKESAInit
+	msg[19] = ikeFlagInitiator
+	if cookie != nil {
+		msg[16] = payloadNotify
+		notify := make([]byte, 8)
+		notify[0] = 33
+		binary.BigEndian.PutUint16(notify[2:], uint16(8+len(cookie)))
+		binary.BigEndian.PutUint16(notify[6:], notifyCookie)
+		msg = append(append(msg, notify...), cookie...)
+	}
+	msg = append(msg, 0, 0, 0, 8, 1, 2, 3, 4)
+	binary.BigEndian.PutUint32(msg[24:], uint32(len(msg)))
+	return msg
+}
+
+func TestIKECookieRequestForwardedUnchanged(t *testing.T) {
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		IKECookies:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	laddr := f.LocalAddr().(*net.UDPAddr)
+	first, err := net.DialUDP("udp", nil, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.DialUDP("udp", nil, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	buf := make([]byte, 2048)
+	dst.SetReadDeadline(time.Now().Add(2 * time.Second))
+	first.Write(ikeSAInit(0x1111111122222222, nil))
+	if _, _, err := dst.ReadFromUDP(buf); err != nil {
+		t.Fatalf("request below the threshold not forwarded: %v", err)
+	}
+
+	// The threshold is exceeded, so the second client is challenged.
+	second.Write(ikeSAInit(0x3333333344444444, nil))
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := second.Read(buf)
+	if err != nil {
+		t.Fatalf("no cookie received: %v", err)
+	}
+	h, ok := ParseIKE(buf[:n])
+	if !ok || !h.Response() {
+		t.Fatalf("received %x, want an IKE_SA_INIT response", buf[:n])
+	}
+	cookie := append([]byte(nil), cookieNotify(buf[:n], h)...)
+	if cookie == nil {
+		t.Fatalf("response %x has no cookie", buf[:n])
+	}
+	if got := f.DropStats()[DropCookie]; got != 1 {
+		t.Errorf("%d requests dropped for cookies, want 1", got)
+	}
+
+	request := ikeSAInit(0x3333333344444444, cookie)
+	second.Write(request)
+	n, _, err = dst.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("request with the cookie not forwarded: %v", err)
+	}
+	if !bytes.Equal(buf[:n], request) {
+		t.Errorf("forwarded %x, want the request unchanged %x", buf[:n], request)
+	}
+}
+
+func TestIKECookieValid(t *testing.T) {
+	var c ikeCookies
+	ip := net.IPv4(192, 0, 2, 1)
+	cookie := c.cookie(ip, 42)
+	if !c.valid(ip, 42, cookie) {
+		t.Error("cookie not valid for its client")
+	}
+	if c.valid(net.IPv4(192, 0, 2, 2), 42, cookie) {
+		t.Error("cookie valid for another address")
+	}
+	if c.valid(ip, 43, cookie) {
+		t.Error("cookie valid for another SPI")
+	}
+}
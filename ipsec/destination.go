@@ -0,0 +1,56 @@
+package ipsec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultPort is the IPSEC NAT-T port assumed for destinations given without
+// a port.
+const DefaultPort = "4500"
+
+// ValidateDestinations checks that every destination can be resolved and
+// returns them in host:port form, adding DefaultPort to destinations given
+// without a port. The error names the first offending entry.
+func ValidateDestinations(dsts []string) ([]string, error) {
+	normalized := make([]string, 0, len(dsts))
+	for _, dst := range dsts {
+		addr, err := normalizeDestination(dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %q: %w", dst, err)
+		}
+		normalized = append(normalized, addr)
+	}
+	return normalized, nil
+}
+
+func normalizeDestination(dst string) (string, error) {
+	dst = strings.TrimSpace(dst)
+	if dst == "" {
+		return "", errors.New("empty address")
+	}
+
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		// Accept bare hosts, including IPv6 addresses with or without
+		// brackets.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(dst, "["), "]"), DefaultPort
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", err
+		}
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if strings.ContainsAny(host, " \t") {
+		return "", errors.New("host contains whitespace")
+	}
+
+	addr := net.JoinHostPort(host, port)
+	if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
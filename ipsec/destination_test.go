@@ -0,0 +1,51 @@
+package ipsec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDestinations(t *testing.T) {
+	for _, test := range []struct {
+		dst  string
+		want string // empty if invalid
+		err  string // the error if invalid
+	}{
+		{"192.0.2.1", "192.0.2.1:4500", ""},
+		{"192.0.2.1:4501", "192.0.2.1:4501", ""},
+		{"  192.0.2.1  ", "192.0.2.1:4500", ""},
+		{"2001:db8::1", "[2001:db8::1]:4500", ""},
+		{"[2001:db8::1]", "[2001:db8::1]:4500", ""},
+		{"[2001:db8::1]:500", "[2001:db8::1]:500", ""},
+		{"localhost", "localhost:4500", ""},
+		{"", "", `invalid destination "": empty address`},
+		{"   ", "", `invalid destination "   ": empty address`},
+		{":4500", "", `invalid destination ":4500": missing host`},
+		{"192.0.2.1:70000", "", `invalid destination "192.0.2.1:70000": address 70000: invalid port`},
+		{"192.0.2.1:port", "", `invalid destination "192.0.2.1:port": lookup udp/port: unknown port`},
+		{"2001:db8::1::2", "", `invalid destination "2001:db8::1::2": address 2001:db8::1::2: too many colons in address`},
+		{"gate way:4500", "", `invalid destination "gate way:4500": host contains whitespace`},
+	} {
+		got, err := ValidateDestinations([]string{test.dst})
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("ValidateDestinations(%q) = %q, want an error", test.dst, got)
+		case test.want == "" && err.Error() != test.err:
+			t.Errorf("ValidateDestinations(%q) error %q, want %q", test.dst, err, test.err)
+		case test.want != "" && err != nil:
+			t.Errorf("ValidateDestinations(%q): %v", test.dst, err)
+		case test.want != "" && got[0] != test.want:
+			t.Errorf("ValidateDestinations(%q) = %q, want %q", test.dst, got[0], test.want)
+		}
+	}
+}
+
+func TestValidateDestinationsNamesOffendingEntry(t *testing.T) {
+	_, err := ValidateDestinations([]string{"192.0.2.1", "192.0.2.2:bad", "192.0.2.3:bad2"})
+	if err == nil {
+		t.Fatal("invalid destination accepted")
+	}
+	if want := `invalid destination "192.0.2.2:bad"`; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error %q, want it to start with %s", err, want)
+	}
+}
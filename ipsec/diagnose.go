@@ -0,0 +1,168 @@
+package ipsec
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTimelineEntries bounds the IKE messages remembered per client in
+// diagnose mode.
+const maxTimelineEntries = 32
+
+// ExchangeName returns the name of the IKEv2 exchange type t, such as
+// IKE_SA_INIT, or its number if it is not one of the common ones.
+func ExchangeName(t uint8) string {
+	switch t {
+	case ExchangeIKESAInit:
+		return "IKE_SA_INIT"
+	case ExchangeIKEAuth:
+		return "IKE_AUTH"
+	case ExchangeCreateChildSA:
+		return "CREATE_CHILD_SA"
+	case ExchangeInformational:
+		return "INFORMATIONAL"
+	}
+	return fmt.Sprintf("exchange %d", t)
+}
+
+// timelineEntry is an IKE message seen in diagnose mode.
+type timelineEntry struct {
+	at         time.Duration // since the session started
+	fromClient bool
+	header     IKEHeader
+	count      int // times the message was sent, more than one if retransmitted
+}
+
+func (e timelineEntry) String() string {
+	dir, kind := "<", "request"
+	if e.fromClient {
+		dir = ">"
+	}
+	if e.header.Response() {
+		kind = "response"
+	}
+	s := fmt.Sprintf("+%v %s %s %s #%d", e.at.Round(time.Millisecond), dir, ExchangeName(e.header.ExchangeType), kind, e.header.MessageID)
+	if e.count > 1 {
+		s += fmt.Sprintf(" x%d", e.count)
+	}
+	return s
+}
+
+// timeline is the handshake of a client as seen in diagnose mode. Messages
+// in both directions are added by different goroutines.
+type timeline struct {
+	mu      sync.Mutex
+	entries []timelineEntry
+	logged  bool // set once the timeline was logged
+}
+
+// add records the message h, reporting whether it completed IKE_AUTH.
+func (t *timeline) add(at time.Duration, fromClient bool, h IKEHeader) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := len(t.entries); n > 0 {
+		last := &t.entries[n-1]
+		if last.fromClient == fromClient && last.header.ExchangeType == h.ExchangeType &&
+			last.header.MessageID == h.MessageID && last.header.Flags == h.Flags {
+			last.count++
+			return false
+		}
+	}
+	if len(t.entries) == maxTimelineEntries {
+		copy(t.entries, t.entries[1:])
+		t.entries = t.entries[:len(t.entries)-1]
+	}
+	t.entries = append(t.entries, timelineEntry{at: at, fromClient: fromClient, header: h, count: 1})
+	return !fromClient && h.Response() && h.ExchangeType == ExchangeIKEAuth
+}
+
+// summary returns the verdict on the handshake and its messages, or false if
+// no IKE message was seen or the timeline was already logged.
+func (t *timeline) summary() (verdict, messages string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.entries) == 0 || t.logged {
+		return "", "", false
+	}
+	t.logged = true
+
+	strs := make([]string, len(t.entries))
+	established := false
+	for i, e := range t.entries {
+		strs[i] = e.String()
+		if !e.fromClient && e.header.Response() && e.header.ExchangeType == ExchangeIKEAuth {
+			established = true
+		}
+	}
+
+	last := t.entries[len(t.entries)-1]
+	name := ExchangeName(last.header.ExchangeType)
+	switch {
+	case !last.header.Response() && last.fromClient:
+		verdict = fmt.Sprintf("gateway never answered %s request", name)
+	case !last.header.Response():
+		verdict = fmt.Sprintf("client never answered %s request", name)
+	case established:
+		verdict = "established"
+	case !last.fromClient:
+		verdict = fmt.Sprintf("client went quiet after %s response", name)
+	default:
+		verdict = fmt.Sprintf("gateway went quiet after %s response", name)
+	}
+	if !last.header.Response() && last.count > 1 {
+		verdict += fmt.Sprintf(", sent %d times", last.count)
+	}
+	return verdict, strings.Join(strs, ", "), true
+}
+
+// SetDiagnose enables logging the IKEv2 handshake of each client, telling
+// apart clients that never retried from gateways that never answered
+// without a packet capture. Every IKE message forwarded is logged at debug
+// level with its exchange type, IKE_SA_INIT, IKE_AUTH, CREATE_CHILD_SA or
+// INFORMATIONAL, and a timeline of the messages with a verdict is logged at
+// info level once IKE_AUTH completes or, failing that, when the client
+// disconnects. It should be set before the forwarder is used.
+func (f *Forwarder) SetDiagnose(enabled bool) {
+	f.diagnose = enabled
+}
+
+// diagnoseIKE records the packet data of client at cliAddr, sent by the
+// client if fromClient is set and by the destination otherwise, if it is
+// an IKE message and diagnose mode is enabled.
+func (f *Forwarder) diagnoseIKE(cliAddr string, client *connection, data []byte, fromClient bool) {
+	if !f.diagnose {
+		return
+	}
+	h, ok := ParseIKE(data)
+	if !ok {
+		return
+	}
+	dir, kind := "from server", "request"
+	if fromClient {
+		dir = "to server"
+	}
+	if h.Response() {
+		kind = "response"
+	}
+	f.logger.Log(LevelDebug, "ike message", "client", cliAddr, "direction", dir,
+		"exchange", ExchangeName(h.ExchangeType), "type", kind, "message_id", h.MessageID,
+		"initiator_spi", fmt.Sprintf("%016x", h.InitiatorSPI))
+	if client.timeline.add(time.Since(client.started), fromClient, h) {
+		f.logTimeline(cliAddr, client)
+	}
+}
+
+// logTimeline logs the handshake timeline of client in diagnose mode, unless
+// it was already logged.
+func (f *Forwarder) logTimeline(cliAddr string, client *connection) {
+	if !f.diagnose {
+		return
+	}
+	if verdict, messages, ok := client.timeline.summary(); ok {
+		f.logger.Log(LevelInfo, "ike handshake", "client", cliAddr, "verdict", verdict, "timeline", messages)
+	}
+}
@@ -0,0 +1,246 @@
+package ipsec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// dialBackoff is the delay before the first dial retry. It doubles with every
+// further attempt.
+const dialBackoff = 100 * time.Millisecond
+
+// dial connects to raddr, retrying up to dialRetries times with exponential
+// backoff. In transparent mode the connection is made from cliAddr, which is
+// nil for connections shared by several clients.
+func (f *Forwarder) dial(raddr, cliAddr *net.UDPAddr) (*net.UDPConn, error) {
+	dialer := net.Dialer{Timeout: f.dialTimeout}
+	if f.transparent && cliAddr != nil {
+		dialer.LocalAddr = cliAddr
+		dialer.Control = transparentControl
+	} else if laddr := f.sourceAddr(raddr); laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	if device := f.outboundOptions.Device; device != "" {
+		control, bind := dialer.Control, deviceControl(device)
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return bind(network, address, c)
+		}
+	}
+
+	backoff := dialBackoff
+	for attempt := 0; ; attempt++ {
+		var conn net.Conn
+		var err error
+		if f.transport != nil {
+			conn, err = f.dialTransport(raddr)
+		} else {
+			conn, err = f.dialFrom(&dialer, raddr, f.transparent && cliAddr != nil)
+		}
+		if err == nil {
+			f.socketOpened()
+			f.setSocketOptions(conn.(*net.UDPConn))
+			// The device was bound before connecting.
+			opts := f.outboundOptions
+			opts.Device = ""
+			applySocketOptions(conn.(*net.UDPConn), opts)
+			return conn.(*net.UDPConn), nil
+		}
+		if attempt >= f.dialRetries {
+			return nil, err
+		}
+
+		select {
+		case <-f.done:
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// sourceAddr returns the local address connections to raddr are made from:
+// the source of its destination if of the same family, see
+// WeightedDest.Source, or else the address set with SetOutboundAddr, or the
+// loopback address of its family for a loopback raddr. It returns nil to
+// leave the address to the system.
+func (f *Forwarder) sourceAddr(raddr *net.UDPAddr) *net.UDPAddr {
+	v4 := raddr.IP.To4() != nil
+	f.dstMu.Lock()
+	for _, dst := range f.dsts {
+		if dst.laddr == nil || (dst.laddr.IP.To4() != nil) != v4 {
+			continue
+		}
+		for _, addr := range []*net.UDPAddr{dst.raddr, dst.alt} {
+			if addr != nil && addr.IP.Equal(raddr.IP) && addr.Port == raddr.Port {
+				f.dstMu.Unlock()
+				return dst.laddr
+			}
+		}
+	}
+	f.dstMu.Unlock()
+
+	switch {
+	case f.outboundAddr != nil:
+		return f.outboundAddr
+	case raddr.IP.IsLoopback() && v4:
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	case raddr.IP.IsLoopback():
+		return &net.UDPAddr{IP: net.IPv6loopback}
+	}
+	return nil
+}
+
+// dialFrom connects dialer to raddr from a port of the range set with
+// SetSourcePortRange, trying the next port while they are in use, unless
+// no range is set or fixed is, when the dialer's local address is kept.
+func (f *Forwarder) dialFrom(dialer *net.Dialer, raddr *net.UDPAddr, fixed bool) (net.Conn, error) {
+	if f.portMin == 0 || fixed {
+		return dialer.DialContext(f.ctx, "udp", raddr.String())
+	}
+
+	laddr := &net.UDPAddr{}
+	if dialer.LocalAddr != nil {
+		*laddr = *dialer.LocalAddr.(*net.UDPAddr)
+	}
+	n := uint32(f.portMax - f.portMin + 1)
+	for i := uint32(0); i < n; i++ {
+		port := *laddr
+		port.Port = f.portMin + int((atomic.AddUint32(&f.nextPort, 1)-1)%n)
+		dialer.LocalAddr = &port
+		conn, err := dialer.DialContext(f.ctx, "udp", raddr.String())
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return nil, fmt.Errorf("ipsec: no free source port in %d-%d", f.portMin, f.portMax)
+}
+
+// SetSourcePortRange makes connections to the destinations come from local
+// ports min to max, so that firewalls between the forwarder and the
+// destinations can be provisioned with a narrow rule instead of the whole
+// ephemeral range. Every client takes a port of its own, or shares one with
+// SetPooledMode, where replies are told apart by their SPIs; a single port,
+// with min equal to max, therefore suits pooled mode with one socket and a
+// single destination. Clients are refused once every port is taken.
+// Transparent connections keep the client's port. Zero for both, the
+// default, leaves the ports to the system.
+func (f *Forwarder) SetSourcePortRange(min, max int) error {
+	if min == 0 && max == 0 {
+		f.portMin, f.portMax = 0, 0
+		return nil
+	}
+	if min < 1 || max > 65535 || min > max {
+		return fmt.Errorf("ipsec: invalid source port range %d-%d", min, max)
+	}
+	f.portMin, f.portMax = min, max
+	return nil
+}
+
+// SetDialTimeout sets the time limit for each attempt to connect to the
+// destination, including resolving it. Zero, the default, means no limit.
+func (f *Forwarder) SetDialTimeout(timeout time.Duration) {
+	f.dialTimeout = timeout
+}
+
+// SetDialRetries sets how many times connecting to the destination is retried,
+// with exponential backoff, before the client's packet is dropped. It defaults
+// to zero.
+func (f *Forwarder) SetDialRetries(retries int) {
+	f.dialRetries = retries
+}
+
+// SetDialFallback makes clients whose destination cannot be connected to,
+// after the retries set with SetDialRetries, fall back to the next healthy
+// destination in the list given to SetDestinations, trying each once, rather
+// than dropping their packet. Every failed destination is reported to the
+// OnDialError callback. It is disabled by default.
+func (f *Forwarder) SetDialFallback(enabled bool) {
+	f.dialFallback = enabled
+}
+
+// fallbackDestination returns the healthy, undrained destination following dst in the
+// list that is not in tried, or nil if there is none or SetDialFallback is
+// disabled.
+func (f *Forwarder) fallbackDestination(dst *destination, tried map[*destination]bool) *destination {
+	if !f.dialFallback {
+		return nil
+	}
+
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	start := 0
+	for i, d := range f.dsts {
+		if d == dst {
+			start = i + 1
+			break
+		}
+	}
+	for i := range f.dsts {
+		j := (start + i) % len(f.dsts)
+		next := f.dsts[j]
+		if !tried[next] && !next.down && !next.drained {
+			atomic.AddInt64(&next.selected, 1)
+			return next
+		}
+	}
+	return nil
+}
+
+// SetOutboundAddr sets the local address connections to the destination are
+// made from, for hosts with several addresses or uplinks, unless the
+// destination has a source of its own, see WeightedDest.Source. addr is an
+// IP address or hostname without a port, as every client needs its own local
+// port.
+func (f *Forwarder) SetOutboundAddr(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		return err
+	}
+	f.outboundAddr = laddr
+	return nil
+}
+
+// SetTransparent makes connections to the destination originate from the
+// client's own address and port instead of the forwarder's, so that the
+// destination can apply per-client policies. It relies on IP_TRANSPARENT,
+// requiring Linux, CAP_NET_ADMIN and policy routing that delivers the
+// destination's replies back to the forwarder. Transparent connections are
+// never pooled and ignore SetOutboundAddr. It applies to clients connecting
+// after it is set.
+func (f *Forwarder) SetTransparent(enabled bool) error {
+	if enabled {
+		if err := checkTransparent(); err != nil {
+			return err
+		}
+	}
+	f.transparent = enabled
+	return nil
+}
+
+// setSocketOptions applies the UDP offload, DSCP and MTU settings to a socket
+// opened after they were set. Failures are ignored, as the options were
+// accepted by the listeners and the socket works without them.
+func (f *Forwarder) setSocketOptions(conn *net.UDPConn) {
+	if f.gro {
+		setGRO(conn, true)
+	}
+	if class := f.dscpClass(); class >= 0 {
+		setDSCP(conn, class)
+	}
+	if f.passingDSCP() {
+		recvDSCP(conn)
+	}
+	if atomic.LoadInt32(&f.dontFragment) != 0 {
+		setDontFragment(conn)
+	}
+}
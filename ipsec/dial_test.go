@@ -0,0 +1,55 @@
+package ipsec
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails its first dial, then dials directly.
+type flakyTransport struct {
+	dials int32 // accessed atomically
+}
+
+func (t *flakyTransport) Dial(ctx context.Context, raddr *net.UDPAddr) (net.Conn, error) {
+	if atomic.AddInt32(&t.dials, 1) == 1 {
+		return nil, errors.New("destination unreachable")
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", raddr.String())
+}
+
+func TestDialRetryRecovers(t *testing.T) {
+	dst := echoServer(t)
+	transport := new(flakyTransport)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		DialRetries:  1,
+		Transport:    transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2048)); err != nil {
+		t.Fatalf("no reply after the dial was retried: %v", err)
+	}
+	if got := atomic.LoadInt32(&transport.dials); got != 2 {
+		t.Errorf("%d dials, want the failed one and its retry", got)
+	}
+	if got := f.Stats().DialFailures; got != 0 {
+		t.Errorf("%d dial failures counted, want none once the retry succeeded", got)
+	}
+}
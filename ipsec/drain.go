@@ -0,0 +1,130 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DrainStatus describes a destination being drained, see Forwarder.Drain.
+type DrainStatus struct {
+	Addr    string `json:"addr"`
+	Clients int64  `json:"clients"` // clients still forwarded to the destination
+
+	// Deadline is when the remaining clients are disconnected, nil if they
+	// may stay until they disconnect.
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Drain stops assigning new clients to the destination given as addr to
+// SetDestinations, for taking a gateway down for maintenance without cutting
+// its clients off. Its existing clients stay until they disconnect or, if
+// timeout is positive, until timeout has passed, when the remaining ones are
+// disconnected so that their next packets go to another destination. Draining
+// again replaces the timeout. When every destination is drained clients are
+// spread over them as before. It returns ErrUnknownDestination if there is
+// no such destination.
+func (f *Forwarder) Drain(addr string, timeout time.Duration) (DrainStatus, error) {
+	if f.isClosed() {
+		return DrainStatus{}, ErrClosed
+	}
+
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	dst := f.findDestination(addr)
+	if dst == nil {
+		return DrainStatus{}, ErrUnknownDestination
+	}
+	if dst.drainTimer != nil {
+		dst.drainTimer.Stop()
+		dst.drainTimer = nil
+	}
+	dst.drained = true
+	dst.drainDeadline = time.Time{}
+	if timeout > 0 {
+		raddr := dst.raddr
+		dst.drainDeadline = time.Now().Add(timeout)
+		dst.drainTimer = time.AfterFunc(timeout, func() {
+			if !f.isClosed() {
+				f.endClientsOf(raddr, "drained")
+			}
+		})
+	}
+	f.logger.Log(LevelInfo, "draining destination", "destination", dst.raddr, "clients", atomic.LoadInt64(&dst.clients), "timeout", timeout)
+	return dst.drainStatus(), nil
+}
+
+// Undrain assigns new clients to the destination given as addr to
+// SetDestinations again, cancelling a pending disconnect of its clients. It
+// returns ErrUnknownDestination if there is no such destination.
+func (f *Forwarder) Undrain(addr string) error {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	dst := f.findDestination(addr)
+	if dst == nil {
+		return ErrUnknownDestination
+	}
+	if dst.drainTimer != nil {
+		dst.drainTimer.Stop()
+		dst.drainTimer = nil
+	}
+	dst.drained = false
+	dst.drainDeadline = time.Time{}
+	return nil
+}
+
+// Draining returns the destinations being drained, with the number of
+// clients they still have.
+func (f *Forwarder) Draining() []DrainStatus {
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+
+	var draining []DrainStatus
+	for _, dst := range f.dsts {
+		if dst.drained {
+			draining = append(draining, dst.drainStatus())
+		}
+	}
+	return draining
+}
+
+// findDestination returns the destination given as addr to SetDestinations,
+// or nil if there is none. dstMu must be held.
+func (f *Forwarder) findDestination(addr string) *destination {
+	for _, dst := range f.dsts {
+		if dst.addr == addr {
+			return dst
+		}
+	}
+	return nil
+}
+
+// drainStatus returns the drain status of the destination. dstMu must be
+// held.
+func (dst *destination) drainStatus() DrainStatus {
+	status := DrainStatus{Addr: dst.addr, Clients: atomic.LoadInt64(&dst.clients)}
+	if !dst.drainDeadline.IsZero() {
+		deadline := dst.drainDeadline
+		status.Deadline = &deadline
+	}
+	return status
+}
+
+// endClientsOf disconnects the clients forwarded to raddr with reason.
+func (f *Forwarder) endClientsOf(raddr *net.UDPAddr, reason string) {
+	clients := make(map[string]*connection)
+	f.clients.Range(func(key, value interface{}) bool {
+		client := value.(*connection)
+		if addr, _ := client.backend(); addr.IP.Equal(raddr.IP) && addr.Port == raddr.Port {
+			clients[key.(string)] = client
+		}
+		return true
+	})
+
+	for cliAddr, client := range clients {
+		f.disconnectedFrom(cliAddr, raddr, reason)
+		f.endClient(cliAddr, client, reason, nil)
+	}
+}
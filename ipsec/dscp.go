@@ -0,0 +1,96 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// errDSCPUnsupported is returned when marking packets is not supported on the
+// platform.
+var errDSCPUnsupported error = unsupportedError("ipsec: DSCP marking is only supported on Linux")
+
+// dscpClasses are the names of the standard DSCP classes.
+var dscpClasses = map[string]int{
+	"BE": 0, "CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14, "AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30, "AF41": 34, "AF42": 36, "AF43": 38,
+	"VA": 44, "EF": 46,
+}
+
+// ParseDSCP parses a DSCP class given by name, such as EF or AF41, or as a
+// number from 0 to 63.
+func ParseDSCP(s string) (int, error) {
+	if class, ok := dscpClasses[strings.ToUpper(s)]; ok {
+		return class, nil
+	}
+	class, err := strconv.Atoi(s)
+	if err != nil || class < 0 || class > 63 {
+		return 0, fmt.Errorf("ipsec: invalid DSCP class %q", s)
+	}
+	return class, nil
+}
+
+// SetDSCP marks every forwarded packet, in both directions, with the DSCP
+// class, so that QoS policies downstream of the forwarder treat the IPSEC
+// traffic alike. It takes precedence over SetDSCPPassthrough. A negative
+// class, the default, leaves the marks to the system. It requires Linux.
+func (f *Forwarder) SetDSCP(class int) error {
+	if class > 63 {
+		return fmt.Errorf("ipsec: invalid DSCP class %d", class)
+	}
+
+	f.listenerMu.RLock()
+	defer f.listenerMu.RUnlock()
+	mark := class
+	if mark < 0 {
+		mark = 0
+	}
+	for _, conn := range f.listeners {
+		if err := setDSCP(conn, mark); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&f.dscp, int32(class))
+	return nil
+}
+
+// SetDSCPPassthrough copies the DSCP class of each packet received onto the
+// packet forwarded, in both directions, so that QoS policies keep working
+// through the forwarder. Replies from destinations are then sent one at a
+// time rather than in batches. It requires Linux. Like the batch size, it
+// applies to the replies of clients connecting after it is set.
+func (f *Forwarder) SetDSCPPassthrough(enabled bool) error {
+	if enabled {
+		f.listenerMu.RLock()
+		defer f.listenerMu.RUnlock()
+		for _, conn := range f.listeners {
+			if err := recvDSCP(conn); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreInt32(&f.dscpPassthrough, boolInt32(enabled))
+	return nil
+}
+
+// dscpClass returns the DSCP class set with SetDSCP, or -1 if none is forced.
+func (f *Forwarder) dscpClass() int {
+	return int(atomic.LoadInt32(&f.dscp))
+}
+
+// passingDSCP reports whether SetDSCPPassthrough is enabled.
+func (f *Forwarder) passingDSCP() bool {
+	return atomic.LoadInt32(&f.dscpPassthrough) != 0
+}
+
+// writeDSCP is like write but marks the packet with the DSCP class dscp if
+// SetDSCPPassthrough is enabled.
+func (f *Forwarder) writeDSCP(conn *net.UDPConn, data []byte, dscp int, addr *net.UDPAddr) error {
+	if !f.passingDSCP() || f.dscpClass() >= 0 {
+		return f.write(conn, data, addr)
+	}
+	return f.writeMsg(conn, data, dscpOOB(dscp), addr)
+}
@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options for the TOS byte of IPv4 and traffic class of IPv6, which
+// carry the DSCP class in their upper six bits.
+const (
+	ipTOS          = 0x1
+	ipRecvTOS      = 0xd
+	ipv6RecvTClass = 0x42
+	ipv6TClass     = 0x43
+	solIPv6        = 0x29
+	dscpShift      = 2
+)
+
+// setSockoptBoth sets an IPv4 and an IPv6 socket option on conn, which may be
+// a socket of either family or a dual-stack one. It fails only if neither
+// can be set.
+func setSockoptBoth(conn *net.UDPConn, ipv4Opt, ipv6Opt, value int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	err = rawConn.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipv4Opt, value)
+		err6 = syscall.SetsockoptInt(int(fd), solIPv6, ipv6Opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return os.NewSyscallError("setsockopt", err4)
+	}
+	return nil
+}
+
+// setDSCP marks all packets sent on conn with the DSCP class.
+func setDSCP(conn *net.UDPConn, class int) error {
+	return setSockoptBoth(conn, ipTOS, ipv6TClass, class<<dscpShift)
+}
+
+// recvDSCP makes reads from conn return the TOS byte or traffic class of
+// each datagram, see dscpFromOOB.
+func recvDSCP(conn *net.UDPConn) error {
+	return setSockoptBoth(conn, ipRecvTOS, ipv6RecvTClass, 1)
+}
+
+// dscpFromOOB returns the DSCP class given in the control messages oob, or
+// zero.
+func dscpFromOOB(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipTOS && len(msg.Data) >= 1:
+			return int(msg.Data[0]) >> dscpShift
+		case msg.Header.Level == solIPv6 && msg.Header.Type == ipv6TClass && len(msg.Data) >= 4:
+			var tclass int32
+			copy((*[4]byte)(unsafe.Pointer(&tclass))[:], msg.Data)
+			return int(tclass&0xff) >> dscpShift
+		}
+	}
+	return 0
+}
+
+// dscpOOB returns control messages marking a packet with the DSCP class.
+// Both the IPv4 and IPv6 one are included, as the kernel uses whichever
+// applies to the destination.
+func dscpOOB(class int) []byte {
+	oob := make([]byte, 2*syscall.CmsgSpace(4))
+	putCmsgInt(oob, syscall.SOL_IP, ipTOS, class<<dscpShift)
+	putCmsgInt(oob[syscall.CmsgSpace(4):], solIPv6, ipv6TClass, class<<dscpShift)
+	return oob
+}
+
+// putCmsgInt stores a control message carrying an int at the start of b.
+func putCmsgInt(b []byte, level, typ int32, value int) {
+	hdr := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	hdr.Level = level
+	hdr.Type = typ
+	hdr.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = int32(value)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import "net"
+
+func setDSCP(conn *net.UDPConn, class int) error {
+	return errDSCPUnsupported
+}
+
+func recvDSCP(conn *net.UDPConn) error {
+	return errDSCPUnsupported
+}
+
+func dscpFromOOB(oob []byte) int {
+	return 0
+}
+
+func dscpOOB(class int) []byte {
+	return nil
+}
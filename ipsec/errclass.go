@@ -0,0 +1,247 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrorLogInterval is how often repeated errors are summarized in the log.
+// Only the first error of each operation and class is logged per interval,
+// followed by the number of occurrences once it ends, see OnError.
+const ErrorLogInterval = time.Minute
+
+// ErrorClass tells what kind of failure an error is, see ClassifyError.
+type ErrorClass int
+
+// Error classes.
+const (
+	ErrorOther       ErrorClass = iota // none of the below
+	ErrorRefused                       // ECONNREFUSED, usually an ICMP port-unreachable
+	ErrorUnreachable                   // ENETUNREACH, EHOSTUNREACH or ENETDOWN
+	ErrorNoBuffers                     // ENOBUFS or ENOMEM, the socket buffers are full
+	ErrorTimeout                       // a deadline was exceeded
+	ErrorPermission                    // EPERM or EACCES, such as from a firewall
+	ErrorTooBig                        // EMSGSIZE
+	ErrorClosed                        // the socket was closed
+	ErrorDNS                           // resolving a hostname failed
+)
+
+var errorClassNames = [...]string{
+	ErrorOther:       "other",
+	ErrorRefused:     "refused",
+	ErrorUnreachable: "unreachable",
+	ErrorNoBuffers:   "no-buffers",
+	ErrorTimeout:     "timeout",
+	ErrorPermission:  "permission",
+	ErrorTooBig:      "too-big",
+	ErrorClosed:      "closed",
+	ErrorDNS:         "dns",
+}
+
+func (c ErrorClass) String() string {
+	if c >= 0 && int(c) < len(errorClassNames) {
+		return errorClassNames[c]
+	}
+	return "unknown"
+}
+
+// Operations errors are counted for, see ErrorStats.
+const (
+	OpRead         = "read"          // reading from the listener
+	OpReadServer   = "read-server"   // reading the replies of a destination
+	OpDial         = "dial"          // dialing a destination
+	OpSendServer   = "send-server"   // forwarding to a destination
+	OpSendClient   = "send-client"   // forwarding to a client
+	OpSendESP      = "send-esp"      // forwarding native ESP, see ForwardESP
+	OpTransport    = "transport"     // sending through a Transport, see SetTransport
+	OpKeepalive    = "keepalive"     // answering a keepalive
+	OpMetadata     = "metadata"      // sending client metadata, see SetMetadataAddr
+	OpRelayTooBig  = "relay-too-big" // relaying an ICMP packet too big, see SetICMPRelay
+	OpGoodbye      = "goodbye"       // telling a destination a client left, see SetGoodbye
+	OpDialFallback = "dial-family"   // dialing the other address family, see SetHappyEyeballs
+	OpCookie       = "cookie"        // answering with an IKE cookie, see SetIKECookies
+)
+
+// ClassifyError returns the class of err.
+func ClassifyError(err error) ErrorClass {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return ErrorUnreachable
+	case errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM):
+		return ErrorNoBuffers
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return ErrorPermission
+	case errors.Is(err, syscall.EMSGSIZE):
+		return ErrorTooBig
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrorTimeout
+	case errors.Is(err, os.ErrClosed), err != nil && strings.Contains(err.Error(), "use of closed network connection"):
+		return ErrorClosed
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	return ErrorOther
+}
+
+// ErrorReport is an error passed to the callbacks of OnError.
+type ErrorReport struct {
+	Op     string // what failed, such as OpSendServer
+	Class  ErrorClass
+	Client string // address of the client, if any
+	Err    error
+}
+
+// ErrorStats is the number of errors of a class an operation failed with.
+type ErrorStats struct {
+	Op    string
+	Class ErrorClass
+	Count int64
+}
+
+// OnError can be called with a callback function to be called on every
+// error of class, such as to page someone on permission errors from a
+// firewall while ignoring refused packets. It has no effect on a closed
+// forwarder.
+func (f *Forwarder) OnError(class ErrorClass, callback func(report ErrorReport)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	defer f.callbackMu.Unlock()
+	// The map is replaced rather than changed, as callback returns a copy
+	// of the callbacks that is used without holding callbackMu.
+	errs := make(map[ErrorClass]func(ErrorReport), len(f.callbacks.errors)+1)
+	for c, cb := range f.callbacks.errors {
+		errs[c] = cb
+	}
+	errs[class] = callback
+	f.callbacks.errors = errs
+}
+
+// errorKey identifies the errors aggregated together.
+type errorKey struct {
+	op    string
+	class ErrorClass
+}
+
+// errorWindow is the errors of an operation and class in the current log
+// interval.
+type errorWindow struct {
+	start      time.Time
+	level      LogLevel
+	last       error
+	suppressed int64 // not logged since start
+}
+
+// errorLog counts errors and rate limits logging them.
+type errorLog struct {
+	mu      sync.Mutex
+	counts  map[errorKey]int64
+	windows map[errorKey]*errorWindow
+}
+
+// add counts err, which occurred doing op, and reports its class and whether
+// it is to be logged at level: only if no error of the same operation and
+// class was logged in the last ErrorLogInterval, so that failures on every
+// packet during an outage do not flood the log, see flush.
+func (l *errorLog) add(level LogLevel, op string, err error) (ErrorClass, bool) {
+	class := ClassifyError(err)
+	key := errorKey{op, class}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[errorKey]int64)
+		l.windows = make(map[errorKey]*errorWindow)
+	}
+	l.counts[key]++
+	if w, ok := l.windows[key]; ok {
+		w.last = err
+		w.suppressed++
+		return class, false
+	}
+	l.windows[key] = &errorWindow{start: time.Now(), level: level, last: err}
+	return class, true
+}
+
+// flush logs to logger how many errors were not logged in the log intervals
+// that ended by now.
+func (l *errorLog) flush(logger Logger, now time.Time) {
+	type summary struct {
+		errorKey
+		errorWindow
+		interval time.Duration
+	}
+	var summaries []summary
+
+	l.mu.Lock()
+	for key, w := range l.windows {
+		if now.Sub(w.start) < ErrorLogInterval {
+			continue
+		}
+		if w.suppressed == 0 {
+			delete(l.windows, key)
+			continue
+		}
+		summaries = append(summaries, summary{key, *w, now.Sub(w.start).Round(time.Second)})
+		// Go on suppressing the errors until an interval passes without.
+		w.start, w.suppressed = now, 0
+	}
+	l.mu.Unlock()
+
+	for _, s := range summaries {
+		logger.Log(s.level, "errors repeated", "op", s.op, "class", s.class.String(),
+			"count", s.suppressed, "interval", s.interval, "last_err", s.last)
+	}
+}
+
+// stats returns the number of errors of each operation and class, ordered by
+// operation and class.
+func (l *errorLog) stats() []ErrorStats {
+	l.mu.Lock()
+	stats := make([]ErrorStats, 0, len(l.counts))
+	for key, count := range l.counts {
+		stats = append(stats, ErrorStats{Op: key.op, Class: key.class, Count: count})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Op != stats[j].Op {
+			return stats[i].Op < stats[j].Op
+		}
+		return stats[i].Class < stats[j].Class
+	})
+	return stats
+}
+
+// logError counts err, which occurred doing op for the client at client, if
+// any, calls the callback of its class and logs msg with keyvals and err at
+// level unless errors like it are being suppressed, see errorLog.add.
+func (f *Forwarder) logError(level LogLevel, op, client string, err error, msg string, keyvals ...interface{}) {
+	class, log := f.errorLog.add(level, op, err)
+	if callback, ok := f.callback().errors[class]; ok {
+		callback(ErrorReport{Op: op, Class: class, Client: client, Err: err})
+	}
+	if log {
+		f.logger.Log(level, msg, append(keyvals, "err", err, "class", class.String())...)
+	}
+}
+
+// ErrorStats returns the number of errors of each operation and class,
+// ordered by operation and class.
+func (f *Forwarder) ErrorStats() []ErrorStats {
+	return f.errorLog.stats()
+}
@@ -0,0 +1,59 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrClosed is returned when operating on a Forwarder that has been closed.
+var ErrClosed = errors.New("ipsec: forwarder closed")
+
+// ErrUnknownClient is returned when referring to a client the forwarder does
+// not know.
+var ErrUnknownClient = errors.New("ipsec: unknown client")
+
+// ErrUnknownDestination is returned when referring to a destination the
+// forwarder does not spread clients over.
+var ErrUnknownDestination = errors.New("ipsec: unknown destination")
+
+// ErrUnknownProfile is returned when referring to a profile a Manager does
+// not run.
+var ErrUnknownProfile = errors.New("ipsec: unknown profile")
+
+// ErrUnsupported is matched by the errors of settings that are not supported
+// on the platform, see errors.Is. The forwarder goes on without them when
+// they are given in a Config, with a warning.
+var ErrUnsupported = errors.New("ipsec: not supported on this platform")
+
+// unsupportedError is an error matching ErrUnsupported.
+type unsupportedError string
+
+func (e unsupportedError) Error() string { return string(e) }
+
+func (e unsupportedError) Is(target error) bool { return target == ErrUnsupported }
+
+// isTransient reports whether err is a read error that is likely to clear up
+// on its own, such as an ICMP port-unreachable surfacing as ECONNREFUSED on a
+// connected UDP socket, or running out of file descriptors or buffers.
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+// isRebindable reports whether err means the listener's address went away,
+// for example because the network interface was reconfigured, so that
+// reopening the listener may recover.
+func isRebindable(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.ENETDOWN) ||
+		errors.Is(err, syscall.ENODEV)
+}
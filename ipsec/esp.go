@@ -0,0 +1,411 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// espHeaderSize is the size of the SPI and sequence number that start every
+// ESP packet.
+const espHeaderSize = 8
+
+// espKey identifies a client by its IP address and the SPI of its packets, as
+// different clients may pick the same SPI.
+type espKey struct {
+	ip  string
+	spi uint32
+}
+
+func newESPKey(addr *net.IPAddr, spi uint32) espKey {
+	return espKey{ip: string(addr.IP.To16()), spi: spi}
+}
+
+type espClient struct {
+	addr       *net.IPAddr
+	dst        *net.IPAddr // the destination the client's packets go to
+	session    *connection // the client's IKE session, see Forwarder.ForwardESP
+	spi        uint32      // SPI of packets sent by the client
+	replySPI   uint32      // SPI of packets sent back by the destination
+	lastActive time.Time
+}
+
+// ESPForwarder represents a forwarder of native ESP (IP protocol 50) packets,
+// for peers that do not encapsulate ESP in UDP.
+//
+// As ESP carries no ports, clients are told apart by their IP address and the
+// SPI of their packets.
+// The SPI the destination answers with is unrelated and negotiated inside
+// the encrypted IKE exchange, so it is learned by handing the first unknown
+// reply of a destination to one of its clients awaiting one. Following the
+// clients of a Forwarder, that is the client whose IKE_AUTH or
+// CREATE_CHILD_SA request, creating the SA, was sent longest ago, so that
+// clients negotiating at the same time and rekeyed SAs are told apart by
+// their IKE exchanges. Otherwise it is the client that sent its first packet
+// longest ago.
+type ESPForwarder struct {
+	conn    *net.IPConn
+	raddr   *net.IPAddr // nil if following ike
+	ike     *Forwarder  // whose clients' destinations ESP goes to
+	timeout time.Duration
+
+	mu       sync.Mutex
+	clients  map[espKey]*espClient
+	replies  map[espKey]*espClient // keyed by destination and its SPI
+	awaiting []*espClient          // unless following ike
+	learned  map[*connection]int64 // IKE sessions by the childSA whose reply SPI is known
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	logger Logger
+	errors errorLog
+}
+
+// ForwardESP forwards ESP packets received on the src IP address to the dst IP
+// address, forgetting clients after the timeout period of inactivity. The
+// address family of dst decides whether ESP over IPv4 or IPv6 is forwarded; a
+// wildcard src listens on every address of that family. Raw sockets require
+// CAP_NET_RAW (or root) on Linux. ForwardESP is asynchronous.
+func ForwardESP(src, dst string, timeout time.Duration) (*ESPForwarder, error) {
+	raddr, err := net.ResolveIPAddr("ip", dst)
+	if err != nil {
+		return nil, err
+	}
+	network := "ip4"
+	if raddr.IP.To4() == nil {
+		network = "ip6"
+	}
+	conn, err := openESP(network, src)
+	if err != nil {
+		return nil, err
+	}
+	return startESP(conn, raddr, nil, timeout), nil
+}
+
+// ForwardESP forwards the ESP packets of the clients of f received on the src
+// IP address to the host of the destination each client's IKE session was
+// sent to, for peers that switch to native ESP after negotiating over UDP
+// port 500. ESP from hosts without an IKE session is dropped, and clients are
+// forgotten after the timeout of f at the time of the call. A wildcard src
+// listens on every IPv4 address, or IPv6 address if it is one. Raw sockets
+// require CAP_NET_RAW (or root) on Linux. ForwardESP is asynchronous.
+func (f *Forwarder) ForwardESP(src string) (*ESPForwarder, error) {
+	network := "ip4"
+	if ip := net.ParseIP(src); ip != nil && ip.To4() == nil {
+		network = "ip6"
+	}
+	conn, err := openESP(network, src)
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt32(&f.nativeESP, 1)
+	return startESP(conn, nil, f, f.Timeout()), nil
+}
+
+// openESP opens a raw ESP socket of network, ip4 or ip6, on the src IP
+// address, or every address of the family if src is a wildcard or empty.
+func openESP(network, src string) (*net.IPConn, error) {
+	laddr, err := net.ResolveIPAddr(network, src)
+	if err != nil {
+		return nil, err
+	}
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		laddr = nil
+	}
+
+	conn, err := net.ListenIP(network+":50", laddr)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("ipsec: raw ESP sockets require CAP_NET_RAW: %w", err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// startESP starts forwarding the ESP packets received on conn to raddr, or
+// the destinations of the clients of ike if it is set.
+func startESP(conn *net.IPConn, raddr *net.IPAddr, ike *Forwarder, timeout time.Duration) *ESPForwarder {
+	forwarder := &ESPForwarder{
+		conn:    conn,
+		raddr:   raddr,
+		ike:     ike,
+		timeout: timeout,
+		clients: make(map[espKey]*espClient),
+		replies: make(map[espKey]*espClient),
+		learned: make(map[*connection]int64),
+		done:    make(chan struct{}),
+		logger:  NewStdLogger(nil, LevelInfo),
+	}
+
+	forwarder.wg.Add(2)
+	go forwarder.janitor()
+	go forwarder.run()
+
+	return forwarder
+}
+
+func (f *ESPForwarder) run() {
+	defer f.wg.Done()
+	buf := make([]byte, MaxBufferSize)
+	for {
+		n, addr, err := f.conn.ReadFromIP(buf)
+		if err != nil {
+			if !f.isClosed() {
+				f.logger.Log(LevelError, "failed to read ESP, terminating", "err", err)
+			}
+			return
+		}
+		if n < espHeaderSize {
+			continue
+		}
+		spi := binary.BigEndian.Uint32(buf)
+
+		var dst *net.IPAddr
+		if f.fromDestination(spi, addr) {
+			dst = f.replyTo(spi, addr)
+		} else {
+			dst = f.forward(spi, addr)
+		}
+		if dst == nil {
+			continue
+		}
+
+		if _, err := f.conn.WriteToIP(buf[:n], dst); err != nil {
+			if class, log := f.errors.add(LevelDebug, OpSendESP, err); log {
+				f.logger.Log(LevelDebug, "error sending ESP packet", "err", err, "class", class.String())
+			}
+		}
+	}
+}
+
+// fromDestination reports whether the packet with the given SPI from addr
+// was sent by a destination rather than a client. Following the clients of a
+// Forwarder, destinations are recognised by the SPIs they answered with
+// before, and otherwise by their host having no IKE session, as they may be
+// pinned to hosts outside the list of destinations.
+func (f *ESPForwarder) fromDestination(spi uint32, addr *net.IPAddr) bool {
+	if f.ike == nil {
+		return addr.IP.Equal(f.raddr.IP)
+	}
+	key := newESPKey(addr, spi)
+	f.mu.Lock()
+	_, client := f.clients[key]
+	_, reply := f.replies[key]
+	f.mu.Unlock()
+	return reply || !client && f.ike.ikeSession(addr.IP) == nil
+}
+
+// forward records a packet from a client and returns the destination address,
+// or nil if it has none.
+func (f *ESPForwarder) forward(spi uint32, addr *net.IPAddr) *net.IPAddr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	client, ok := f.clients[newESPKey(addr, spi)]
+	if !ok {
+		client = &espClient{addr: addr, dst: f.raddr, spi: spi}
+	}
+	if f.ike != nil && !client.following() {
+		// Follow the IKE session, which may have timed out or moved
+		// to another destination, or keep the last destination
+		// until the client negotiates again.
+		session := f.ike.ikeSession(addr.IP)
+		if session != nil {
+			raddr, _ := session.backend()
+			client.session, client.dst = session, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone}
+		}
+		if client.dst == nil {
+			return nil
+		}
+	}
+	if !ok {
+		f.clients[newESPKey(addr, spi)] = client
+		if f.ike == nil {
+			f.awaiting = append(f.awaiting, client)
+		}
+	}
+	client.lastActive = time.Now()
+	return client.dst
+}
+
+// following reports whether the IKE session the client follows is still
+// connected.
+func (c *espClient) following() bool {
+	if c.session == nil {
+		return false
+	}
+	select {
+	case <-c.session.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// replyTo returns the address of the client a packet from the destination at
+// from with the given SPI belongs to, or nil if there is none.
+func (f *ESPForwarder) replyTo(spi uint32, from *net.IPAddr) *net.IPAddr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := newESPKey(from, spi)
+	client, ok := f.replies[key]
+	if !ok {
+		if f.ike != nil {
+			client = f.awaitingSA(from)
+		} else {
+			client = f.awaitingFirst(from)
+		}
+		if client == nil {
+			return nil
+		}
+		client.replySPI = spi
+		f.replies[key] = client
+	}
+	return client.addr
+}
+
+// awaitingFirst removes and returns the client of the destination at from
+// that sent its first packet longest ago, or nil if none awaits a reply.
+func (f *ESPForwarder) awaitingFirst(from *net.IPAddr) *espClient {
+	for i, client := range f.awaiting {
+		if client.dst.IP.Equal(from.IP) {
+			f.awaiting = append(f.awaiting[:i:i], f.awaiting[i+1:]...)
+			return client
+		}
+	}
+	return nil
+}
+
+// awaitingSA returns the client of the destination at from whose IKE session
+// asked for an SA longest ago without a reply SPI learned since, preferring
+// the most recently active one of the session, as a rekeyed SA comes with a
+// new SPI from the client too. It returns nil if none awaits a reply.
+func (f *ESPForwarder) awaitingSA(from *net.IPAddr) *espClient {
+	var awaiting *espClient
+	var oldest int64
+	for _, client := range f.clients {
+		if client.session == nil || !client.dst.IP.Equal(from.IP) {
+			continue
+		}
+		sa := atomic.LoadInt64(&client.session.childSA)
+		if sa == 0 || sa <= f.learned[client.session] {
+			continue
+		}
+		if awaiting == nil || sa < oldest || sa == oldest && client.lastActive.After(awaiting.lastActive) {
+			awaiting, oldest = client, sa
+		}
+	}
+	if awaiting != nil {
+		f.learned[awaiting.session] = oldest
+	}
+	return awaiting
+}
+
+func (f *ESPForwarder) janitor() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.timeout):
+		}
+
+		f.mu.Lock()
+		deadline := time.Now().Add(-f.timeout)
+		for key, client := range f.clients {
+			if client.lastActive.Before(deadline) {
+				delete(f.clients, key)
+				delete(f.replies, newESPKey(client.dst, client.replySPI))
+			}
+		}
+		awaiting := f.awaiting[:0]
+		for _, client := range f.awaiting {
+			if _, ok := f.clients[newESPKey(client.addr, client.spi)]; ok {
+				awaiting = append(awaiting, client)
+			}
+		}
+		f.awaiting = awaiting
+		followed := make(map[*connection]bool)
+		for _, client := range f.clients {
+			followed[client.session] = true
+		}
+		for session := range f.learned {
+			if !followed[session] {
+				delete(f.learned, session)
+			}
+		}
+		f.mu.Unlock()
+
+		f.errors.flush(f.logger, time.Now())
+	}
+}
+
+// isClosed reports whether Close has been called.
+func (f *ESPForwarder) isClosed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the forwarder and blocks until all of its goroutines have
+// returned. Closing an already closed forwarder returns ErrClosed.
+func (f *ESPForwarder) Close() error {
+	err := ErrClosed
+	f.closeOnce.Do(func() {
+		err = nil
+		close(f.done)
+		f.conn.Close()
+	})
+	f.wg.Wait()
+	return err
+}
+
+// Connected returns the list of connected clients' IP addresses.
+func (f *ESPForwarder) Connected() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var results []string
+	for _, client := range f.clients {
+		results = append(results, client.addr.String())
+	}
+	return results
+}
+
+// trackChildSA records when client asks for an SA to be created, for the
+// ESPForwarder following the clients of f to learn the SPI of its replies.
+func (f *Forwarder) trackChildSA(client *connection, data []byte) {
+	if atomic.LoadInt32(&f.nativeESP) == 0 {
+		return
+	}
+	h, ok := ParseIKE(data)
+	if ok && !h.Response() && (h.ExchangeType == ExchangeIKEAuth || h.ExchangeType == ExchangeCreateChildSA) {
+		atomic.StoreInt64(&client.childSA, time.Now().UnixNano())
+	}
+}
+
+// ikeSession returns the most recently active client of f at ip, or nil if
+// there is none.
+func (f *Forwarder) ikeSession(ip net.IP) *connection {
+	var session *connection
+	f.clients.Range(func(key, value interface{}) bool {
+		client := value.(*connection)
+		if client.clientAddr().IP.Equal(ip) && (session == nil || client.lastActiveTime().After(session.lastActiveTime())) {
+			session = client
+		}
+		return true
+	})
+	return session
+}
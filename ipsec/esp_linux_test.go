@@ -0,0 +1,251 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenESP returns a raw ESP socket on ip, skipping the test without the
+// privileges to open one.
+func listenESP(t *testing.T, ip net.IP) *net.IPConn {
+	t.Helper()
+	conn, err := net.ListenIP("ip4:50", &net.IPAddr{IP: ip})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("raw ESP sockets require CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// espGateway starts a gateway on ip answering every ESP packet with the SPI
+// of its outbound SA, one more than that of the packet, and returns the
+// number of packets it received.
+func espGateway(t *testing.T, ip net.IP) *int64 {
+	t.Helper()
+	gateway := listenESP(t, ip)
+	received := new(int64)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := gateway.ReadFromIP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(received, 1)
+			binary.BigEndian.PutUint32(buf, binary.BigEndian.Uint32(buf)+1)
+			gateway.WriteToIP(buf[:n], addr)
+		}
+	}()
+	return received
+}
+
+// espRoundTrip sends an ESP packet of spi from client to the forwarder at
+// forwarderIP and checks that it is sent back by the gateway.
+func espRoundTrip(t *testing.T, client *net.IPConn, forwarderIP net.IP, spi, seq uint32) {
+	t.Helper()
+	packet := make([]byte, espHeaderSize, espHeaderSize+4)
+	binary.BigEndian.PutUint32(packet, spi)
+	binary.BigEndian.PutUint32(packet[4:], seq)
+	packet = append(packet, 0xde, 0xad, 0xbe, 0xef)
+	if _, err := client.WriteToIP(packet, &net.IPAddr{IP: forwarderIP}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := client.ReadFromIP(buf)
+	if err != nil {
+		t.Fatalf("packet %d of SPI %#x not sent back: %v", seq, spi, err)
+	}
+	if !addr.IP.Equal(forwarderIP) {
+		t.Errorf("reply from %s, want the forwarder %s", addr, forwarderIP)
+	}
+	binary.BigEndian.PutUint32(packet, spi+1)
+	if !bytes.Equal(buf[:n], packet) {
+		t.Errorf("reply %x, want %x", buf[:n], packet)
+	}
+}
+
+func TestESPRoundTrip(t *testing.T) {
+	forwarderIP, gatewayIP, clientIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)
+	espGateway(t, gatewayIP)
+	client := listenESP(t, clientIP)
+	f, err := ForwardESP(forwarderIP.String(), gatewayIP.String(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for seq := uint32(1); seq <= 3; seq++ {
+		espRoundTrip(t, client, forwarderIP, 0x1000, seq)
+	}
+	if got := f.Connected(); len(got) != 1 || got[0] != clientIP.String() {
+		t.Errorf("connected clients %v, want %s", got, clientIP)
+	}
+}
+
+// ikeConn returns a socket of a client at ip sending to the forwarder f.
+func ikeConn(t *testing.T, f *Forwarder, ip net.IP) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: ip}, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// ikeRequest sends an IKE request of exchange on conn, with an SPI of the
+// client's own. Its first bytes are not zero, which would be taken for the
+// non-ESP marker.
+func ikeRequest(t *testing.T, conn *net.UDPConn, exchange uint8) {
+	t.Helper()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	msg := ikeSAInit(0x0102030405060700|uint64(ip[len(ip)-1]), nil)
+	msg[18] = exchange
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ikeResponse waits for the response to a request sent on conn.
+func ikeResponse(t *testing.T, conn *net.UDPConn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2048)); err != nil {
+		t.Fatalf("IKE of %s not answered: %v", conn.LocalAddr(), err)
+	}
+}
+
+func TestESPFollowsIKEDestination(t *testing.T) {
+	forwarderIP, clientIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 4)
+	gatewayIPs := []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)}
+	var dsts []WeightedDest
+	var received []*int64
+	for _, ip := range gatewayIPs {
+		received = append(received, espGateway(t, ip))
+		dsts = append(dsts, WeightedDest{Addr: echoServerAt(t, ip).LocalAddr().String(), Weight: 1})
+	}
+	client := listenESP(t, clientIP)
+
+	f, err := New(Config{Listen: forwarderIP.String() + ":0", Destinations: dsts, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Not the first destination, which all ESP went to before.
+	if err := f.Pin(clientIP.String(), dsts[1].Addr); err != nil {
+		t.Fatal(err)
+	}
+	esp, err := f.ForwardESP(forwarderIP.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer esp.Close()
+
+	conn := ikeConn(t, f, clientIP)
+	for _, exchange := range []uint8{ExchangeIKESAInit, ExchangeIKEAuth} {
+		ikeRequest(t, conn, exchange)
+		ikeResponse(t, conn)
+	}
+	for seq := uint32(1); seq <= 3; seq++ {
+		espRoundTrip(t, client, forwarderIP, 0x2000, seq)
+	}
+	if got := atomic.LoadInt64(received[0]); got != 0 {
+		t.Errorf("%d ESP packets sent to the first destination, want none", got)
+	}
+	if got := atomic.LoadInt64(received[1]); got != 3 {
+		t.Errorf("%d ESP packets sent to the client's IKE destination, want 3", got)
+	}
+}
+
+func TestESPRepliesFollowIKEExchanges(t *testing.T) {
+	forwarderIP, gatewayIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+	clientIPs := []net.IP{net.IPv4(127, 0, 0, 4), net.IPv4(127, 0, 0, 5)}
+	spis := []uint32{0xa000, 0xb000}
+	gateway := listenESP(t, gatewayIP)
+	var clients []*net.IPConn
+	for _, ip := range clientIPs {
+		clients = append(clients, listenESP(t, ip))
+	}
+
+	f, err := New(Config{
+		Listen:       forwarderIP.String() + ":0",
+		Destinations: []WeightedDest{{Addr: echoServerAt(t, gatewayIP).LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	esp, err := f.ForwardESP(forwarderIP.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer esp.Close()
+
+	// Both clients start IKE at the same time, and the second one
+	// creates its SA first.
+	var conns []*net.UDPConn
+	for _, ip := range clientIPs {
+		conn := ikeConn(t, f, ip)
+		ikeRequest(t, conn, ExchangeIKESAInit)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		ikeResponse(t, conn)
+	}
+	for _, i := range []int{1, 0} {
+		ikeRequest(t, conns[i], ExchangeIKEAuth)
+		ikeResponse(t, conns[i])
+	}
+
+	// The first client sends ESP first, but the gateway answers the
+	// second one first, as its SA is older.
+	for i, client := range clients {
+		packet := make([]byte, espHeaderSize)
+		binary.BigEndian.PutUint32(packet, spis[i])
+		binary.BigEndian.PutUint32(packet[4:], 1)
+		if _, err := client.WriteToIP(packet, &net.IPAddr{IP: forwarderIP}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 2048)
+	for range clients {
+		gateway.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := gateway.ReadFromIP(buf); err != nil {
+			t.Fatalf("ESP not forwarded to the gateway: %v", err)
+		}
+	}
+	for _, i := range []int{1, 0} {
+		reply := make([]byte, espHeaderSize)
+		binary.BigEndian.PutUint32(reply, spis[i]+1)
+		binary.BigEndian.PutUint32(reply[4:], 1)
+		if _, err := gateway.WriteToIP(reply, &net.IPAddr{IP: forwarderIP}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := client.ReadFromIP(buf)
+		if err != nil {
+			t.Fatalf("client %s got no reply: %v", clientIPs[i], err)
+		}
+		if got := binary.BigEndian.Uint32(buf[:n]); got != spis[i]+1 {
+			t.Errorf("client %s got the reply of SPI %#x, want %#x", clientIPs[i], got, spis[i]+1)
+		}
+	}
+}
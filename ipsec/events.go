@@ -0,0 +1,121 @@
+package ipsec
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventBufferSize is the number of events buffered by the channel returned by
+// Events. Events are dropped while the buffer is full.
+const EventBufferSize = 256
+
+// EventType tells what an Event reports.
+type EventType int
+
+// Event types.
+const (
+	EventConnect     EventType = iota // a client connected to its destination
+	EventDisconnect                   // a client was disconnected
+	EventMigrate                      // a client was recognised at a new address
+	EventBackendDown                  // a destination failed its health checks
+	EventBackendUp                    // a destination passes its health checks again
+	EventACLDrop                      // a packet was dropped by the ACL
+	EventError                        // dialing a destination or reading failed
+	EventSocketsHigh                  // outbound sockets near their limit, see SetSocketLimit
+	EventBan                          // a source address was banned, see SetBanPolicy
+	EventRemap                        // a client was moved, see OnRemap
+)
+
+var eventTypeNames = [...]string{
+	EventConnect:     "connect",
+	EventDisconnect:  "disconnect",
+	EventMigrate:     "migrate",
+	EventBackendDown: "backend-down",
+	EventBackendUp:   "backend-up",
+	EventACLDrop:     "acl-drop",
+	EventError:       "error",
+	EventSocketsHigh: "sockets-high",
+	EventBan:         "ban",
+	EventRemap:       "remap",
+}
+
+func (t EventType) String() string {
+	if t >= 0 && int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a Forwarder.
+type Event struct {
+	Type           EventType
+	Time           time.Time
+	Client         string // address of the client, if any
+	OldClient      string // previous address of the client for EventMigrate and EventRemap
+	Destination    string // address of the destination, if any
+	OldDestination string // previous address of the destination for EventRemap
+	Err            error  // for EventError and EventBackendDown
+}
+
+// events delivers events to the channel returned by Events.
+type events struct {
+	subscribed int32 // set once Events is called
+
+	mu     sync.RWMutex
+	ch     chan Event
+	closed bool
+}
+
+// emit delivers event unless nobody asked for events or the buffer is full.
+func (f *Forwarder) emit(event Event) {
+	e := &f.events
+	if atomic.LoadInt32(&e.subscribed) == 0 {
+		return
+	}
+	event.Time = time.Now()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.ch <- event:
+	default:
+		atomic.AddInt64(&f.eventsDropped, 1)
+	}
+}
+
+// closeEvents closes the channel returned by Events, if any.
+func (f *Forwarder) closeEvents() {
+	e := &f.events
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.closed = true
+		if e.ch != nil {
+			close(e.ch)
+		}
+	}
+}
+
+// Events returns a channel of the connects, disconnects, migrations, changes
+// to the health of destinations, ACL drops and errors of the forwarder, so
+// that an application can react to them without polling. Events are only
+// recorded once Events has been called, and every call returns the same
+// channel. It buffers EventBufferSize events; events that do not fit are
+// dropped and counted in Stats. The channel is closed by Close.
+func (f *Forwarder) Events() <-chan Event {
+	e := &f.events
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ch == nil {
+		e.ch = make(chan Event, EventBufferSize)
+		if e.closed {
+			close(e.ch)
+		}
+		atomic.StoreInt32(&e.subscribed, 1)
+	}
+	return e.ch
+}
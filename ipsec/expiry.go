@@ -0,0 +1,166 @@
+package ipsec
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultExpiryResolution bounds how late inactive clients are disconnected,
+// see SetExpiryResolution.
+const DefaultExpiryResolution = time.Second
+
+// wheelSlots is the number of slots of the timer wheel. Clients due further
+// ahead than a turn of the wheel are looked at once every turn.
+const wheelSlots = 512
+
+// expiry is a client scheduled to be looked at by the janitor.
+type expiry struct {
+	cliAddr string
+	client  *connection
+	tick    int64 // when it is due
+}
+
+// timerWheel schedules the clients to be looked at by the janitor when they
+// may have timed out, so that it need not scan every client on every sweep.
+// A client is rescheduled for its new deadline whenever it turns out to
+// have been active meanwhile, so that packets never touch the wheel and each
+// client is looked at about once per timeout.
+type timerWheel struct {
+	mu         sync.Mutex
+	slots      [wheelSlots][]expiry
+	start      time.Time
+	resolution time.Duration
+	next       int64 // the first tick not looked at yet
+}
+
+// newTimerWheel returns a wheel turning a slot every resolution.
+func newTimerWheel(resolution time.Duration) *timerWheel {
+	return &timerWheel{start: time.Now(), resolution: resolution}
+}
+
+// tickAt returns the tick t falls into, rounded up.
+func (w *timerWheel) tickAt(t time.Time) int64 {
+	d := t.Sub(w.start)
+	return int64((d + w.resolution - 1) / w.resolution)
+}
+
+// schedule schedules the client at cliAddr to be looked at at deadline, or
+// on the next tick if it is past.
+func (w *timerWheel) schedule(cliAddr string, client *connection, deadline time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	tick := w.tickAt(deadline)
+	if tick < w.next {
+		tick = w.next
+	}
+	slot := &w.slots[tick%wheelSlots]
+	*slot = append(*slot, expiry{cliAddr: cliAddr, client: client, tick: tick})
+}
+
+// advance turns the wheel to now and returns the clients due.
+func (w *timerWheel) advance(now time.Time) []expiry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current := int64(now.Sub(w.start) / w.resolution) // the last tick elapsed
+	var due []expiry
+	for n := 0; w.next <= current && n < wheelSlots; n++ {
+		slot := &w.slots[w.next%wheelSlots]
+		kept := (*slot)[:0]
+		for _, e := range *slot {
+			if e.tick <= current {
+				due = append(due, e)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		for i := len(kept); i < len(*slot); i++ {
+			(*slot)[i] = expiry{}
+		}
+		*slot = kept
+		w.next++
+	}
+	if w.next <= current {
+		// Every slot was looked at while the janitor lagged behind.
+		w.next = current + 1
+	}
+	return due
+}
+
+// reset restarts the wheel turning every resolution, and removes and
+// returns every client scheduled.
+func (w *timerWheel) reset(resolution time.Duration) []expiry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var all []expiry
+	for i := range w.slots {
+		all = append(all, w.slots[i]...)
+		w.slots[i] = nil
+	}
+	w.start, w.resolution, w.next = time.Now(), resolution, 0
+	return all
+}
+
+// SetExpiryResolution sets how often the janitor looks for clients that
+// timed out, and so how late after their timeout they may be disconnected.
+// Each client is looked at around its deadline rather than all of them on
+// every sweep, so that a fine resolution stays cheap with many clients.
+// Zero, the default, uses DefaultExpiryResolution or the shortest timeout in
+// use, whichever is shorter. It applies to connected clients too.
+func (f *Forwarder) SetExpiryResolution(resolution time.Duration) {
+	if resolution < 0 {
+		resolution = 0
+	}
+	atomic.StoreInt64(&f.expiryResolution, int64(resolution))
+	f.timeoutChanged()
+}
+
+// resolution returns the resolution of the timer wheel.
+func (f *Forwarder) resolution() time.Duration {
+	if resolution := time.Duration(atomic.LoadInt64(&f.expiryResolution)); resolution > 0 {
+		return resolution
+	}
+	resolution := DefaultExpiryResolution
+	if interval := f.sweepInterval(); interval < resolution {
+		resolution = interval
+	}
+	if resolution < time.Millisecond {
+		resolution = time.Millisecond
+	}
+	return resolution
+}
+
+// scheduleExpiry schedules the client at cliAddr, just added, to be looked
+// at by the janitor once it may have timed out.
+func (f *Forwarder) scheduleExpiry(cliAddr string, client *connection) {
+	f.wheel.schedule(cliAddr, client, client.lastActiveTime().Add(f.clientTimeout(cliAddr, client)))
+}
+
+// resetWheel restarts the timer wheel at the current resolution,
+// rescheduling the clients for their current timeouts.
+func (f *Forwarder) resetWheel() time.Duration {
+	resolution := f.resolution()
+	for _, e := range f.wheel.reset(resolution) {
+		f.scheduleExpiry(e.cliAddr, e.client)
+	}
+	return resolution
+}
+
+// expire disconnects the clients due on the timer wheel that timed out, and
+// reschedules those that were active meanwhile.
+func (f *Forwarder) expire(now time.Time) {
+	for _, e := range f.wheel.advance(now) {
+		if value, ok := f.clients.Load(e.cliAddr); !ok || value != e.client {
+			// Removed, or moved to another address and scheduled there.
+			continue
+		}
+		f.syncFastPath(e.client)
+		deadline := e.client.lastActiveTime().Add(f.clientTimeout(e.cliAddr, e.client))
+		if deadline.After(now) {
+			f.wheel.schedule(e.cliAddr, e.client, deadline)
+			continue
+		}
+		f.sayGoodbye(e.cliAddr, e.client)
+		f.endClient(e.cliAddr, e.client, "timeout", nil)
+	}
+}
@@ -0,0 +1,40 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutChangesDoNotHoldOffExpiry(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0x12, 0x34, 0x56, 0x78, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting the timeout more often than the wheel turns must not keep
+	// the janitor from disconnecting the client.
+	deadline := time.Now().Add(2 * time.Second)
+	for f.Metrics().Disconnects == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client not expired while the timeout was being set")
+		}
+		f.SetTimeout(50 * time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHappyEyeballsDelay is the delay before falling back to the other
+// address family recommended by RFC 8305, see SetHappyEyeballs.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// SetHappyEyeballs makes the forwarder connect clients of destinations whose
+// hostname has both IPv4 and IPv6 addresses over IPv6 first, falling back to
+// IPv4 for the session if the destination does not answer within delay, and
+// the other way round once IPv4 is remembered to work, as in RFC 8305. The
+// packet that went unanswered is sent again over the other family, so that
+// clients need not wait for their own retransmission. Each destination
+// remembers the family it last answered on and new clients try that first,
+// so that gateway fleets mixing single and dual-stack hosts work without
+// configuration. Only clients with a socket of their own race the families:
+// not those of pooled mode, see SetPooledMode, nor transparent clients or
+// those relayed by a transport. Zero, the default, disables it and uses the
+// first address a hostname resolves to. It should be set before the
+// forwarder is used.
+func (f *Forwarder) SetHappyEyeballs(delay time.Duration) {
+	if delay < 0 {
+		delay = 0
+	}
+	f.eyeballsDelay = delay
+	if delay == 0 {
+		return
+	}
+
+	f.dstMu.Lock()
+	dsts := append([]*destination(nil), f.dsts...)
+	f.dstMu.Unlock()
+	for _, dst := range dsts {
+		f.dstMu.Lock()
+		raddr := dst.raddr
+		f.dstMu.Unlock()
+		alt := f.alternate(dst.addr, raddr)
+		f.dstMu.Lock()
+		dst.alt = alt
+		f.dstMu.Unlock()
+	}
+}
+
+// alternate returns the first address of the other family than raddr the
+// hostname of the destination addr resolves to, or nil if addr is an IP
+// address, happy eyeballs are disabled or there is none.
+func (f *Forwarder) alternate(addr string, raddr *net.UDPAddr) *net.UDPAddr {
+	if f.eyeballsDelay == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(f.ctx, host)
+	if err != nil {
+		return nil
+	}
+	v4 := raddr.IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) != v4 {
+			return &net.UDPAddr{IP: ip.IP, Port: raddr.Port, Zone: ip.Zone}
+		}
+	}
+	return nil
+}
+
+// families returns the addresses of the destination of client in the order
+// they are to be tried, or nils unless the client races the address
+// families.
+func (f *Forwarder) families(client *connection) (first, second *net.UDPAddr) {
+	if f.eyeballsDelay == 0 || f.transparent || f.transport != nil || f.pooledSize() > 0 {
+		return nil, nil
+	}
+	raddr, dst := client.backend()
+	if dst == nil {
+		return nil, nil
+	}
+	f.dstMu.Lock()
+	v6, v4 := dst.alt, dst.raddr
+	f.dstMu.Unlock()
+	if v6 == nil || !(raddr.IP.Equal(v4.IP) || raddr.IP.Equal(v6.IP)) {
+		// Pinned to another address.
+		return nil, nil
+	}
+	if v4.IP.To4() == nil {
+		v6, v4 = v4, v6
+	}
+	if atomic.LoadInt32(&dst.family) == 4 {
+		return v4, v6
+	}
+	return v6, v4
+}
+
+// preferFamily moves the client, yet to be dialed, to the address of the
+// family its destination is to be tried on first.
+func (f *Forwarder) preferFamily(client *connection) {
+	if first, _ := f.families(client); first != nil {
+		client.mu.Lock()
+		client.raddr = first
+		client.mu.Unlock()
+	}
+}
+
+// answered records that the destination of client replied, remembering the
+// family it replied on.
+func (f *Forwarder) answered(client *connection) {
+	if atomic.LoadInt32(&client.eyeballs) == 2 {
+		return
+	}
+	atomic.StoreInt32(&client.eyeballs, 2)
+	if f.eyeballsDelay == 0 {
+		return
+	}
+	raddr, dst := client.backend()
+	if dst == nil {
+		return
+	}
+	family := int32(6)
+	if raddr.IP.To4() != nil {
+		family = 4
+	}
+	atomic.StoreInt32(&dst.family, family)
+}
+
+// awaitingFallback reports whether client may still fall back to the other
+// address family, so that errors such as ICMP port unreachable from the
+// first do not end it.
+func (f *Forwarder) awaitingFallback(client *connection) bool {
+	if atomic.LoadInt32(&client.eyeballs) != 0 {
+		return false
+	}
+	first, _ := f.families(client)
+	return first != nil
+}
+
+// fallBack moves client, whose destination did not answer on the family
+// tried first, to its address of the other family, reporting whether it
+// did. The socket to the first address is closed, and replies still
+// arriving on it are lost.
+func (f *Forwarder) fallBack(cliAddr string, client *connection) bool {
+	first, second := f.families(client)
+	if second == nil || !atomic.CompareAndSwapInt32(&client.eyeballs, 0, 1) {
+		return false
+	}
+	// The family remembered may have changed since the client was dialed.
+	if raddr, _ := client.backend(); raddr.IP.Equal(second.IP) {
+		first, second = second, first
+	}
+	conn, err := f.dial(second, nil)
+	if err != nil {
+		f.logError(LevelDebug, OpDialFallback, cliAddr, err, "failed to dial other address family", "client", cliAddr, "destination", second)
+		return false
+	}
+
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		f.closeSocket(conn)
+		return false
+	}
+	old := client.rConn
+	client.rConn, client.raddr = conn, second
+	client.mu.Unlock()
+	f.closeSocket(old)
+
+	atomic.AddInt64(&f.familyFallbacks, 1)
+	f.logger.Log(LevelDebug, "destination did not answer, falling back to other address family", "client", cliAddr, "from", first, "to", second)
+	client.traceEvent("fallback", Attribute{AttrBackendAddr, second.String()})
+	f.remapped(client, Remap{
+		OldClient:      cliAddr,
+		Client:         cliAddr,
+		OldDestination: first.String(),
+		Destination:    second.String(),
+		Reason:         RemapAddressFamily,
+	})
+	f.wg.Add(1)
+	go f.serve(client)
+	return true
+}
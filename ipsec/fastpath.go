@@ -0,0 +1,247 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// FastPathInterval is how often the counters of the fast path are added to
+// those of the forwarder, see SetFastPath.
+const FastPathInterval = 10 * time.Second
+
+// FastSession is a session handed to a FastPath: the packets Client sends to
+// the port of Listen are sent on from Local to Destination, and those
+// Destination sends back to Local are sent on to Client from the address the
+// client sent to.
+type FastSession struct {
+	Client      *net.UDPAddr
+	Listen      *net.UDPAddr // the IP is unspecified when listening on all addresses
+	Local       *net.UDPAddr // the forwarder's socket to the destination
+	Destination *net.UDPAddr
+}
+
+// FastPathStats counts the packets a FastPath forwarded for a session, and
+// their UDP payload bytes.
+type FastPathStats struct {
+	PacketsToServer int64
+	BytesToServer   int64
+	PacketsToClient int64
+	BytesToClient   int64
+	LastToServer    time.Time // zero if none was forwarded
+	LastToClient    time.Time
+}
+
+// FastPath forwards the packets of established sessions instead of the
+// forwarder, such as in the kernel, see package xdp. Its methods are called
+// concurrently.
+type FastPath interface {
+	// Add starts forwarding the packets of s, or returns an error if it
+	// cannot, leaving them to the forwarder.
+	Add(s FastSession) error
+	// Remove stops forwarding the packets of s.
+	Remove(s FastSession)
+	// Stats returns the counters of s since it was added, or false if it is
+	// not known.
+	Stats(s FastSession) (FastPathStats, bool)
+}
+
+// fastSession is a session of a client handed to a FastPath.
+type fastSession struct {
+	fp      FastPath
+	s       FastSession
+	counted FastPathStats // added to the counters of the forwarder
+}
+
+// fastPathValue wraps the FastPath stored in an atomic.Value, which cannot
+// store nil.
+type fastPathValue struct {
+	fp FastPath
+}
+
+// SetFastPath hands the sessions of clients to fp once they are connected to
+// their destination, which then forwards their ESP packets while the
+// forwarder keeps forwarding IKE messages and keepalives, and the packets of
+// sessions fp refused. Its counters are added to those of the forwarder
+// every FastPathInterval and before expiring clients, so their activity keeps
+// them from timing out as set with SetRefreshPolicy.
+//
+// Packets forwarded by fp bypass the packet filter, the ACL applied to
+// packets, the rate and bandwidth limits, taps, the mirror, DSCP marking and
+// the MTU, so it is meant for the NAT-T port only, as IKE on port 500 is not
+// marked apart from ESP. The sessions of clients denied by a later SetACL or
+// banned are taken back from fp, so that their packets are dropped again.
+// Clients sharing their socket to the destination, see SetPooledMode, those
+// reaching it through a Transport, those of transparent mode or of the PROXY
+// protocol on every packet, and those connecting while middlewares, built-in
+// middlewares or an impairment are set are not handed to fp. A nil fp, the
+// default, disables it for clients connecting afterwards.
+func (f *Forwarder) SetFastPath(fp FastPath) {
+	if f.isClosed() {
+		return
+	}
+	f.fastPath.Store(fastPathValue{fp})
+	if fp == nil {
+		return
+	}
+	f.fastPathOnce.Do(func() {
+		f.wg.Add(1)
+		go f.syncFastPaths()
+	})
+}
+
+// fastPathOf returns the FastPath set with SetFastPath, or nil.
+func (f *Forwarder) fastPathOf() FastPath {
+	v, _ := f.fastPath.Load().(fastPathValue)
+	return v.fp
+}
+
+// startFastPath hands the session of client at cliAddr to the FastPath, if
+// any and if the client may use it.
+func (f *Forwarder) startFastPath(cliAddr string, client *connection) {
+	fp := f.fastPathOf()
+	if _, every := f.proxying(); fp == nil || client.pool != nil || f.transparent || every || f.impairing() {
+		return
+	}
+	if middlewares, _ := f.middlewares.Load().([]Middleware); len(middlewares) > 0 || f.builtinsSet() {
+		return
+	}
+	if _, bridged := f.bridges.Load(client.rConn); bridged {
+		// The destination is only reachable through the transport.
+		return
+	}
+	local, ok := client.rConn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	f.listenerMu.RLock()
+	listen, ok := f.listeners[0].LocalAddr().(*net.UDPAddr)
+	f.listenerMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed {
+		return
+	}
+	s := FastSession{Client: client.addr, Listen: listen, Local: local, Destination: client.raddr}
+	if err := fp.Add(s); err != nil {
+		f.logger.Log(LevelDebug, "not using the fast path", "client", cliAddr, "err", err)
+		return
+	}
+	client.fast = &fastSession{fp: fp, s: s}
+}
+
+// moveFastPath hands the session of client to its FastPath again after it
+// migrated to addr.
+func (f *Forwarder) moveFastPath(client *connection, addr *net.UDPAddr) {
+	f.syncFastPath(client)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed || client.fast == nil {
+		return
+	}
+	fast := client.fast
+	fast.fp.Remove(fast.s)
+	client.fast = nil
+	s := fast.s
+	s.Client = addr
+	if err := fast.fp.Add(s); err == nil {
+		client.fast = &fastSession{fp: fast.fp, s: s}
+	}
+}
+
+// stopFastPaths takes the sessions of the clients whose IP address denied
+// reports true back from their FastPath, so that the forwarder applies the
+// ACL and bans to their packets again. They are not handed to it again.
+func (f *Forwarder) stopFastPaths(denied func(ip net.IP) bool) {
+	f.clients.Range(func(_, value interface{}) bool {
+		client := value.(*connection)
+		if denied(client.clientAddr().IP) {
+			f.stopFastPath(client)
+		}
+		return true
+	})
+}
+
+// stopFastPath takes the session of client back from its FastPath, counting
+// what it forwarded until then.
+func (f *Forwarder) stopFastPath(client *connection) {
+	f.syncFastPath(client)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.fast == nil {
+		return
+	}
+	client.fast.fp.Remove(client.fast.s)
+	client.fast = nil
+}
+
+// syncFastPaths adds the counters of the FastPath to those of the forwarder
+// every FastPathInterval until the forwarder is closed.
+func (f *Forwarder) syncFastPaths() {
+	defer f.wg.Done()
+	ticker := time.NewTicker(FastPathInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		f.clients.Range(func(_, value interface{}) bool {
+			f.syncFastPath(value.(*connection))
+			return true
+		})
+	}
+}
+
+// syncFastPath adds what the FastPath forwarded for client since the last
+// call to the counters of the client, its destination and the forwarder, and
+// records its activity.
+func (f *Forwarder) syncFastPath(client *connection) {
+	client.mu.Lock()
+	fast := client.fast
+	if fast == nil {
+		client.mu.Unlock()
+		return
+	}
+	stats, ok := fast.fp.Stats(fast.s)
+	if !ok {
+		client.mu.Unlock()
+		return
+	}
+	counted := fast.counted
+	fast.counted = stats
+	dst := client.dst
+	client.mu.Unlock()
+
+	if n := stats.PacketsToServer - counted.PacketsToServer; n > 0 {
+		bytes := stats.BytesToServer - counted.BytesToServer
+		atomic.AddInt64(&client.packetsToServer, n)
+		atomic.AddInt64(&client.bytesToServer, bytes)
+		atomic.AddInt64(&f.packetsToServer, n)
+		atomic.AddInt64(&f.bytesToServer, bytes)
+		if dst != nil {
+			atomic.AddInt64(&dst.bytesToServer, bytes)
+		}
+		if f.refreshFromClient && stats.LastToServer.After(client.lastActiveTime()) {
+			client.setLastActive(stats.LastToServer)
+		}
+	}
+	if n := stats.PacketsToClient - counted.PacketsToClient; n > 0 {
+		bytes := stats.BytesToClient - counted.BytesToClient
+		atomic.AddInt64(&client.packetsToClient, n)
+		atomic.AddInt64(&client.bytesToClient, bytes)
+		atomic.AddInt64(&f.packetsToClient, n)
+		atomic.AddInt64(&f.bytesToClient, bytes)
+		if dst != nil {
+			atomic.AddInt64(&dst.bytesToClient, bytes)
+		}
+		if f.refreshFromServer && stats.LastToClient.After(client.lastActiveTime()) {
+			client.setLastActive(stats.LastToClient)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package ipsec
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingFastPath is a FastPath keeping the sessions it is handed without
+// forwarding their packets.
+type recordingFastPath struct {
+	mu       sync.Mutex
+	sessions map[FastSession]bool
+}
+
+func (p *recordingFastPath) Add(s FastSession) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s] = true
+	return nil
+}
+
+func (p *recordingFastPath) Remove(s FastSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s)
+}
+
+func (p *recordingFastPath) Stats(s FastSession) (FastPathStats, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return FastPathStats{}, p.sessions[s]
+}
+
+func (p *recordingFastPath) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// fastClient connects a client to f, which hands its session to fp, and
+// returns its socket.
+func fastClient(t *testing.T, f *Forwarder, fp *recordingFastPath) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write(ikeSAInit(0x0102030405060708, nil)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for fp.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not handed to the fast path")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return conn
+}
+
+func TestFastPathStopsForDeniedClients(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fp := &recordingFastPath{sessions: make(map[FastSession]bool)}
+	f.SetFastPath(fp)
+	fastClient(t, f, fp)
+
+	// Denying another network keeps the session.
+	other, _ := ParseCIDRs([]string{"192.0.2.0/24"})
+	f.SetACL(nil, other)
+	if fp.len() != 1 {
+		t.Fatal("session of a permitted client taken from the fast path")
+	}
+	loopback, _ := ParseCIDRs([]string{"127.0.0.0/8"})
+	f.SetACL(nil, loopback)
+	if fp.len() != 0 {
+		t.Error("session of a denied client left in the fast path")
+	}
+}
+
+func TestFastPathStopsForBannedClients(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+		BanThreshold: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.SetValidation(true)
+	fp := &recordingFastPath{sessions: make(map[FastSession]bool)}
+	f.SetFastPath(fp)
+	conn := fastClient(t, f, fp)
+
+	// An invalid packet bans the client at once.
+	if _, err := conn.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for fp.len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("session of a banned client left in the fast path, bans %v", f.Bans())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -2,213 +2,1449 @@
 package ipsec
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-const bufferSize = 4096
+// DefaultBufferSize is the default size of the buffers packets are read into.
+// Larger datagrams are dropped.
+const DefaultBufferSize = 4096
+
+// MaxBufferSize is the largest buffer size, enough for any UDP datagram.
+const MaxBufferSize = 64 * 1024
+
+// natKeepalive is a NAT-T keepalive packet as defined by RFC 3948.
+var natKeepalive = []byte{0xff}
+
+// DefaultQueueSize is the default number of packets from a client that may
+// wait to be forwarded before further packets are dropped.
+const DefaultQueueSize = 256
+
+// packet is a packet from a client waiting to be forwarded.
+type packet struct {
+	data []byte
+	dscp int // see SetDSCPPassthrough
+}
 
 type connection struct {
-	available  chan struct{}
-	rConn      *net.UDPConn
-	lastActive time.Time
+	// Counters are accessed atomically and kept first for 64-bit alignment.
+	rateLimited     int64
+	packetsToServer int64
+	bytesToServer   int64
+	packetsToClient int64
+	bytesToClient   int64
+	lastActive      int64 // in Unix nanoseconds
+	remaps          int64 // see OnRemap
+	childSA         int64 // last IKE_AUTH or CREATE_CHILD_SA request in Unix nanoseconds, see ForwardESP
+	dialing         int32 // set once a goroutine dials rConn
+	accounted       int32 // 1 once started and 2 once stopped, see SetAccounting
+	eyeballs        int32 // 1 once fallen back to the other family, 2 once answered, see SetHappyEyeballs
+
+	started time.Time
+	queue   chan packet   // packets from the client
+	done    chan struct{} // closed once the client is removed
+
+	// The address of the client changes if it migrates, and rConn and pool
+	// are set by the goroutine dialing the destination while others may be
+	// closing the client, as are raddr and dst if it falls back to another
+	// destination. They are only read without holding mu by that goroutine
+	// and the goroutines forwarding the packets of the client, which start
+	// once rConn is set.
+	mu     sync.Mutex
+	raddr  *net.UDPAddr
+	dst    *destination // nil if raddr is no longer a destination
+	addr   *net.UDPAddr
+	rConn  *net.UDPConn
+	pool   *pool // set if rConn is shared with other clients
+	closed bool
+	trace  *sessionTrace // nil unless a Tracer is set
+
+	// closeSocket closes rConn, unless it is shared.
+	closeSocket func(*net.UDPConn)
+
+	session string       // accounting session ID guarded by mu, see SetAccounting
+	fast    *fastSession // guarded by mu, see SetFastPath
+
+	espSPI    uint32       // last ESP SPI seen from the client, see ikeSessions
+	timeline  timeline     // IKE messages, see SetDiagnose
+	ikeTimer  ikeTimer     // see SetRTTMeasurement
+	limiter   *tokenBucket // packets per second
+	bwLimiter *tokenBucket // bytes per second
+}
+
+// close closes the connection to the destination, if it has been dialed and
+// is not shared, or makes setConn refuse it otherwise.
+func (c *connection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed && c.fast != nil {
+		c.fast.fp.Remove(c.fast.s)
+	}
+	if !c.closed && c.rConn != nil && c.pool == nil {
+		c.closeSocket(c.rConn)
+	}
+	c.closed = true
+}
+
+// setConn sets the connection to the destination and the pool it belongs to,
+// if any. It reports false if the client has been closed meanwhile, in which
+// case the caller must close rConn unless it is shared.
+func (c *connection) setConn(rConn *net.UDPConn, p *pool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.rConn, c.pool = rConn, p
+	return true
+}
+
+// sharedPool returns the pool the connection to the destination belongs to,
+// or nil if it is not shared.
+func (c *connection) sharedPool() *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pool
+}
+
+// socket returns the connection to the destination, nil until dialed.
+func (c *connection) socket() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rConn
+}
+
+// backend returns the address of the destination of the client and the
+// destination itself, which is nil if the address is no longer one.
+func (c *connection) backend() (*net.UDPAddr, *destination) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raddr, c.dst
+}
+
+// setBackend moves the client to dst before it is connected, see
+// SetDialFallback. It reports false if the client has been removed meanwhile.
+func (c *connection) setBackend(dst *destination) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	if c.dst != nil {
+		atomic.AddInt64(&c.dst.clients, -1)
+	}
+	atomic.AddInt64(&dst.clients, 1)
+	c.raddr, c.dst = dst.raddr, dst
+	return true
+}
+
+// clientAddr returns the address the client currently sends from.
+func (c *connection) clientAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+// localAddr returns the address of the socket the client is forwarded from,
+// or nil until it is dialed.
+func (c *connection) localAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rConn == nil {
+		return nil
+	}
+	return c.rConn.LocalAddr()
+}
+
+// setClientAddr changes the address the client sends from.
+func (c *connection) setClientAddr(addr *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addr = addr
+}
+
+// lastActiveTime returns when the client was last active, see
+// SetRefreshPolicy.
+func (c *connection) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
+
+// setLastActive records that the client was active at t.
+func (c *connection) setLastActive(t time.Time) {
+	atomic.StoreInt64(&c.lastActive, t.UnixNano())
+}
+
+// callbacks are the functions registered with OnConnect and the like.
+type callbacks struct {
+	connect     func(addr string)
+	disconnect  func(addr string)
+	sessionEnd  func(event SessionEvent)
+	dialError   func(addr string, err error)
+	migrate     func(oldAddr, newAddr string)
+	backendUp   func(addr string)
+	backendDown func(addr string)
+	ban         func(ban Ban)
+	remap       func(remap Remap)
+	errors      map[ErrorClass]func(report ErrorReport) // by class, see OnError
 }
 
 // Forwarder represents a IPSEC packet forwarder.
 type Forwarder struct {
-	raddr        *net.UDPAddr
-	listenerConn *net.UDPConn
+	// Counters are accessed atomically and kept first for 64-bit alignment.
+	timeout              int64 // in nanoseconds, see SetTimeout
+	newConnsLimited      int64
+	clientsRejected      int64
+	rateLimited          int64
+	writeTimeouts        int64
+	dialFailures         int64
+	initialWriteFails    int64
+	serverWriteFails     int64
+	clientWriteFails     int64
+	truncated            int64
+	truncationLogged     int64 // in Unix nanoseconds, see dropTruncated
+	queueFull            int64
+	clientCount          int64
+	packetsToServer      int64
+	bytesToServer        int64
+	packetsToClient      int64
+	bytesToClient        int64
+	connects             int64
+	disconnects          int64
+	aclDenied            int64
+	keepalivesFromClient int64
+	keepalivesFromServer int64
+	migrations           int64
+	eventsDropped        int64
+	tooBigDrops          int64
+	mirrorFails          int64  // copies not sent to the mirror, see SetMirror
+	mirrorSeq            uint64 // packets considered for mirroring
+	outboundSockets      int64  // sockets to the destinations, see SetSocketLimit
+	invalidDrops         int64
+	bannedDrops          int64
+	accountingDropped    int64 // records not fitting the queue, see SetAccounting
+	accountingFailures   int64
+	familyFallbacks      int64  // see SetHappyEyeballs
+	impairmentDrops      int64  // see SetImpairment
+	cookieDrops          int64  // requests answered with a cookie, see SetIKECookies
+	middlewareDrops      int64  // see SetMiddlewares
+	draining             int32  // set once Shutdown is called
+	gsoDisabled          int32  // set once a segmented send fails, see writeSegmented
+	nextPort             uint32 // next source port to try, see SetSourcePortRange
+	listenersFailed      int32  // listeners given up on, see Err
+	socketsWarned        int32  // set once EventSocketsHigh is emitted, see socketOpened
+	validate             int32  // see SetValidation
+	measureRTT           int32  // see SetRTTMeasurement
 
-	clients          sync.Map
+	// Settings that may change while packets are forwarded are accessed
+	// atomically too, booleans as 0 or 1.
+	proxyProtocol    int32 // see SetProxyProtocol
+	proxyEveryPacket int32
+	trackIKE         int32 // see SetTrackIKESessions
+	answerKeepalives int32 // see SetAnswerKeepalives
+	dscp             int32 // forced on every packet if not negative, see SetDSCP
+	dscpPassthrough  int32
+	batchSize        int32 // see SetBatchSize
+	poolSize         int32 // see SetPooledMode
+	mtu              int32 // see SetMTU
+	dontFragment     int32
+	maxReadErrors    int32 // see SetMaxReadErrors
+	bufferSize       int32 // see SetBufferSize
+	queueSize        int32 // see SetQueueSize
+	maxClients       int64 // see SetMaxClients
+	writeTimeout     int64 // see SetWriteTimeout
+	backendKeepalive int64 // see SetBackendKeepalive
+	expiryResolution int64 // see SetExpiryResolution
+	nativeESP        int32 // set once an ESPForwarder follows the clients, see ForwardESP
 
-	connectCallback    func(addr string)
-	disconnectCallback func(addr string)
+	dsts       []*destination
+	dstMu      sync.Mutex
+	pairing    *pairing
+	balancer   Balancer
+	listeners  []*net.UDPConn // replies are sent from the first
+	listenerMu sync.RWMutex
 
-	timeout time.Duration
+	resolveUDPAddr  func(network, address string) (*net.UDPAddr, error)
+	lookupIPAddr    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	resolveInterval time.Duration
+	resolveOnce     sync.Once
 
-	closed bool
+	healthInterval time.Duration
+	healthProbe    func(addr *net.UDPAddr) error
+	healthOnce     sync.Once
+
+	steering         Steering // guarded by dstMu
+	steeringInterval time.Duration
+	steeringOnce     sync.Once
+
+	rttInterval time.Duration // see SetRTTMeasurement
+	rttProbe    func(ip net.IP) (time.Duration, error)
+	rttOnce     sync.Once
+
+	pins   map[string]*net.UDPAddr // destinations by client, see Pin
+	pinsMu sync.Mutex
+
+	// clients maps the address of each client to its *connection. It is
+	// read without locking, but only changed with clientsMu held, so that
+	// a client is removed by exactly one of the goroutines ending its
+	// session, see removeClient.
+	clients   sync.Map
+	clientsMu sync.Mutex
+
+	callbackMu sync.RWMutex // guards callbacks, which may change at any time
+	callbacks  callbacks
+
+	metadata       *net.UDPConn // see SetMetadataAddr
+	accounting     *accounting  // see SetAccounting
+	mirror         *net.UDPConn // see SetMirror
+	mirrorToServer bool
+	mirrorToClient bool
+	mirrorRatio    float64
+	diagnose       bool
+
+	newConnLimiter atomic.Value // of *tokenBucket, see SetNewConnRate
+	sourceLimiter  atomic.Value // of *sourceLimiter, see SetNewConnRatePerSource
+	bans           *banList     // see SetBanPolicy
+	cookies        atomic.Value // of *ikeCookies, see SetIKECookies
+	rateLimit      atomic.Value // of clientLimit, see SetRateLimit
+	bandwidthLimit atomic.Value // of clientLimit, see SetBandwidthLimit
+
+	outboundAddr *net.UDPAddr
+	dialTimeout  time.Duration
+	dialRetries  int
+	dialFallback bool
+	portMin      int // see SetSourcePortRange
+	portMax      int
+	socketLimit  int // see SetSocketLimit
+	transparent  bool
+	transport    Transport // see SetTransport
+	bridges      sync.Map  // *net.UDPConn of clients to their *bridge
+
+	movedMu sync.Mutex
+	moved   map[string]movedClient // clients disconnected from their destination, see OnRemap
+
+	errorLog errorLog // see logError
+
+	started    time.Time
+	throughput throughput // see Snapshot
+
+	eyeballsDelay time.Duration // see SetHappyEyeballs
+
+	listenerOptions SocketOptions // see SetListenerOptions
+	outboundOptions SocketOptions // see SetOutboundOptions
+
+	goodbye        []byte // sent to destinations on timeout, see SetGoodbye
+	keepalivesIdle bool   // keepalives do not extend the timeout
+
+	// Whether packets in either direction extend the timeout, see
+	// SetRefreshPolicy.
+	refreshFromClient bool
+	refreshFromServer bool
+
+	pools   map[string]*pool
+	poolsMu sync.Mutex
+
+	buffers  sync.Pool // of *[]byte, see getBuffer
+	gro, gso bool      // see SetUDPOffload
+
+	packetFilter       atomic.Value // of packetFilter, see SetPacketFilter
+	middlewares        atomic.Value // of []Middleware, see SetMiddlewares
+	builtinMiddlewares atomic.Value // of []Middleware, see SetBuiltinMiddlewares
+	impairment         atomic.Value // of *Impairment, see SetImpairment
+	tap                atomic.Value // of packetTap, see SetTap
+	tracer             atomic.Value // of tracerValue, see SetTracer
+	fastPath           atomic.Value // of fastPathValue, see SetFastPath
+	fastPathOnce       sync.Once
+	icmp               atomic.Value // of *icmpRelay, see SetICMPRelay
+	ikeSessions        ikeSessions
+	acl                atomic.Value // of *acl, see SetACL
+
+	events          events
+	clientTimeouts  atomic.Value  // of []ClientTimeout
+	timeoutsChanged chan struct{} // wakes the janitor, see timeoutChanged
+	wheel           *timerWheel   // clients by when they may time out
+
+	logger Logger
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+	errc      chan error // see Err
+	errOnce   sync.Once
+	wg        sync.WaitGroup
 }
 
 // DefaultTimeout is the default timeout period of inactivity for convenience
 // sake. It is equivelant to 5 minutes.
 const DefaultTimeout = time.Minute * 5
 
+const (
+	// readBackoff is the delay before retrying after a transient error
+	// reading from the listener. It doubles up to maxReadBackoff while the
+	// errors persist.
+	readBackoff    = 10 * time.Millisecond
+	maxReadBackoff = time.Second
+
+	// maxRebinds is how many times in a row the listener is reopened after
+	// its address became unavailable before giving up.
+	maxRebinds = 5
+)
+
+// DefaultMaxReadErrors is the default number of consecutive transient read
+// errors from a destination tolerated before the client is disconnected.
+const DefaultMaxReadErrors = 5
+
 // Forward forwards IPSEC packets from the laddr address to the raddr address, with a
 // timeout to "disconnect" clients after the timeout period of inactivity. It
 // implements a reverse NAT and thus supports multiple seperate users. Forward
 // is also asynchronous.
+//
+// Deprecated: Use New, which takes every setting and callback up front.
 func Forward(src, dst string, timeout time.Duration) (*Forwarder, error) {
+	return ForwardWeighted(src, []WeightedDest{{Addr: dst, Weight: 1}}, timeout)
+}
+
+// ForwardMulti is like Forward but spreads new clients evenly over several
+// destinations, such as multiple IPSEC gateways. A client stays with the
+// destination it was first assigned to.
+//
+// Deprecated: Use New.
+func ForwardMulti(src string, dsts []string, timeout time.Duration) (*Forwarder, error) {
+	weighted := make([]WeightedDest, len(dsts))
+	for i, dst := range dsts {
+		weighted[i] = WeightedDest{Addr: dst, Weight: 1}
+	}
+	return ForwardWeighted(src, weighted, timeout)
+}
+
+// ForwardWeighted is like Forward but spreads new clients over several
+// destinations in proportion to their weights. A client stays with the
+// destination it was first assigned to.
+//
+// Deprecated: Use New.
+func ForwardWeighted(src string, dsts []WeightedDest, timeout time.Duration) (*Forwarder, error) {
+	return forward(context.Background(), Config{Listen: src, Destinations: dsts, Timeout: timeout}, nil)
+}
+
+// forward starts a forwarder listening on cfg.Listen and forwarding to
+// cfg.Destinations that is closed when ctx is cancelled. The other settings
+// of cfg and opts are applied before any packet is read.
+func forward(ctx context.Context, cfg Config, pairing *pairing, opts ...Option) (*Forwarder, error) {
 	forwarder := new(Forwarder)
-	forwarder.connectCallback = func(addr string) {}
-	forwarder.disconnectCallback = func(addr string) {}
+	forwarder.callbacks = callbacks{
+		connect:     func(addr string) {},
+		disconnect:  func(addr string) {},
+		sessionEnd:  func(event SessionEvent) {},
+		dialError:   func(addr string, err error) {},
+		migrate:     func(oldAddr, newAddr string) {},
+		backendUp:   func(addr string) {},
+		backendDown: func(addr string) {},
+		ban:         func(ban Ban) {},
+		remap:       func(remap Remap) {},
+	}
 	forwarder.clients = sync.Map{}
-	forwarder.timeout = timeout
+	forwarder.started = time.Now()
+	forwarder.timeout = int64(cfg.Timeout)
+	forwarder.maxReadErrors = DefaultMaxReadErrors
+	forwarder.bufferSize = DefaultBufferSize
+	forwarder.dscp = -1
+	forwarder.refreshFromClient = true
+	forwarder.refreshFromServer = true
+	forwarder.queueSize = DefaultQueueSize
+	forwarder.ctx, forwarder.cancel = context.WithCancel(ctx)
+	forwarder.done = make(chan struct{})
+	forwarder.errc = make(chan error, 1)
+	forwarder.timeoutsChanged = make(chan struct{}, 1)
+	forwarder.wheel = newTimerWheel(DefaultExpiryResolution)
+	forwarder.pools = make(map[string]*pool)
+	forwarder.pairing = pairing
+	forwarder.balancer = NewRoundRobin()
+	forwarder.resolveUDPAddr = net.ResolveUDPAddr
+	forwarder.lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	forwarder.logger = NewStdLogger(nil, LevelInfo)
 
-	listenAddr, err := net.ResolveUDPAddr("udp", src)
+	var err error
+	forwarder.dsts, err = forwarder.newDestinations(cfg.Destinations)
 	if err != nil {
 		return nil, err
 	}
 
-	forwarder.raddr, err = net.ResolveUDPAddr("udp", dst)
-	if err != nil {
-		return nil, err
+	if len(cfg.ListenConns) > 0 {
+		forwarder.listeners = append([]*net.UDPConn(nil), cfg.ListenConns...)
+	} else {
+		listenAddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+		forwarder.listeners, err = listen(listenAddr, cfg.Listeners)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	forwarder.listenerConn, err = net.ListenUDP("udp", listenAddr)
-	if err != nil {
+	if err := forwarder.apply(cfg); err != nil {
+		forwarder.Close()
 		return nil, err
 	}
+	for _, opt := range opts {
+		opt(forwarder)
+	}
+	if len(cfg.ListenConns) == 0 && cfg.Listeners > len(forwarder.listeners) {
+		forwarder.logger.Log(LevelWarn, "multiple listeners are not supported on this platform, using one", "listeners", cfg.Listeners)
+	}
 
+	forwarder.wg.Add(1 + len(forwarder.listeners))
 	go forwarder.janitor()
-	go forwarder.run()
+	for i := range forwarder.listeners {
+		go forwarder.run(i)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				forwarder.Close()
+			case <-forwarder.done:
+			}
+		}()
+	}
 
 	return forwarder, nil
 }
 
-func (f *Forwarder) run() {
+// run reads and forwards the packets arriving on the i-th listener.
+func (f *Forwarder) run(i int) {
+	defer f.wg.Done()
+	backoff := readBackoff
+	rebinds := 0
+	var groMsgs []message
 	for {
-		buf := make([]byte, bufferSize)
-		oob := make([]byte, bufferSize)
-		n, _, _, addr, err := f.listenerConn.ReadMsgUDP(buf, oob)
-		if err != nil {
-			log.Println("forward: failed to read, terminating:", err)
+		var err error
+		if f.gro {
+			if groMsgs == nil {
+				groMsgs = newGROMessages(f.batch())
+			}
+			err = f.runGRO(f.listenerAt(i), groMsgs)
+		} else if batchSize := f.batch(); batchSize > 1 || f.passingDSCP() {
+			if batchSize < 1 {
+				batchSize = 1
+			}
+			err = f.runBatch(f.listenerAt(i), batchSize)
+		} else {
+			buf := f.getBuffer()
+			var n, flags int
+			var addr *net.UDPAddr
+			n, _, flags, addr, err = readMsg(f.listenerAt(i), buf, nil)
+			if err == nil {
+				f.receive(buf[:n], flags, 0, addr)
+			} else {
+				f.putBuffer(buf)
+			}
+		}
+		if err == nil {
+			backoff, rebinds = readBackoff, 0
+			continue
+		}
+		if f.isClosed() {
+			return
+		}
+
+		switch {
+		case isTransient(err):
+			f.logError(LevelWarn, OpRead, "", err, "transient read error, retrying")
+			select {
+			case <-f.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxReadBackoff {
+				backoff = maxReadBackoff
+			}
+		case isRebindable(err) && rebinds < maxRebinds:
+			rebinds++
+			f.logger.Log(LevelWarn, "listener failed, reopening", "err", err)
+			if err := f.rebind(i); err != nil {
+				f.logger.Log(LevelError, "failed to reopen listener, terminating", "err", err)
+				f.fail(err)
+				return
+			}
+		default:
+			f.logger.Log(LevelError, "failed to read, terminating", "err", err)
+			f.fail(err)
 			return
 		}
-		go f.handle(buf[:n], addr)
 	}
 }
 
-func (f *Forwarder) janitor() {
-	for !f.closed {
-		time.Sleep(f.timeout)
-		var keysToDelete []interface{}
+// rebind replaces the i-th listener with a new one bound to the same address.
+func (f *Forwarder) rebind(i int) error {
+	f.listenerMu.Lock()
+	defer f.listenerMu.Unlock()
+	if f.isClosed() {
+		return ErrClosed
+	}
 
-		f.clients.Range(func(key, value interface{}) bool {
-			client := value.(*connection)
-			if client.lastActive.Before(time.Now().Add(-f.timeout)) {
-				keysToDelete = append(keysToDelete, key)
-			}
-			return true
-		})
+	laddr := f.listeners[i].LocalAddr().(*net.UDPAddr)
+	f.listeners[i].Close()
+	conn, err := listenUDP(laddr, len(f.listeners) > 1)
+	if err != nil {
+		return err
+	}
+	f.setSocketOptions(conn)
+	applySocketOptions(conn, f.listenerOptions)
+	f.listeners[i] = conn
+	return nil
+}
+
+// listenAddr returns the address clients send their packets to.
+func (f *Forwarder) listenAddr() *net.UDPAddr {
+	return f.listener().LocalAddr().(*net.UDPAddr)
+}
+
+// listener returns the socket clients send their packets to and receive
+// replies from.
+func (f *Forwarder) listener() *net.UDPConn {
+	return f.listenerAt(0)
+}
+
+// listenerAt returns the i-th socket clients send their packets to.
+func (f *Forwarder) listenerAt(i int) *net.UDPConn {
+	f.listenerMu.RLock()
+	defer f.listenerMu.RUnlock()
+	return f.listeners[i]
+}
 
-		for _, key := range keysToDelete {
-			if value, loaded := f.clients.LoadAndDelete(key); loaded {
-				value.(*connection).rConn.Close()
+// receive passes a packet read from a client on to be forwarded, marked with
+// dscp if SetDSCPPassthrough is enabled. data is returned to the buffer pool
+// once it has been sent or dropped.
+func (f *Forwarder) receive(data []byte, flags, dscp int, addr *net.UDPAddr) {
+	if flags&msgTrunc != 0 {
+		f.dropTruncated(addr)
+		f.putBuffer(data)
+		return
+	}
+	out, ok := f.middleware(data, PacketMeta{ToServer: true, Client: addr})
+	if !ok {
+		f.putBuffer(data)
+		return
+	}
+	if len(out) == 0 || &out[0] != &data[0] {
+		// Keep the packet in the buffer, which goes back to the pool.
+		out = append(data[:0], out...)
+	}
+	data = out
+
+	client := f.lookupClient(addr, data)
+	if client == nil {
+		f.putBuffer(data)
+		return
+	}
+	select {
+	case client.queue <- packet{data: data, dscp: dscp}:
+	default:
+		atomic.AddInt64(&f.queueFull, 1)
+		f.putBuffer(data)
+	}
+}
+
+// janitor disconnects the clients that timed out, as scheduled on the timer
+// wheel, and expires the other state kept per client every sweep interval.
+func (f *Forwarder) janitor() {
+	defer f.wg.Done()
+	resolution := f.resetWheel()
+	ticker := time.NewTicker(resolution)
+	defer ticker.Stop()
+	lastSweep := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-f.done:
+			return
+		case <-f.timeoutsChanged:
+			// Disconnect the clients already due and reschedule the
+			// others for the new timeouts. The ticker keeps its phase
+			// unless the resolution changed, so that frequent changes
+			// cannot hold off the expiry of clients.
+			f.expire(time.Now())
+			if r := f.resetWheel(); r != resolution {
+				resolution = r
+				ticker.Reset(resolution)
 			}
+			continue
+		case now = <-ticker.C:
 		}
+		f.expire(now)
+		f.errorLog.flush(f.logger, now)
+		f.throughput.sample(now, f.traffic())
 
-		for _, key := range keysToDelete {
-			f.disconnectCallback(key.(string))
+		if now.Sub(lastSweep) < f.sweepInterval() {
+			continue
+		}
+		lastSweep = now
+		if f.pairing != nil {
+			f.pairing.expire(f.Timeout())
+		}
+		if f.bans != nil {
+			f.bans.expire()
+		}
+		if limiter := f.perSourceLimiter(); limiter != nil {
+			limiter.expire()
 		}
+		f.expireMoved()
 	}
 }
 
-func (f *Forwarder) handle(data []byte, addr *net.UDPAddr) {
+// lookupClient returns the client at addr that sent data, creating it and
+// starting the goroutine forwarding its packets if needed. It returns nil if
+// the client may not be created.
+func (f *Forwarder) lookupClient(addr *net.UDPAddr, data []byte) *connection {
 	cliAddr := addr.String()
 	value, loaded := f.clients.Load(cliAddr)
+	if !loaded && f.trackingIKE() {
+		if client := f.ikeSessions.lookup(data); client != nil && f.migrate(client, addr) {
+			return client
+		}
+	}
 	if !loaded {
-		value = &connection{
-			available:  make(chan struct{}),
-			rConn:      nil,
-			lastActive: time.Now(),
+		if f.isDraining() {
+			atomic.AddInt64(&f.clientsRejected, 1)
+			return nil
+		}
+		if limiter := f.perSourceLimiter(); limiter != nil && !limiter.allow(addr.IP) {
+			atomic.AddInt64(&f.newConnsLimited, 1)
+			f.offend(addr, BanChurn)
+			return nil
+		}
+		if limiter := f.newConnBucket(); limiter != nil && !limiter.allow() {
+			atomic.AddInt64(&f.newConnsLimited, 1)
+			return nil
+		}
+		if max := f.clientsAllowed(); max > 0 && atomic.LoadInt64(&f.clientCount) >= max {
+			atomic.AddInt64(&f.clientsRejected, 1)
+			return nil
+		}
+		if f.socketsExhausted() {
+			atomic.AddInt64(&f.clientsRejected, 1)
+			return nil
+		}
+		var client *connection
+		if raddr := f.pinned(addr); raddr != nil {
+			client = f.newConnection(raddr, f.lookupDestination(raddr))
+		} else {
+			dst := f.destination(addr)
+			client = f.newConnection(dst.raddr, dst)
+		}
+		f.clientsMu.Lock()
+		value, loaded = f.clients.LoadOrStore(cliAddr, client)
+		f.clientsMu.Unlock()
+		if !loaded {
+			atomic.AddInt64(&f.clientCount, 1)
+			if client.dst != nil {
+				atomic.AddInt64(&client.dst.clients, 1)
+			}
+			f.scheduleExpiry(cliAddr, client)
 		}
-		f.clients.Store(cliAddr, value)
 	}
 	client := value.(*connection)
 
-	if !loaded {
-		var rconn *net.UDPConn
-		var err error
-		if f.raddr.IP.To4()[0] == 127 {
-			// log.Println("using local listener")
-			laddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:")
-			rconn, err = net.DialUDP("udp", laddr, f.raddr)
+	// Imported clients are only started once their traffic arrives.
+	if atomic.CompareAndSwapInt32(&client.dialing, 0, 1) {
+		client.setClientAddr(addr)
+		f.wg.Add(1)
+		go f.handle(cliAddr, client)
+	}
+	return client
+}
+
+// handle dials the destination for a client and then forwards the client's
+// packets to it, in order, until the client is removed.
+func (f *Forwarder) handle(cliAddr string, client *connection) {
+	defer f.wg.Done()
+	f.startTrace(cliAddr, client)
+
+	var rconn *net.UDPConn
+	var p *pool
+	var err error
+	pooled := f.pooledSize() > 0 && !f.transparent
+	tried := make(map[*destination]bool)
+	for {
+		tried[client.dst] = true
+		endDial := f.traceDial(client, pooled)
+		if pooled {
+			p, rconn, err = f.pooledConn(client.raddr, cliAddr)
 		} else {
-			rconn, err = net.DialUDP("udp", nil, f.raddr)
+			f.preferFamily(client)
+			rconn, err = f.dial(client.raddr, client.addr)
 		}
-		if err != nil {
-			log.Println("failed to dial:", err)
-			f.clients.Delete(cliAddr)
+		endDial(rconn, err)
+		if err == nil {
+			break
+		}
+		f.logError(LevelWarn, OpDial, cliAddr, err, "failed to dial", "client", cliAddr, "destination", client.raddr)
+		atomic.AddInt64(&f.dialFailures, 1)
+		f.callback().dialError(cliAddr, err)
+		f.emit(Event{Type: EventError, Client: cliAddr, Destination: client.raddr.String(), Err: err})
+		old := client.raddr.String()
+		if next := f.fallbackDestination(client.dst, tried); next != nil && client.setBackend(next) {
+			client.traceEvent("fallback", Attribute{AttrBackendAddr, next.raddr.String()})
+			f.remapped(client, Remap{
+				OldClient:      cliAddr,
+				Client:         cliAddr,
+				OldDestination: old,
+				Destination:    next.raddr.String(),
+				Reason:         RemapDialFailed,
+			})
+			continue
+		}
+		f.removeClient(cliAddr, client)
+		client.endTrace("dial failed", err)
+		return
+	}
+
+	if !client.setConn(rconn, p) {
+		// The client was removed or the forwarder closed while dialing.
+		if p == nil {
+			f.closeSocket(rconn)
+		}
+		client.endTrace("closed while dialing", nil)
+		return
+	}
+	client.setLastActive(time.Now())
+	client.traceEvent("connected")
+
+	atomic.AddInt64(&f.connects, 1)
+	f.announce("connect", cliAddr, client, "")
+	f.accountStart(cliAddr, client)
+	f.callback().connect(cliAddr)
+	f.emit(Event{Type: EventConnect, Client: cliAddr, Destination: client.raddr.String()})
+	f.reconnected(cliAddr, client)
+	f.startFastPath(cliAddr, client)
+
+	if client.pool == nil {
+		f.wg.Add(1)
+		go f.serve(client)
+	}
+
+	var keepalive <-chan time.Time
+	interval := f.keepaliveInterval()
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// Clients racing the address families keep their last packet until the
+	// destination answers, to send it again over the other family.
+	_, racing := f.families(client)
+	var fallback <-chan time.Time
+	var last packet
+
+	initial := true
+	lastSent := time.Now()
+	for {
+		select {
+		case <-f.done:
 			return
+		case <-client.done:
+			return
+		case pkt := <-client.queue:
+			dscp, first := pkt.dscp, initial
+			f.impair(pkt.data, func(data []byte) {
+				f.sendToServer(client, data, dscp, first)
+			})
+			if racing != nil {
+				last.data, last.dscp = append(last.data[:0], pkt.data...), pkt.dscp
+				if fallback == nil {
+					fallback = time.After(f.eyeballsDelay)
+				}
+			}
+			f.putBuffer(pkt.data)
+			initial = false
+			lastSent = time.Now()
+		case <-fallback:
+			if f.fallBack(cliAddr, client) {
+				f.sendToServer(client, last.data, last.dscp, true)
+			}
+			racing, fallback, last.data = nil, nil, nil
+		case <-keepalive:
+			// Keep the mapping of intermediate NATs towards the
+			// destination alive while the client is quiet.
+			if time.Since(lastSent) >= interval {
+				f.write(client.rConn, natKeepalive, nil)
+				lastSent = time.Now()
+			}
+		}
+	}
+}
+
+// sendToServer forwards a packet from the client to the destination.
+func (f *Forwarder) sendToServer(client *connection, data []byte, dscp int, initial bool) {
+	if !f.allowPacket(client, len(data)) {
+		return
+	}
+	addr := client.clientAddr()
+	if client.pool != nil {
+		client.pool.track(addr.String(), data)
+	}
+	if f.trackingIKE() {
+		f.ikeSessions.track(client, data)
+	}
+	f.traceSPIs(client, data)
+	f.trackChildSA(client, data)
+	f.diagnoseIKE(addr.String(), client, data, true)
+	f.timeIKE(client, data, true)
+	active := f.refreshes(data, true)
+
+	n := len(data)
+	if first, every := f.proxying(); first && (initial || every) {
+		header := proxyHeader(addr, f.listener().LocalAddr().(*net.UDPAddr))
+		data = append(header, data...)
+	}
+
+	// log.Println("sent packet to server", client.rConn.RemoteAddr())
+	var err error
+	if f.tooBig(len(data), client.raddr.IP) {
+		f.dropTooBig(addr, f.listenAddr(), n, client.raddr.IP, f.pathMTU()-(len(data)-n))
+	} else if err = f.writeDSCP(client.rConn, data, dscp, nil); errors.Is(err, syscall.EMSGSIZE) {
+		// Path MTU discovery found a smaller MTU towards the destination.
+		f.dropTooBig(addr, f.listenAddr(), n, client.raddr.IP, 0)
+	} else if err != nil {
+		if initial {
+			atomic.AddInt64(&f.initialWriteFails, 1)
+			f.logError(LevelDebug, OpSendServer, addr.String(), err, "error sending initial packet to server", "client", addr)
+		} else {
+			atomic.AddInt64(&f.serverWriteFails, 1)
+			f.logError(LevelDebug, OpSendServer, addr.String(), err, "error sending packet to server", "client", addr)
 		}
+	} else {
+		f.countToServer(client, len(data))
+		f.tapPacket(addr, client.raddr, true, data[len(data)-n:])
+	}
 
-		client.rConn = rconn
-		client.lastActive = time.Now()
-		close(client.available)
+	if active {
+		client.setLastActive(time.Now())
+	}
+}
 
-		f.connectCallback(cliAddr)
+// serve forwards the replies of the destination to the client until reading
+// from the destination fails.
+func (f *Forwarder) serve(client *connection) {
+	defer f.wg.Done()
+	batchSize := f.batch()
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	passDSCP := f.passingDSCP()
+	var msgs []message
+	if f.gro {
+		msgs = newGROMessages(batchSize)
+	} else {
+		msgs = make([]message, batchSize)
+		for i := range msgs {
+			msgs[i].buf = make([]byte, f.readBufferSize())
+			if passDSCP {
+				msgs[i].oob = newOOB()
+			}
+		}
+	}
+	replies := make([][]byte, 0, batchSize)
+	var dscps []int
+	conn := client.socket()
+	local := conn.LocalAddr().(*net.UDPAddr)
 
-		_, _, err = client.rConn.WriteMsgUDP(data, nil, nil)
+	readErrors := 0
+	for {
+		// log.Println("in loop to read from NAT connection to servers")
+		n, err := readMessages(conn, msgs)
+		if err != nil && isTransient(err) && (readErrors < f.readErrorLimit() || f.awaitingFallback(client)) {
+			readErrors++
+			cliAddr := client.clientAddr().String()
+			f.logError(LevelDebug, OpReadServer, cliAddr, err, "transient read error from server, retrying", "client", cliAddr)
+			continue
+		}
+		if err != nil && client.socket() != conn {
+			// Replaced by a socket to another address family, see
+			// SetHappyEyeballs.
+			return
+		}
 		if err != nil {
-			log.Println("error sending initial packet to client", err)
-		}
-
-		for {
-			// log.Println("in loop to read from NAT connection to servers")
-			buf := make([]byte, bufferSize)
-			oob := make([]byte, bufferSize)
-			n, _, _, _, err := client.rConn.ReadMsgUDP(buf, oob)
-			if err != nil {
-				client.rConn.Close()
-				f.clients.Delete(cliAddr)
-				f.disconnectCallback(cliAddr)
-				log.Println("abnormal read, closing:", err)
-				return
+			cliAddr := client.clientAddr().String()
+			client.close()
+			// The client may have been removed already, and a new one
+			// may have taken its address.
+			f.endClient(cliAddr, client, "read error", err)
+			f.logger.Log(LevelDebug, "abnormal read, closing", "client", cliAddr, "err", err)
+			return
+		}
+		readErrors = 0
+
+		replies, dscps = replies[:0], dscps[:0]
+		cliAddr := client.clientAddr()
+		cliIP := cliAddr.IP
+		active, received := false, false
+		for _, msg := range msgs[:n] {
+			if msg.flags&msgTrunc != 0 {
+				f.dropTruncated(msg.addr)
+				continue
 			}
+			segments(msg.buf[:msg.n], msg.segment, func(reply []byte) {
+				if len(reply) > f.readBufferSize() {
+					f.dropTruncated(msg.addr)
+					return
+				}
+				reply, ok := f.middleware(reply, PacketMeta{Client: cliAddr, Destination: msg.addr})
+				if !ok {
+					return
+				}
+				if f.tooBig(len(reply), cliIP) {
+					f.dropTooBig(msg.addr, local, len(reply), cliIP, f.pathMTU())
+					return
+				}
+				if isNATKeepalive(reply) {
+					atomic.AddInt64(&f.keepalivesFromServer, 1)
+				}
+				f.diagnoseIKE(cliAddr.String(), client, reply, false)
+				f.timeIKE(client, reply, false)
+				active = active || f.refreshes(reply, false)
+				received = true
+				if f.impairing() {
+					var dscps []int
+					if passDSCP {
+						dscps = []int{msg.dscp}
+					}
+					f.impair(reply, func(reply []byte) {
+						f.sendToClient(client, [][]byte{reply}, dscps, client.clientAddr())
+					})
+					return
+				}
+				replies = append(replies, reply)
+				if passDSCP {
+					dscps = append(dscps, msg.dscp)
+				}
+			})
+		}
 
-			// log.Println("sent packet to client")
-			_, _, err = f.listenerConn.WriteMsgUDP(buf[:n], nil, addr)
-			if err != nil {
-				log.Println("error sending packet to client:", err)
+		if active {
+			client.setLastActive(time.Now())
+		}
+		if received {
+			f.answered(client)
+		}
+		// log.Println("sent packet to client")
+		f.sendToClient(client, replies, dscps, client.clientAddr())
+	}
+}
+
+// sendToClient forwards replies from the destination to the client at addr,
+// marking each with its DSCP in dscps if given.
+func (f *Forwarder) sendToClient(client *connection, replies [][]byte, dscps []int, addr *net.UDPAddr) {
+	var sent int
+	var err error
+	if dscps != nil {
+		// Marks are set per packet, so batches cannot be used.
+		for sent < len(replies) {
+			if err = f.writeDSCP(f.listener(), replies[sent], dscps[sent], addr); err != nil {
+				break
 			}
+			sent++
+		}
+	} else if len(replies) == 1 {
+		if err = f.write(f.listener(), replies[0], addr); err == nil {
+			sent = 1
 		}
+	} else if f.useGSO() {
+		sent, err = f.writeSegmented(f.listener(), replies, addr)
+	} else {
+		sent, err = f.writeAll(f.listener(), replies, addr)
+	}
 
-		// unreachable
+	for _, reply := range replies[:sent] {
+		f.countToClient(client, len(reply))
+		f.tapPacket(client.raddr, addr, false, reply)
+	}
+	if errors.Is(err, syscall.EMSGSIZE) && sent < len(replies) {
+		// Path MTU discovery found a smaller MTU towards the client.
+		f.dropTooBig(client.raddr, client.rConn.LocalAddr().(*net.UDPAddr), len(replies[sent]), addr.IP, 0)
+		sent++
 	}
+	if err != nil && sent < len(replies) {
+		atomic.AddInt64(&f.clientWriteFails, int64(len(replies)-sent))
+		f.logError(LevelDebug, OpSendClient, addr.String(), err, "error sending packet to client", "client", addr)
+	}
+}
 
-	<-client.available
+// newConnection returns a connection for a new client that is yet to be
+// dialed to raddr, the address of dst.
+func (f *Forwarder) newConnection(raddr *net.UDPAddr, dst *destination) *connection {
+	now := time.Now()
+	conn := &connection{
+		lastActive: now.UnixNano(),
+		started:    now,
+		queue:      make(chan packet, f.clientQueueSize()),
+		done:       make(chan struct{}),
+		raddr:      raddr,
+		dst:        dst,
+		rConn:      nil,
 
-	// log.Println("sent packet to server", client.rConn.RemoteAddr())
-	_, _, err := client.rConn.WriteMsgUDP(data, nil, nil)
-	if err != nil {
-		log.Println("error sending packet to server:", err)
+		closeSocket: f.closeSocket,
 	}
+	conn.limiter = f.clientBucket(&f.rateLimit)
+	conn.bwLimiter = f.clientBucket(&f.bandwidthLimit)
+	return conn
+}
 
-	if value, loaded := f.clients.Load(cliAddr); loaded {
-		client := value.(*connection)
-		// If should change time
-		if client.lastActive.Before(time.Now().Add(f.timeout / 4)) {
-			client.lastActive = time.Now()
-		}
+// write sends data on conn, to addr unless conn is connected. A write that
+// exceeds the write timeout drops the packet and is counted rather than
+// reported as an error.
+func (f *Forwarder) write(conn *net.UDPConn, data []byte, addr *net.UDPAddr) error {
+	return f.writeMsg(conn, data, nil, addr)
+}
+
+// writeMsg is like write with the control messages oob.
+func (f *Forwarder) writeMsg(conn *net.UDPConn, data, oob []byte, addr *net.UDPAddr) error {
+	if timeout := f.sendTimeout(); timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, _, err := conn.WriteMsgUDP(data, oob, addr)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddInt64(&f.writeTimeouts, 1)
+		return nil
 	}
+	return err
 }
 
-// Close stops the forwarder.
-func (f *Forwarder) Close() {
-	f.closed = true
-	f.clients.Range(func(key, value interface{}) bool {
-		value.(*connection).rConn.Close()
+// writeAll is like write for several packets to addr, sending them in as few
+// system calls as the platform allows. It returns the number of packets sent,
+// counting those dropped by the write timeout as sent.
+func (f *Forwarder) writeAll(conn *net.UDPConn, data [][]byte, addr *net.UDPAddr) (int, error) {
+	if timeout := f.sendTimeout(); timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := writeBatch(conn, data, addr)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddInt64(&f.writeTimeouts, int64(len(data)-n))
+		return len(data), nil
+	}
+	return n, err
+}
+
+// allowPacket reports whether a packet of n bytes from client is within its
+// rate limits, counting the drop if it is not.
+func (f *Forwarder) allowPacket(client *connection, n int) bool {
+	if (client.limiter == nil || client.limiter.allow()) &&
+		(client.bwLimiter == nil || client.bwLimiter.allowN(float64(n))) {
+		return true
+	}
+	atomic.AddInt64(&client.rateLimited, 1)
+	atomic.AddInt64(&f.rateLimited, 1)
+	return false
+}
+
+// removeClient deletes client, stopping the goroutine sending its packets,
+// and reports whether it did. It does nothing if client is no longer known at
+// cliAddr, because it has been removed already or has migrated, even if
+// another client has since taken cliAddr; only the first caller for a client
+// gets true and tears it down.
+func (f *Forwarder) removeClient(cliAddr string, client *connection) bool {
+	f.clientsMu.Lock()
+	value, loaded := f.clients.Load(cliAddr)
+	if !loaded || value != client {
+		f.clientsMu.Unlock()
+		return false
+	}
+	f.clients.Delete(cliAddr)
+	f.clientsMu.Unlock()
+
+	// done is closed first so that the client cannot fall back to another
+	// destination once its count was taken.
+	close(client.done)
+	atomic.AddInt64(&f.clientCount, -1)
+	if _, dst := client.backend(); dst != nil {
+		atomic.AddInt64(&dst.clients, -1)
+	}
+	if p := client.sharedPool(); p != nil {
+		p.forget(cliAddr)
+	}
+	f.ikeSessions.forget(client)
+	return true
+}
+
+// endClient ends the session of client at cliAddr for reason, recording err
+// if not nil: it removes the client, closes its socket to the destination,
+// which stops the goroutine reading replies, and reports the end of the
+// session. It does nothing, and reports false, if another goroutine ended it
+// first.
+func (f *Forwarder) endClient(cliAddr string, client *connection, reason string, err error) bool {
+	if !f.removeClient(cliAddr, client) {
+		return false
+	}
+	client.close()
+	if err != nil {
+		client.traceError(err)
+	}
+	f.endSession(cliAddr, client, reason)
+	return true
+}
+
+// callback returns the registered callbacks.
+func (f *Forwarder) callback() callbacks {
+	f.callbackMu.RLock()
+	defer f.callbackMu.RUnlock()
+	return f.callbacks
+}
+
+// isClosed reports whether Close has been called.
+func (f *Forwarder) isClosed() bool {
+	select {
+	case <-f.done:
 		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the forwarder and blocks until all of its goroutines have
+// returned. Closing an already closed forwarder returns ErrClosed.
+func (f *Forwarder) Close() error {
+	err := ErrClosed
+	f.closeOnce.Do(func() {
+		err = nil
+		close(f.done)
+		f.cancel()
+		f.listenerMu.Lock()
+		for _, conn := range f.listeners {
+			conn.Close()
+		}
+		f.listenerMu.Unlock()
+		f.clients.Range(func(key, value interface{}) bool {
+			client := value.(*connection)
+			client.close()
+			client.endTrace("forwarder closed", nil)
+			return true
+		})
+		f.closePools()
+		if relay := f.icmpSender(); relay != nil {
+			relay.close()
+		}
+		if f.metadata != nil {
+			f.metadata.Close()
+		}
+		if f.mirror != nil {
+			f.mirror.Close()
+		}
+	})
+	f.wg.Wait()
+	f.closeEvents()
+	f.errOnce.Do(func() {
+		close(f.errc)
+	})
+	return err
+}
+
+// Err returns a channel that receives the error that made the forwarder stop
+// reading from a listener, after which the listener is given up on. Transient
+// errors, such as running out of file descriptors, are retried with backoff
+// instead, and a failed listener is reopened a few times first. The
+// forwarder is not closed, so that the application can decide whether to go
+// on with the other listeners, if any. The channel is closed once the
+// forwarder is closed, without an error if none occurred.
+func (f *Forwarder) Err() <-chan error {
+	return f.errc
+}
+
+// fail reports the error that made the forwarder stop reading from a
+// listener, see Err. Only the first is reported.
+func (f *Forwarder) fail(err error) {
+	atomic.AddInt32(&f.listenersFailed, 1)
+	f.emit(Event{Type: EventError, Err: err})
+	f.errOnce.Do(func() {
+		f.errc <- err
+		close(f.errc)
 	})
-	f.listenerConn.Close()
 }
 
 // OnConnect can be called with a callback function to be called whenever a
-// new client connects.
+// new client connects. It has no effect on a closed forwarder.
 func (f *Forwarder) OnConnect(callback func(addr string)) {
-	f.connectCallback = callback
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.connect = callback
+	f.callbackMu.Unlock()
 }
 
 // OnDisconnect can be called with a callback function to be called whenever a
-// new client disconnects (after 5 minutes of inactivity).
+// new client disconnects (after 5 minutes of inactivity). It has no effect on
+// a closed forwarder.
 func (f *Forwarder) OnDisconnect(callback func(addr string)) {
-	f.disconnectCallback = callback
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.disconnect = callback
+	f.callbackMu.Unlock()
+}
+
+// OnDialError can be called with a callback function to be called with the
+// client's address whenever connecting to the destination on its behalf
+// fails. It has no effect on a closed forwarder.
+func (f *Forwarder) OnDialError(callback func(addr string, err error)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.dialError = callback
+	f.callbackMu.Unlock()
+}
+
+// SetPacketFilter sets a function called with the source address and payload
+// of every packet in both directions before it is forwarded. Packets for which
+// filter returns false are silently dropped. A nil filter, the default,
+// forwards everything.
+func (f *Forwarder) SetPacketFilter(filter func(src *net.UDPAddr, data []byte) bool) {
+	f.packetFilter.Store(packetFilter(filter))
+}
+
+// packetFilter is the type of the functions given to SetPacketFilter.
+type packetFilter func(src *net.UDPAddr, data []byte) bool
+
+// filter reports whether the packet data from src passes the packet filter.
+func (f *Forwarder) filter(src *net.UDPAddr, data []byte) bool {
+	filter, _ := f.packetFilter.Load().(packetFilter)
+	return filter == nil || filter(src, data)
+}
+
+// SetBufferSize sets the size of the buffers packets are read into, such as
+// MaxBufferSize for IKE messages carrying large certificates that are not
+// fragmented. Datagrams larger than size are dropped, counted in DropStats
+// and logged. It defaults to DefaultBufferSize, and sizes above MaxBufferSize
+// are reduced to it.
+func (f *Forwarder) SetBufferSize(size int) {
+	if size > MaxBufferSize {
+		size = MaxBufferSize
+	}
+	atomic.StoreInt32(&f.bufferSize, int32(size))
+}
+
+// readBufferSize returns the size set with SetBufferSize.
+func (f *Forwarder) readBufferSize() int {
+	return int(atomic.LoadInt32(&f.bufferSize))
+}
+
+// SetQueueSize sets how many packets from each client may wait to be
+// forwarded while the destination is being dialed or written to. Packets
+// arriving at a full queue are dropped and counted rather than blocking the
+// other clients. It defaults to DefaultQueueSize and applies to clients
+// connecting after it is set.
+func (f *Forwarder) SetQueueSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&f.queueSize, int32(n))
+}
+
+// clientQueueSize returns the size set with SetQueueSize.
+func (f *Forwarder) clientQueueSize() int {
+	return int(atomic.LoadInt32(&f.queueSize))
+}
+
+// SetMaxClients limits the number of clients tracked at once. Packets from
+// new clients beyond the limit are dropped. Zero, the default, means no limit.
+func (f *Forwarder) SetMaxClients(n int) {
+	atomic.StoreInt64(&f.maxClients, int64(n))
+}
+
+// clientsAllowed returns the limit set with SetMaxClients, zero if there is
+// none.
+func (f *Forwarder) clientsAllowed() int64 {
+	return atomic.LoadInt64(&f.maxClients)
+}
+
+// SetWriteTimeout sets how long sending a packet may block before it is
+// dropped. Zero, the default, means writes never time out.
+func (f *Forwarder) SetWriteTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&f.writeTimeout, int64(timeout))
+}
+
+// sendTimeout returns the timeout set with SetWriteTimeout.
+func (f *Forwarder) sendTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&f.writeTimeout))
+}
+
+// SetBackendKeepalive makes the forwarder send a NAT-T keepalive to the
+// destination on behalf of every client that has been quiet for interval, so
+// that NATs between the forwarder and the destination do not expire the
+// client's mapping before the client times out. Zero, the default, disables
+// keepalives. It applies to clients connecting after it is set.
+func (f *Forwarder) SetBackendKeepalive(interval time.Duration) {
+	atomic.StoreInt64(&f.backendKeepalive, int64(interval))
+}
+
+// keepaliveInterval returns the interval set with SetBackendKeepalive.
+func (f *Forwarder) keepaliveInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&f.backendKeepalive))
+}
+
+// SetTimeout sets the period of inactivity after which clients are
+// disconnected.
+func (f *Forwarder) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&f.timeout, int64(timeout))
+	f.timeoutChanged()
+}
+
+// Timeout returns the period of inactivity after which clients are
+// disconnected.
+func (f *Forwarder) Timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&f.timeout))
 }
 
-// Connected returns the list of connected clients in IP:port form.
+// SetMaxReadErrors sets how many consecutive transient read errors (such as
+// ICMP port-unreachable) from a destination are tolerated before the client
+// is disconnected. It defaults to DefaultMaxReadErrors.
+func (f *Forwarder) SetMaxReadErrors(n int) {
+	atomic.StoreInt32(&f.maxReadErrors, int32(n))
+}
+
+// readErrorLimit returns the number set with SetMaxReadErrors.
+func (f *Forwarder) readErrorLimit() int {
+	return int(atomic.LoadInt32(&f.maxReadErrors))
+}
+
+// Disconnect forcibly disconnects the client at addr, given in IP:port form,
+// as if it had timed out.
+func (f *Forwarder) Disconnect(addr string) error {
+	if f.isClosed() {
+		return ErrClosed
+	}
+	value, loaded := f.clients.Load(addr)
+	if !loaded || !f.endClient(addr, value.(*connection), "disconnected", nil) {
+		return ErrUnknownClient
+	}
+	return nil
+}
+
+// LocalAddr returns the address the forwarder is listening on, including the
+// port chosen by the system when listening on port 0.
+func (f *Forwarder) LocalAddr() net.Addr {
+	return f.listener().LocalAddr()
+}
+
+// Connected returns the list of connected clients in IP:port form. It returns
+// nil once the forwarder is closed.
 func (f *Forwarder) Connected() []string {
+	if f.isClosed() {
+		return nil
+	}
 	var results []string
 	f.clients.Range(func(key, value interface{}) bool {
 		results = append(results, key.(string))
@@ -216,3 +1452,11 @@ func (f *Forwarder) Connected() []string {
 	})
 	return results
 }
+
+// boolInt32 returns b as the 0 or 1 of the settings accessed atomically.
+func boolInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
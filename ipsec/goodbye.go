@@ -0,0 +1,33 @@
+package ipsec
+
+// SetGoodbye makes the forwarder send payload to the destination of each
+// client that times out, from the client's own socket just before it is
+// closed, so that a gateway listening for it can tear down its half of the
+// client's SAs at once instead of waiting for dead peer detection. The
+// gateway recognises the client by the address the goodbye comes from,
+// which is the one the client's packets came from. An IKEv2 Delete cannot
+// be sent instead, as it must be encrypted with keys only the client and
+// the gateway hold. Clients sharing pooled sockets, see SetPooledMode, get no
+// goodbye, as it could not be told which client it is for. A nil payload,
+// the default, disables goodbyes. It should be set before the forwarder is
+// used.
+func (f *Forwarder) SetGoodbye(payload []byte) {
+	f.goodbye = append([]byte(nil), payload...)
+}
+
+// sayGoodbye sends the goodbye payload, if any, to the destination of the
+// client at cliAddr, which timed out.
+func (f *Forwarder) sayGoodbye(cliAddr string, client *connection) {
+	if len(f.goodbye) == 0 {
+		return
+	}
+	client.mu.Lock()
+	conn, shared := client.rConn, client.pool != nil
+	client.mu.Unlock()
+	if conn == nil || shared {
+		return
+	}
+	if err := f.write(conn, f.goodbye, nil); err != nil {
+		f.logError(LevelDebug, OpGoodbye, cliAddr, err, "error saying goodbye to destination", "client", cliAddr)
+	}
+}
@@ -0,0 +1,207 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// unhealthyAfter is the number of consecutive failed probes after which a
+// destination is considered down. A single successful probe brings it back up.
+const unhealthyAfter = 2
+
+// maxProbeTimeout caps how long the default probe waits for an ICMP error.
+const maxProbeTimeout = time.Second
+
+// probeUDP checks that addr is reachable by sending it a NAT-T keepalive,
+// which IPSEC gateways silently discard, and waiting up to timeout for an ICMP
+// port-unreachable error. Hearing nothing back means the destination is up.
+func probeUDP(addr *net.UDPAddr, timeout time.Duration) error {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(natKeepalive); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return nil
+}
+
+// Probe checks that addr is reachable as the default health check of
+// SetHealthCheck does, waiting up to timeout for an ICMP port-unreachable
+// error, such as to check destinations before deploying a configuration.
+func Probe(addr *net.UDPAddr, timeout time.Duration) error {
+	return probeUDP(addr, timeout)
+}
+
+// healthChecker periodically probes the destinations, taking those failing
+// their probes out of rotation until they recover.
+func (f *Forwarder) healthChecker() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.healthInterval):
+		}
+
+		f.dstMu.Lock()
+		dsts := append([]*destination(nil), f.dsts...)
+		f.dstMu.Unlock()
+
+		for _, dst := range dsts {
+			f.dstMu.Lock()
+			raddr := dst.raddr
+			f.dstMu.Unlock()
+
+			err := f.healthProbe(raddr)
+
+			f.dstMu.Lock()
+			wasDown := dst.down
+			if err != nil {
+				dst.failures++
+				dst.down = dst.failures >= unhealthyAfter
+			} else {
+				dst.failures = 0
+				dst.down = false
+			}
+			down := dst.down
+			f.dstMu.Unlock()
+
+			switch {
+			case down && !wasDown:
+				f.logger.Log(LevelInfo, "destination is down", "destination", raddr, "err", err)
+				f.rehome(raddr)
+				f.callback().backendDown(raddr.String())
+				f.emit(Event{Type: EventBackendDown, Destination: raddr.String(), Err: err})
+			case !down && wasDown:
+				f.logger.Log(LevelInfo, "destination is up again", "destination", raddr)
+				f.callback().backendUp(raddr.String())
+				f.emit(Event{Type: EventBackendUp, Destination: raddr.String()})
+			}
+		}
+	}
+}
+
+// rehome disconnects the clients forwarded to raddr, so that their next
+// packets assign them to a healthy destination.
+func (f *Forwarder) rehome(raddr *net.UDPAddr) {
+	f.endClientsOf(raddr, "failover")
+}
+
+// healthy reports whether the destination at index i may receive new
+// clients. Destinations that are down or drained may only when every other
+// destination is as well, drained ones last. dstMu must be held.
+func (f *Forwarder) healthy(i int) bool {
+	if i >= len(f.dsts) {
+		// The destinations changed since the index was chosen.
+		return false
+	}
+	dst := f.dsts[i]
+	if !dst.down && !dst.drained {
+		return true
+	}
+	for _, other := range f.dsts {
+		if !other.down && !other.drained {
+			return false
+		}
+		if dst.drained && !other.drained {
+			return false
+		}
+	}
+	return true
+}
+
+// SetHealthCheck makes the forwarder probe every destination each interval.
+// A destination failing consecutive probes receives no new clients, and its
+// existing clients are disconnected so that they move to a healthy
+// destination, until it passes a probe again. When every destination is down
+// clients are spread over all of them. A nil probe checks that the
+// destination does not answer with ICMP port-unreachable. The first call with
+// a positive interval starts checking; it cannot be stopped short of Close.
+func (f *Forwarder) SetHealthCheck(interval time.Duration, probe func(addr *net.UDPAddr) error) {
+	if interval <= 0 || f.isClosed() {
+		return
+	}
+	if probe == nil {
+		timeout := interval / 2
+		if timeout > maxProbeTimeout {
+			timeout = maxProbeTimeout
+		}
+		probe = func(addr *net.UDPAddr) error {
+			return probeUDP(addr, timeout)
+		}
+	}
+	f.healthInterval = interval
+	f.healthProbe = probe
+	f.healthOnce.Do(func() {
+		f.wg.Add(1)
+		go f.healthChecker()
+	})
+}
+
+// OnBackendDown can be called with a callback function to be called with the
+// address of a destination whenever it starts failing its health checks. It
+// has no effect on a closed forwarder.
+func (f *Forwarder) OnBackendDown(callback func(addr string)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.backendDown = callback
+	f.callbackMu.Unlock()
+}
+
+// OnBackendUp can be called with a callback function to be called with the
+// address of a destination whenever it passes a health check after being
+// down. It has no effect on a closed forwarder.
+func (f *Forwarder) OnBackendUp(callback func(addr string)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.backendUp = callback
+	f.callbackMu.Unlock()
+}
+
+// Health tells whether a forwarder is fit to serve clients, for the health
+// checks of container orchestrators, see Forwarder.Health.
+type Health struct {
+	Listening    bool `json:"listening"`    // every listener is still read from
+	Destinations int  `json:"destinations"` // number of destinations
+	Reachable    int  `json:"reachable"`    // destinations passing their health checks
+}
+
+// OK reports whether clients can be forwarded: the listeners work and at
+// least one destination is reachable.
+func (h Health) OK() bool {
+	return h.Listening && h.Reachable > 0
+}
+
+// Health reports whether the forwarder still reads from its listeners, see
+// Err, and how many destinations pass their health checks, see
+// SetHealthCheck. Destinations count as reachable without health checks.
+func (f *Forwarder) Health() Health {
+	var h Health
+	h.Listening = !f.isClosed() && atomic.LoadInt32(&f.listenersFailed) == 0
+	for _, dst := range f.destinationStats() {
+		h.Destinations++
+		if dst.Healthy {
+			h.Reachable++
+		}
+	}
+	return h
+}
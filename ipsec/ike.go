@@ -0,0 +1,245 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// IKEv2 exchange types, see RFC 7296 section 3.1.
+const (
+	ExchangeIKESAInit     = 34
+	ExchangeIKEAuth       = 35
+	ExchangeCreateChildSA = 36
+	ExchangeInformational = 37
+)
+
+// IKEv2 header flags.
+const (
+	ikeFlagInitiator = 0x08
+	ikeFlagResponse  = 0x20
+)
+
+// IKEHeader is the fixed header of an IKEv2 message.
+type IKEHeader struct {
+	InitiatorSPI uint64
+	ResponderSPI uint64 // zero in the first message of an IKE SA
+	NextPayload  uint8
+	ExchangeType uint8
+	Flags        uint8
+	MessageID    uint32
+	Length       uint32
+}
+
+// Initiator reports whether the message was sent by the original initiator of
+// the IKE SA.
+func (h IKEHeader) Initiator() bool {
+	return h.Flags&ikeFlagInitiator != 0
+}
+
+// Response reports whether the message is a response.
+func (h IKEHeader) Response() bool {
+	return h.Flags&ikeFlagResponse != 0
+}
+
+// ParseIKE parses the header of the IKEv2 message in data, which may be
+// preceded by the non-ESP marker used on the NAT-T port. It reports false if
+// data is not an IKEv2 message, such as ESP or a NAT-T keepalive.
+func ParseIKE(data []byte) (IKEHeader, bool) {
+	if len(data) >= nonESPMarkerSize && binary.BigEndian.Uint32(data) == 0 {
+		data = data[nonESPMarkerSize:]
+	}
+	if len(data) < ikeHeaderSize || data[17]>>4 != 2 {
+		return IKEHeader{}, false
+	}
+	h := IKEHeader{
+		InitiatorSPI: binary.BigEndian.Uint64(data),
+		ResponderSPI: binary.BigEndian.Uint64(data[8:]),
+		NextPayload:  data[16],
+		ExchangeType: data[18],
+		Flags:        data[19],
+		MessageID:    binary.BigEndian.Uint32(data[20:]),
+		Length:       binary.BigEndian.Uint32(data[24:]),
+	}
+	if h.InitiatorSPI == 0 || h.Length < ikeHeaderSize {
+		return IKEHeader{}, false
+	}
+	return h, true
+}
+
+// ikeSession is an IKE SA seen between a client and its destination.
+type ikeSession struct {
+	client       *connection
+	responderSPI uint64
+}
+
+// ikeSessions indexes clients by the SPIs of their IKE and ESP SAs, so that a
+// client can be recognised when its address changes.
+type ikeSessions struct {
+	mu       sync.Mutex
+	sessions map[uint64]ikeSession // by initiator SPI
+	esp      map[uint32]*connection
+}
+
+// track records the IKE or ESP SA of the packet data sent by client. It is
+// only called from the goroutine forwarding the packets of client.
+func (s *ikeSessions) track(client *connection, data []byte) {
+	h, ok := ParseIKE(data)
+	if !ok {
+		s.trackESP(client, data)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]ikeSession)
+	}
+	session := s.sessions[h.InitiatorSPI]
+	if session.client != nil && session.client != client {
+		// Another client is using the same SPI, keep the first.
+		return
+	}
+	session.client = client
+	if h.ResponderSPI != 0 {
+		session.responderSPI = h.ResponderSPI
+	}
+	s.sessions[h.InitiatorSPI] = session
+}
+
+// trackESP records the SPI of the ESP packet data sent by client, if it is
+// one. ESP packets to the destination carry the SPI it chose, which stays the
+// same until the SA is rekeyed.
+func (s *ikeSessions) trackESP(client *connection, data []byte) {
+	if len(data) < espHeaderSize || isNATKeepalive(data) {
+		return
+	}
+	spi := binary.BigEndian.Uint32(data)
+	if spi == 0 || spi == client.espSPI {
+		return
+	}
+	client.espSPI = spi
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.esp == nil {
+		s.esp = make(map[uint32]*connection)
+	}
+	if _, ok := s.esp[spi]; !ok {
+		s.esp[spi] = client
+	}
+}
+
+// lookup returns the client whose established IKE SA or ESP SA the packet
+// data belongs to. Both SPIs of IKE messages must match, so only IKE SAs past
+// their first exchange are found.
+func (s *ikeSessions) lookup(data []byte) *connection {
+	h, ok := ParseIKE(data)
+	if !ok {
+		if len(data) < espHeaderSize || isNATKeepalive(data) {
+			return nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.esp[binary.BigEndian.Uint32(data)]
+	}
+	if h.ResponderSPI == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[h.InitiatorSPI]
+	if !ok || session.responderSPI != h.ResponderSPI {
+		return nil
+	}
+	return session.client
+}
+
+// forget drops the IKE SAs of client.
+func (s *ikeSessions) forget(client *connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for spi, session := range s.sessions {
+		if session.client == client {
+			delete(s.sessions, spi)
+		}
+	}
+	for spi, c := range s.esp {
+		if c == client {
+			delete(s.esp, spi)
+		}
+	}
+}
+
+// migrate moves client to addr if it is still known, reporting whether it
+// did.
+func (f *Forwarder) migrate(client *connection, addr *net.UDPAddr) bool {
+	oldAddr, newAddr := client.clientAddr().String(), addr.String()
+	f.clientsMu.Lock()
+	if value, loaded := f.clients.Load(oldAddr); !loaded || value != client {
+		// The client has been removed meanwhile.
+		f.clientsMu.Unlock()
+		return false
+	}
+	if _, loaded := f.clients.Load(newAddr); loaded {
+		f.clientsMu.Unlock()
+		return false
+	}
+	f.clients.Delete(oldAddr)
+	f.clients.Store(newAddr, client)
+	client.setClientAddr(addr)
+	f.clientsMu.Unlock()
+	f.scheduleExpiry(newAddr, client)
+	if p := client.sharedPool(); p != nil {
+		p.rename(oldAddr, newAddr)
+	}
+	f.moveFastPath(client, addr)
+
+	client.traceEvent("migrated", Attribute{"client.old_address", oldAddr}, Attribute{AttrClientAddr, newAddr})
+	atomic.AddInt64(&f.migrations, 1)
+	f.logger.Log(LevelInfo, "client migrated", "from", oldAddr, "to", newAddr)
+	f.announce("migrate", newAddr, client, "")
+	f.callback().migrate(oldAddr, newAddr)
+	raddr, _ := client.backend()
+	f.emit(Event{Type: EventMigrate, Client: newAddr, OldClient: oldAddr, Destination: raddr.String()})
+	f.remapped(client, Remap{
+		OldClient:      oldAddr,
+		Client:         newAddr,
+		OldDestination: raddr.String(),
+		Destination:    raddr.String(),
+		Reason:         RemapMigrated,
+	})
+	return true
+}
+
+// OnMigrate can be called with a callback function to be called whenever a
+// client is recognised at a new address, such as a mobile client switching
+// networks with MOBIKE, and keeps its session and destination. It has no
+// effect on a closed forwarder.
+func (f *Forwarder) OnMigrate(callback func(oldAddr, newAddr string)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.migrate = callback
+	f.callbackMu.Unlock()
+}
+
+// SetTrackIKESessions makes the forwarder recognise clients by the SPIs of
+// their IKE and ESP SAs as well as by address. A client whose address
+// changes, after NAT rebinding or a MOBIKE address update for example, keeps
+// its session and destination once it sends an IKE message of an
+// established SA or an ESP packet from the new address, instead of being
+// treated as a new client. Migrations are counted in Stats and reported to
+// OnMigrate.
+func (f *Forwarder) SetTrackIKESessions(track bool) {
+	atomic.StoreInt32(&f.trackIKE, boolInt32(track))
+}
+
+// trackingIKE reports whether clients are recognised by their SPIs, see
+// SetTrackIKESessions.
+func (f *Forwarder) trackingIKE() bool {
+	return atomic.LoadInt32(&f.trackIKE) != 0
+}
@@ -0,0 +1,171 @@
+package ipsec
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReorderGap is how much longer than the others packets picked to be
+// reordered are held back at least, see Impairment.
+const ReorderGap = 10 * time.Millisecond
+
+// Impairment degrades the traffic forwarded, in both directions, to test
+// how clients and destinations cope with a lossy, slow or reordering
+// network, see SetImpairment. It is not meant for production.
+type Impairment struct {
+	Loss    float64       // the fraction of packets dropped, from 0 to 1
+	Delay   time.Duration // added to every packet
+	Jitter  time.Duration // by which the delay varies, more or less
+	Reorder float64       // the fraction of packets held back behind the next ones, from 0 to 1
+}
+
+// ParseImpairment parses an impairment given as comma-separated settings,
+// such as "loss=1%,delay=20ms±5ms,reorder=0.5%". Fractions may be given as
+// percentages, and the jitter as "+-" or "jitter=5ms" too.
+func ParseImpairment(spec string) (Impairment, error) {
+	var imp Impairment
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		i := strings.IndexByte(setting, '=')
+		if i < 0 {
+			return Impairment{}, fmt.Errorf("ipsec: invalid impairment %q: expected name=value", setting)
+		}
+		name, value := setting[:i], setting[i+1:]
+		var err error
+		switch name {
+		case "loss":
+			imp.Loss, err = parseFraction(value)
+		case "reorder":
+			imp.Reorder, err = parseFraction(value)
+		case "delay":
+			value = strings.Replace(value, "+-", "±", 1)
+			if j := strings.Index(value, "±"); j >= 0 {
+				if imp.Jitter, err = time.ParseDuration(value[j+len("±"):]); err != nil {
+					break
+				}
+				value = value[:j]
+			}
+			imp.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			imp.Jitter, err = time.ParseDuration(value)
+		default:
+			return Impairment{}, fmt.Errorf("ipsec: unknown impairment %q", name)
+		}
+		if err != nil {
+			return Impairment{}, fmt.Errorf("ipsec: invalid impairment %q: %w", setting, err)
+		}
+	}
+	return imp, imp.validate()
+}
+
+// parseFraction parses a fraction given as a number or a percentage.
+func parseFraction(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return percent / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// validate checks that the impairment is possible.
+func (imp Impairment) validate() error {
+	if imp.Loss < 0 || imp.Loss > 1 || imp.Reorder < 0 || imp.Reorder > 1 {
+		return fmt.Errorf("ipsec: invalid impairment fractions %g and %g", imp.Loss, imp.Reorder)
+	}
+	if imp.Delay < 0 || imp.Jitter < 0 {
+		return fmt.Errorf("ipsec: invalid impairment delay %v±%v", imp.Delay, imp.Jitter)
+	}
+	return nil
+}
+
+// String returns the impairment as ParseImpairment parses it.
+func (imp Impairment) String() string {
+	var settings []string
+	if imp.Loss > 0 {
+		settings = append(settings, "loss="+strconv.FormatFloat(imp.Loss*100, 'g', -1, 64)+"%")
+	}
+	if imp.Delay > 0 || imp.Jitter > 0 {
+		delay := "delay=" + imp.Delay.String()
+		if imp.Jitter > 0 {
+			delay += "±" + imp.Jitter.String()
+		}
+		settings = append(settings, delay)
+	}
+	if imp.Reorder > 0 {
+		settings = append(settings, "reorder="+strconv.FormatFloat(imp.Reorder*100, 'g', -1, 64)+"%")
+	}
+	return strings.Join(settings, ",")
+}
+
+// delay returns how long to hold a packet back.
+func (imp *Impairment) delay() time.Duration {
+	delay := imp.Delay
+	if imp.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*imp.Jitter)+1)) - imp.Jitter
+	}
+	if imp.Reorder > 0 && rand.Float64() < imp.Reorder {
+		gap := imp.Delay
+		if gap < ReorderGap {
+			gap = ReorderGap
+		}
+		delay += imp.Jitter + gap
+	}
+	return delay
+}
+
+// SetImpairment makes the forwarder drop, delay and reorder the packets it
+// forwards as imp says, in both directions, so that QA can check how IPsec
+// clients and gateways behave over a degraded network. Each direction of
+// each client is impaired on its own, and the packets dropped are counted in
+// Stats. The zero Impairment, the default, forwards packets untouched. It
+// may be changed at any time.
+func (f *Forwarder) SetImpairment(imp Impairment) error {
+	if err := imp.validate(); err != nil {
+		return err
+	}
+	if imp == (Impairment{}) {
+		f.impairment.Store((*Impairment)(nil))
+		return nil
+	}
+	f.impairment.Store(&imp)
+	return nil
+}
+
+// impair passes data on to send unless it is lost, right away or once the
+// delay of the impairment in use has elapsed. data is copied if it is held
+// back, and dropped if the forwarder is closed meanwhile.
+func (f *Forwarder) impair(data []byte, send func(data []byte)) {
+	imp, _ := f.impairment.Load().(*Impairment)
+	if imp == nil {
+		send(data)
+		return
+	}
+	if imp.Loss > 0 && rand.Float64() < imp.Loss {
+		atomic.AddInt64(&f.impairmentDrops, 1)
+		return
+	}
+	delay := imp.delay()
+	if delay <= 0 {
+		send(data)
+		return
+	}
+	data = append([]byte(nil), data...)
+	time.AfterFunc(delay, func() {
+		if !f.isClosed() {
+			send(data)
+		}
+	})
+}
+
+// impairing reports whether an impairment is in use.
+func (f *Forwarder) impairing() bool {
+	imp, _ := f.impairment.Load().(*Impairment)
+	return imp != nil
+}
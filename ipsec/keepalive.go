@@ -0,0 +1,44 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// isNATKeepalive reports whether data is a NAT-T keepalive.
+func isNATKeepalive(data []byte) bool {
+	return len(data) == 1 && data[0] == 0xff
+}
+
+// keepalive counts a NAT-T keepalive from the client at addr and answers it if
+// configured to, in which case it reports true and the keepalive is not
+// forwarded.
+func (f *Forwarder) keepalive(addr *net.UDPAddr) bool {
+	atomic.AddInt64(&f.keepalivesFromClient, 1)
+	if atomic.LoadInt32(&f.answerKeepalives) == 0 {
+		return false
+	}
+	if value, ok := f.clients.Load(addr.String()); ok && f.refreshes(natKeepalive, true) {
+		value.(*connection).setLastActive(time.Now())
+	}
+	if err := f.write(f.listener(), natKeepalive, addr); err != nil {
+		f.logError(LevelDebug, OpKeepalive, addr.String(), err, "error answering keepalive", "client", addr)
+	}
+	return true
+}
+
+// SetAnswerKeepalives makes the forwarder answer NAT-T keepalives from
+// clients itself instead of forwarding them to the destination. Keepalives
+// then never start a session. Either way they are counted in Stats.
+func (f *Forwarder) SetAnswerKeepalives(answer bool) {
+	atomic.StoreInt32(&f.answerKeepalives, boolInt32(answer))
+}
+
+// SetKeepalivesExtendTimeout sets whether NAT-T keepalives from a client, or
+// from its destination, count as activity that keeps it from timing out,
+// which is the default. Clients that only exchange keepalives are otherwise
+// disconnected after the timeout.
+func (f *Forwarder) SetKeepalivesExtendTimeout(extend bool) {
+	f.keepalivesIdle = !extend
+}
@@ -0,0 +1,61 @@
+package ipsec
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendKeepalive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	f, err := New(Config{
+		Listen:           "127.0.0.1:0",
+		Destinations:     []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:          time.Minute,
+		BackendKeepalive: interval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1})
+	buf := make([]byte, 2048)
+	dst.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := dst.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client stays quiet, so the forwarder keeps its mapping alive.
+	for i := 0; i < 3; i++ {
+		dst.SetReadDeadline(time.Now().Add(10 * interval))
+		n, _, err := dst.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("keepalive %d not sent: %v", i+1, err)
+		}
+		if !bytes.Equal(buf[:n], natKeepalive) {
+			t.Fatalf("sent %x while the client was quiet, want a keepalive", buf[:n])
+		}
+	}
+
+	if err := f.Disconnect(conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	// A keepalive may have been on its way as the client was evicted.
+	dst.SetReadDeadline(time.Now().Add(interval))
+	dst.ReadFromUDP(buf)
+	if received(dst, 5*interval) {
+		t.Error("keepalive sent after the client was evicted")
+	}
+}
@@ -0,0 +1,67 @@
+package ipsec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listen opens n sockets on laddr, or one if n is less than two or the
+// platform lacks SO_REUSEPORT. Several sockets share the port with
+// SO_REUSEPORT, so the kernel spreads clients over them.
+func listen(laddr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	if n < 1 {
+		n = 1
+	}
+	reusePort := n > 1
+
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := listenUDP(laddr, reusePort)
+		if i == 0 && errors.Is(err, ErrUnsupported) {
+			// Make do with one socket without SO_REUSEPORT.
+			n, reusePort = 1, false
+			conn, err = listenUDP(laddr, false)
+		}
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		// Open the others on the port picked for the first if it was
+		// left to the system.
+		laddr = conn.LocalAddr().(*net.UDPAddr)
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// listenUDP opens a socket on laddr, allowing other sockets to share its port
+// if reusePort is set.
+func listenUDP(laddr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		conn, err := net.ListenUDP("udp", laddr)
+		return conn, privilegedError(laddr, err)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, privilegedError(laddr, err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// privilegedError explains err, from listening on laddr, if the port is
+// privileged and the process lacks the capability to bind it, as is common
+// in containers running as a user other than root.
+func privilegedError(laddr *net.UDPAddr, err error) error {
+	if !errors.Is(err, syscall.EACCES) || laddr.Port == 0 || laddr.Port >= 1024 || canBindPrivileged() {
+		return err
+	}
+	return fmt.Errorf("ipsec: listening on port %d requires CAP_NET_BIND_SERVICE, "+
+		"grant it with setcap cap_net_bind_service=+ep, AmbientCapabilities in the systemd unit "+
+		"or --cap-add NET_BIND_SERVICE in Docker, or listen on a port above 1023: %w", laddr.Port, err)
+}
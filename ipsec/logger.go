@@ -0,0 +1,148 @@
+package ipsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+// Log levels, from the most to the least verbose.
+const (
+	LevelDebug LogLevel = iota // per-packet errors
+	LevelInfo                  // changes of state, such as destinations going down
+	LevelWarn                  // errors the forwarder recovers from
+	LevelError                 // errors stopping part of the forwarder
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLogLevel parses the name of a log level, as returned by its String
+// method.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("ipsec: unknown log level %q", name)
+}
+
+// Logger receives the log messages of a forwarder. keyvals alternate keys,
+// which are strings, and values giving details such as the error.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+type stdLogger struct {
+	logger *log.Logger // nil for the standard logger
+	min    LogLevel
+}
+
+// NewStdLogger returns a Logger writing messages of at least level min as
+// text lines to logger, or to the standard logger if logger is nil. It is the
+// default, logging messages of LevelInfo and above to the standard logger.
+func NewStdLogger(logger *log.Logger, min LogLevel) Logger {
+	return &stdLogger{logger: logger, min: min}
+}
+
+func (l *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.min {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", level, msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	if l.logger == nil {
+		log.Output(2, b.String())
+	} else {
+		l.logger.Output(2, b.String())
+	}
+}
+
+type jsonLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min LogLevel
+}
+
+// NewJSONLogger returns a Logger writing messages of at least level min to w
+// as JSON objects, one per line, with time, level and msg fields followed by
+// the key-value pairs.
+func NewJSONLogger(w io.Writer, min LogLevel) Logger {
+	return &jsonLogger{w: w, min: min}
+}
+
+func (l *jsonLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.min {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		b.WriteByte(',')
+		writeJSONValue(&b, fmt.Sprint(keyvals[i]))
+		b.WriteByte(':')
+		writeJSONValue(&b, keyvals[i+1])
+	}
+	b.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b.Bytes())
+}
+
+// writeJSONValue writes v to b as JSON, using the text of errors and
+// Stringers.
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// SetLogger sets the logger the forwarder's messages are sent to. It defaults
+// to NewStdLogger(nil, LevelInfo).
+func (f *Forwarder) SetLogger(logger Logger) {
+	f.logger = logger
+}
+
+// SetLogger sets the logger the forwarder's messages are sent to. It defaults
+// to NewStdLogger(nil, LevelInfo).
+func (f *ESPForwarder) SetLogger(logger Logger) {
+	f.logger = logger
+}
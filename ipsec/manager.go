@@ -0,0 +1,311 @@
+package ipsec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Profile is a named forwarding profile run by a Manager, such as IPSEC on
+// ports 500 and 4500, WireGuard on 51820 or OpenVPN on 1194. The forwarder is
+// generic UDP; the IPSEC specific settings of Config are simply left unset
+// for other protocols. Setting Config.ListenIKE runs a Pair instead, see
+// ForwardPairContext.
+type Profile struct {
+	Name   string
+	Config Config
+}
+
+// managed is a running profile.
+type managed struct {
+	profile   Profile
+	forwarder *Forwarder // NAT-T forwarder of pair, if set
+	pair      *Pair
+}
+
+// forwarders returns the forwarders of the profile.
+func (m *managed) forwarders() []*Forwarder {
+	if m.pair != nil {
+		return []*Forwarder{m.pair.NATT, m.pair.IKE}
+	}
+	return []*Forwarder{m.forwarder}
+}
+
+// Close stops the forwarders of the profile.
+func (m *managed) Close() error {
+	if m.pair != nil {
+		return m.pair.Close()
+	}
+	return m.forwarder.Close()
+}
+
+// Manager runs several forwarding profiles in one process, each with its own
+// listen addresses, destinations, timeout and client networks, such as one
+// per tenant: port 4500 for the corporate VPN and 14500 for a partner's, each
+// with its own gateways and ACL.
+type Manager struct {
+	mu       sync.Mutex
+	profiles map[string]*managed
+	logger   Logger // see SetLogger
+	closed   bool
+}
+
+// NewManager returns a Manager running no profiles, see Apply.
+func NewManager() *Manager {
+	return &Manager{profiles: make(map[string]*managed)}
+}
+
+// SetLogger sets the logger of the profiles started without one from then
+// on, such as those added by Set.
+func (m *Manager) SetLogger(logger Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = logger
+}
+
+// Apply makes the manager run exactly profiles. Profiles no longer given are
+// stopped and new ones started. Running profiles whose listen addresses and
+// listener options are unchanged take the new destinations, timeout, client
+// networks and client timeouts, keeping their clients as
+// Forwarder.SetDestinations does, while the other settings only take effect
+// when the listen addresses or options change and the profile is restarted.
+// On error the profiles handled so far stay applied.
+func (m *Manager) Apply(profiles []Profile) error {
+	names := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		if profile.Name == "" {
+			return errors.New("ipsec: profile without a name")
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("ipsec: duplicate profile %q", profile.Name)
+		}
+		names[profile.Name] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	for name, running := range m.profiles {
+		if !names[name] {
+			running.Close()
+			delete(m.profiles, name)
+		}
+	}
+	for _, profile := range profiles {
+		if err := m.apply(profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set starts profile, or updates it if it runs already as Apply does,
+// leaving the other profiles alone.
+func (m *Manager) Set(profile Profile) error {
+	if profile.Name == "" {
+		return errors.New("ipsec: profile without a name")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	return m.apply(profile)
+}
+
+// Remove stops the named profile, returning ErrUnknownProfile if it is not
+// running.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running, ok := m.profiles[name]
+	if !ok {
+		return ErrUnknownProfile
+	}
+	delete(m.profiles, name)
+	return running.Close()
+}
+
+// apply starts or updates profile. m.mu must be held.
+func (m *Manager) apply(profile Profile) error {
+	if profile.Config.Logger == nil {
+		profile.Config.Logger = m.logger
+	}
+	running, ok := m.profiles[profile.Name]
+	if ok && running.profile.Config.Listen == profile.Config.Listen &&
+		running.profile.Config.ListenIKE == profile.Config.ListenIKE &&
+		running.profile.Config.ListenerOptions == profile.Config.ListenerOptions {
+		if err := running.update(profile); err != nil {
+			return fmt.Errorf("ipsec: profile %q: %w", profile.Name, err)
+		}
+		return nil
+	}
+	if ok {
+		// The listen addresses or options changed, so start over.
+		running.Close()
+		delete(m.profiles, profile.Name)
+	}
+	started, err := startProfile(profile)
+	if err != nil {
+		return fmt.Errorf("ipsec: profile %q: %w", profile.Name, err)
+	}
+	m.profiles[profile.Name] = started
+	return nil
+}
+
+// startProfile starts the forwarders of profile.
+func startProfile(profile Profile) (*managed, error) {
+	cfg := profile.Config
+	if cfg.Logger != nil {
+		cfg.Logger = profileLogger{cfg.Logger, profile.Name}
+	}
+	if cfg.ListenIKE != "" {
+		pair, err := ForwardPairContext(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &managed{profile: profile, forwarder: pair.NATT, pair: pair}, nil
+	}
+	forwarder, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &managed{profile: profile, forwarder: forwarder}, nil
+}
+
+// update applies the destinations, timeout, client networks and client
+// timeouts of profile to the running profile.
+func (m *managed) update(profile Profile) error {
+	cfg := profile.Config
+	var err error
+	if m.pair != nil {
+		err = m.pair.SetDestinations(cfg.Destinations)
+	} else {
+		err = m.forwarder.SetDestinations(cfg.Destinations)
+	}
+	if err != nil {
+		return err
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	for _, f := range m.forwarders() {
+		f.SetTimeout(timeout)
+		f.SetACL(cfg.Allow, cfg.Deny)
+		f.SetClientTimeouts(cfg.ClientTimeouts)
+	}
+	m.profile = profile
+	return nil
+}
+
+// Names returns the names of the running profiles in order.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.profiles))
+	for name := range m.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the forwarders of the named profile, the NAT-T one first
+// if it runs a Pair, or nil if it is not running.
+func (m *Manager) Profile(name string) []*Forwarder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if running, ok := m.profiles[name]; ok {
+		return running.forwarders()
+	}
+	return nil
+}
+
+// Running returns the named profile as last applied, and the Pair running it
+// if it forwards IKE as well, or false if it is not running.
+func (m *Manager) Running(name string) (Profile, *Pair, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if running, ok := m.profiles[name]; ok {
+		return running.profile, running.pair, true
+	}
+	return Profile{}, nil, false
+}
+
+// Forwarders returns the forwarders of every running profile, ordered by
+// profile name.
+func (m *Manager) Forwarders() []*Forwarder {
+	var forwarders []*Forwarder
+	for _, name := range m.Names() {
+		forwarders = append(forwarders, m.Profile(name)...)
+	}
+	return forwarders
+}
+
+// Shutdown shuts the forwarders of every profile down as Forwarder.Shutdown
+// does and closes the manager, returning the first error.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	forwarders := m.close()
+	errs := make(chan error, len(forwarders))
+	for _, f := range forwarders {
+		go func(f *Forwarder) {
+			errs <- f.Shutdown(ctx)
+		}(f)
+	}
+	var err error
+	for range forwarders {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close stops every profile and closes the manager.
+func (m *Manager) Close() error {
+	var err error
+	for _, f := range m.close() {
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// close marks the manager closed and returns the forwarders of the profiles
+// it ran.
+func (m *Manager) close() []*Forwarder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	var forwarders []*Forwarder
+	for name, running := range m.profiles {
+		forwarders = append(forwarders, running.forwarders()...)
+		delete(m.profiles, name)
+	}
+	return forwarders
+}
+
+// profileLogger adds the name of a profile to the messages of the forwarders
+// running it.
+type profileLogger struct {
+	Logger
+	name string
+}
+
+func (l profileLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.Logger.Log(level, msg, append([]interface{}{"profile", l.name}, keyvals...)...)
+}
@@ -0,0 +1,69 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// MetadataRecord tells a destination which client is behind the address the
+// forwarder sends the client's packets from, see SetMetadataAddr.
+type MetadataRecord struct {
+	Event       string `json:"event"`  // connect, migrate or disconnect
+	Client      string `json:"client"` // the client's own address
+	Local       string `json:"local"`  // the address the destination sees
+	Destination string `json:"destination"`
+	Reason      string `json:"reason,omitempty"` // why a client disconnected
+}
+
+// SetMetadataAddr makes the forwarder announce the original address of each
+// client on a side channel, for destinations that can neither take a PROXY
+// protocol header, see SetProxyProtocol, nor be reached transparently, see
+// SetTransparent. A MetadataRecord is sent as a JSON datagram to the UDP
+// address addr when a client connects, migrates and disconnects, so that
+// the destination can map the address it sees to the real client. With
+// SetPooledMode several clients share the address the destination sees.
+// An empty addr, the default, disables it. It should be set before the
+// forwarder is used.
+func (f *Forwarder) SetMetadataAddr(addr string) error {
+	if addr == "" {
+		f.metadata = nil
+		return nil
+	}
+	raddr, err := f.resolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	f.metadata = conn
+	return nil
+}
+
+// announce sends a MetadataRecord of the event of client at cliAddr on the
+// metadata channel, if one is set. Nothing is sent for clients that never
+// connected to their destination.
+func (f *Forwarder) announce(event, cliAddr string, client *connection, reason string) {
+	if f.metadata == nil {
+		return
+	}
+	local := client.localAddr()
+	if local == nil {
+		return
+	}
+	raddr, _ := client.backend()
+	record, err := json.Marshal(MetadataRecord{
+		Event:       event,
+		Client:      cliAddr,
+		Local:       local.String(),
+		Destination: raddr.String(),
+		Reason:      reason,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := f.metadata.Write(record); err != nil {
+		f.logError(LevelDebug, OpMetadata, cliAddr, err, "error sending client metadata", "client", cliAddr)
+	}
+}
@@ -0,0 +1,87 @@
+package ipsec
+
+import "sync/atomic"
+
+// Metrics holds the counters and gauges exported for monitoring a Forwarder.
+type Metrics struct {
+	// Packets and bytes forwarded from clients to destinations.
+	PacketsToServer int64
+	BytesToServer   int64
+
+	// Packets and bytes forwarded from destinations back to clients.
+	PacketsToClient int64
+	BytesToClient   int64
+
+	// Clients is the number of clients currently known.
+	Clients int64
+
+	// OutboundSockets is the number of sockets to the destinations open, and
+	// OutboundSocketLimit their limit, zero if there is none, see
+	// SetSocketLimit.
+	OutboundSockets     int64
+	OutboundSocketLimit int64
+
+	// Connects and Disconnects count client sessions started and ended.
+	Connects    int64
+	Disconnects int64
+
+	// KeepalivesFromClient and KeepalivesFromServer count NAT-T keepalives,
+	// which are also included in the packets forwarded unless answered by
+	// the forwarder.
+	KeepalivesFromClient int64
+	KeepalivesFromServer int64
+
+	// Drops is the number of packets dropped for each reason, as returned
+	// by DropStats.
+	Drops map[string]int64
+
+	// Errors is the number of errors of each operation and class, as
+	// returned by ErrorStats.
+	Errors []ErrorStats
+
+	// Destinations describes the traffic and clients of each destination.
+	Destinations []DestinationStats
+}
+
+// Metrics returns a snapshot of the forwarder's metrics.
+func (f *Forwarder) Metrics() Metrics {
+	sockets, socketLimit := f.OutboundSockets()
+	return Metrics{
+		PacketsToServer:      atomic.LoadInt64(&f.packetsToServer),
+		BytesToServer:        atomic.LoadInt64(&f.bytesToServer),
+		PacketsToClient:      atomic.LoadInt64(&f.packetsToClient),
+		BytesToClient:        atomic.LoadInt64(&f.bytesToClient),
+		Clients:              atomic.LoadInt64(&f.clientCount),
+		OutboundSockets:      sockets,
+		OutboundSocketLimit:  socketLimit,
+		Connects:             atomic.LoadInt64(&f.connects),
+		Disconnects:          atomic.LoadInt64(&f.disconnects),
+		KeepalivesFromClient: atomic.LoadInt64(&f.keepalivesFromClient),
+		KeepalivesFromServer: atomic.LoadInt64(&f.keepalivesFromServer),
+		Drops:                f.DropStats(),
+		Errors:               f.ErrorStats(),
+		Destinations:         f.destinationStats(),
+	}
+}
+
+// countToServer records n bytes forwarded from client to its destination.
+func (f *Forwarder) countToServer(client *connection, n int) {
+	atomic.AddInt64(&client.packetsToServer, 1)
+	atomic.AddInt64(&client.bytesToServer, int64(n))
+	atomic.AddInt64(&f.packetsToServer, 1)
+	atomic.AddInt64(&f.bytesToServer, int64(n))
+	if client.dst != nil {
+		atomic.AddInt64(&client.dst.bytesToServer, int64(n))
+	}
+}
+
+// countToClient records n bytes forwarded from the destination to client.
+func (f *Forwarder) countToClient(client *connection, n int) {
+	atomic.AddInt64(&client.packetsToClient, 1)
+	atomic.AddInt64(&client.bytesToClient, int64(n))
+	atomic.AddInt64(&f.packetsToClient, 1)
+	atomic.AddInt64(&f.bytesToClient, int64(n))
+	if client.dst != nil {
+		atomic.AddInt64(&client.dst.bytesToClient, int64(n))
+	}
+}
@@ -0,0 +1,224 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Middleware inspects a packet before it is forwarded, such as to filter,
+// rewrite, tag or count packets. It returns the packet to forward in place of
+// pkt, which may be pkt itself, pkt changed in place or another slice, or
+// drop set to drop it. pkt is only valid during the call. Middlewares are
+// called concurrently for different clients.
+type Middleware func(pkt []byte, meta PacketMeta) (out []byte, drop bool)
+
+// PacketMeta describes the packet passed to a Middleware.
+type PacketMeta struct {
+	ToServer    bool         // sent by the client rather than its destination
+	Client      *net.UDPAddr // address of the client
+	Destination *net.UDPAddr // nil for a client not yet assigned one
+}
+
+// clientMiddlewares are the built-in middlewares every packet of a client
+// passes, in order, before those of SetMiddlewares.
+var clientMiddlewares = []func(f *Forwarder, pkt []byte, meta PacketMeta) ([]byte, bool){
+	(*Forwarder).banMiddleware,
+	(*Forwarder).aclMiddleware,
+	(*Forwarder).validMiddleware,
+	(*Forwarder).filterMiddleware,
+	(*Forwarder).keepaliveMiddleware,
+	(*Forwarder).cookieMiddleware,
+}
+
+// serverMiddlewares are the built-in middlewares every packet of a
+// destination passes before those of SetMiddlewares.
+var serverMiddlewares = []func(f *Forwarder, pkt []byte, meta PacketMeta) ([]byte, bool){
+	(*Forwarder).filterMiddleware,
+}
+
+// SetMiddlewares sets the middlewares packets pass in both directions, in
+// order, after the built-in ones: the ban policy, ACL, validation, packet
+// filter, keepalive answering and IKE cookies for packets of clients, and the
+// packet filter for packets of destinations, see SetBuiltinMiddlewares to
+// reorder those. A packet dropped by one of them is passed to none of the
+// following and is counted in DropStats. It may be called at any time and
+// applies to the next packet.
+func (f *Forwarder) SetMiddlewares(middlewares ...Middleware) {
+	f.middlewares.Store(append([]Middleware(nil), middlewares...))
+}
+
+// SetBuiltinMiddlewares replaces the built-in middlewares packets pass in
+// both directions before those of SetMiddlewares, such as to reorder them,
+// leave some out or put others between them. DefaultMiddlewares returns them
+// in their default order. Packets the built-in middlewares drop are counted
+// under their own reasons in DropStats, unlike those dropped by others given
+// here. Clients connecting while it is set are not handed to a FastPath. A nil
+// slice restores the default order. It may be called at any time and applies
+// to the next packet.
+func (f *Forwarder) SetBuiltinMiddlewares(middlewares []Middleware) {
+	if middlewares != nil {
+		middlewares = append([]Middleware{}, middlewares...)
+	}
+	f.builtinMiddlewares.Store(middlewares)
+}
+
+// DefaultMiddlewares returns the built-in middlewares in the order packets
+// pass them unless set otherwise with SetBuiltinMiddlewares.
+func (f *Forwarder) DefaultMiddlewares() []Middleware {
+	return []Middleware{
+		f.BanMiddleware(),
+		f.ACLMiddleware(),
+		f.ValidationMiddleware(),
+		f.FilterMiddleware(),
+		f.KeepaliveMiddleware(),
+		f.CookieMiddleware(),
+	}
+}
+
+// builtinsSet reports whether the built-in middlewares are set with
+// SetBuiltinMiddlewares.
+func (f *Forwarder) builtinsSet() bool {
+	builtins, _ := f.builtinMiddlewares.Load().([]Middleware)
+	return builtins != nil
+}
+
+// middleware passes the packet data through the built-in middlewares, then
+// those of SetMiddlewares, and returns the packet to forward or false if it is
+// dropped.
+func (f *Forwarder) middleware(data []byte, meta PacketMeta) ([]byte, bool) {
+	var drop bool
+	if builtins, _ := f.builtinMiddlewares.Load().([]Middleware); builtins != nil {
+		for _, mw := range builtins {
+			if data, drop = mw(data, meta); drop {
+				return nil, false
+			}
+		}
+	} else {
+		builtin := serverMiddlewares
+		if meta.ToServer {
+			builtin = clientMiddlewares
+		}
+		for _, mw := range builtin {
+			if data, drop = mw(f, data, meta); drop {
+				return nil, false
+			}
+		}
+	}
+
+	middlewares, _ := f.middlewares.Load().([]Middleware)
+	if len(middlewares) == 0 {
+		return data, true
+	}
+	if meta.Destination == nil {
+		if value, ok := f.clients.Load(meta.Client.String()); ok {
+			meta.Destination, _ = value.(*connection).backend()
+		}
+	}
+	for _, mw := range middlewares {
+		if data, drop = mw(data, meta); drop {
+			atomic.AddInt64(&f.middlewareDrops, 1)
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// BanMiddleware returns the middleware dropping the packets of banned
+// clients, see SetBanPolicy.
+func (f *Forwarder) BanMiddleware() Middleware {
+	return f.banMiddleware
+}
+
+// ACLMiddleware returns the middleware dropping the packets of clients the
+// ACL of SetACL denies.
+func (f *Forwarder) ACLMiddleware() Middleware {
+	return f.aclMiddleware
+}
+
+// ValidationMiddleware returns the middleware dropping the packets of clients
+// that fail validation, see SetValidation.
+func (f *Forwarder) ValidationMiddleware() Middleware {
+	return f.validMiddleware
+}
+
+// FilterMiddleware returns the middleware dropping the packets the packet
+// filter of SetPacketFilter rejects, in both directions.
+func (f *Forwarder) FilterMiddleware() Middleware {
+	return f.filterMiddleware
+}
+
+// KeepaliveMiddleware returns the middleware counting the NAT-T keepalives of
+// clients and, if SetAnswerKeepalives is enabled, answering them instead of
+// forwarding them.
+func (f *Forwarder) KeepaliveMiddleware() Middleware {
+	return f.keepaliveMiddleware
+}
+
+// CookieMiddleware returns the middleware answering the IKE_SA_INIT requests
+// of new clients with a cookie instead of forwarding them, see SetIKECookies.
+func (f *Forwarder) CookieMiddleware() Middleware {
+	return f.cookieMiddleware
+}
+
+func (f *Forwarder) banMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	return pkt, meta.ToServer && f.banned(meta.Client)
+}
+
+func (f *Forwarder) aclMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	return pkt, meta.ToServer && !f.permitted(meta.Client)
+}
+
+func (f *Forwarder) validMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	return pkt, meta.ToServer && !f.valid(meta.Client, pkt)
+}
+
+func (f *Forwarder) filterMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	src := meta.Client
+	if !meta.ToServer {
+		src = meta.Destination
+	}
+	return pkt, !f.filter(src, pkt)
+}
+
+func (f *Forwarder) keepaliveMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	return pkt, meta.ToServer && isNATKeepalive(pkt) && f.keepalive(meta.Client)
+}
+
+func (f *Forwarder) cookieMiddleware(pkt []byte, meta PacketMeta) ([]byte, bool) {
+	if !meta.ToServer {
+		return pkt, false
+	}
+	return pkt, !f.checkCookie(meta.Client, pkt)
+}
+
+// PacketCounter counts the packets and bytes passing its middleware each way,
+// such as those of the clients selected by a middleware before it. The zero
+// value is ready to use.
+type PacketCounter struct {
+	traffic Traffic // accessed atomically
+}
+
+// Middleware returns the middleware counting the packets passing it, which
+// it never drops.
+func (c *PacketCounter) Middleware() Middleware {
+	return func(pkt []byte, meta PacketMeta) ([]byte, bool) {
+		if meta.ToServer {
+			atomic.AddInt64(&c.traffic.PacketsToServer, 1)
+			atomic.AddInt64(&c.traffic.BytesToServer, int64(len(pkt)))
+		} else {
+			atomic.AddInt64(&c.traffic.PacketsToClient, 1)
+			atomic.AddInt64(&c.traffic.BytesToClient, int64(len(pkt)))
+		}
+		return pkt, false
+	}
+}
+
+// Traffic returns the packets and bytes counted so far.
+func (c *PacketCounter) Traffic() Traffic {
+	return Traffic{
+		PacketsToServer: atomic.LoadInt64(&c.traffic.PacketsToServer),
+		BytesToServer:   atomic.LoadInt64(&c.traffic.BytesToServer),
+		PacketsToClient: atomic.LoadInt64(&c.traffic.PacketsToClient),
+		BytesToClient:   atomic.LoadInt64(&c.traffic.BytesToClient),
+	}
+}
@@ -0,0 +1,80 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBuiltinMiddlewaresReordered(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	loopback, _ := ParseCIDRs([]string{"127.0.0.0/8"})
+	f.SetACL(nil, loopback)
+
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func() {
+		t.Helper()
+		if _, err := conn.Write([]byte{0x12, 0x34, 0x56, 0x78, 0, 0, 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitDenied := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for f.DropStats()[DropACLDenied] < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d packets denied by the ACL, want %d", f.DropStats()[DropACLDenied], n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// By default the ACL drops the packet before any other middleware.
+	var counter PacketCounter
+	f.SetMiddlewares(counter.Middleware())
+	send()
+	waitDenied(1)
+	if got := counter.Traffic().PacketsToServer; got != 0 {
+		t.Errorf("%d packets counted after the ACL, want none", got)
+	}
+
+	// Counting ahead of the built-in middlewares sees the packet the ACL
+	// then drops.
+	f.SetMiddlewares()
+	f.SetBuiltinMiddlewares(append([]Middleware{counter.Middleware()}, f.DefaultMiddlewares()...))
+	send()
+	waitDenied(2)
+	if got := counter.Traffic().PacketsToServer; got != 1 {
+		t.Errorf("%d packets counted before the ACL, want 1", got)
+	}
+
+	// Leaving the ACL out forwards the packet.
+	f.SetBuiltinMiddlewares([]Middleware{
+		f.BanMiddleware(),
+		f.ValidationMiddleware(),
+		f.FilterMiddleware(),
+		f.KeepaliveMiddleware(),
+		f.CookieMiddleware(),
+	})
+	send()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2048)); err != nil {
+		t.Errorf("packet not forwarded without the ACL: %v", err)
+	}
+	if got := f.DropStats()[DropACLDenied]; got != 2 {
+		t.Errorf("%d packets denied by the ACL, want 2", got)
+	}
+}
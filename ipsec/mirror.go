@@ -0,0 +1,78 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Mirror directions naming which packets are mirrored, see SetMirror.
+const (
+	MirrorBoth     = "both"      // packets in either direction, the default
+	MirrorToServer = "to-server" // packets from clients to destinations
+	MirrorToClient = "to-client" // packets from destinations to clients
+)
+
+// SetMirror sends a copy of the packets forwarded in direction to the UDP
+// address addr, such as an intrusion detection system or a recorder. Each
+// copy is the packet prefixed with a PROXY protocol v2 header carrying its
+// original source and destination. ratio, between 0 and 1, is the share of
+// the packets mirrored, spread evenly, so that mirroring a full-rate tunnel
+// need not double its bandwidth; 0 selects 1, every packet. An empty
+// direction selects MirrorBoth, and an empty addr, the default, disables
+// mirroring. It should be set before the forwarder is used.
+func (f *Forwarder) SetMirror(addr, direction string, ratio float64) error {
+	if addr == "" {
+		f.mirror = nil
+		return nil
+	}
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("ipsec: mirror ratio %v not between 0 and 1", ratio)
+	}
+	if ratio == 0 {
+		ratio = 1
+	}
+	var toServer, toClient bool
+	switch direction {
+	case MirrorBoth, "":
+		toServer, toClient = true, true
+	case MirrorToServer:
+		toServer = true
+	case MirrorToClient:
+		toClient = true
+	default:
+		return fmt.Errorf("ipsec: unknown mirror direction %q", direction)
+	}
+	raddr, err := f.resolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	f.mirror = conn
+	f.mirrorToServer, f.mirrorToClient = toServer, toClient
+	f.mirrorRatio = ratio
+	return nil
+}
+
+// mirrorPacket sends a copy of a forwarded packet to the mirror, if one is
+// set and the packet is sampled.
+func (f *Forwarder) mirrorPacket(src, dst *net.UDPAddr, toServer bool, data []byte) {
+	if f.mirror == nil || toServer && !f.mirrorToServer || !toServer && !f.mirrorToClient {
+		return
+	}
+	if f.mirrorRatio < 1 {
+		// Mirror the packets that take the count of sampled ones to the
+		// next integer.
+		n := atomic.AddUint64(&f.mirrorSeq, 1)
+		if uint64(float64(n)*f.mirrorRatio) == uint64(float64(n-1)*f.mirrorRatio) {
+			return
+		}
+	}
+	packet := append(proxyHeader(src, dst), data...)
+	if _, err := f.mirror.Write(packet); err != nil {
+		atomic.AddInt64(&f.mirrorFails, 1)
+	}
+}
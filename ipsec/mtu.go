@@ -0,0 +1,235 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Sizes of the IP and UDP headers in front of a datagram.
+const (
+	udpIPv4Overhead = 20 + 8
+	udpIPv6Overhead = 40 + 8
+)
+
+// icmpRelay sends the ICMP errors of SetICMPRelay.
+type icmpRelay struct {
+	mu     sync.Mutex
+	v4, v6 net.PacketConn // opened on first use
+}
+
+// conn returns the raw socket for sending ICMP to ip, opening it if needed.
+func (r *icmpRelay) conn(ip net.IP) (net.PacketConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn, network := &r.v6, "ip6:ipv6-icmp"
+	if ip.To4() != nil {
+		conn, network = &r.v4, "ip4:icmp"
+	}
+	if *conn == nil {
+		c, err := net.ListenPacket(network, "")
+		if err != nil {
+			return nil, err
+		}
+		*conn = c
+	}
+	return *conn, nil
+}
+
+// send sends the ICMP message msg to ip.
+func (r *icmpRelay) send(ip net.IP, msg []byte) error {
+	conn, err := r.conn(ip)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(msg, &net.IPAddr{IP: ip})
+	return err
+}
+
+// close closes the raw sockets.
+func (r *icmpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range []net.PacketConn{r.v4, r.v6} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// tooBig reports whether a datagram of n bytes to ip exceeds the MTU set with
+// SetMTU.
+func (f *Forwarder) tooBig(n int, ip net.IP) bool {
+	mtu := f.pathMTU()
+	if mtu <= 0 {
+		return false
+	}
+	if ip.To4() != nil {
+		return n+udpIPv4Overhead > mtu
+	}
+	return n+udpIPv6Overhead > mtu
+}
+
+// dropTooBig counts a datagram of n bytes from src to dst, on its way to
+// next, that is too big for the path onward, and tells src with ICMP if
+// SetICMPRelay is enabled. mtu is the MTU of the path onward, or zero if it
+// is unknown, in which case the path MTU known to the system is used.
+func (f *Forwarder) dropTooBig(src, dst *net.UDPAddr, n int, next net.IP, mtu int) {
+	atomic.AddInt64(&f.tooBigDrops, 1)
+	if mtu <= 0 {
+		mtu = pathMTU(next)
+	}
+	f.logger.Log(LevelDebug, "dropped packet too big for the path", "from", src, "size", n, "mtu", mtu)
+	relay := f.icmpSender()
+	if relay == nil || mtu <= 0 {
+		return
+	}
+
+	// The sender's own packet went to an address of the forwarder, which
+	// is not known for sockets bound to a wildcard address.
+	if dst.IP.IsUnspecified() {
+		dst = &net.UDPAddr{IP: localIP(src.IP), Port: dst.Port}
+	}
+	if err := relay.send(src.IP, packetTooBigMsg(src, dst, n, mtu)); err != nil {
+		f.logError(LevelDebug, OpRelayTooBig, "", err, "error relaying packet too big", "to", src)
+	}
+}
+
+// packetTooBigMsg returns an ICMP fragmentation needed or ICMPv6 packet too
+// big message telling src that its datagram of n bytes to dst does not fit in
+// mtu. It quotes the IP and UDP headers of the datagram, which is all the
+// sender's kernel needs to find the socket to lower the MTU of.
+func packetTooBigMsg(src, dst *net.UDPAddr, n, mtu int) []byte {
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		msg := make([]byte, 8+udpIPv4Overhead)
+		msg[0], msg[1] = 3, 4 // destination unreachable, fragmentation needed
+		binary.BigEndian.PutUint16(msg[6:], uint16(mtu))
+		ip := msg[8:28]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(udpIPv4Overhead+n))
+		ip[6] = 0x40 // don't fragment
+		ip[8], ip[9] = 64, 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		putUDPHeader(msg[28:], src, dst, n)
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+		return msg
+	}
+
+	// The kernel computes the checksum of ICMPv6 messages.
+	if mtu < 1280 {
+		mtu = 1280
+	}
+	msg := make([]byte, 8+udpIPv6Overhead)
+	msg[0] = 2 // packet too big
+	binary.BigEndian.PutUint32(msg[4:], uint32(mtu))
+	ip := msg[8:48]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(8+n))
+	ip[6], ip[7] = 17, 64
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	putUDPHeader(msg[48:], src, dst, n)
+	return msg
+}
+
+// putUDPHeader stores the header of a datagram of n bytes from src to dst,
+// without a checksum.
+func putUDPHeader(b []byte, src, dst *net.UDPAddr, n int) {
+	binary.BigEndian.PutUint16(b, uint16(src.Port))
+	binary.BigEndian.PutUint16(b[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(b[4:], uint16(8+n))
+}
+
+// checksum returns the Internet checksum of b, which must have its own
+// checksum field zeroed.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// localIP returns the address the system sends packets to ip from.
+func localIP(ip net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// SetMTU sets the largest IP packet forwarded to destinations and clients.
+// Larger ones are dropped and counted rather than fragmented, and their
+// senders told if SetICMPRelay is enabled. Fragmentation is also disabled for
+// paths with a smaller MTU found by path MTU discovery. Zero, the default,
+// leaves fragmentation to the system. It requires Linux and should be set
+// before the forwarder is used.
+func (f *Forwarder) SetMTU(mtu int) error {
+	if mtu > 0 {
+		if err := f.disableFragmentation(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&f.mtu, int32(mtu))
+	return nil
+}
+
+// pathMTU returns the MTU set with SetMTU.
+func (f *Forwarder) pathMTU() int {
+	return int(atomic.LoadInt32(&f.mtu))
+}
+
+// SetICMPRelay answers packets dropped as too big for the path onward, in
+// either direction, with an ICMP fragmentation needed or ICMPv6 packet too
+// big message to their sender, as a router would, so that path MTU discovery
+// works through the forwarder instead of large ESP packets disappearing.
+// Like SetMTU, it disables fragmentation. Sending ICMP requires raw sockets
+// and so CAP_NET_RAW. It requires Linux and should be set before the
+// forwarder is used.
+func (f *Forwarder) SetICMPRelay(enabled bool) error {
+	if !enabled {
+		f.icmp.Store((*icmpRelay)(nil))
+		return nil
+	}
+	if err := f.disableFragmentation(); err != nil {
+		return err
+	}
+	// Fail now rather than on the first packet without CAP_NET_RAW.
+	relay := new(icmpRelay)
+	if _, err := relay.conn(net.IPv4zero); err != nil {
+		return err
+	}
+	f.icmp.Store(relay)
+	return nil
+}
+
+// icmpSender returns the relay set with SetICMPRelay, or nil.
+func (f *Forwarder) icmpSender() *icmpRelay {
+	relay, _ := f.icmp.Load().(*icmpRelay)
+	return relay
+}
+
+// disableFragmentation sets the don't fragment bit on the packets of the
+// listeners and of sockets opened from now on.
+func (f *Forwarder) disableFragmentation() error {
+	f.listenerMu.RLock()
+	defer f.listenerMu.RUnlock()
+	for _, conn := range f.listeners {
+		if err := setDontFragment(conn); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&f.dontFragment, 1)
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"net"
+	"syscall"
+)
+
+// Socket options of path MTU discovery.
+const (
+	ipMTUDiscover   = 0xa
+	ipMTU           = 0xe
+	ipv6MTUDiscover = 0x17
+	ipv6MTU         = 0x18
+	pmtuDiscDo      = 2 // IP_PMTUDISC_DO and IPV6_PMTUDISC_DO
+)
+
+// setDontFragment makes conn send packets with the don't fragment bit set,
+// failing sends larger than the path MTU with EMSGSIZE.
+func setDontFragment(conn *net.UDPConn) error {
+	return setSockoptBoth(conn, ipMTUDiscover, ipv6MTUDiscover, pmtuDiscDo)
+}
+
+// pathMTU returns the MTU the system knows for the path to ip, or zero.
+func pathMTU(ip net.IP) int {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return 0
+	}
+	defer conn.Close()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var mtu int
+	rawConn.Control(func(fd uintptr) {
+		if ip.To4() != nil {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, ipMTU)
+		} else {
+			mtu, err = syscall.GetsockoptInt(int(fd), solIPv6, ipv6MTU)
+		}
+	})
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import "net"
+
+func setDontFragment(conn *net.UDPConn) error {
+	return errMTUUnsupported
+}
+
+func pathMTU(ip net.IP) int {
+	return 0
+}
+
+var errMTUUnsupported error = unsupportedError("ipsec: MTU handling is only supported on Linux")
@@ -0,0 +1,124 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errOffloadUnsupported is returned by setGRO on platforms without UDP
+// offload.
+var errOffloadUnsupported error = unsupportedError("ipsec: UDP offload is only supported on Linux")
+
+// segments calls fn with each datagram in data, which holds several of size
+// bytes, the last possibly shorter, when the kernel coalesced them with GRO.
+// A size of zero means data is a single datagram.
+func segments(data []byte, size int, fn func(datagram []byte)) {
+	if size <= 0 || size >= len(data) {
+		fn(data)
+		return
+	}
+	for len(data) > size {
+		fn(data[:size])
+		data = data[size:]
+	}
+	fn(data)
+}
+
+// newGROMessages returns n messages, at least one, to read coalesced
+// datagrams into.
+func newGROMessages(n int) []message {
+	if n < 1 {
+		n = 1
+	}
+	msgs := make([]message, n)
+	for i := range msgs {
+		msgs[i].buf = make([]byte, MaxBufferSize)
+		msgs[i].oob = newOOB()
+	}
+	return msgs
+}
+
+// runGRO reads datagrams from the listener conn into msgs, splits those the
+// kernel coalesced and passes them on to be forwarded. Each is copied into a
+// buffer of the configured size, so oversize datagrams are still dropped.
+func (f *Forwarder) runGRO(conn *net.UDPConn, msgs []message) error {
+	n, err := readMessages(conn, msgs)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs[:n] {
+		if msg.flags&msgTrunc != 0 {
+			f.dropTruncated(msg.addr)
+			continue
+		}
+		segments(msg.buf[:msg.n], msg.segment, func(datagram []byte) {
+			if len(datagram) > f.readBufferSize() {
+				f.dropTruncated(msg.addr)
+				return
+			}
+			buf := f.getBuffer()
+			f.receive(buf[:copy(buf, datagram)], msg.flags, msg.dscp, msg.addr)
+		})
+	}
+	return nil
+}
+
+// writeSegmented is like writeAll but hands runs of equally sized packets to
+// the kernel in one system call with GSO. It falls back to writeAll for good
+// if the kernel or network interface turns out not to support it.
+func (f *Forwarder) writeSegmented(conn *net.UDPConn, data [][]byte, addr *net.UDPAddr) (int, error) {
+	if timeout := f.sendTimeout(); timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := writeSegments(conn, data, addr)
+	if isGSOUnsupported(err) {
+		if atomic.CompareAndSwapInt32(&f.gsoDisabled, 0, 1) {
+			f.logger.Log(LevelWarn, "UDP segmentation offload failed, sending packets separately", "err", err)
+		}
+		sent, err := f.writeAll(conn, data[n:], addr)
+		return n + sent, err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddInt64(&f.writeTimeouts, int64(len(data)-n))
+		return len(data), nil
+	}
+	return n, err
+}
+
+// useGSO reports whether replies should be sent with writeSegmented.
+func (f *Forwarder) useGSO() bool {
+	return f.gso && atomic.LoadInt32(&f.gsoDisabled) == 0
+}
+
+// SetUDPOffload enables UDP generic receive offload (GRO) and generic
+// segmentation offload (GSO) on Linux, letting the kernel hand over and take
+// several datagrams of a flow per system call, which raises throughput of
+// busy relays. GRO is used on the listener and destination sockets and
+// requires Linux 5.0, GSO for batches of replies, see SetBatchSize, and
+// requires Linux 4.18. Whichever the kernel does not support is left off, as
+// is GSO once a network interface rejects it. It should be set before the
+// forwarder is used.
+func (f *Forwarder) SetUDPOffload(enabled bool) {
+	f.listenerMu.RLock()
+	defer f.listenerMu.RUnlock()
+
+	gro := enabled
+	for _, conn := range f.listeners {
+		if gro && setGRO(conn, true) != nil {
+			gro = false
+		}
+	}
+	if !gro && (enabled || f.gro) {
+		for _, conn := range f.listeners {
+			setGRO(conn, false)
+		}
+	}
+	f.gro = gro
+	f.gso = enabled && supportsGSO(f.listeners[0])
+	if enabled && (!f.gro || !f.gso) {
+		f.logger.Log(LevelInfo, "UDP offload not fully supported, falling back", "gro", f.gro, "gso", f.gso)
+	}
+}
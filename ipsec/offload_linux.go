@@ -0,0 +1,148 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// UDP socket options of Linux's segmentation and receive offload, and
+// SOL_UDP, which the syscall package does not define on every architecture.
+const (
+	solUDP     = 0x11
+	udpSegment = 103
+	udpGRO     = 104
+
+	// udpMaxSegments is the most datagrams the kernel accepts per send.
+	udpMaxSegments = 64
+	// gsoMaxSize is the most payload that fits in one IPv4 send.
+	gsoMaxSize = 65507
+)
+
+// setGRO enables or disables UDP_GRO on conn.
+func setGRO(conn *net.UDPConn, enabled bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if enabled {
+		value = 1
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), solUDP, udpGRO, value)
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", sockErr)
+}
+
+// supportsGSO reports whether the kernel knows UDP_SEGMENT.
+func supportsGSO(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		_, sockErr = syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+	})
+	return err == nil && sockErr == nil
+}
+
+// newOOB returns a buffer for the control messages read with a datagram, the
+// GRO segment size and its TOS or traffic class.
+func newOOB() []byte {
+	return make([]byte, 2*syscall.CmsgSpace(4))
+}
+
+// groSegment returns the segment size of coalesced datagrams given in the
+// control messages oob, or zero.
+func groSegment(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == solUDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			var size int32
+			copy((*[4]byte)(unsafe.Pointer(&size))[:], msg.Data)
+			return int(size)
+		}
+	}
+	return 0
+}
+
+// segmentOOB returns a control message asking the kernel to split a send into
+// datagrams of size bytes.
+func segmentOOB(size int) []byte {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	hdr := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = solUDP
+	hdr.Type = udpSegment
+	hdr.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(size)
+	return oob
+}
+
+// writeSegments sends every buffer in bufs to addr over conn, joining each
+// run of equally sized buffers, of which the last may be shorter, into a
+// single send with UDP_SEGMENT. It returns the number of buffers sent.
+func writeSegments(conn *net.UDPConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	var payload []byte
+	sent := 0
+	for sent < len(bufs) {
+		size := len(bufs[sent])
+		end, total := sent+1, size
+		for size > 0 && end < len(bufs) && end-sent < udpMaxSegments &&
+			len(bufs[end]) <= size && total+len(bufs[end]) <= gsoMaxSize {
+			total += len(bufs[end])
+			end++
+			if len(bufs[end-1]) < size {
+				break
+			}
+		}
+
+		var err error
+		if end-sent == 1 {
+			_, _, err = conn.WriteMsgUDP(bufs[sent], nil, addr)
+		} else {
+			payload = payload[:0]
+			for _, buf := range bufs[sent:end] {
+				payload = append(payload, buf...)
+			}
+			_, _, err = conn.WriteMsgUDP(payload, segmentOOB(size), addr)
+			if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EMSGSIZE) {
+				// Segments larger than the path MTU are refused, and
+				// some kernels refuse large segments on loopback.
+				var n int
+				n, err = writeBatch(conn, bufs[sent:end], addr)
+				if err != nil {
+					return sent + n, err
+				}
+			}
+		}
+		if err != nil {
+			return sent, err
+		}
+		sent = end
+	}
+	return sent, nil
+}
+
+// isGSOUnsupported reports whether err means segmented sends do not work,
+// because the kernel lacks UDP_SEGMENT or the interface checksum offload.
+func isGSOUnsupported(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENOPROTOOPT) ||
+		errors.Is(err, syscall.EOPNOTSUPP)
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import "net"
+
+func setGRO(conn *net.UDPConn, enabled bool) error {
+	return errOffloadUnsupported
+}
+
+func supportsGSO(conn *net.UDPConn) bool {
+	return false
+}
+
+func newOOB() []byte {
+	return nil
+}
+
+func groSegment(oob []byte) int {
+	return 0
+}
+
+func writeSegments(conn *net.UDPConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	return writeBatch(conn, bufs, addr)
+}
+
+func isGSOUnsupported(err error) bool {
+	return false
+}
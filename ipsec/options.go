@@ -0,0 +1,108 @@
+package ipsec
+
+import (
+	"context"
+	"net"
+)
+
+// Option sets up a Forwarder created by New before it reads its first
+// packet, for settings that do not fit in a Config, such as callbacks.
+// Setting them after New returns instead can miss the first clients.
+type Option func(f *Forwarder)
+
+// New starts a forwarder described by cfg, applying opts before any packet
+// is read. It is ForwardContext with a background context.
+func New(cfg Config, opts ...Option) (*Forwarder, error) {
+	return ForwardContext(context.Background(), cfg, opts...)
+}
+
+// WithOnConnect sets the callback of OnConnect.
+func WithOnConnect(callback func(addr string)) Option {
+	return func(f *Forwarder) {
+		f.OnConnect(callback)
+	}
+}
+
+// WithOnDisconnect sets the callback of OnDisconnect.
+func WithOnDisconnect(callback func(addr string)) Option {
+	return func(f *Forwarder) {
+		f.OnDisconnect(callback)
+	}
+}
+
+// WithOnSessionEnd sets the callback of OnSessionEnd.
+func WithOnSessionEnd(callback func(event SessionEvent)) Option {
+	return func(f *Forwarder) {
+		f.OnSessionEnd(callback)
+	}
+}
+
+// WithOnDialError sets the callback of OnDialError.
+func WithOnDialError(callback func(addr string, err error)) Option {
+	return func(f *Forwarder) {
+		f.OnDialError(callback)
+	}
+}
+
+// WithOnMigrate sets the callback of OnMigrate.
+func WithOnMigrate(callback func(oldAddr, newAddr string)) Option {
+	return func(f *Forwarder) {
+		f.OnMigrate(callback)
+	}
+}
+
+// WithOnBackendDown sets the callback of OnBackendDown.
+func WithOnBackendDown(callback func(addr string)) Option {
+	return func(f *Forwarder) {
+		f.OnBackendDown(callback)
+	}
+}
+
+// WithOnBackendUp sets the callback of OnBackendUp.
+func WithOnBackendUp(callback func(addr string)) Option {
+	return func(f *Forwarder) {
+		f.OnBackendUp(callback)
+	}
+}
+
+// WithOnBan sets the callback of OnBan.
+func WithOnBan(callback func(ban Ban)) Option {
+	return func(f *Forwarder) {
+		f.OnBan(callback)
+	}
+}
+
+// WithOnRemap sets the callback of OnRemap.
+func WithOnRemap(callback func(remap Remap)) Option {
+	return func(f *Forwarder) {
+		f.OnRemap(callback)
+	}
+}
+
+// WithPacketFilter sets the filter of SetPacketFilter.
+func WithPacketFilter(filter func(src *net.UDPAddr, data []byte) bool) Option {
+	return func(f *Forwarder) {
+		f.SetPacketFilter(filter)
+	}
+}
+
+// WithMiddlewares sets the middlewares of SetMiddlewares.
+func WithMiddlewares(middlewares ...Middleware) Option {
+	return func(f *Forwarder) {
+		f.SetMiddlewares(middlewares...)
+	}
+}
+
+// WithTap sets the tap of SetTap.
+func WithTap(tap func(p TappedPacket)) Option {
+	return func(f *Forwarder) {
+		f.SetTap(tap)
+	}
+}
+
+// WithOnError sets the callback of OnError for class.
+func WithOnError(class ErrorClass, callback func(report ErrorReport)) Option {
+	return func(f *Forwarder) {
+		f.OnError(class, callback)
+	}
+}
@@ -0,0 +1,319 @@
+package ipsec
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Standard IPSEC ports.
+const (
+	IKEPort  = "500"
+	NATTPort = "4500"
+)
+
+// pairing remembers which destination each client IP address was sent to, so
+// that the IKE and NAT-T flows of a client reach the same destination even
+// though their source ports differ.
+type pairing struct {
+	mu      sync.Mutex
+	clients map[string]*pairedClient
+}
+
+type pairedClient struct {
+	index    int
+	lastSeen time.Time
+}
+
+// index returns the destination index of the client at ip, choosing one with
+// pick if the client is not known or its destination is no longer healthy.
+func (p *pairing) index(ip net.IP, pick func() int, healthy func(i int) bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	client, ok := p.clients[ip.String()]
+	if !ok {
+		client = &pairedClient{index: pick()}
+		p.clients[ip.String()] = client
+	} else if !healthy(client.index) {
+		client.index = pick()
+	}
+	client.lastSeen = time.Now()
+	return client.index
+}
+
+// expire forgets clients that have not started a flow within timeout.
+func (p *pairing) expire(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(-timeout)
+	for ip, client := range p.clients {
+		if client.lastSeen.Before(deadline) {
+			delete(p.clients, ip)
+		}
+	}
+}
+
+// Pair forwards the IKE (UDP port 500) and NAT-T (UDP port 4500) flows of
+// IPSEC clients, keeping both flows of a client on the same destination so
+// that a session survives the switch to port 4500 when NAT is detected.
+type Pair struct {
+	IKE  *Forwarder
+	NATT *Forwarder
+}
+
+// ForwardPair forwards IKE packets received on ikeSrc to port 500 and NAT-T
+// packets received on nattSrc to port 4500 of the destination hosts. The
+// Addr of each destination is a host without a port. Clients are told apart
+// by IP address when pairing their flows.
+//
+// Deprecated: Use ForwardPairContext, which takes every setting up front.
+func ForwardPair(ikeSrc, nattSrc string, dsts []WeightedDest, timeout time.Duration) (*Pair, error) {
+	p := &pairing{clients: make(map[string]*pairedClient)}
+	ike, err := forward(context.Background(), Config{Listen: ikeSrc, Destinations: withPort(dsts, IKEPort), Timeout: timeout}, p)
+	if err != nil {
+		return nil, err
+	}
+	natt, err := forward(context.Background(), Config{Listen: nattSrc, Destinations: withPort(dsts, NATTPort), Timeout: timeout}, p)
+	if err != nil {
+		ike.Close()
+		return nil, err
+	}
+
+	return &Pair{IKE: ike, NATT: natt}, nil
+}
+
+// withPort returns dsts with port added to each host.
+func withPort(dsts []WeightedDest, port string) []WeightedDest {
+	withPort := make([]WeightedDest, len(dsts))
+	for i, dst := range dsts {
+		withPort[i] = dst
+		withPort[i].Addr = net.JoinHostPort(dst.Addr, port)
+	}
+	return withPort
+}
+
+// SetDestinations replaces the destination hosts of both forwarders, as
+// Forwarder.SetDestinations does.
+func (p *Pair) SetDestinations(dsts []WeightedDest) error {
+	if err := p.IKE.SetDestinations(withPort(dsts, IKEPort)); err != nil {
+		return err
+	}
+	return p.NATT.SetDestinations(withPort(dsts, NATTPort))
+}
+
+// SetWeight changes the weight of the destination host on both forwarders,
+// as Forwarder.SetWeight does.
+func (p *Pair) SetWeight(host string, weight int) error {
+	if err := p.IKE.SetWeight(net.JoinHostPort(host, IKEPort), weight); err != nil {
+		return err
+	}
+	return p.NATT.SetWeight(net.JoinHostPort(host, NATTPort), weight)
+}
+
+// Pin assigns every flow of the client at the IP address clientIP to the
+// destination host on both forwarders, as Forwarder.Pin does.
+func (p *Pair) Pin(clientIP, host string) error {
+	if err := p.IKE.Pin(clientIP, net.JoinHostPort(host, IKEPort)); err != nil {
+		return err
+	}
+	return p.NATT.Pin(clientIP, net.JoinHostPort(host, NATTPort))
+}
+
+// Unpin removes the pin of clientIP from both forwarders, as Forwarder.Unpin
+// does.
+func (p *Pair) Unpin(clientIP string) error {
+	err := p.IKE.Unpin(clientIP)
+	if err2 := p.NATT.Unpin(clientIP); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Drain stops assigning new clients to the destination host on both
+// forwarders, as Forwarder.Drain does. The clients of both are counted.
+func (p *Pair) Drain(host string, timeout time.Duration) (DrainStatus, error) {
+	ike, err := p.IKE.Drain(net.JoinHostPort(host, IKEPort), timeout)
+	if err != nil {
+		return DrainStatus{}, err
+	}
+	natt, err := p.NATT.Drain(net.JoinHostPort(host, NATTPort), timeout)
+	if err != nil {
+		return DrainStatus{}, err
+	}
+	natt.Addr = host
+	natt.Clients += ike.Clients
+	return natt, nil
+}
+
+// Undrain undoes Drain of the destination host on both forwarders.
+func (p *Pair) Undrain(host string) error {
+	if err := p.IKE.Undrain(net.JoinHostPort(host, IKEPort)); err != nil {
+		return err
+	}
+	return p.NATT.Undrain(net.JoinHostPort(host, NATTPort))
+}
+
+// Draining returns the destination hosts being drained, counting the
+// clients of both forwarders.
+func (p *Pair) Draining() []DrainStatus {
+	ike := make(map[string]int64)
+	for _, status := range p.IKE.Draining() {
+		if host, _, err := net.SplitHostPort(status.Addr); err == nil {
+			ike[host] = status.Clients
+		}
+	}
+	draining := p.NATT.Draining()
+	for i := range draining {
+		if host, _, err := net.SplitHostPort(draining[i].Addr); err == nil {
+			draining[i].Addr = host
+			draining[i].Clients += ike[host]
+		}
+	}
+	return draining
+}
+
+// Bans returns the source addresses banned by either forwarder, see
+// Forwarder.SetBanPolicy, ordered by address.
+func (p *Pair) Bans() []Ban {
+	bans := p.NATT.Bans()
+	seen := make(map[string]bool, len(bans))
+	for _, ban := range bans {
+		seen[ban.IP] = true
+	}
+	for _, ban := range p.IKE.Bans() {
+		if !seen[ban.IP] {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Unban lifts the ban of ip on both forwarders. It returns ErrUnknownClient
+// if neither banned it.
+func (p *Pair) Unban(ip string) error {
+	err := p.IKE.Unban(ip)
+	if err2 := p.NATT.Unban(ip); err2 == nil {
+		err = nil
+	}
+	return err
+}
+
+// RTT returns the round trip times measured to the destinations by both
+// forwarders, see Forwarder.RTT, on the IKE and the NAT-T port.
+func (p *Pair) RTT() []DestinationRTT {
+	rtts := append(p.IKE.RTT(), p.NATT.RTT()...)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i].Addr < rtts[j].Addr })
+	return rtts
+}
+
+// SetSteering sets the steering of both forwarders, as
+// Forwarder.SetSteering does. steering is shared, so it must be safe for
+// concurrent use, as the built-in ones are.
+func (p *Pair) SetSteering(steering Steering, interval time.Duration) {
+	p.IKE.SetSteering(steering, interval)
+	p.NATT.SetSteering(steering, interval)
+}
+
+// SetTracer sets the tracer of both forwarders, see Forwarder.SetTracer.
+func (p *Pair) SetTracer(tracer Tracer) {
+	p.IKE.SetTracer(tracer)
+	p.NATT.SetTracer(tracer)
+}
+
+// ForwardPairContext is like ForwardPair but takes the IKE and NAT-T listen
+// addresses from cfg.ListenIKE and cfg.Listen and applies the other settings
+// of cfg to both forwarders. The Addr of each destination is a host without a
+// port. A cfg.Balancer or cfg.Steering is shared by both forwarders, so it
+// must be safe for concurrent use; the balancers named by cfg.Strategy are
+// not shared. opts are applied to both forwarders before any packet is read.
+// Both forwarders are closed when ctx is cancelled.
+func ForwardPairContext(ctx context.Context, cfg Config, opts ...Option) (*Pair, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	p := &pairing{clients: make(map[string]*pairedClient)}
+
+	ikeCfg := cfg
+	ikeCfg.Listen, ikeCfg.Destinations = cfg.ListenIKE, withPort(cfg.Destinations, IKEPort)
+	ikeCfg.ListenConns = cfg.ListenIKEConns
+	ike, err := forward(ctx, ikeCfg, p, opts...)
+	if err != nil {
+		return nil, err
+	}
+	nattCfg := cfg
+	nattCfg.Destinations = withPort(cfg.Destinations, NATTPort)
+	natt, err := forward(ctx, nattCfg, p, opts...)
+	if err != nil {
+		ike.Close()
+		return nil, err
+	}
+
+	return &Pair{IKE: ike, NATT: natt}, nil
+}
+
+// Destinations returns the destination hosts of the pair.
+func (p *Pair) Destinations() []WeightedDest {
+	dsts := p.NATT.Destinations()
+	for i := range dsts {
+		if host, _, err := net.SplitHostPort(dsts[i].Addr); err == nil {
+			dsts[i].Addr = host
+		}
+	}
+	return dsts
+}
+
+// ClientStats returns the statistics of the clients of both forwarders.
+func (p *Pair) ClientStats() []ClientStat {
+	return append(p.IKE.ClientStats(), p.NATT.ClientStats()...)
+}
+
+// Disconnect disconnects the client at addr from whichever forwarder it is
+// connected to. Only the flow from addr is affected, not the client's other
+// flow.
+func (p *Pair) Disconnect(addr string) error {
+	err := p.NATT.Disconnect(addr)
+	if errors.Is(err, ErrUnknownClient) {
+		err = p.IKE.Disconnect(addr)
+	}
+	return err
+}
+
+// Health reports the health of both forwarders, see Forwarder.Health. The pair
+// listens if both do, and has as many reachable destinations as the one with
+// fewer.
+func (p *Pair) Health() Health {
+	ike, natt := p.IKE.Health(), p.NATT.Health()
+	if ike.Reachable < natt.Reachable {
+		natt.Reachable = ike.Reachable
+	}
+	natt.Listening = natt.Listening && ike.Listening
+	return natt
+}
+
+// SetTimeout sets the timeout of both forwarders.
+func (p *Pair) SetTimeout(timeout time.Duration) {
+	p.IKE.SetTimeout(timeout)
+	p.NATT.SetTimeout(timeout)
+}
+
+// Timeout returns the timeout of the forwarders.
+func (p *Pair) Timeout() time.Duration {
+	return p.NATT.Timeout()
+}
+
+// Close stops both forwarders.
+func (p *Pair) Close() error {
+	err := p.IKE.Close()
+	if err2 := p.NATT.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
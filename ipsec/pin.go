@@ -0,0 +1,97 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+)
+
+// pinKey returns the key clientAddr, in IP:port form or an IP address, is
+// pinned under.
+func pinKey(clientAddr string) (string, error) {
+	if ip := net.ParseIP(clientAddr); ip != nil {
+		return ip.String(), nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", clientAddr)
+	if err != nil || addr.IP == nil {
+		return "", fmt.Errorf("ipsec: invalid client address %q", clientAddr)
+	}
+	return addr.String(), nil
+}
+
+// Pin assigns the client at clientAddr to the destination at backendAddr,
+// overriding the balancer, health checks and the pairing of a Pair, for
+// external controllers that know which gateway owns which client. clientAddr
+// is in IP:port form, or an IP address to pin every flow of the host, and a
+// pin of the flow takes precedence over one of its host. backendAddr need not
+// be one of the destinations. A client connected to another destination is
+// disconnected so that its next packet goes to backendAddr. The pin lasts
+// until Unpin, across reconnects.
+func (f *Forwarder) Pin(clientAddr, backendAddr string) error {
+	if f.isClosed() {
+		return ErrClosed
+	}
+	key, err := pinKey(clientAddr)
+	if err != nil {
+		return err
+	}
+	raddr, err := f.resolveUDPAddr("udp", backendAddr)
+	if err != nil {
+		return err
+	}
+
+	f.pinsMu.Lock()
+	if f.pins == nil {
+		f.pins = make(map[string]*net.UDPAddr)
+	}
+	f.pins[key] = raddr
+	f.pinsMu.Unlock()
+
+	moved := make(map[string]*connection)
+	f.clients.Range(func(key, value interface{}) bool {
+		client := value.(*connection)
+		addr, _ := client.backend()
+		moving := !addr.IP.Equal(raddr.IP) || addr.Port != raddr.Port
+		if moving && f.pinned(client.clientAddr()) == raddr {
+			moved[key.(string)] = client
+		}
+		return true
+	})
+	for cliAddr, client := range moved {
+		addr, _ := client.backend()
+		f.disconnectedFrom(cliAddr, addr, "pinned")
+		f.endClient(cliAddr, client, "pinned", nil)
+	}
+	return nil
+}
+
+// Unpin removes the pin of clientAddr, given as to Pin, so that the balancer
+// picks the destination when the client next connects. A connected client
+// keeps its destination. It returns ErrUnknownClient if clientAddr is not
+// pinned.
+func (f *Forwarder) Unpin(clientAddr string) error {
+	key, err := pinKey(clientAddr)
+	if err != nil {
+		return err
+	}
+
+	f.pinsMu.Lock()
+	defer f.pinsMu.Unlock()
+
+	if _, ok := f.pins[key]; !ok {
+		return ErrUnknownClient
+	}
+	delete(f.pins, key)
+	return nil
+}
+
+// pinned returns the address of the destination the client at addr is pinned
+// to, or nil if it is not.
+func (f *Forwarder) pinned(addr *net.UDPAddr) *net.UDPAddr {
+	f.pinsMu.Lock()
+	defer f.pinsMu.Unlock()
+
+	if raddr, ok := f.pins[addr.String()]; ok {
+		return raddr
+	}
+	return f.pins[addr.IP.String()]
+}
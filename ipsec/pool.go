@@ -0,0 +1,271 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	nonESPMarkerSize = 4
+	ikeHeaderSize    = 28
+)
+
+// pool is a fixed set of sockets to one destination shared by all of its
+// clients, for relays with many clients where a socket and reader goroutine
+// per client is too costly.
+//
+// Replies are told apart by their payload. IKE messages carry the initiator
+// SPI chosen by the client in both directions. The SPI of ESP packets sent
+// back by the destination is negotiated inside the encrypted IKE exchange,
+// so the first packet with an unknown SPI is handed to the client that has
+// been waiting longest since its last IKE_AUTH or CREATE_CHILD_SA exchange,
+// the ones creating SAs. This is reliable as long as clients do not finish
+// establishing tunnels at the same moment.
+type pool struct {
+	conns []*net.UDPConn
+
+	mu       sync.Mutex
+	ike      map[uint64]string // initiator SPI -> client
+	esp      map[uint32]string // destination ESP SPI -> client
+	awaiting []string
+}
+
+// pooledConn returns the shared socket of the pool to raddr that cliAddr is
+// assigned to, creating the pool if needed.
+func (f *Forwarder) pooledConn(raddr *net.UDPAddr, cliAddr string) (*pool, *net.UDPConn, error) {
+	f.poolsMu.Lock()
+	defer f.poolsMu.Unlock()
+
+	p, ok := f.pools[raddr.String()]
+	if !ok {
+		p = &pool{
+			ike: make(map[uint64]string),
+			esp: make(map[uint32]string),
+		}
+		for i := 0; i < f.pooledSize(); i++ {
+			conn, err := f.dial(raddr, nil)
+			if err != nil {
+				for _, conn := range p.conns {
+					f.closeSocket(conn)
+				}
+				return nil, nil, err
+			}
+			p.conns = append(p.conns, conn)
+		}
+		for _, conn := range p.conns {
+			f.wg.Add(1)
+			go f.servePool(p, conn)
+		}
+		f.pools[raddr.String()] = p
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(cliAddr))
+	return p, p.conns[h.Sum32()%uint32(len(p.conns))], nil
+}
+
+// track learns how to recognise replies to a packet sent by cliAddr.
+func (p *pool) track(cliAddr string, data []byte) {
+	if len(data) < nonESPMarkerSize+ikeHeaderSize || binary.BigEndian.Uint32(data) != 0 {
+		return
+	}
+	spi := binary.BigEndian.Uint64(data[nonESPMarkerSize:])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ike[spi] = cliAddr
+	// Only exchanges creating a child SA lead to ESP with a new SPI, not
+	// INFORMATIONAL ones such as dead peer detection of established clients.
+	h, ok := ParseIKE(data)
+	if !ok || (h.ExchangeType != ExchangeIKEAuth && h.ExchangeType != ExchangeCreateChildSA) {
+		return
+	}
+	for _, awaiting := range p.awaiting {
+		if awaiting == cliAddr {
+			return
+		}
+	}
+	p.awaiting = append(p.awaiting, cliAddr)
+}
+
+// lookup returns the client a packet from the destination belongs to.
+func (p *pool) lookup(data []byte) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(data) >= nonESPMarkerSize+ikeHeaderSize && binary.BigEndian.Uint32(data) == 0 {
+		cliAddr, ok := p.ike[binary.BigEndian.Uint64(data[nonESPMarkerSize:])]
+		return cliAddr, ok
+	}
+	if len(data) < espHeaderSize {
+		// NAT-T keepalives cannot be attributed to a client.
+		return "", false
+	}
+
+	spi := binary.BigEndian.Uint32(data)
+	cliAddr, ok := p.esp[spi]
+	if !ok && len(p.awaiting) > 0 {
+		cliAddr, ok = p.awaiting[0], true
+		p.awaiting = p.awaiting[1:]
+		p.esp[spi] = cliAddr
+	}
+	return cliAddr, ok
+}
+
+// forget drops everything learned about cliAddr.
+func (p *pool) forget(cliAddr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for spi, c := range p.ike {
+		if c == cliAddr {
+			delete(p.ike, spi)
+		}
+	}
+	for spi, c := range p.esp {
+		if c == cliAddr {
+			delete(p.esp, spi)
+		}
+	}
+	awaiting := p.awaiting[:0]
+	for _, c := range p.awaiting {
+		if c != cliAddr {
+			awaiting = append(awaiting, c)
+		}
+	}
+	p.awaiting = awaiting
+}
+
+// rename moves everything learned about the client at oldAddr to newAddr.
+func (p *pool) rename(oldAddr, newAddr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for spi, c := range p.ike {
+		if c == oldAddr {
+			p.ike[spi] = newAddr
+		}
+	}
+	for spi, c := range p.esp {
+		if c == oldAddr {
+			p.esp[spi] = newAddr
+		}
+	}
+	for i, c := range p.awaiting {
+		if c == oldAddr {
+			p.awaiting[i] = newAddr
+		}
+	}
+}
+
+// servePool forwards the replies read from a shared socket to their clients
+// until reading from it fails.
+func (f *Forwarder) servePool(p *pool, conn *net.UDPConn) {
+	defer f.wg.Done()
+	var msgs []message
+	if f.gro {
+		msgs = newGROMessages(1)
+	} else {
+		msgs = []message{{buf: make([]byte, f.readBufferSize())}}
+		if f.passingDSCP() {
+			msgs[0].oob = newOOB()
+		}
+	}
+	for {
+		_, err := readMessages(conn, msgs)
+		if err != nil && isTransient(err) {
+			continue
+		}
+		if err != nil {
+			if !f.isClosed() {
+				f.logger.Log(LevelError, "abnormal read from shared socket, closing", "err", err)
+			}
+			return
+		}
+		msg := msgs[0]
+		if msg.flags&msgTrunc != 0 {
+			f.dropTruncated(msg.addr)
+			continue
+		}
+		segments(msg.buf[:msg.n], msg.segment, func(reply []byte) {
+			if len(reply) > f.readBufferSize() {
+				f.dropTruncated(msg.addr)
+				return
+			}
+			f.impair(reply, func(reply []byte) {
+				f.replyPooled(p, conn, msg.addr, reply, msg.dscp)
+			})
+		})
+	}
+}
+
+// replyPooled sends a reply read from the shared socket conn on to its
+// client.
+func (f *Forwarder) replyPooled(p *pool, conn *net.UDPConn, from *net.UDPAddr, reply []byte, dscp int) {
+	cliAddr, ok := p.lookup(reply)
+	if !ok {
+		return
+	}
+	value, ok := f.clients.Load(cliAddr)
+	if !ok {
+		return
+	}
+	client := value.(*connection)
+	reply, ok = f.middleware(reply, PacketMeta{Client: client.clientAddr(), Destination: from})
+	if !ok {
+		return
+	}
+	f.diagnoseIKE(cliAddr, client, reply, false)
+	f.timeIKE(client, reply, false)
+	if f.refreshes(reply, false) {
+		client.setLastActive(time.Now())
+	}
+	addr := client.clientAddr()
+	if f.tooBig(len(reply), addr.IP) {
+		f.dropTooBig(from, conn.LocalAddr().(*net.UDPAddr), len(reply), addr.IP, f.pathMTU())
+		return
+	}
+
+	err := f.writeDSCP(f.listener(), reply, dscp, addr)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		f.dropTooBig(from, conn.LocalAddr().(*net.UDPAddr), len(reply), addr.IP, 0)
+	} else if err != nil {
+		atomic.AddInt64(&f.clientWriteFails, 1)
+		f.logError(LevelDebug, OpSendClient, cliAddr, err, "error sending packet to client", "client", cliAddr)
+	} else {
+		f.countToClient(client, len(reply))
+		f.tapPacket(from, addr, false, reply)
+	}
+}
+
+// closePools closes every shared socket.
+func (f *Forwarder) closePools() {
+	f.poolsMu.Lock()
+	defer f.poolsMu.Unlock()
+	for _, p := range f.pools {
+		for _, conn := range p.conns {
+			f.closeSocket(conn)
+		}
+	}
+}
+
+// SetPooledMode makes new clients share size sockets per destination instead
+// of each getting their own, so that sockets and reader goroutines grow with
+// the number of destinations rather than clients. Replies are matched to
+// clients by their IKE and ESP SPIs, see the pool type for the caveats. Zero,
+// the default, gives every client its own socket.
+func (f *Forwarder) SetPooledMode(size int) {
+	atomic.StoreInt32(&f.poolSize, int32(size))
+}
+
+// pooledSize returns the number of sockets set with SetPooledMode, zero if
+// clients get their own.
+func (f *Forwarder) pooledSize() int {
+	return int(atomic.LoadInt32(&f.poolSize))
+}
@@ -0,0 +1,41 @@
+package ipsec
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolCloseLogsNoReadError(t *testing.T) {
+	dst := echoServer(t)
+	var logged bytes.Buffer
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		PoolSize:     1,
+		Logger:       NewStdLogger(log.New(&logged, "", 0), LevelError),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(append([]byte{0, 0, 0, 0}, ikeSAInit(0x0102030405060708, nil)...))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Close waits for servePool, which reads from the shared socket closed
+	// beneath it; that is no abnormal read.
+	if strings.Contains(logged.String(), "shared socket") {
+		t.Errorf("logged after Close:\n%s", logged.String())
+	}
+}
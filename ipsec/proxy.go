@@ -0,0 +1,65 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// proxySignature is the fixed 12 byte preamble of a PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyVersionCommand = 0x21 // version 2, PROXY command
+	proxyFamilyUDP4     = 0x12 // AF_INET, SOCK_DGRAM
+	proxyFamilyUDP6     = 0x22 // AF_INET6, SOCK_DGRAM
+)
+
+// proxyHeader builds a PROXY protocol v2 header announcing that the datagram
+// originally travelled from src to dst.
+func proxyHeader(src, dst *net.UDPAddr) []byte {
+	family := byte(proxyFamilyUDP4)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family = proxyFamilyUDP6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	addrLen := 2*len(srcIP) + 4
+	header := make([]byte, 0, len(proxySignature)+4+addrLen)
+	header = append(header, proxySignature...)
+	header = append(header, proxyVersionCommand, family)
+	header = append(header, byte(addrLen>>8), byte(addrLen))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	return append(header, ports[:]...)
+}
+
+// SetProxyProtocol enables or disables prepending a PROXY protocol v2 header,
+// carrying the original client address, to the first datagram of every new
+// client session sent to the destination. Only enable this when the
+// destination understands PROXY protocol v2.
+func (f *Forwarder) SetProxyProtocol(enabled bool) {
+	atomic.StoreInt32(&f.proxyProtocol, boolInt32(enabled))
+}
+
+// SetProxyProtocolEveryPacket controls whether the PROXY protocol v2 header is
+// prepended to every datagram sent to the destination instead of only the
+// first one of each session. It has no effect unless SetProxyProtocol is
+// enabled.
+func (f *Forwarder) SetProxyProtocolEveryPacket(every bool) {
+	atomic.StoreInt32(&f.proxyEveryPacket, boolInt32(every))
+}
+
+// proxying reports whether the PROXY protocol header is prepended to the
+// first packet of each session, and whether to every packet.
+func (f *Forwarder) proxying() (first, every bool) {
+	if atomic.LoadInt32(&f.proxyProtocol) == 0 {
+		return false, false
+	}
+	return true, atomic.LoadInt32(&f.proxyEveryPacket) != 0
+}
@@ -0,0 +1,83 @@
+package ipsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// parseProxyHeader decodes the PROXY protocol v2 header of an IPv4 datagram,
+// returning its source and destination and the payload following it.
+func parseProxyHeader(t *testing.T, data []byte) (src, dst *net.UDPAddr, payload []byte) {
+	t.Helper()
+	if len(data) < len(proxySignature)+4 || !bytes.Equal(data[:len(proxySignature)], proxySignature) {
+		t.Fatalf("datagram %x has no PROXY protocol v2 signature", data)
+	}
+	data = data[len(proxySignature):]
+	if data[0] != proxyVersionCommand || data[1] != proxyFamilyUDP4 {
+		t.Fatalf("header version and command %#x, family %#x, want %#x and UDP over IPv4", data[0], data[1], proxyVersionCommand)
+	}
+	n := int(binary.BigEndian.Uint16(data[2:]))
+	data = data[4:]
+	if n != 12 || len(data) < n {
+		t.Fatalf("address block of %d bytes, want 12", n)
+	}
+	src = &net.UDPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}
+	dst = &net.UDPAddr{IP: net.IP(data[4:8]), Port: int(binary.BigEndian.Uint16(data[10:]))}
+	return src, dst, data[n:]
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	f, err := New(Config{
+		Listen:        "127.0.0.1:0",
+		Destinations:  []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		ProxyProtocol: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	client, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	first := []byte{0, 0, 0, 1, 0, 0, 0, 1, 0xaa}
+	second := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0xbb}
+	client.Write(first)
+	client.Write(second)
+
+	buf := make([]byte, 2048)
+	dst.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := dst.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, to, payload := parseProxyHeader(t, buf[:n])
+	if want := client.LocalAddr().String(); src.String() != want {
+		t.Errorf("header source %s, want the client %s", src, want)
+	}
+	if want := f.LocalAddr().String(); to.String() != want {
+		t.Errorf("header destination %s, want the listener %s", to, want)
+	}
+	if !bytes.Equal(payload, first) {
+		t.Errorf("payload %x after the header, want %x", payload, first)
+	}
+
+	// Only the first datagram of the session carries the header.
+	n, _, err = dst.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], second) {
+		t.Errorf("second datagram %x, want %x without a header", buf[:n], second)
+	}
+}
@@ -0,0 +1,51 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketOrderPreserved(t *testing.T) {
+	const packets = DefaultQueueSize - 1
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(1 << 20)
+
+	for seq := uint32(1); seq <= packets; seq++ {
+		packet := make([]byte, espHeaderSize)
+		binary.BigEndian.PutUint32(packet, 0x1000)
+		binary.BigEndian.PutUint32(packet[4:], seq)
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every packet travels to the destination and back, so the replies
+	// are in order only if both directions keep it.
+	buf := make([]byte, 2048)
+	for want := uint32(1); want <= packets; want++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reply %d of %d: %v", want, packets, err)
+		}
+		if got := binary.BigEndian.Uint32(buf[4:n]); got != want {
+			t.Fatalf("reply %d has sequence number %d", want, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ipsec
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer returns a destination sending every datagram back to its sender
+// until the test ends.
+func echoServer(t testing.TB) *net.UDPConn {
+	t.Helper()
+	return echoServerAt(t, net.IPv4(127, 0, 0, 1))
+}
+
+// echoServerAt is like echoServer on the loopback address ip.
+func echoServerAt(t testing.TB, ip net.IP) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// TestSettersDuringTraffic changes the settings documented as changeable at
+// any time while clients send traffic and time out, for the race detector to
+// check them.
+func TestSettersDuringTraffic(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		Timeout:      20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	laddr := f.LocalAddr().(*net.UDPAddr)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			packet := []byte{0x12, 0x34, 0x56, byte(i), 0, 0, 0, 1, 0xaa, 0xbb}
+			buf := make([]byte, 2048)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// A new socket per round is a new client, and the
+				// pause lets the one before time out.
+				conn, err := net.DialUDP("udp", nil, laddr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for j := 0; j < 5; j++ {
+					conn.Write(packet)
+					conn.Write(natKeepalive)
+					conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+					conn.Read(buf)
+				}
+				conn.Close()
+				time.Sleep(30 * time.Millisecond)
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			on := i%2 == 0
+			f.SetProxyProtocol(on)
+			f.SetProxyProtocolEveryPacket(!on)
+			f.SetTrackIKESessions(on)
+			f.SetAnswerKeepalives(on)
+			f.SetDSCP(i % 64)
+			f.SetDSCPPassthrough(on)
+			f.SetBatchSize(i % 4)
+			f.SetPooledMode(i % 3)
+			f.SetMTU(1400 + i%100)
+			f.SetIKECookies(i % 2)
+			f.SetTimeout(time.Duration(10+i%20) * time.Millisecond)
+			f.SetExpiryResolution(time.Duration(i%3) * time.Millisecond)
+			f.SetWriteTimeout(time.Duration(i%2) * time.Second)
+			f.SetMaxClients(100 * (i % 2))
+			f.SetBufferSize(2048 + i%2048)
+			f.SetQueueSize(1 + i%256)
+			f.SetMaxReadErrors(i % 5)
+			f.SetBackendKeepalive(time.Duration(i%2) * time.Millisecond)
+			f.SetRateLimit(1e6*(i%2), 1000)
+			f.SetBandwidthLimit(1e9*(i%2), 0)
+			f.SetNewConnRate(1e6*float64(i%2), 1000)
+			f.SetNewConnRatePerSource(1e6*float64(i%2), 1000)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if f.Metrics().Disconnects == 0 {
+		t.Error("no client timed out")
+	}
+}
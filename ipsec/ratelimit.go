@@ -0,0 +1,193 @@
+package ipsec
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSourceLimiters bounds the number of sources whose new clients are rate
+// limited at once, and so the memory a flood from spoofed addresses can use.
+const maxSourceLimiters = 65536
+
+// tokenBucket is a simple token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow reports whether a token is available, consuming it if so.
+func (b *tokenBucket) allow() bool {
+	return b.allowN(1)
+}
+
+// allowN reports whether n tokens are available, consuming them if so. More
+// tokens than the burst are available once the bucket is full.
+func (b *tokenBucket) allowN(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < n && b.tokens < b.burst {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// full reports whether the bucket has refilled completely.
+func (b *tokenBucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.burst
+}
+
+// sourceLimiter limits the rate of new clients per source address.
+type sourceLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	sources map[string]*tokenBucket
+}
+
+// allow reports whether another client from ip may be created. IPv6 sources
+// are limited per /64, which a single host usually has to itself. Sources are
+// refused while maxSourceLimiters others are being limited.
+func (l *sourceLimiter) allow(ip net.IP) bool {
+	key := ip.String()
+	if ip.To4() == nil {
+		key = ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+
+	l.mu.Lock()
+	bucket, ok := l.sources[key]
+	if !ok {
+		if len(l.sources) >= maxSourceLimiters {
+			l.mu.Unlock()
+			return false
+		}
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.sources[key] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.allow()
+}
+
+// expire forgets the sources whose buckets have refilled, as they are no
+// different from new ones.
+func (l *sourceLimiter) expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.sources {
+		if bucket.full() {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// SetNewConnRate limits how many new clients may be created per second, with
+// bursts of up to burst clients. Packets from new clients over the limit are
+// dropped without dialing the destination; existing clients are unaffected.
+// A rate of zero or less removes the limit.
+func (f *Forwarder) SetNewConnRate(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		f.newConnLimiter.Store((*tokenBucket)(nil))
+		return
+	}
+	f.newConnLimiter.Store(newTokenBucket(perSecond, burst))
+}
+
+// newConnBucket returns the limiter set with SetNewConnRate, nil if there is
+// none.
+func (f *Forwarder) newConnBucket() *tokenBucket {
+	b, _ := f.newConnLimiter.Load().(*tokenBucket)
+	return b
+}
+
+// SetNewConnRatePerSource is like SetNewConnRate but limits the new clients
+// of each source IP address, or IPv6 /64, separately, so that a single host
+// cycling through source ports cannot use up the overall limit or the
+// maximum number of clients. Packets over the limit are dropped before a
+// socket is opened to the destination. A rate of zero or less removes the
+// limit.
+func (f *Forwarder) SetNewConnRatePerSource(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		f.sourceLimiter.Store((*sourceLimiter)(nil))
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	f.sourceLimiter.Store(&sourceLimiter{
+		rate:    perSecond,
+		burst:   burst,
+		sources: make(map[string]*tokenBucket),
+	})
+}
+
+// perSourceLimiter returns the limiter set with SetNewConnRatePerSource, nil
+// if there is none.
+func (f *Forwarder) perSourceLimiter() *sourceLimiter {
+	l, _ := f.sourceLimiter.Load().(*sourceLimiter)
+	return l
+}
+
+// clientLimit is a rate limit of each client, see SetRateLimit and
+// SetBandwidthLimit.
+type clientLimit struct {
+	rate  int
+	burst int
+}
+
+// clientBucket returns a limiter of a new client for the limit stored in v,
+// nil if there is none.
+func (f *Forwarder) clientBucket(v *atomic.Value) *tokenBucket {
+	limit, _ := v.Load().(clientLimit)
+	if limit.rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(float64(limit.rate), limit.burst)
+}
+
+// SetRateLimit limits each client to packetsPerSec packets per second towards
+// the destination, with bursts of up to burst packets. Packets over the limit
+// are dropped and counted. The limit applies to clients connecting after it
+// is set; zero, the default, means no limit.
+func (f *Forwarder) SetRateLimit(packetsPerSec int, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	f.rateLimit.Store(clientLimit{rate: packetsPerSec, burst: burst})
+}
+
+// SetBandwidthLimit limits each client to bytesPerSec bytes per second towards
+// the destination, with bursts of up to burst bytes, or one second's worth if
+// burst is zero. Packets over the limit are dropped and counted as rate
+// limited. The limit applies to clients connecting after it is set; zero, the
+// default, means no limit.
+func (f *Forwarder) SetBandwidthLimit(bytesPerSec int, burst int) {
+	if burst < 1 {
+		burst = bytesPerSec
+	}
+	f.bandwidthLimit.Store(clientLimit{rate: bytesPerSec, burst: burst})
+}
@@ -0,0 +1,108 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRate(t *testing.T) {
+	const (
+		rate  = 200
+		burst = 10
+		run   = 500 * time.Millisecond
+	)
+	b := newTokenBucket(rate, burst)
+	allowed := 0
+	start := time.Now()
+	for time.Since(start) < run {
+		if b.allow() {
+			allowed++
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	want := burst + int(rate*time.Since(start).Seconds())
+	if allowed < want*8/10 || allowed > want*12/10 {
+		t.Errorf("%d allowed in %v at %d per second with bursts of %d, want about %d", allowed, run, rate, burst, want)
+	}
+}
+
+func TestNewConnRate(t *testing.T) {
+	dst := echoServer(t)
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		NewConnRate:  1,
+		NewConnBurst: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1})
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := len(f.Connected()); got != 2 {
+		t.Errorf("%d clients connected, want the burst of 2", got)
+	}
+	if got := f.Stats().NewConnsLimited; got != 3 {
+		t.Errorf("%d new clients limited, want 3", got)
+	}
+}
+
+func TestRateLimitDropsExcessPackets(t *testing.T) {
+	const (
+		packets = 50
+		burst   = 5
+	)
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		RateLimit:    1,
+		RateBurst:    burst,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < packets; i++ {
+		conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, byte(i)})
+	}
+	received := 0
+	buf := make([]byte, 2048)
+	for {
+		dst.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, _, err := dst.ReadFromUDP(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received < burst || received > burst+1 {
+		t.Errorf("%d packets forwarded, want the burst of %d", received, burst)
+	}
+	if got := f.DropStats()[DropRateLimited]; got != int64(packets-received) {
+		t.Errorf("%d packets dropped as rate limited, want %d", got, packets-received)
+	}
+	stats := f.ClientStats()
+	if len(stats) != 1 || stats[0].RateLimited != int64(packets-received) {
+		t.Errorf("client stats %+v, want %d packets rate limited", stats, packets-received)
+	}
+}
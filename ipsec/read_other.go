@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package ipsec
+
+import (
+	"net"
+	"syscall"
+)
+
+// msgTrunc is the flag of datagrams that did not fit in the buffer.
+const msgTrunc = syscall.MSG_TRUNC
+
+// readMsg reads a datagram from conn, see net.UDPConn.ReadMsgUDP.
+func readMsg(conn *net.UDPConn, b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	return conn.ReadMsgUDP(b, oob)
+}
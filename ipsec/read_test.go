@@ -0,0 +1,61 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// readErrors returns the number of errors reading from the listeners.
+func readErrors(f *Forwarder) int64 {
+	var n int64
+	for _, stat := range f.ErrorStats() {
+		if stat.Op == OpRead {
+			n += stat.Count
+		}
+	}
+	return n
+}
+
+func TestTransientReadErrorRetried(t *testing.T) {
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A read deadline in the past fails reads with a timeout, which clears
+	// up once the deadline is lifted.
+	f.listener().SetReadDeadline(time.Now())
+	deadline := time.Now().Add(2 * time.Second)
+	for readErrors(f) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no read error")
+		}
+		time.Sleep(readBackoff)
+	}
+	f.listener().SetReadDeadline(time.Time{})
+
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1})
+	if !received(dst, 2*time.Second) {
+		t.Fatal("packet not forwarded after the transient read error")
+	}
+	select {
+	case err := <-f.Err():
+		t.Errorf("forwarder gave up on its listener: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,24 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// msgTrunc is the flag of datagrams that did not fit in the buffer.
+const msgTrunc = 0x100
+
+// wsaEMSGSIZE is the error reading a datagram larger than the buffer.
+const wsaEMSGSIZE = syscall.Errno(10040)
+
+// readMsg reads a datagram from conn, see net.UDPConn.ReadMsgUDP. Windows
+// fails reads of datagrams larger than the buffer, these are reported with
+// msgTrunc like elsewhere, without the address of the sender.
+func readMsg(conn *net.UDPConn, b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, addr, err = conn.ReadMsgUDP(b, oob)
+	if errors.Is(err, wsaEMSGSIZE) {
+		return n, 0, flags | msgTrunc, addr, nil
+	}
+	return n, oobn, flags, addr, err
+}
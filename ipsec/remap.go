@@ -0,0 +1,107 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons of a Remap, besides those clients are disconnected for before they
+// reconnect to another destination, "failover", "drained" and "pinned".
+const (
+	RemapMigrated      = "migrated"       // the client's address changed, see SetTrackIKESessions
+	RemapDialFailed    = "dial failed"    // see SetDialFallback
+	RemapAddressFamily = "address family" // see SetHappyEyeballs
+)
+
+// Remap describes a client moved to another destination or address.
+type Remap struct {
+	OldClient      string `json:"old_client"` // differs from Client if the address changed
+	Client         string `json:"client"`
+	OldDestination string `json:"old_destination"` // differs from Destination if the destination changed
+	Destination    string `json:"destination"`
+	Reason         string `json:"reason"`
+}
+
+// OnRemap can be called with a callback function to be called whenever the
+// mapping of a client to its destination changes: when a client is
+// recognised at a new address, is moved to another destination or address
+// family while connecting, or reconnects to another destination after it was
+// disconnected from its own by a failover, drain or pin, so that monitoring
+// tools can follow the topology. It has no effect on a closed forwarder.
+func (f *Forwarder) OnRemap(callback func(remap Remap)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.remap = callback
+	f.callbackMu.Unlock()
+}
+
+// remapped reports that client, at cliAddr, was moved.
+func (f *Forwarder) remapped(client *connection, remap Remap) {
+	atomic.AddInt64(&client.remaps, 1)
+	f.callback().remap(remap)
+	f.emit(Event{
+		Type:           EventRemap,
+		Client:         remap.Client,
+		OldClient:      remap.OldClient,
+		Destination:    remap.Destination,
+		OldDestination: remap.OldDestination,
+	})
+}
+
+// movedClient is the destination a client was disconnected from by reason,
+// until it reconnects to another.
+type movedClient struct {
+	destination string
+	reason      string
+	at          time.Time
+}
+
+// disconnectedFrom records that the client at cliAddr was disconnected from
+// raddr for reason, so that it is reported remapped once it reconnects to
+// another destination.
+func (f *Forwarder) disconnectedFrom(cliAddr string, raddr *net.UDPAddr, reason string) {
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	if f.moved == nil {
+		f.moved = make(map[string]movedClient)
+	}
+	f.moved[cliAddr] = movedClient{destination: raddr.String(), reason: reason, at: time.Now()}
+}
+
+// reconnected reports the client at cliAddr remapped if it connected to
+// another destination than the one it was disconnected from.
+func (f *Forwarder) reconnected(cliAddr string, client *connection) {
+	f.movedMu.Lock()
+	moved, ok := f.moved[cliAddr]
+	delete(f.moved, cliAddr)
+	f.movedMu.Unlock()
+	if !ok {
+		return
+	}
+	raddr, _ := client.backend()
+	if destination := raddr.String(); destination != moved.destination {
+		f.remapped(client, Remap{
+			OldClient:      cliAddr,
+			Client:         cliAddr,
+			OldDestination: moved.destination,
+			Destination:    destination,
+			Reason:         moved.reason,
+		})
+	}
+}
+
+// expireMoved forgets the clients disconnected longer than the timeout ago,
+// which are not expected back.
+func (f *Forwarder) expireMoved() {
+	deadline := time.Now().Add(-f.Timeout())
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	for cliAddr, moved := range f.moved {
+		if moved.at.Before(deadline) {
+			delete(f.moved, cliAddr)
+		}
+	}
+}
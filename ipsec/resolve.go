@@ -0,0 +1,87 @@
+package ipsec
+
+import (
+	"net"
+	"time"
+)
+
+// resolver periodically re-resolves the destinations so that new clients
+// follow changes to their DNS records. Existing clients keep their address.
+func (f *Forwarder) resolver() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.resolveInterval):
+		}
+
+		f.dstMu.Lock()
+		dsts := append([]*destination(nil), f.dsts...)
+		f.dstMu.Unlock()
+
+		for _, dst := range dsts {
+			f.dstMu.Lock()
+			current := dst.raddr
+			f.dstMu.Unlock()
+
+			raddr, err := f.resolve(dst.addr, current)
+			if err != nil {
+				f.logger.Log(LevelWarn, "failed to resolve destination", "destination", dst.addr, "err", err)
+				continue
+			}
+
+			f.dstMu.Lock()
+			if !raddr.IP.Equal(dst.raddr.IP) || raddr.Port != dst.raddr.Port {
+				f.logger.Log(LevelInfo, "destination now resolves to a new address", "destination", dst.addr, "addr", raddr)
+				dst.raddr = raddr
+			}
+			f.dstMu.Unlock()
+
+			alt := f.alternate(dst.addr, raddr)
+			f.dstMu.Lock()
+			dst.alt = alt
+			f.dstMu.Unlock()
+		}
+	}
+}
+
+// resolve returns the address to forward new clients of the destination addr
+// to. The current address is kept as long as the name still resolves to it,
+// so that names with several addresses returned in varying order do not
+// move new clients back and forth.
+func (f *Forwarder) resolve(addr string, current *net.UDPAddr) (*net.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return current, nil
+	}
+
+	ips, err := f.lookupIPAddr(f.ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.IP.Equal(current.IP) {
+			return current, nil
+		}
+	}
+	return f.resolveUDPAddr("udp", addr)
+}
+
+// SetResolveInterval makes the forwarder re-resolve the destinations every
+// interval, so that new clients are forwarded to their current addresses when
+// destinations are given as hostnames. The first call with a positive
+// interval starts re-resolving; it cannot be stopped short of Close.
+func (f *Forwarder) SetResolveInterval(interval time.Duration) {
+	if interval <= 0 || f.isClosed() {
+		return
+	}
+	f.resolveInterval = interval
+	f.resolveOnce.Do(func() {
+		f.wg.Add(1)
+		go f.resolver()
+	})
+}
@@ -0,0 +1,90 @@
+package ipsec
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// received reports whether conn receives a datagram within timeout.
+func received(conn *net.UDPConn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, _, err := conn.ReadFromUDP(make([]byte, 2048))
+	return err == nil
+}
+
+func TestResolveFollowsNewAddress(t *testing.T) {
+	oldDst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldDst.Close()
+	newDst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	defer newDst.Close()
+
+	port := oldDst.LocalAddr().(*net.UDPAddr).Port
+	name := net.JoinHostPort("localhost", strconv.Itoa(port))
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: name, Weight: 1}},
+		Timeout:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	laddr := f.LocalAddr().(*net.UDPAddr)
+	packet := []byte{0, 0, 0, 1, 0, 0, 0, 1}
+
+	before, err := net.DialUDP("udp", nil, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	before.Write(packet)
+	if !received(oldDst, 2*time.Second) {
+		t.Fatal("client not forwarded to the address the name resolved to")
+	}
+
+	// The name now resolves to the new destination.
+	f.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: newDst.LocalAddr().(*net.UDPAddr).IP}}, nil
+	}
+	f.resolveUDPAddr = func(network, address string) (*net.UDPAddr, error) {
+		if address == name {
+			return newDst.LocalAddr().(*net.UDPAddr), nil
+		}
+		return net.ResolveUDPAddr(network, address)
+	}
+	f.SetResolveInterval(10 * time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		after, err := net.DialUDP("udp", nil, laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after.Write(packet)
+		moved := received(newDst, 50*time.Millisecond)
+		after.Close()
+		if moved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new client not forwarded to the new address")
+		}
+	}
+	// Drain the packets of clients forwarded before the change was seen.
+	for received(oldDst, 10*time.Millisecond) {
+	}
+
+	before.Write(packet)
+	if !received(oldDst, 2*time.Second) {
+		t.Error("existing client moved to the new address")
+	}
+}
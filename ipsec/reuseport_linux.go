@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define on
+// every architecture.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on a socket.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
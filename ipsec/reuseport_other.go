@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import "syscall"
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return unsupportedError("ipsec: multiple listeners are only supported on Linux")
+}
@@ -0,0 +1,235 @@
+package ipsec
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRTTInterval is how often destinations are probed by default, see
+// SetRTTMeasurement.
+const DefaultRTTInterval = 10 * time.Second
+
+// rttEstimator smooths the round trip times measured to a destination like
+// TCP does, and their jitter like RTP does (RFC 3550).
+type rttEstimator struct {
+	mu      sync.Mutex
+	srtt    time.Duration
+	jitter  time.Duration
+	last    time.Duration // the last sample, for the jitter
+	samples int64
+	at      time.Time // of the last sample
+}
+
+// add records a round trip time measured.
+func (e *rttEstimator) add(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+	} else {
+		e.srtt += (rtt - e.srtt) / 8
+		d := rtt - e.last
+		if d < 0 {
+			d = -d
+		}
+		e.jitter += (d - e.jitter) / 16
+	}
+	e.last = rtt
+	e.samples++
+	e.at = time.Now()
+}
+
+// get returns the smoothed round trip time and jitter, zero if nothing was
+// measured.
+func (e *rttEstimator) get() (rtt, jitter time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt, e.jitter
+}
+
+// DestinationRTT is the round trip time and jitter measured to a
+// destination, see SetRTTMeasurement. Durations are in nanoseconds in JSON.
+type DestinationRTT struct {
+	Addr     string        `json:"addr"`
+	RTT      time.Duration `json:"rtt"`    // smoothed round trip time
+	Jitter   time.Duration `json:"jitter"` // mean deviation between samples
+	Samples  int64         `json:"samples"`
+	Measured *time.Time    `json:"measured,omitempty"` // when last sampled, nil if never
+}
+
+// ikeTimer times the INFORMATIONAL requests of a client until its
+// destination answers them, see SetRTTMeasurement.
+type ikeTimer struct {
+	mu      sync.Mutex
+	request IKEHeader
+	sent    time.Time // zero unless a request is outstanding
+	resent  bool
+}
+
+// start records that the request h was sent. A retransmission is not timed,
+// as the response cannot be told apart from that to the original.
+func (t *ikeTimer) start(h IKEHeader) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.sent.IsZero() && t.request.InitiatorSPI == h.InitiatorSPI && t.request.MessageID == h.MessageID {
+		t.resent = true
+		return
+	}
+	t.request, t.sent, t.resent = h, time.Now(), false
+}
+
+// stop returns the round trip time of the request answered by the response
+// h, or false if it does not answer the outstanding request.
+func (t *ikeTimer) stop(h IKEHeader) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent.IsZero() || t.request.InitiatorSPI != h.InitiatorSPI || t.request.MessageID != h.MessageID {
+		return 0, false
+	}
+	rtt, resent := time.Since(t.sent), t.resent
+	t.sent = time.Time{}
+	return rtt, !resent
+}
+
+// SetRTTMeasurement makes the forwarder measure the round trip time and
+// jitter to each destination, reported by RTT and in DestinationStats, and
+// used by RTTSteering. The time the destination takes to answer the
+// INFORMATIONAL requests of clients, such as IKEv2 liveness checks, is
+// measured from the traffic passing through, and every interval each
+// destination is probed with probe as well. A nil probe sends an ICMP echo
+// request, which needs the privilege to open raw sockets (CAP_NET_RAW on
+// Linux); without it only the traffic is measured. The first call with a
+// positive interval starts measuring; it cannot be stopped short of Close.
+func (f *Forwarder) SetRTTMeasurement(interval time.Duration, probe func(ip net.IP) (time.Duration, error)) {
+	if interval <= 0 || f.isClosed() {
+		return
+	}
+	if probe == nil {
+		probe = func(ip net.IP) (time.Duration, error) {
+			return ping(ip, maxProbeTimeout)
+		}
+	}
+	f.rttInterval = interval
+	f.rttProbe = probe
+	f.rttOnce.Do(func() {
+		atomic.StoreInt32(&f.measureRTT, 1)
+		f.wg.Add(1)
+		go f.rttProber()
+	})
+}
+
+// rttProber probes the destinations every RTT interval until the probe
+// turns out not to be permitted.
+func (f *Forwarder) rttProber() {
+	defer f.wg.Done()
+	for {
+		f.dstMu.Lock()
+		dsts := append([]*destination(nil), f.dsts...)
+		f.dstMu.Unlock()
+
+		byIP := make(map[string][]*destination)
+		for _, dst := range dsts {
+			ip := dst.raddr.IP.String()
+			byIP[ip] = append(byIP[ip], dst)
+		}
+		var wg sync.WaitGroup
+		var denied int32
+		for _, dsts := range byIP {
+			wg.Add(1)
+			go func(dsts []*destination) {
+				defer wg.Done()
+				rtt, err := f.rttProbe(dsts[0].raddr.IP)
+				if err != nil {
+					if errors.Is(err, os.ErrPermission) {
+						atomic.StoreInt32(&denied, 1)
+					}
+					f.logger.Log(LevelDebug, "rtt probe failed", "destination", dsts[0].raddr.IP, "err", err)
+					return
+				}
+				for _, dst := range dsts {
+					dst.rtt.add(rtt)
+				}
+			}(dsts)
+		}
+		wg.Wait()
+		if atomic.LoadInt32(&denied) != 0 {
+			f.logger.Log(LevelWarn, "not permitted to probe destinations, measuring their round trip time from traffic only")
+			return
+		}
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.rttInterval):
+		}
+	}
+}
+
+// timeIKE times the INFORMATIONAL requests of client answered by its
+// destination, data being a packet sent by the client if fromClient is set
+// and by the destination otherwise, if RTT measurement is enabled.
+func (f *Forwarder) timeIKE(client *connection, data []byte, fromClient bool) {
+	if atomic.LoadInt32(&f.measureRTT) == 0 {
+		return
+	}
+	h, ok := ParseIKE(data)
+	if !ok || h.ExchangeType != ExchangeInformational || fromClient == h.Response() {
+		// Only requests of the client and their responses are timed.
+		return
+	}
+	if fromClient {
+		client.ikeTimer.start(h)
+		return
+	}
+	if rtt, ok := client.ikeTimer.stop(h); ok {
+		if _, dst := client.backend(); dst != nil {
+			dst.rtt.add(rtt)
+		}
+	}
+}
+
+// RTT returns the round trip time and jitter measured to each destination,
+// see SetRTTMeasurement.
+func (f *Forwarder) RTT() []DestinationRTT {
+	f.dstMu.Lock()
+	dsts := append([]*destination(nil), f.dsts...)
+	f.dstMu.Unlock()
+
+	rtts := make([]DestinationRTT, len(dsts))
+	for i, dst := range dsts {
+		dst.rtt.mu.Lock()
+		rtts[i] = DestinationRTT{
+			Addr:    dst.raddr.String(),
+			RTT:     dst.rtt.srtt,
+			Jitter:  dst.rtt.jitter,
+			Samples: dst.rtt.samples,
+		}
+		if dst.rtt.samples > 0 {
+			at := dst.rtt.at
+			rtts[i].Measured = &at
+		}
+		dst.rtt.mu.Unlock()
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i].Addr < rtts[j].Addr })
+	return rtts
+}
+
+// RTTSteering steers clients to the destination with the lowest round trip
+// time plus jitter measured by the forwarder, see SetRTTMeasurement, so that
+// new clients avoid degraded gateways. Destinations not measured yet count as
+// the nearest, so that they receive clients and are measured from their
+// traffic even where they cannot be probed.
+type RTTSteering struct{}
+
+// Measure does nothing, the forwarder measures the destinations itself.
+func (RTTSteering) Measure(dsts []*net.UDPAddr) {}
+
+// Distance returns the round trip time plus jitter to dst in seconds.
+func (RTTSteering) Distance(addr *net.UDPAddr, dst DestinationStats) float64 {
+	return (dst.RTT + dst.Jitter).Seconds()
+}
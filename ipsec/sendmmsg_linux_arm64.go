@@ -0,0 +1,8 @@
+//go:build linux && arm64
+// +build linux,arm64
+
+package ipsec
+
+// sysSendmmsg is the number of the sendmmsg system call, which the syscall
+// package does not define on every architecture.
+const sysSendmmsg = 269
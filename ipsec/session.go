@@ -0,0 +1,229 @@
+package ipsec
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ClientStat describes a connected client and its traffic.
+type ClientStat struct {
+	Addr            string    `json:"addr"`
+	Listener        string    `json:"listener"`             // address the client sends to
+	LocalAddr       string    `json:"local_addr,omitempty"` // address the destination is sent from, once dialed
+	Destination     string    `json:"destination"`
+	Backend         string    `json:"backend,omitempty"` // the destination as configured, possibly a hostname
+	Remaps          int64     `json:"remaps"`            // times the client was moved, see OnRemap
+	Start           time.Time `json:"start"`
+	LastActive      time.Time `json:"last_active"`
+	PacketsToServer int64     `json:"packets_to_server"`
+	BytesToServer   int64     `json:"bytes_to_server"`
+	PacketsToClient int64     `json:"packets_to_client"`
+	BytesToClient   int64     `json:"bytes_to_client"`
+	RateLimited     int64     `json:"rate_limited"` // packets dropped by the rate limits
+
+	// Timeout is the inactivity after which the client is disconnected,
+	// in nanoseconds in JSON.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// ClientFilter selects clients among ClientStats. Zero fields match every
+// client.
+type ClientFilter struct {
+	Network     *net.IPNet    // containing the address of the client
+	Destination string        // the destination, as its address or as configured
+	IdleFor     time.Duration // the least time since the client was last active
+}
+
+// Match reports whether the client described by stat is selected.
+func (filter ClientFilter) Match(stat ClientStat) bool {
+	if filter.Network != nil {
+		addr, err := net.ResolveUDPAddr("udp", stat.Addr)
+		if err != nil || !filter.Network.Contains(addr.IP) {
+			return false
+		}
+	}
+	if filter.Destination != "" && filter.Destination != stat.Destination && filter.Destination != stat.Backend {
+		return false
+	}
+	if filter.IdleFor > 0 && time.Since(stat.LastActive) < filter.IdleFor {
+		return false
+	}
+	return true
+}
+
+// FilterClients returns the clients among stats that filter selects.
+func FilterClients(stats []ClientStat, filter ClientFilter) []ClientStat {
+	var results []ClientStat
+	for _, stat := range stats {
+		if filter.Match(stat) {
+			results = append(results, stat)
+		}
+	}
+	return results
+}
+
+// ClientInfo describes a connected client.
+//
+// Deprecated: Use ClientStat.
+type ClientInfo = ClientStat
+
+// ClientStats returns the statistics of every connected client, ordered by
+// address. It returns nil once the forwarder is closed.
+func (f *Forwarder) ClientStats() []ClientStat {
+	if f.isClosed() {
+		return nil
+	}
+	var results []ClientStat
+	listener := f.LocalAddr().String()
+	f.clients.Range(func(key, value interface{}) bool {
+		client := value.(*connection)
+		raddr, dst := client.backend()
+		var backend string
+		if dst != nil {
+			backend = dst.addr
+		}
+		var localAddr string
+		if addr := client.localAddr(); addr != nil {
+			localAddr = addr.String()
+		}
+		results = append(results, ClientStat{
+			Addr:            key.(string),
+			Listener:        listener,
+			LocalAddr:       localAddr,
+			Destination:     raddr.String(),
+			Backend:         backend,
+			Remaps:          atomic.LoadInt64(&client.remaps),
+			Start:           client.started,
+			LastActive:      client.lastActiveTime(),
+			PacketsToServer: atomic.LoadInt64(&client.packetsToServer),
+			BytesToServer:   atomic.LoadInt64(&client.bytesToServer),
+			PacketsToClient: atomic.LoadInt64(&client.packetsToClient),
+			BytesToClient:   atomic.LoadInt64(&client.bytesToClient),
+			RateLimited:     atomic.LoadInt64(&client.rateLimited),
+			Timeout:         f.clientTimeout(key.(string), client),
+		})
+		return true
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Addr < results[j].Addr
+	})
+	return results
+}
+
+// ConnectedDetailed returns a description of every connected client. It
+// returns nil once the forwarder is closed.
+//
+// Deprecated: Use ClientStats.
+func (f *Forwarder) ConnectedDetailed() []ClientInfo {
+	return f.ClientStats()
+}
+
+// SessionEvent describes a client session that has ended.
+type SessionEvent struct {
+	Client        string
+	Destination   string
+	Start         time.Time
+	Duration      time.Duration
+	BytesToServer int64
+	BytesToClient int64
+}
+
+// endSession reports that the session of the client at cliAddr has ended for
+// reason.
+func (f *Forwarder) endSession(cliAddr string, client *connection, reason string) {
+	atomic.AddInt64(&f.disconnects, 1)
+	client.traceAttributes(
+		Attribute{AttrBytesIn, atomic.LoadInt64(&client.bytesToServer)},
+		Attribute{AttrBytesOut, atomic.LoadInt64(&client.bytesToClient)})
+	client.endTrace(reason, nil)
+	f.announce("disconnect", cliAddr, client, reason)
+	f.accountStop(cliAddr, client, reason)
+	f.logTimeline(cliAddr, client)
+	f.callback().disconnect(cliAddr)
+	raddr, _ := client.backend()
+	f.emit(Event{Type: EventDisconnect, Client: cliAddr, Destination: raddr.String()})
+	f.callback().sessionEnd(SessionEvent{
+		Client:        cliAddr,
+		Destination:   raddr.String(),
+		Start:         client.started,
+		Duration:      time.Since(client.started),
+		BytesToServer: atomic.LoadInt64(&client.bytesToServer),
+		BytesToClient: atomic.LoadInt64(&client.bytesToClient),
+	})
+}
+
+// OnSessionEnd can be called with a callback function to be called with a
+// summary of each client session when the client disconnects. It has no
+// effect on a closed forwarder.
+func (f *Forwarder) OnSessionEnd(callback func(event SessionEvent)) {
+	if f.isClosed() {
+		return
+	}
+	f.callbackMu.Lock()
+	f.callbacks.sessionEnd = callback
+	f.callbackMu.Unlock()
+}
+
+// SessionRecord describes the mapping of a client to its destination, for
+// handing sessions over to another Forwarder.
+type SessionRecord struct {
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	LastActive  time.Time `json:"last_active"`
+}
+
+// ExportSessions returns a record of every client currently known to the
+// forwarder.
+func (f *Forwarder) ExportSessions() []SessionRecord {
+	var records []SessionRecord
+	f.clients.Range(func(key, value interface{}) bool {
+		client := value.(*connection)
+		raddr, _ := client.backend()
+		records = append(records, SessionRecord{
+			Client:      key.(string),
+			Destination: raddr.String(),
+			LastActive:  client.lastActiveTime(),
+		})
+		return true
+	})
+	return records
+}
+
+// ImportSessions adds the clients described by records, as exported by
+// another forwarder, so that their traffic keeps going to the same
+// destinations. The destination is only dialed once a packet from the client
+// arrives. Clients that are already connected are left untouched, while
+// clients imported earlier that have not sent anything yet take the later
+// LastActive, so that they do not time out as long as they are active
+// elsewhere.
+func (f *Forwarder) ImportSessions(records []SessionRecord) error {
+	if f.isClosed() {
+		return ErrClosed
+	}
+	for _, record := range records {
+		raddr, err := f.resolveUDPAddr("udp", record.Destination)
+		if err != nil {
+			return err
+		}
+		client := f.newConnection(raddr, f.lookupDestination(raddr))
+		client.setLastActive(record.LastActive)
+		f.clientsMu.Lock()
+		value, loaded := f.clients.LoadOrStore(record.Client, client)
+		f.clientsMu.Unlock()
+		if !loaded {
+			atomic.AddInt64(&f.clientCount, 1)
+			if client.dst != nil {
+				atomic.AddInt64(&client.dst.clients, 1)
+			}
+			f.scheduleExpiry(record.Client, client)
+			continue
+		}
+		known := value.(*connection)
+		if atomic.LoadInt32(&known.dialing) == 0 && known.lastActiveTime().Before(record.LastActive) {
+			known.setLastActive(record.LastActive)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExportImportSessions(t *testing.T) {
+	var dsts []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+		dsts = append(dsts, dst)
+	}
+	weighted := func(order ...int) []WeightedDest {
+		var ws []WeightedDest
+		for _, i := range order {
+			ws = append(ws, WeightedDest{Addr: dsts[i].LocalAddr().String(), Weight: 1})
+		}
+		return ws
+	}
+
+	from, err := New(Config{Listen: "127.0.0.1:0", Destinations: weighted(0, 1), Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	packet := []byte{0, 0, 0, 1, 0, 0, 0, 1}
+	var clients []*net.UDPConn
+	for i := range dsts {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+		conn.WriteToUDP(packet, from.LocalAddr().(*net.UDPAddr))
+		if !received(dsts[i], 2*time.Second) {
+			t.Fatalf("client %d not forwarded to destination %d", i, i)
+		}
+	}
+
+	records := from.ExportSessions()
+	if len(records) != len(clients) {
+		t.Fatalf("%d sessions exported, want %d", len(records), len(clients))
+	}
+	// A new client of the forwarder importing the sessions would go to the
+	// destinations the other way round.
+	to, err := New(Config{Listen: "127.0.0.1:0", Destinations: weighted(1, 0), Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	if err := to.ImportSessions(records); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(to.Connected()); got != len(clients) {
+		t.Errorf("%d clients imported, want %d", got, len(clients))
+	}
+
+	for i, conn := range clients {
+		conn.WriteToUDP(packet, to.LocalAddr().(*net.UDPAddr))
+		if !received(dsts[i], 2*time.Second) {
+			t.Errorf("imported client %d not forwarded to its destination %d", i, i)
+		}
+	}
+	for i, dst := range dsts {
+		if received(dst, 50*time.Millisecond) {
+			t.Errorf("destination %d received a packet of another client", i)
+		}
+	}
+}
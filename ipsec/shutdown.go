@@ -0,0 +1,53 @@
+package ipsec
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often Shutdown checks whether clients remain.
+const drainPollInterval = 100 * time.Millisecond
+
+// Shutdown stops accepting new clients and waits for the existing ones to
+// time out before closing the forwarder. If ctx expires first, the
+// remaining clients are dropped and ctx's error is returned. Shutting down an
+// already closed forwarder returns ErrClosed.
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	if f.isClosed() {
+		return ErrClosed
+	}
+	atomic.StoreInt32(&f.draining, 1)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&f.clientCount) > 0 {
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return ctx.Err()
+		case <-f.done:
+			return ErrClosed
+		case <-ticker.C:
+		}
+	}
+	return f.Close()
+}
+
+// isDraining reports whether Shutdown has been called.
+func (f *Forwarder) isDraining() bool {
+	return atomic.LoadInt32(&f.draining) != 0
+}
+
+// Shutdown shuts both forwarders down, as Forwarder.Shutdown does.
+func (p *Pair) Shutdown(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.IKE.Shutdown(ctx)
+	}()
+	err := p.NATT.Shutdown(ctx)
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	return err
+}
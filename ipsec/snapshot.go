@@ -0,0 +1,170 @@
+package ipsec
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotVersion is the version of the format of Snapshot. It is increased
+// when fields are removed or change meaning, not when fields are added.
+const SnapshotVersion = 1
+
+// ThroughputInterval is the period the throughput of a Snapshot is averaged
+// over.
+const ThroughputInterval = 10 * time.Second
+
+// Snapshot is the status of a forwarder at a point in time, for monitoring
+// tools and the status command. Durations are given in nanoseconds in JSON.
+type Snapshot struct {
+	Version   int           `json:"version"` // SnapshotVersion
+	Time      time.Time     `json:"time"`
+	Started   time.Time     `json:"started"`
+	Uptime    time.Duration `json:"uptime"`
+	Listeners []string      `json:"listeners"` // addresses clients send to
+	Health    Health        `json:"health"`
+
+	Clients     int64 `json:"clients"`     // currently connected
+	Connects    int64 `json:"connects"`    // client sessions started
+	Disconnects int64 `json:"disconnects"` // client sessions ended
+
+	Traffic    Traffic    `json:"traffic"`    // since started
+	Throughput Throughput `json:"throughput"` // over the last ThroughputInterval
+
+	Destinations []DestinationSnapshot `json:"destinations"`
+}
+
+// Traffic counts the packets and bytes forwarded each way.
+type Traffic struct {
+	PacketsToServer int64 `json:"packets_to_server"`
+	BytesToServer   int64 `json:"bytes_to_server"`
+	PacketsToClient int64 `json:"packets_to_client"`
+	BytesToClient   int64 `json:"bytes_to_client"`
+}
+
+// Throughput is the packets and bytes forwarded each way per second.
+type Throughput struct {
+	PacketsToServer float64 `json:"packets_to_server"`
+	BytesToServer   float64 `json:"bytes_to_server"`
+	PacketsToClient float64 `json:"packets_to_client"`
+	BytesToClient   float64 `json:"bytes_to_client"`
+}
+
+// DestinationSnapshot is the status of a destination in a Snapshot, see
+// DestinationStats.
+type DestinationSnapshot struct {
+	Addr          string        `json:"addr"`
+	Weight        int           `json:"weight"`
+	Healthy       bool          `json:"healthy"`
+	Draining      bool          `json:"draining"`
+	Clients       int64         `json:"clients"`
+	RTT           time.Duration `json:"rtt,omitempty"`
+	Jitter        time.Duration `json:"jitter,omitempty"`
+	BytesToServer int64         `json:"bytes_to_server"`
+	BytesToClient int64         `json:"bytes_to_client"`
+}
+
+// Snapshot returns the status of the forwarder.
+func (f *Forwarder) Snapshot() Snapshot {
+	now := time.Now()
+	s := Snapshot{
+		Version:     SnapshotVersion,
+		Time:        now,
+		Started:     f.started,
+		Uptime:      now.Sub(f.started),
+		Listeners:   []string{f.LocalAddr().String()},
+		Health:      f.Health(),
+		Clients:     atomic.LoadInt64(&f.clientCount),
+		Connects:    atomic.LoadInt64(&f.connects),
+		Disconnects: atomic.LoadInt64(&f.disconnects),
+		Traffic:     f.traffic(),
+		Throughput:  f.throughput.get(),
+	}
+	for _, dst := range f.destinationStats() {
+		s.Destinations = append(s.Destinations, DestinationSnapshot{
+			Addr:          dst.Addr,
+			Weight:        dst.Weight,
+			Healthy:       dst.Healthy,
+			Draining:      dst.Draining,
+			Clients:       dst.Clients,
+			RTT:           dst.RTT,
+			Jitter:        dst.Jitter,
+			BytesToServer: dst.BytesToServer,
+			BytesToClient: dst.BytesToClient,
+		})
+	}
+	return s
+}
+
+// Snapshot returns the status of both forwarders, see Forwarder.Snapshot,
+// with the destinations on the IKE and the NAT-T port.
+func (p *Pair) Snapshot() Snapshot {
+	ike, natt := p.IKE.Snapshot(), p.NATT.Snapshot()
+	s := natt
+	if ike.Started.Before(s.Started) {
+		s.Started, s.Uptime = ike.Started, ike.Uptime
+	}
+	s.Listeners = append(ike.Listeners, natt.Listeners...)
+	s.Health = p.Health()
+	s.Clients += ike.Clients
+	s.Connects += ike.Connects
+	s.Disconnects += ike.Disconnects
+	s.Traffic.PacketsToServer += ike.Traffic.PacketsToServer
+	s.Traffic.BytesToServer += ike.Traffic.BytesToServer
+	s.Traffic.PacketsToClient += ike.Traffic.PacketsToClient
+	s.Traffic.BytesToClient += ike.Traffic.BytesToClient
+	s.Throughput.PacketsToServer += ike.Throughput.PacketsToServer
+	s.Throughput.BytesToServer += ike.Throughput.BytesToServer
+	s.Throughput.PacketsToClient += ike.Throughput.PacketsToClient
+	s.Throughput.BytesToClient += ike.Throughput.BytesToClient
+	s.Destinations = append(ike.Destinations, natt.Destinations...)
+	sort.SliceStable(s.Destinations, func(i, j int) bool { return s.Destinations[i].Addr < s.Destinations[j].Addr })
+	return s
+}
+
+// traffic returns the packets and bytes forwarded so far.
+func (f *Forwarder) traffic() Traffic {
+	return Traffic{
+		PacketsToServer: atomic.LoadInt64(&f.packetsToServer),
+		BytesToServer:   atomic.LoadInt64(&f.bytesToServer),
+		PacketsToClient: atomic.LoadInt64(&f.packetsToClient),
+		BytesToClient:   atomic.LoadInt64(&f.bytesToClient),
+	}
+}
+
+// throughput averages the traffic of a forwarder over ThroughputInterval.
+type throughput struct {
+	mu    sync.Mutex
+	at    time.Time // of last
+	last  Traffic
+	rates Throughput
+}
+
+// sample records the traffic forwarded by now, updating the rates once
+// ThroughputInterval passed since the last sample.
+func (t *throughput) sample(now time.Time, traffic Traffic) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := now.Sub(t.at)
+	if !t.at.IsZero() && elapsed < ThroughputInterval {
+		return
+	}
+	if !t.at.IsZero() {
+		secs := elapsed.Seconds()
+		t.rates = Throughput{
+			PacketsToServer: float64(traffic.PacketsToServer-t.last.PacketsToServer) / secs,
+			BytesToServer:   float64(traffic.BytesToServer-t.last.BytesToServer) / secs,
+			PacketsToClient: float64(traffic.PacketsToClient-t.last.PacketsToClient) / secs,
+			BytesToClient:   float64(traffic.BytesToClient-t.last.BytesToClient) / secs,
+		}
+	}
+	t.at, t.last = now, traffic
+}
+
+// get returns the rates of the last interval sampled.
+func (t *throughput) get() Throughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rates
+}
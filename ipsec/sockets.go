@@ -0,0 +1,83 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// socketWarnRatio is the share of the outbound socket limit in use at which
+// EventSocketsHigh is emitted.
+const socketWarnRatio = 0.9
+
+// SetSocketLimit limits the sockets to the destinations the forwarder keeps
+// open, each taking a local port, to max. Every client has a socket of its
+// own unless SetPooledMode is set, so sizing the host for tens of thousands
+// of concurrent clients is a matter of file descriptors and ephemeral ports.
+// Once the limit is reached new clients are refused and counted in
+// Stats.ClientsRejected instead of failing to connect, and EventSocketsHigh
+// is emitted and a warning logged when 90% of it is in use. With a source
+// port range set, see SetSourcePortRange, the limit defaults to the size of
+// the range. Pooled sockets are counted, but as their number is bounded by
+// the destinations and pool size, clients of pooled mode are never refused.
+// Zero, the default, sets no limit.
+func (f *Forwarder) SetSocketLimit(max int) {
+	f.socketLimit = max
+}
+
+// OutboundSockets returns the number of sockets to the destinations open and
+// their limit, zero if there is none, see SetSocketLimit.
+func (f *Forwarder) OutboundSockets() (open, limit int64) {
+	return atomic.LoadInt64(&f.outboundSockets), int64(f.outboundSocketLimit())
+}
+
+// outboundSocketLimit returns the limit of sockets to the destinations, zero
+// if there is none.
+func (f *Forwarder) outboundSocketLimit() int {
+	if f.socketLimit > 0 {
+		return f.socketLimit
+	}
+	if f.portMin > 0 && !f.transparent {
+		return f.portMax - f.portMin + 1
+	}
+	return 0
+}
+
+// socketsExhausted reports whether a new client would exceed the outbound
+// socket limit. Clients still dialing count as they will take a socket.
+func (f *Forwarder) socketsExhausted() bool {
+	if f.pooledSize() > 0 && !f.transparent {
+		return false
+	}
+	limit := int64(f.outboundSocketLimit())
+	return limit > 0 && (atomic.LoadInt64(&f.clientCount) >= limit || atomic.LoadInt64(&f.outboundSockets) >= limit)
+}
+
+// socketOpened counts a socket to a destination, warning once the limit is
+// nearly reached.
+func (f *Forwarder) socketOpened() {
+	open := atomic.AddInt64(&f.outboundSockets, 1)
+	limit := f.outboundSocketLimit()
+	if limit == 0 || float64(open) < socketWarnRatio*float64(limit) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&f.socketsWarned, 0, 1) {
+		f.logger.Log(LevelWarn, "outbound sockets nearly exhausted", "open", open, "limit", limit)
+		f.emit(Event{Type: EventSocketsHigh})
+	}
+}
+
+// socketClosed counts a socket to a destination closed, warning again the
+// next time the limit is nearly reached once usage dropped below it.
+func (f *Forwarder) socketClosed() {
+	open := atomic.AddInt64(&f.outboundSockets, -1)
+	if limit := f.outboundSocketLimit(); float64(open) < socketWarnRatio*float64(limit) {
+		atomic.StoreInt32(&f.socketsWarned, 0)
+	}
+}
+
+// closeSocket closes a socket to a destination.
+func (f *Forwarder) closeSocket(conn *net.UDPConn) {
+	conn.Close()
+	f.closeBridge(conn)
+	f.socketClosed()
+}
@@ -0,0 +1,108 @@
+package ipsec
+
+import (
+	"fmt"
+	"net"
+)
+
+// errSocketOptionUnsupported is returned when a socket option is not
+// supported on the platform.
+var errSocketOptionUnsupported error = unsupportedError("ipsec: setting the TTL and binding to a device are only supported on Linux")
+
+// SocketOptions tune the sockets of the forwarder, see SetListenerOptions
+// and SetOutboundOptions. Zero values leave an option to the system.
+type SocketOptions struct {
+	// ReceiveBuffer and SendBuffer are the sizes of the kernel buffers in
+	// bytes, SO_RCVBUF and SO_SNDBUF, to absorb bursts at high packet
+	// rates. The system may cap them, e.g. at net.core.rmem_max on Linux.
+	ReceiveBuffer int
+	SendBuffer    int
+
+	// TTL is the time to live, or IPv6 hop limit, of the packets sent, from
+	// 1 to 255. It requires Linux.
+	TTL int
+
+	// Device is the network interface the socket is bound to with
+	// SO_BINDTODEVICE, so that its traffic leaves through that interface
+	// on multi-homed hosts whatever the routes. It requires Linux and,
+	// before Linux 5.7, CAP_NET_RAW.
+	Device string
+}
+
+// validate checks that the options can be set.
+func (o SocketOptions) validate() error {
+	if o.ReceiveBuffer < 0 || o.SendBuffer < 0 {
+		return fmt.Errorf("ipsec: invalid socket buffer sizes %d and %d", o.ReceiveBuffer, o.SendBuffer)
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("ipsec: invalid TTL %d", o.TTL)
+	}
+	if o.Device != "" {
+		if _, err := net.InterfaceByName(o.Device); err != nil {
+			return fmt.Errorf("ipsec: invalid device %q: %w", o.Device, err)
+		}
+	}
+	return nil
+}
+
+// SetListenerOptions applies opts to the sockets clients send their packets
+// to, and to those reopened later. Binding them to a device makes them
+// receive only the packets arriving on it.
+func (f *Forwarder) SetListenerOptions(opts SocketOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	f.listenerMu.RLock()
+	defer f.listenerMu.RUnlock()
+	for _, conn := range f.listeners {
+		if err := applySocketOptions(conn, opts); err != nil {
+			return err
+		}
+	}
+	f.listenerOptions = opts
+	return nil
+}
+
+// SetOutboundOptions applies opts to the sockets to the destinations opened
+// from then on. Unlike the other options, which are ignored if the system
+// refuses them, failing to bind to the device fails the connection, so that
+// traffic never leaves through another interface. It should be set before
+// the forwarder is used.
+func (f *Forwarder) SetOutboundOptions(opts SocketOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.TTL > 0 || opts.Device != "" {
+		if err := checkSocketOptions(); err != nil {
+			return err
+		}
+	}
+	f.outboundOptions = opts
+	return nil
+}
+
+// applySocketOptions sets opts on conn.
+func applySocketOptions(conn *net.UDPConn, opts SocketOptions) error {
+	if opts.ReceiveBuffer > 0 {
+		if err := conn.SetReadBuffer(opts.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := conn.SetWriteBuffer(opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.TTL > 0 {
+		if err := setTTL(conn, opts.TTL); err != nil {
+			return err
+		}
+	}
+	if opts.Device != "" {
+		if err := bindToDevice(conn, opts.Device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// ipv6UnicastHops is IPV6_UNICAST_HOPS, the hop limit of IPv6 packets.
+const ipv6UnicastHops = 0x10
+
+func checkSocketOptions() error {
+	return nil
+}
+
+// setTTL sets the TTL, or hop limit, of the packets sent on conn.
+func setTTL(conn *net.UDPConn, ttl int) error {
+	return setSockoptBoth(conn, syscall.IP_TTL, ipv6UnicastHops, ttl)
+}
+
+// bindToDevice binds conn to the network interface device.
+func bindToDevice(conn *net.UDPConn, device string) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return deviceControl(device)("", "", rawConn)
+}
+
+// deviceControl returns a dialer control function binding the socket to the
+// network interface device before it connects, so that the route is looked
+// up on that interface.
+func deviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		return os.NewSyscallError("setsockopt", sockErr)
+	}
+}
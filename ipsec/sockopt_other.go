@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import (
+	"net"
+	"syscall"
+)
+
+func checkSocketOptions() error {
+	return errSocketOptionUnsupported
+}
+
+func setTTL(conn *net.UDPConn, ttl int) error {
+	return errSocketOptionUnsupported
+}
+
+func bindToDevice(conn *net.UDPConn, device string) error {
+	return errSocketOptionUnsupported
+}
+
+func deviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errSocketOptionUnsupported
+	}
+}
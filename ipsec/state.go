@@ -0,0 +1,96 @@
+package ipsec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// stateVersion is the version of the format written by SaveState.
+const stateVersion = 1
+
+// state is the format written by SaveState.
+type state struct {
+	Version  int             `json:"version"`
+	Saved    time.Time       `json:"saved"`
+	Sessions []SessionRecord `json:"sessions"`
+}
+
+// pairState is the format written by Pair.SaveState.
+type pairState struct {
+	Version int             `json:"version"`
+	Saved   time.Time       `json:"saved"`
+	IKE     []SessionRecord `json:"ike"`
+	NATT    []SessionRecord `json:"natt"`
+}
+
+// SaveState writes the destination of every client currently known to w, so
+// that a forwarder started later can route the clients to the same
+// destinations with LoadState, where their IKE SAs still are.
+func (f *Forwarder) SaveState(w io.Writer) error {
+	return json.NewEncoder(w).Encode(state{
+		Version:  stateVersion,
+		Saved:    time.Now(),
+		Sessions: f.ExportSessions(),
+	})
+}
+
+// LoadState reads the clients saved by SaveState from r and routes them to
+// the same destinations once they send again. Clients that would have timed
+// out by now and clients of destinations that are no longer configured are
+// skipped.
+func (f *Forwarder) LoadState(r io.Reader) error {
+	var s state
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != stateVersion {
+		return fmt.Errorf("ipsec: unsupported state version %d", s.Version)
+	}
+	return f.ImportSessions(f.liveSessions(s.Sessions))
+}
+
+// liveSessions returns the records that are still worth importing.
+func (f *Forwarder) liveSessions(records []SessionRecord) []SessionRecord {
+	var live []SessionRecord
+	deadline := time.Now().Add(-f.Timeout())
+	for _, record := range records {
+		if record.LastActive.Before(deadline) {
+			continue
+		}
+		raddr, err := f.resolveUDPAddr("udp", record.Destination)
+		if err != nil || f.lookupDestination(raddr) == nil {
+			continue
+		}
+		live = append(live, record)
+	}
+	return live
+}
+
+// SaveState writes the clients of both forwarders to w, see
+// Forwarder.SaveState.
+func (p *Pair) SaveState(w io.Writer) error {
+	return json.NewEncoder(w).Encode(pairState{
+		Version: stateVersion,
+		Saved:   time.Now(),
+		IKE:     p.IKE.ExportSessions(),
+		NATT:    p.NATT.ExportSessions(),
+	})
+}
+
+// LoadState reads the clients saved by Pair.SaveState from r into both
+// forwarders, see Forwarder.LoadState.
+func (p *Pair) LoadState(r io.Reader) error {
+	var s pairState
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != stateVersion {
+		return fmt.Errorf("ipsec: unsupported state version %d", s.Version)
+	}
+	if err := p.IKE.ImportSessions(p.IKE.liveSessions(s.IKE)); err != nil {
+		return err
+	}
+	return p.NATT.ImportSessions(p.NATT.liveSessions(s.NATT))
+}
@@ -0,0 +1,120 @@
+package ipsec
+
+import "sync/atomic"
+
+// Stats holds counters describing the activity of a Forwarder.
+type Stats struct {
+	// NewConnsLimited is the number of packets from new clients dropped by
+	// the new connection rate limits.
+	NewConnsLimited int64
+
+	// ClientsRejected is the number of packets from new clients dropped
+	// because the maximum number of clients or outbound sockets was reached
+	// or the forwarder is shutting down.
+	ClientsRejected int64
+
+	// RateLimited is the number of client packets dropped by the per-client
+	// rate limit.
+	RateLimited int64
+
+	// WriteTimeouts is the number of packets dropped because sending them
+	// exceeded the write timeout.
+	WriteTimeouts int64
+
+	// DialFailures is the number of times connecting to the destination
+	// failed.
+	DialFailures int64
+
+	// KeepalivesFromClient and KeepalivesFromServer count the NAT-T
+	// keepalives received from clients and destinations.
+	KeepalivesFromClient int64
+	KeepalivesFromServer int64
+
+	// Migrations is the number of clients recognised by their IKE SA after
+	// their address changed, see SetTrackIKESessions.
+	Migrations int64
+
+	// EventsDropped is the number of events that did not fit in the buffer
+	// of the channel returned by Events.
+	EventsDropped int64
+
+	// MirrorFailures is the number of packet copies that could not be sent
+	// to the mirror, see SetMirror.
+	MirrorFailures int64
+
+	// AccountingDropped is the number of accounting records dropped because
+	// the queue was full, and AccountingFailures the number the accounter
+	// failed to export, see SetAccounting.
+	AccountingDropped  int64
+	AccountingFailures int64
+
+	// FamilyFallbacks is the number of clients moved to the other address
+	// family of their destination as it did not answer, see
+	// SetHappyEyeballs.
+	FamilyFallbacks int64
+
+	// ImpairmentDrops is the number of packets dropped on purpose, see
+	// SetImpairment.
+	ImpairmentDrops int64
+
+	// Destinations describes how new clients have been spread over the
+	// destinations.
+	Destinations []DestinationStats
+}
+
+// Stats returns a snapshot of the forwarder's counters.
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		NewConnsLimited:      atomic.LoadInt64(&f.newConnsLimited),
+		ClientsRejected:      atomic.LoadInt64(&f.clientsRejected),
+		RateLimited:          atomic.LoadInt64(&f.rateLimited),
+		WriteTimeouts:        atomic.LoadInt64(&f.writeTimeouts),
+		DialFailures:         atomic.LoadInt64(&f.dialFailures),
+		KeepalivesFromClient: atomic.LoadInt64(&f.keepalivesFromClient),
+		KeepalivesFromServer: atomic.LoadInt64(&f.keepalivesFromServer),
+		Migrations:           atomic.LoadInt64(&f.migrations),
+		EventsDropped:        atomic.LoadInt64(&f.eventsDropped),
+		MirrorFailures:       atomic.LoadInt64(&f.mirrorFails),
+		AccountingDropped:    atomic.LoadInt64(&f.accountingDropped),
+		AccountingFailures:   atomic.LoadInt64(&f.accountingFailures),
+		FamilyFallbacks:      atomic.LoadInt64(&f.familyFallbacks),
+		ImpairmentDrops:      atomic.LoadInt64(&f.impairmentDrops),
+		Destinations:         f.destinationStats(),
+	}
+}
+
+// Reasons packets are dropped, as reported by DropStats.
+const (
+	DropInitialWriteFail = "InitialWriteFail"
+	DropServerWriteFail  = "ServerWriteFail"
+	DropClientWriteFail  = "ClientWriteFail"
+	DropDialFail         = "DialFail"
+	DropTruncated        = "Truncated"
+	DropRateLimited      = "RateLimited"
+	DropQueueFull        = "QueueFull"
+	DropACLDenied        = "ACLDenied"
+	DropTooBig           = "TooBig"     // larger than the MTU of the path onward
+	DropInvalid          = "Invalid"    // neither IKE, ESP nor a keepalive, see SetValidation
+	DropBanned           = "Banned"     // from a banned source, see SetBanPolicy
+	DropCookie           = "Cookie"     // answered with an IKE cookie, see SetIKECookies
+	DropMiddleware       = "Middleware" // see SetMiddlewares
+)
+
+// DropStats returns the number of packets dropped for each reason.
+func (f *Forwarder) DropStats() map[string]int64 {
+	return map[string]int64{
+		DropInitialWriteFail: atomic.LoadInt64(&f.initialWriteFails),
+		DropServerWriteFail:  atomic.LoadInt64(&f.serverWriteFails),
+		DropClientWriteFail:  atomic.LoadInt64(&f.clientWriteFails),
+		DropDialFail:         atomic.LoadInt64(&f.dialFailures),
+		DropTruncated:        atomic.LoadInt64(&f.truncated),
+		DropRateLimited:      atomic.LoadInt64(&f.rateLimited),
+		DropQueueFull:        atomic.LoadInt64(&f.queueFull),
+		DropACLDenied:        atomic.LoadInt64(&f.aclDenied),
+		DropTooBig:           atomic.LoadInt64(&f.tooBigDrops),
+		DropInvalid:          atomic.LoadInt64(&f.invalidDrops),
+		DropBanned:           atomic.LoadInt64(&f.bannedDrops),
+		DropCookie:           atomic.LoadInt64(&f.cookieDrops),
+		DropMiddleware:       atomic.LoadInt64(&f.middlewareDrops),
+	}
+}
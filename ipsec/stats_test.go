@@ -0,0 +1,29 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientWriteFailCounted(t *testing.T) {
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: "127.0.0.1:9", Weight: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The IPv4 listener cannot send to an IPv6 client.
+	client := f.newConnection(f.dsts[0].raddr, f.dsts[0])
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4500}
+	f.sendToClient(client, [][]byte{{0, 0, 0, 1, 0, 0, 0, 1}, {0, 0, 0, 1, 0, 0, 0, 2}}, nil, addr)
+
+	if got := f.DropStats()[DropClientWriteFail]; got != 2 {
+		t.Errorf("%d client write failures, want 2", got)
+	}
+	if got := f.Metrics().PacketsToClient; got != 0 {
+		t.Errorf("%d packets counted as sent to the client, want none", got)
+	}
+}
@@ -0,0 +1,308 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSteeringInterval is how often destinations are measured by
+// default, see SetSteering.
+const DefaultSteeringInterval = time.Minute
+
+// steeringSlack is how much farther than the nearest destination another may
+// be and still be considered as near, so that clients are spread over
+// destinations at about the same distance instead of all going to the one
+// that measured marginally better.
+const steeringSlack = 0.1
+
+// Steering tells how near each destination is to a client, for sending new
+// clients to the nearest or fastest destination, see SetSteering.
+type Steering interface {
+	// Measure is called every steering interval with the addresses of the
+	// destinations, to update what Distance is based on. It may block
+	// for a while, but not past the interval.
+	Measure(dsts []*net.UDPAddr)
+
+	// Distance returns how far the destination dst is from the client at
+	// addr, in any unit as long as it is the same for all destinations,
+	// or a negative value if it is unknown. Distance is called with
+	// dstMu held and must not block.
+	Distance(addr *net.UDPAddr, dst DestinationStats) float64
+}
+
+type steered struct {
+	steering Steering
+	fallback Balancer
+}
+
+// NewSteered returns a Balancer sending each new client to the destination
+// steering tells is nearest. Destinations within 10% of the nearest are
+// considered as near, and the clients of near destinations are spread by
+// least connections relative to their weights, as are all clients while no
+// distance is known.
+func NewSteered(steering Steering) Balancer {
+	return steered{steering: steering, fallback: NewLeastConnections()}
+}
+
+func (b steered) Pick(addr *net.UDPAddr, dsts []DestinationStats) int {
+	distances := make([]float64, len(dsts))
+	nearest := math.Inf(1)
+	for i, dst := range dsts {
+		distances[i] = b.steering.Distance(addr, dst)
+		if distances[i] >= 0 && distances[i] < nearest {
+			nearest = distances[i]
+		}
+	}
+	if math.IsInf(nearest, 1) {
+		return b.fallback.Pick(addr, dsts)
+	}
+
+	var indexes []int
+	var near []DestinationStats
+	for i, distance := range distances {
+		if distance >= 0 && distance <= nearest*(1+steeringSlack) {
+			indexes = append(indexes, i)
+			near = append(near, dsts[i])
+		}
+	}
+	return indexes[b.fallback.Pick(addr, near)]
+}
+
+// LatencySteering steers clients to the destination with the lowest round
+// trip time from the forwarder. It is safe for concurrent use, and may be
+// shared by the forwarders of a Pair.
+type LatencySteering struct {
+	probe func(ip net.IP) (time.Duration, error)
+
+	mu  sync.Mutex
+	rtt map[string]time.Duration // smoothed, by destination IP address
+}
+
+// NewLatencySteering returns a Steering measuring the round trip time to each
+// destination with probe. A nil probe sends an ICMP echo request and waits
+// up to a second for the reply, which needs the privilege to open raw
+// sockets (CAP_NET_RAW on Linux).
+func NewLatencySteering(probe func(ip net.IP) (time.Duration, error)) *LatencySteering {
+	if probe == nil {
+		probe = func(ip net.IP) (time.Duration, error) {
+			return ping(ip, maxProbeTimeout)
+		}
+	}
+	return &LatencySteering{probe: probe, rtt: make(map[string]time.Duration)}
+}
+
+// Measure probes every destination concurrently. Measurements are smoothed
+// over successive calls like TCP smooths its round trip time, and forgotten
+// for destinations failing their probe.
+func (s *LatencySteering) Measure(dsts []*net.UDPAddr) {
+	probed := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, dst := range dsts {
+		ip := dst.IP.String()
+		if probed[ip] {
+			continue
+		}
+		probed[ip] = true
+
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+			rtt, err := s.probe(ip)
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			key := ip.String()
+			switch last, ok := s.rtt[key]; {
+			case err != nil:
+				delete(s.rtt, key)
+			case ok:
+				s.rtt[key] = last - last/8 + rtt/8
+			default:
+				s.rtt[key] = rtt
+			}
+		}(dst.IP)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip := range s.rtt {
+		if !probed[ip] {
+			delete(s.rtt, ip)
+		}
+	}
+}
+
+// Distance returns the smoothed round trip time to dst in seconds.
+func (s *LatencySteering) Distance(addr *net.UDPAddr, dst DestinationStats) float64 {
+	rtt, ok := s.RTT(hostOf(dst.Addr))
+	if !ok {
+		return -1
+	}
+	return rtt.Seconds()
+}
+
+// RTT returns the smoothed round trip time to the destination at ip, and
+// false if it is not known.
+func (s *LatencySteering) RTT(ip string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtt, ok := s.rtt[ip]
+	return rtt, ok
+}
+
+// Location is a point on Earth, in degrees.
+type Location struct {
+	Latitude, Longitude float64
+}
+
+// earthRadius is the mean radius of the Earth in kilometres.
+const earthRadius = 6371
+
+// kilometresTo returns the great-circle distance from l to to.
+func (l Location) kilometresTo(to Location) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(to.Latitude-l.Latitude), rad(to.Longitude-l.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(l.Latitude))*math.Cos(rad(to.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// GeoSteering steers clients to the destination geographically nearest to
+// their source address.
+type GeoSteering struct {
+	// Locate returns the location of ip, typically looked up in a GeoIP
+	// database, and false if it is unknown. It must be safe for
+	// concurrent use and should not block.
+	Locate func(ip net.IP) (Location, bool)
+
+	// Destinations holds the location of destinations by IP address,
+	// taking precedence over Locate, which is used for the others.
+	Destinations map[string]Location
+}
+
+// Measure does nothing, locations do not change.
+func (s *GeoSteering) Measure(dsts []*net.UDPAddr) {}
+
+// Distance returns the distance between the client and dst in kilometres.
+func (s *GeoSteering) Distance(addr *net.UDPAddr, dst DestinationStats) float64 {
+	from, ok := s.Locate(addr.IP)
+	if !ok {
+		return -1
+	}
+	host := hostOf(dst.Addr)
+	to, ok := s.Destinations[host]
+	if !ok {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return -1
+		}
+		if to, ok = s.Locate(ip); !ok {
+			return -1
+		}
+	}
+	return from.kilometresTo(to)
+}
+
+// hostOf returns the host of addr, or addr itself if it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// pingSeq numbers the echo requests sent by ping, so that concurrent pings
+// tell their replies apart.
+var pingSeq uint32
+
+// ping returns the time an ICMP echo request to ip takes to be answered,
+// waiting up to timeout.
+func ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	network, request, reply := "ip6:ipv6-icmp", byte(128), byte(129)
+	if ip.To4() != nil {
+		network, request, reply = "ip4:icmp", 8, 0
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	msg := make([]byte, 8)
+	msg[0] = request
+	id, seq := uint16(os.Getpid()), uint16(atomic.AddUint32(&pingSeq, 1))
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	if ip.To4() != nil {
+		// The system computes the checksum of ICMPv6 messages.
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 8 && buf[0] == reply && from.(*net.IPAddr).IP.Equal(ip) &&
+			binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// SetSteering makes the forwarder send each new client to the destination
+// steering tells is nearest, see NewSteered, replacing the balancer. The
+// destinations are measured right away and then every interval, which
+// defaults to DefaultSteeringInterval. Clients already assigned keep their
+// destination.
+func (f *Forwarder) SetSteering(steering Steering, interval time.Duration) {
+	if f.isClosed() {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultSteeringInterval
+	}
+	f.SetBalancer(NewSteered(steering))
+
+	f.dstMu.Lock()
+	f.steering, f.steeringInterval = steering, interval
+	f.dstMu.Unlock()
+	f.steeringOnce.Do(func() {
+		f.wg.Add(1)
+		go f.steer()
+	})
+}
+
+// steer measures the destinations with the steering every steering interval.
+func (f *Forwarder) steer() {
+	defer f.wg.Done()
+	for {
+		f.dstMu.Lock()
+		steering, interval := f.steering, f.steeringInterval
+		raddrs := make([]*net.UDPAddr, len(f.dsts))
+		for i, dst := range f.dsts {
+			raddrs[i] = dst.raddr
+		}
+		f.dstMu.Unlock()
+
+		steering.Measure(raddrs)
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
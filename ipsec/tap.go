@@ -0,0 +1,35 @@
+package ipsec
+
+import (
+	"net"
+	"time"
+)
+
+// TappedPacket is a packet forwarded between a client and a destination, as
+// passed to the function set with SetTap.
+type TappedPacket struct {
+	Time     time.Time
+	Src, Dst *net.UDPAddr // the client and destination, in the packet's direction
+	ToServer bool
+	Data     []byte // only valid during the call
+}
+
+// packetTap is the type of the functions given to SetTap.
+type packetTap func(p TappedPacket)
+
+// SetTap sets a function called with every packet forwarded in either
+// direction, such as to capture the traffic of clients that fail to establish
+// their tunnels. It is called by the goroutines forwarding the packets, so it
+// must be quick and safe for concurrent use. A nil tap, the default, disables
+// it.
+func (f *Forwarder) SetTap(tap func(p TappedPacket)) {
+	f.tap.Store(packetTap(tap))
+}
+
+// tapPacket passes a forwarded packet to the tap and the mirror, if any.
+func (f *Forwarder) tapPacket(src, dst *net.UDPAddr, toServer bool, data []byte) {
+	f.mirrorPacket(src, dst, toServer, data)
+	if tap, _ := f.tap.Load().(packetTap); tap != nil {
+		tap(TappedPacket{Time: time.Now(), Src: src, Dst: dst, ToServer: toServer, Data: data})
+	}
+}
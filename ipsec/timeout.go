@@ -0,0 +1,99 @@
+package ipsec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ClientTimeout overrides the timeout of the clients in a network, e.g. a
+// longer one for site-to-site peers.
+type ClientTimeout struct {
+	Network net.IPNet
+	Timeout time.Duration
+}
+
+// clientTimeout returns the period of inactivity after which the client at
+// cliAddr is disconnected: that of the most specific network in the client
+// timeouts containing it, else that of its destination, else the timeout of
+// the forwarder.
+func (f *Forwarder) clientTimeout(cliAddr string, client *connection) time.Duration {
+	rules, _ := f.clientTimeouts.Load().([]ClientTimeout)
+	if len(rules) > 0 {
+		if host, _, err := net.SplitHostPort(cliAddr); err == nil {
+			if timeout, ok := matchClientTimeout(rules, net.ParseIP(host)); ok {
+				return timeout
+			}
+		}
+	}
+	if _, dst := client.backend(); dst != nil {
+		if timeout := atomic.LoadInt64(&dst.timeout); timeout > 0 {
+			return time.Duration(timeout)
+		}
+	}
+	return f.Timeout()
+}
+
+// matchClientTimeout returns the timeout of the most specific of rules whose
+// network contains ip.
+func matchClientTimeout(rules []ClientTimeout, ip net.IP) (time.Duration, bool) {
+	if ip == nil {
+		return 0, false
+	}
+	best := -1
+	var timeout time.Duration
+	for _, rule := range rules {
+		if !rule.Network.Contains(ip) {
+			continue
+		}
+		if ones, _ := rule.Network.Mask.Size(); ones > best {
+			best, timeout = ones, rule.Timeout
+		}
+	}
+	return timeout, best >= 0
+}
+
+// sweepInterval returns how often the janitor looks for inactive clients,
+// which is the shortest of the timeouts in use.
+func (f *Forwarder) sweepInterval() time.Duration {
+	interval := f.Timeout()
+	rules, _ := f.clientTimeouts.Load().([]ClientTimeout)
+	for _, rule := range rules {
+		if rule.Timeout < interval {
+			interval = rule.Timeout
+		}
+	}
+
+	f.dstMu.Lock()
+	defer f.dstMu.Unlock()
+	for _, dst := range f.dsts {
+		if timeout := time.Duration(atomic.LoadInt64(&dst.timeout)); timeout > 0 && timeout < interval {
+			interval = timeout
+		}
+	}
+	return interval
+}
+
+// SetClientTimeouts overrides the timeout of the clients in the networks of
+// rules. The most specific network containing a client applies, and takes
+// precedence over the timeout of its destination, see WeightedDest. Rules
+// with a non-positive timeout are ignored. It applies to connected clients
+// too.
+func (f *Forwarder) SetClientTimeouts(rules []ClientTimeout) {
+	var valid []ClientTimeout
+	for _, rule := range rules {
+		if rule.Timeout > 0 {
+			valid = append(valid, rule)
+		}
+	}
+	f.clientTimeouts.Store(valid)
+	f.timeoutChanged()
+}
+
+// timeoutChanged makes the janitor pick up a change to the timeouts.
+func (f *Forwarder) timeoutChanged() {
+	select {
+	case f.timeoutsChanged <- struct{}{}:
+	default:
+	}
+}
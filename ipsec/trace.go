@@ -0,0 +1,187 @@
+package ipsec
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Tracer starts the spans tracing the lifecycle of client sessions, so that
+// operators can follow why the tunnel of a client was slow to set up or
+// failed. Its methods mirror those of the OpenTelemetry trace API, so that an
+// adapter to an OpenTelemetry tracer is a thin wrapper converting the
+// attributes. The Exporter of package otlp exports the spans over OTLP
+// without one.
+//
+// A session span, named "ipsec.session", lasts from the first packet of a
+// client to its disconnection and has a child span "ipsec.dial" for dialing
+// its destination. Failovers and migrations are recorded as events of the
+// session span, and IKE and ESP SPIs as attributes as they are seen.
+type Tracer interface {
+	// Start starts a span named name, a child of the span in ctx if any,
+	// and returns a context holding it.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key and a value, a string, an int64 or a bool, describing
+// a span or an event.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attribute keys of the spans.
+const (
+	AttrClientAddr  = "client.address"
+	AttrBackendAddr = "backend.address"
+	AttrLocalAddr   = "local.address"
+	AttrPooled      = "ipsec.pooled"
+	AttrIKESPI      = "ipsec.ike.initiator_spi"
+	AttrESPSPI      = "ipsec.esp.spi"
+	AttrBytesIn     = "ipsec.bytes_to_server"
+	AttrBytesOut    = "ipsec.bytes_to_client"
+	AttrEndReason   = "ipsec.end_reason"
+)
+
+// tracerValue holds the Tracer of a forwarder, which atomic.Value cannot
+// hold directly as it may be nil or change type.
+type tracerValue struct {
+	Tracer
+}
+
+// sessionTrace is the span of a client session, if a Tracer is set.
+type sessionTrace struct {
+	ctx  context.Context
+	span Span
+
+	// The last SPIs recorded, only used by the goroutine sending the
+	// packets of the client.
+	ikeSPI uint64
+	espSPI uint32
+}
+
+// loadTracer returns the tracer of the forwarder, or nil.
+func (f *Forwarder) loadTracer() Tracer {
+	value, _ := f.tracer.Load().(tracerValue)
+	return value.Tracer
+}
+
+// startTrace starts the session span of client, sending from cliAddr.
+func (f *Forwarder) startTrace(cliAddr string, client *connection) {
+	tracer := f.loadTracer()
+	if tracer == nil {
+		return
+	}
+	ctx, span := tracer.Start(f.ctx, "ipsec.session",
+		Attribute{AttrClientAddr, cliAddr},
+		Attribute{AttrBackendAddr, client.raddr.String()})
+	client.mu.Lock()
+	client.trace = &sessionTrace{ctx: ctx, span: span}
+	client.mu.Unlock()
+}
+
+// sessionSpan returns the session span of client, or nil.
+func (c *connection) sessionSpan() *sessionTrace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trace
+}
+
+// traceEvent records an event in the session span of client, if any.
+func (c *connection) traceEvent(name string, attrs ...Attribute) {
+	if t := c.sessionSpan(); t != nil {
+		t.span.AddEvent(name, attrs...)
+	}
+}
+
+// traceAttributes sets attributes of the session span of client, if any.
+func (c *connection) traceAttributes(attrs ...Attribute) {
+	if t := c.sessionSpan(); t != nil {
+		t.span.SetAttributes(attrs...)
+	}
+}
+
+// traceSPIs records in the session span of client the IKE initiator SPI or
+// the ESP SPI of data, a packet from the client, when it changes.
+func (f *Forwarder) traceSPIs(client *connection, data []byte) {
+	if f.loadTracer() == nil {
+		return
+	}
+	t := client.sessionSpan()
+	if t == nil {
+		return
+	}
+	if h, ok := ParseIKE(data); ok {
+		if h.InitiatorSPI != t.ikeSPI {
+			t.ikeSPI = h.InitiatorSPI
+			t.span.SetAttributes(Attribute{AttrIKESPI, fmt.Sprintf("%016x", h.InitiatorSPI)})
+		}
+		return
+	}
+	if len(data) >= espHeaderSize {
+		if spi := binary.BigEndian.Uint32(data); spi != 0 && spi != t.espSPI {
+			t.espSPI = spi
+			t.span.SetAttributes(Attribute{AttrESPSPI, fmt.Sprintf("%08x", spi)})
+		}
+	}
+}
+
+// traceError records err in the session span of client, if any.
+func (c *connection) traceError(err error) {
+	if t := c.sessionSpan(); t != nil {
+		t.span.RecordError(err)
+	}
+}
+
+// traceDial starts the span of dialing the destination of client. The
+// returned function ends it, recording err.
+func (f *Forwarder) traceDial(client *connection, pooled bool) func(conn *net.UDPConn, err error) {
+	tracer := f.loadTracer()
+	t := client.sessionSpan()
+	if tracer == nil || t == nil {
+		return func(*net.UDPConn, error) {}
+	}
+	_, span := tracer.Start(t.ctx, "ipsec.dial",
+		Attribute{AttrBackendAddr, client.raddr.String()},
+		Attribute{AttrPooled, pooled})
+	return func(conn *net.UDPConn, err error) {
+		if err != nil {
+			span.RecordError(err)
+		} else {
+			span.SetAttributes(Attribute{AttrLocalAddr, conn.LocalAddr().String()})
+		}
+		span.End()
+	}
+}
+
+// endTrace ends the session span of client, if any, giving reason as the
+// reason the session ended and recording err.
+func (c *connection) endTrace(reason string, err error) {
+	c.mu.Lock()
+	t := c.trace
+	c.trace = nil
+	c.mu.Unlock()
+	if t == nil {
+		return
+	}
+	if err != nil {
+		t.span.RecordError(err)
+	}
+	t.span.SetAttributes(Attribute{AttrEndReason, reason})
+	t.span.End()
+}
+
+// SetTracer makes the forwarder trace the sessions of new clients with
+// tracer, see Tracer. A nil tracer stops tracing.
+func (f *Forwarder) SetTracer(tracer Tracer) {
+	f.tracer.Store(tracerValue{tracer})
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package ipsec
+
+import "syscall"
+
+// Socket options of Linux's transparent proxy support.
+const (
+	ipTransparent   = 0x13
+	ipv6Transparent = 0x4b
+)
+
+// transparentControl sets IP_TRANSPARENT on a socket so that it may be bound
+// to a foreign address.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1)
+		if network == "udp6" && sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func checkTransparent() error {
+	return nil
+}
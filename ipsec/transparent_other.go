@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package ipsec
+
+import "syscall"
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparentUnsupported
+}
+
+func checkTransparent() error {
+	return errTransparentUnsupported
+}
+
+var errTransparentUnsupported error = unsupportedError("ipsec: transparent mode is only supported on Linux")
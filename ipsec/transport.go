@@ -0,0 +1,129 @@
+package ipsec
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// Transport relays the packets of clients to their destinations in place of
+// plain UDP, such as through a SOCKS5 proxy or a tunnel, see SetTransport.
+type Transport interface {
+	// Dial returns a connection whose writes are delivered to raddr as
+	// single datagrams and whose reads return those raddr sends back, one
+	// per read. Closing it ends the relay. ctx bounds the dialing only.
+	Dial(ctx context.Context, raddr *net.UDPAddr) (net.Conn, error)
+}
+
+// SetTransport makes the forwarder reach the destinations through transport,
+// e.g. a SOCKS5 UDP associate where only a proxy may reach them, rather than
+// sending to them directly. The destinations see the transport's address, so
+// SetOutboundAddr, SetSourcePortRange and SetTransparent do not apply, nor do
+// socket options such as DSCP beyond the forwarder's own host. Each socket to
+// a destination, one per client unless pooled, is bridged to a connection of
+// the transport over the loopback interface. A nil transport, the default,
+// sends directly. It applies to sockets dialed after it is set.
+func (f *Forwarder) SetTransport(transport Transport) {
+	f.transport = transport
+}
+
+// bridge relays the datagrams between a socket of the forwarder, connected to
+// shim over the loopback interface, and a connection of the transport.
+type bridge struct {
+	closed int32
+
+	shim     *net.UDPConn
+	peer     *net.UDPAddr // the forwarder's socket
+	upstream net.Conn
+}
+
+// dialTransport connects to raddr through the transport, returning a socket
+// bridged to it.
+func (f *Forwarder) dialTransport(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	ctx := f.ctx
+	if f.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.dialTimeout)
+		defer cancel()
+	}
+	upstream, err := f.transport.Dial(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	shim, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", loopback, shim.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		shim.Close()
+		upstream.Close()
+		return nil, err
+	}
+	b := &bridge{shim: shim, peer: conn.LocalAddr().(*net.UDPAddr), upstream: upstream}
+	f.bridges.Store(conn, b)
+	go f.relayUp(b)
+	go f.relayDown(b, raddr)
+	return conn, nil
+}
+
+// relayUp passes the packets of the forwarder's socket to the transport until
+// the bridge is closed.
+func (f *Forwarder) relayUp(b *bridge) {
+	buf := make([]byte, f.readBufferSize())
+	for {
+		n, addr, err := b.shim.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(b.peer.IP) || addr.Port != b.peer.Port {
+			continue
+		}
+		if _, err := b.upstream.Write(buf[:n]); err != nil {
+			f.logError(LevelDebug, OpTransport, "", err, "error sending packet through transport", "destination", b.upstream.RemoteAddr())
+		}
+	}
+}
+
+// relayDown passes the packets from raddr, received through the transport, to
+// the forwarder's socket until the bridge is closed. A transport failing
+// closes the bridge, and the clients using it time out.
+func (f *Forwarder) relayDown(b *bridge, raddr *net.UDPAddr) {
+	buf := make([]byte, f.readBufferSize())
+	for {
+		n, err := b.upstream.Read(buf)
+		if err != nil {
+			if b.close() {
+				f.logger.Log(LevelDebug, "transport closed", "destination", raddr, "err", err)
+			}
+			return
+		}
+		if _, err := b.shim.WriteToUDP(buf[:n], b.peer); err != nil {
+			b.close()
+			return
+		}
+	}
+}
+
+// close closes both ends of the bridge, reporting false if it was closed
+// already.
+func (b *bridge) close() bool {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return false
+	}
+	b.shim.Close()
+	b.upstream.Close()
+	return true
+}
+
+// closeBridge closes the bridge of conn, if it was dialed through the
+// transport.
+func (f *Forwarder) closeBridge(conn *net.UDPConn) {
+	if b, ok := f.bridges.Load(conn); ok {
+		f.bridges.Delete(conn)
+		b.(*bridge).close()
+	}
+}
@@ -0,0 +1,64 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	// minESPSPI is the lowest ESP SPI in use, those below being reserved by
+	// RFC 4303.
+	minESPSPI = 256
+
+	// minESPSize is the size of the smallest ESP packet, a dummy packet
+	// with the header, the pad length and next header fields and a 96 bit
+	// integrity check value.
+	minESPSize = espHeaderSize + 2 + 12
+)
+
+// isIPSEC reports whether data looks like a packet of an IPSEC client: an
+// IKEv2 message, with or without the non-ESP marker, whose length matches
+// the datagram, an ESP packet of plausible size with a valid SPI and
+// sequence number, or a NAT-T keepalive.
+func isIPSEC(data []byte) bool {
+	if isNATKeepalive(data) {
+		return true
+	}
+	if h, ok := ParseIKE(data); ok {
+		n := len(data)
+		if binary.BigEndian.Uint32(data) == 0 {
+			n -= nonESPMarkerSize
+		}
+		return int(h.Length) == n
+	}
+	return len(data) >= minESPSize &&
+		binary.BigEndian.Uint32(data) >= minESPSPI &&
+		binary.BigEndian.Uint32(data[4:]) != 0
+}
+
+// SetValidation makes the forwarder drop packets from clients that look
+// like neither IKEv2, ESP nor NAT-T keepalives, see isIPSEC, so that
+// scanners probing the port cause no connections to the destinations and
+// take no place in the client table. Drops are counted in DropStats. It
+// should not be enabled for other protocols, see Profile. It may be called
+// at any time.
+func (f *Forwarder) SetValidation(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.validate, v)
+}
+
+// valid reports whether the packet data from addr passes validation, if
+// enabled, counting the drop if not.
+func (f *Forwarder) valid(addr *net.UDPAddr, data []byte) bool {
+	if atomic.LoadInt32(&f.validate) == 0 || isIPSEC(data) {
+		return true
+	}
+	atomic.AddInt64(&f.invalidDrops, 1)
+	f.logger.Log(LevelDebug, "dropping invalid packet", "client", addr, "size", len(data))
+	f.offend(addr, BanInvalid)
+	return false
+}
@@ -0,0 +1,46 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeoutDropsPacket(t *testing.T) {
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// Every write outlasts a timeout of a nanosecond, as one to a stuck
+	// socket would a longer one.
+	f, err := New(Config{
+		Listen:       "127.0.0.1:0",
+		Destinations: []WeightedDest{{Addr: dst.LocalAddr().String(), Weight: 1}},
+		WriteTimeout: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.DialUDP("udp", nil, f.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const packets = 3
+	for i := 0; i < packets; i++ {
+		conn.Write([]byte{0, 0, 0, 1, 0, 0, 0, byte(i)})
+	}
+	if received(dst, 200*time.Millisecond) {
+		t.Error("packet sent despite its write timing out")
+	}
+	if got := f.Stats().WriteTimeouts; got != packets {
+		t.Errorf("%d write timeouts, want %d", got, packets)
+	}
+	drops := f.DropStats()
+	if got := drops[DropInitialWriteFail] + drops[DropServerWriteFail]; got != 0 {
+		t.Errorf("%d writes failed, want the timeouts not to count as failures", got)
+	}
+}
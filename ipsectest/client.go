@@ -0,0 +1,150 @@
+package ipsectest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Client is a simulated IPSEC client sending to a forwarder from a loopback
+// port of its own. It is not safe for concurrent use.
+type Client struct {
+	conn    *net.UDPConn
+	server  *net.UDPAddr
+	marker  bool
+	timeout time.Duration
+
+	initiatorSPI uint64
+	responderSPI uint64
+	messageID    uint32
+	spi          uint32
+	seq          uint32
+}
+
+// NewClient returns a client of the forwarder at server. marker selects the
+// non-ESP marker on IKE messages, as used on the NAT-T port.
+func NewClient(server *net.UDPAddr, marker bool) (*Client, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn:         conn,
+		server:       server,
+		marker:       marker,
+		timeout:      DefaultTimeout,
+		initiatorSPI: rand.Uint64() | 1,
+		spi:          uint32(rand.Int31n(1<<30)) + 256,
+	}, nil
+}
+
+// Addr returns the address of the client, as the forwarder sees it.
+func (c *Client) Addr() *net.UDPAddr {
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// SetTimeout sets how long the client waits for replies, DefaultTimeout
+// unless set.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// Handshake exchanges IKE_SA_INIT and IKE_AUTH with the gateway behind the
+// forwarder, establishing a session.
+func (c *Client) Handshake() error {
+	c.messageID = 0
+	c.responderSPI = 0
+	for _, exchange := range []uint8{ipsec.ExchangeIKESAInit, ipsec.ExchangeIKEAuth} {
+		if _, err := c.Exchange(exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exchange sends an IKE request of exchange and waits for its response,
+// which it returns.
+func (c *Client) Exchange(exchange uint8) (ipsec.IKEHeader, error) {
+	request := ipsec.IKEHeader{
+		InitiatorSPI: c.initiatorSPI,
+		ResponderSPI: c.responderSPI,
+		ExchangeType: exchange,
+		Flags:        ikeFlagInitiator,
+		MessageID:    c.messageID,
+	}
+	if err := c.Send(IKEMessage(request, c.marker)); err != nil {
+		return ipsec.IKEHeader{}, err
+	}
+	for {
+		data, err := c.Receive()
+		if err != nil {
+			return ipsec.IKEHeader{}, fmt.Errorf("%s response: %w", ipsec.ExchangeName(exchange), err)
+		}
+		h, ok := ipsec.ParseIKE(data)
+		if !ok || !h.Response() || h.InitiatorSPI != c.initiatorSPI || h.MessageID != c.messageID {
+			continue
+		}
+		c.responderSPI = h.ResponderSPI
+		c.messageID++
+		return h, nil
+	}
+}
+
+// RoundTrip sends an ESP packet carrying payload and waits for the gateway
+// to send it back, checking delivery in both directions.
+func (c *Client) RoundTrip(payload []byte) error {
+	c.seq++
+	if err := c.Send(ESPPacket(c.spi, c.seq, payload)); err != nil {
+		return err
+	}
+	for {
+		data, err := c.Receive()
+		if err != nil {
+			return fmt.Errorf("ESP reply: %w", err)
+		}
+		spi, seq, got, ok := ParseESP(data)
+		if !ok || spi != c.spi+1 || seq != c.seq {
+			continue
+		}
+		if !bytes.Equal(got, payload) {
+			return fmt.Errorf("ipsectest: ESP payload %x sent back as %x", payload, got)
+		}
+		return nil
+	}
+}
+
+// Keepalive sends a NAT-T keepalive.
+func (c *Client) Keepalive() error {
+	return c.Send([]byte{0xff})
+}
+
+// Send sends data to the forwarder.
+func (c *Client) Send(data []byte) error {
+	_, err := c.conn.WriteToUDP(data, c.server)
+	return err
+}
+
+// Receive waits for a packet from the forwarder, returning ErrTimeout if none
+// arrives in time.
+func (c *Client) Receive() ([]byte, error) {
+	buf := make([]byte, 65536)
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.conn.Read(buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close closes the client's socket. The forwarder only notices once the
+// client times out.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
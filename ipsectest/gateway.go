@@ -0,0 +1,158 @@
+package ipsectest
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Gateway is a simulated IPSEC gateway. It answers every IKEv2 request with
+// an empty response of the same exchange, taking a responder SPI for new IKE
+// SAs, and sends every ESP packet back with the SPI incremented, as the
+// outbound SA of the tunnel. NAT-T keepalives are counted but not answered.
+type Gateway struct {
+	addr *net.UDPAddr
+
+	mu         sync.Mutex
+	conn       *net.UDPConn // nil while down
+	received   int
+	keepalives int
+	peers      map[string]bool
+	wg         sync.WaitGroup
+}
+
+// NewGateway starts a gateway on a free loopback port.
+func NewGateway() (*Gateway, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	g := &Gateway{addr: conn.LocalAddr().(*net.UDPAddr), peers: make(map[string]bool)}
+	g.start(conn)
+	return g, nil
+}
+
+// Addr returns the address of the gateway, which stays the same while it is
+// down.
+func (g *Gateway) Addr() *net.UDPAddr {
+	return g.addr
+}
+
+// Received returns the number of packets received, keepalives included.
+func (g *Gateway) Received() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.received
+}
+
+// Keepalives returns the number of NAT-T keepalives received.
+func (g *Gateway) Keepalives() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.keepalives
+}
+
+// Peers returns the number of distinct addresses packets were received from,
+// one per client of the forwarder unless it pools its sockets.
+func (g *Gateway) Peers() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.peers)
+}
+
+// Down stops the gateway, so that packets sent to it draw ICMP port
+// unreachable errors and the forwarder's health checks fail.
+func (g *Gateway) Down() {
+	g.mu.Lock()
+	conn := g.conn
+	g.conn = nil
+	g.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	g.wg.Wait()
+}
+
+// Up starts the gateway again on its address after Down.
+func (g *Gateway) Up() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn != nil {
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", g.addr)
+	if err != nil {
+		return err
+	}
+	g.startLocked(conn)
+	return nil
+}
+
+// Close stops the gateway.
+func (g *Gateway) Close() error {
+	g.Down()
+	return nil
+}
+
+func (g *Gateway) start(conn *net.UDPConn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.startLocked(conn)
+}
+
+func (g *Gateway) startLocked(conn *net.UDPConn) {
+	g.conn = conn
+	g.wg.Add(1)
+	go g.serve(conn)
+}
+
+// serve answers the packets arriving on conn until it is closed.
+func (g *Gateway) serve(conn *net.UDPConn) {
+	defer g.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		data := buf[:n]
+
+		g.mu.Lock()
+		g.received++
+		g.peers[addr.String()] = true
+		keepalive := n == 1 && data[0] == 0xff
+		if keepalive {
+			g.keepalives++
+		}
+		g.mu.Unlock()
+
+		if reply := answer(data); !keepalive && reply != nil {
+			conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+// answer returns the reply of a gateway to data, or nil if there is none.
+func answer(data []byte) []byte {
+	if h, ok := ipsec.ParseIKE(data); ok {
+		if h.Response() {
+			return nil
+		}
+		if h.ResponderSPI == 0 {
+			h.ResponderSPI = rand.Uint64() | 1
+		}
+		h.Flags = ikeFlagResponse
+		return IKEMessage(h, len(data) >= 4 && binary.BigEndian.Uint32(data) == 0)
+	}
+	spi, seq, payload, ok := ParseESP(data)
+	if !ok {
+		return nil
+	}
+	return ESPPacket(spi+1, seq, payload)
+}
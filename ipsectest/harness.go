@@ -0,0 +1,98 @@
+package ipsectest
+
+import (
+	"net"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Harness is a forwarder in front of simulated gateways.
+type Harness struct {
+	Forwarder *ipsec.Forwarder
+	Gateways  []*Gateway
+
+	clients []*Client
+}
+
+// Start starts n gateways and a forwarder described by cfg in front of
+// them, listening on a free loopback port unless cfg.Listen is set. The
+// destinations of cfg are replaced by the gateways.
+func Start(cfg ipsec.Config, n int, opts ...ipsec.Option) (*Harness, error) {
+	h := &Harness{}
+	for i := 0; i < n; i++ {
+		g, err := NewGateway()
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.Gateways = append(h.Gateways, g)
+	}
+
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	cfg.Destinations = make([]ipsec.WeightedDest, n)
+	for i, g := range h.Gateways {
+		cfg.Destinations[i] = ipsec.WeightedDest{Addr: g.Addr().String(), Weight: 1}
+	}
+	f, err := ipsec.New(cfg, opts...)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.Forwarder = f
+	return h, nil
+}
+
+// NewClient returns a client of the forwarder, closed with the harness. It
+// uses the non-ESP marker as clients on the NAT-T port do.
+func (h *Harness) NewClient() (*Client, error) {
+	c, err := NewClient(h.Forwarder.LocalAddr().(*net.UDPAddr), true)
+	if err != nil {
+		return nil, err
+	}
+	h.clients = append(h.clients, c)
+	return c, nil
+}
+
+// Gateway returns the gateway the forwarder sends the client c to, or nil if
+// it has none.
+func (h *Harness) Gateway(c *Client) *Gateway {
+	addr := c.Addr().String()
+	for _, stat := range h.Forwarder.ClientStats() {
+		if stat.Addr != addr {
+			continue
+		}
+		for _, g := range h.Gateways {
+			if g.Addr().String() == stat.Destination {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// Connected reports whether the forwarder knows the client c.
+func (h *Harness) Connected(c *Client) bool {
+	addr := c.Addr().String()
+	for _, connected := range h.Forwarder.Connected() {
+		if connected == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the forwarder, the gateways and the clients.
+func (h *Harness) Close() error {
+	for _, c := range h.clients {
+		c.Close()
+	}
+	if h.Forwarder != nil {
+		h.Forwarder.Close()
+	}
+	for _, g := range h.Gateways {
+		g.Close()
+	}
+	return nil
+}
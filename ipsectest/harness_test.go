@@ -0,0 +1,126 @@
+package ipsectest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+	"github.com/bytejedi/ipsec-forward/ipsectest"
+)
+
+// start returns a harness of n gateways closed when the test ends.
+func start(t *testing.T, cfg ipsec.Config, n int) *ipsectest.Harness {
+	t.Helper()
+	h, err := ipsectest.Start(cfg, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// handshake returns a client of h with an established session.
+func handshake(t *testing.T, h *ipsectest.Harness) *ipsectest.Client {
+	t.Helper()
+	c, err := h.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSessionCreated(t *testing.T) {
+	h := start(t, ipsec.Config{Timeout: time.Minute}, 1)
+	c := handshake(t, h)
+	if !h.Connected(c) {
+		t.Fatal("client not connected after its handshake")
+	}
+	if g := h.Gateway(c); g != h.Gateways[0] {
+		t.Errorf("client sent to %v, want the gateway", g)
+	}
+	if got := h.Gateways[0].Peers(); got != 1 {
+		t.Errorf("gateway received from %d addresses, want 1", got)
+	}
+}
+
+func TestBidirectionalDelivery(t *testing.T) {
+	const packets = 20
+	h := start(t, ipsec.Config{Timeout: time.Minute}, 1)
+	c := handshake(t, h)
+	for i := 0; i < packets; i++ {
+		if err := c.RoundTrip([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	// Two IKE exchanges precede the ESP packets each way.
+	m := h.Forwarder.Metrics()
+	if m.PacketsToServer != packets+2 || m.PacketsToClient != packets+2 {
+		t.Errorf("%d packets forwarded to the gateway and %d back, want %d each way", m.PacketsToServer, m.PacketsToClient, packets+2)
+	}
+}
+
+func TestIdleClientExpires(t *testing.T) {
+	h := start(t, ipsec.Config{Timeout: 100 * time.Millisecond}, 1)
+	c := handshake(t, h)
+	if err := ipsectest.WaitFor(func() bool { return !h.Connected(c) }, 2*time.Second); err != nil {
+		t.Fatal("idle client not expired")
+	}
+	if got := h.Forwarder.Metrics().Disconnects; got != 1 {
+		t.Errorf("%d disconnects, want 1", got)
+	}
+
+	// The client comes back as a new session.
+	if err := c.RoundTrip([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Connected(c) {
+		t.Error("client not connected again after sending")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	h := start(t, ipsec.Config{Timeout: time.Minute, HealthInterval: 50 * time.Millisecond}, 2)
+	c := handshake(t, h)
+	c.SetTimeout(100 * time.Millisecond)
+	first := h.Gateway(c)
+	if first == nil {
+		t.Fatal("client has no gateway")
+	}
+
+	first.Down()
+	err := ipsectest.WaitFor(func() bool {
+		return c.RoundTrip([]byte("failover")) == nil && h.Gateway(c) != first
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatal("client not failed over to the other gateway")
+	}
+	if err := c.Handshake(); err != nil {
+		t.Errorf("handshake with the other gateway: %v", err)
+	}
+}
+
+func TestPooledClientAfterDPD(t *testing.T) {
+	h := start(t, ipsec.Config{Timeout: time.Minute, PoolSize: 1}, 1)
+	established := handshake(t, h)
+	if err := established.RoundTrip([]byte("established")); err != nil {
+		t.Fatal(err)
+	}
+	// Dead peer detection of the established client creates no SA, so the
+	// next unknown ESP SPI is not its.
+	if _, err := established.Exchange(ipsec.ExchangeInformational); err != nil {
+		t.Fatal(err)
+	}
+
+	c := handshake(t, h)
+	c.SetTimeout(time.Second)
+	if err := c.RoundTrip([]byte("new")); err != nil {
+		t.Fatalf("new client after DPD: %v", err)
+	}
+	if err := established.RoundTrip([]byte("established")); err != nil {
+		t.Errorf("established client after DPD: %v", err)
+	}
+}
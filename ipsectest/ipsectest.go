@@ -0,0 +1,82 @@
+// Package ipsectest provides simulated IPSEC clients and gateways exchanging
+// synthetic IKEv2 and ESP-in-UDP traffic, for end-to-end tests of the
+// forwarder in the manner of net/http/httptest. A Harness runs a forwarder
+// in front of a number of Gateways, and its Clients check that sessions are
+// established, packets are delivered both ways, idle clients time out and
+// clients fail over when their gateway goes down. Everything listens on the
+// loopback interface.
+package ipsectest
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// DefaultTimeout is how long a Client waits for a reply unless told
+// otherwise.
+const DefaultTimeout = 2 * time.Second
+
+// ErrTimeout is returned when an expected packet does not arrive in time.
+var ErrTimeout = errors.New("ipsectest: timed out")
+
+const (
+	ikeHeaderSize = 28
+	espHeaderSize = 8
+
+	ikeFlagInitiator = 0x08
+	ikeFlagResponse  = 0x20
+)
+
+// IKEMessage returns an IKEv2 message with header h and no payloads, its
+// length filled in, preceded by the non-ESP marker if marker is set as on
+// the NAT-T port.
+func IKEMessage(h ipsec.IKEHeader, marker bool) []byte {
+	var msg []byte
+	if marker {
+		msg = make([]byte, 4, 4+ikeHeaderSize)
+	}
+	var header [ikeHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:], h.InitiatorSPI)
+	binary.BigEndian.PutUint64(header[8:], h.ResponderSPI)
+	header[16] = h.NextPayload
+	header[17] = 0x20 // IKEv2
+	header[18] = h.ExchangeType
+	header[19] = h.Flags
+	binary.BigEndian.PutUint32(header[20:], h.MessageID)
+	binary.BigEndian.PutUint32(header[24:], ikeHeaderSize)
+	return append(msg, header[:]...)
+}
+
+// ESPPacket returns an ESP packet of the SA spi with sequence number seq
+// carrying payload, which stands in for the encrypted data.
+func ESPPacket(spi, seq uint32, payload []byte) []byte {
+	packet := make([]byte, espHeaderSize, espHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(packet, spi)
+	binary.BigEndian.PutUint32(packet[4:], seq)
+	return append(packet, payload...)
+}
+
+// ParseESP returns the SPI, sequence number and payload of the ESP packet
+// data, or false if it is too short or an IKE message or keepalive.
+func ParseESP(data []byte) (spi, seq uint32, payload []byte, ok bool) {
+	if len(data) < espHeaderSize || binary.BigEndian.Uint32(data) == 0 {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), data[espHeaderSize:], true
+}
+
+// WaitFor polls cond until it holds, returning ErrTimeout if it does not
+// within timeout, such as for a client to time out of the forwarder.
+func WaitFor(cond func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
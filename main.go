@@ -1,17 +1,149 @@
 package main
 
 import (
+    "context"
+    "encoding/hex"
     "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
     "time"
 
+    "github.com/bytejedi/ipsec-forward/accounting"
+    "github.com/bytejedi/ipsec-forward/admin"
+    "github.com/bytejedi/ipsec-forward/capture"
+    "github.com/bytejedi/ipsec-forward/cluster"
+    "github.com/bytejedi/ipsec-forward/control"
+    "github.com/bytejedi/ipsec-forward/debug"
+    "github.com/bytejedi/ipsec-forward/discovery"
     "github.com/bytejedi/ipsec-forward/ipsec"
+    "github.com/bytejedi/ipsec-forward/metrics"
+    "github.com/bytejedi/ipsec-forward/otlp"
+    "github.com/bytejedi/ipsec-forward/systemd"
+    "github.com/bytejedi/ipsec-forward/transport"
+    "github.com/bytejedi/ipsec-forward/xdp"
 
     "github.com/spf13/cobra"
     "github.com/spf13/viper"
 )
 
-const flagDestination = "destination"
+const (
+    flagConfig      = "config"
+    flagListen      = "listen"
+    flagDestination = "destination"
+    flagTimeout     = "timeout"
+    flagExpiry      = "expiry-resolution"
+    flagMaxClients  = "max-clients"
+    flagMaxSockets  = "max-sockets"
+    flagNewClients  = "max-new-clients"
+    flagSrcClients  = "max-new-clients-per-source"
+    flagBufferSize  = "buffer-size"
+    flagOutbound    = "outbound-addr"
+    flagSourcePorts = "source-ports"
+    flagPoolSize    = "pool-size"
+    flagESP         = "esp"
+    flagXDP         = "xdp"
+    flagXDPMode     = "xdp-mode"
+    flagDialTimeout = "dial-timeout"
+    flagDialRetries = "dial-retries"
+    flagFallback    = "dial-fallback"
+    flagAdminAddr   = "admin-addr"
+    flagAdminListen = "admin-listen"
+    flagLogLevel    = "log-level"
+    flagLogFormat   = "log-format"
+    flagListenIKE   = "listen-ike"
+    flagHealth      = "health-interval"
+    flagStrategy    = "lb-strategy"
+    flagSteering    = "steering-interval"
+    flagMetrics     = "metrics-listen"
+    flagDebug       = "debug-listen"
+    flagGRPC        = "grpc-listen"
+    flagShutdown    = "shutdown-timeout"
+    flagMaxPPS      = "max-pps"
+    flagMaxBW       = "max-bandwidth"
+    flagTransparent = "transparent"
+    flagUpstream    = "upstream"
+    flagEyeballs    = "happy-eyeballs"
+    flagImpair      = "impair"
+
+    flagListenRcvBuf   = "listen-receive-buffer"
+    flagListenSndBuf   = "listen-send-buffer"
+    flagListenTTL      = "listen-ttl"
+    flagListenDevice   = "listen-device"
+    flagOutboundRcvBuf = "outbound-receive-buffer"
+    flagOutboundSndBuf = "outbound-send-buffer"
+    flagOutboundTTL    = "outbound-ttl"
+    flagOutboundDevice = "outbound-device"
+    flagProxy       = "proxy-protocol"
+    flagMetadata    = "metadata-addr"
+    flagMirror      = "mirror"
+    flagMirrorDir   = "mirror-direction"
+    flagMirrorRatio = "mirror-ratio"
+    flagDSCP        = "dscp"
+    flagDSCPPass    = "dscp-passthrough"
+    flagMTU         = "mtu"
+    flagRelayICMP   = "relay-icmp"
+    flagBatchSize   = "batch-size"
+    flagUDPOffload  = "udp-offload"
+    flagListeners   = "listeners"
+    flagAllowCIDR   = "allow-cidr"
+    flagDenyCIDR    = "deny-cidr"
+    flagValidate    = "validate"
+    flagBan         = "ban-threshold"
+    flagBanWindow   = "ban-window"
+    flagBanDuration = "ban-duration"
+    flagIKECookies  = "ike-cookies"
+    flagAnswerKA    = "answer-keepalives"
+    flagIdleKA      = "keepalives-idle"
+    flagGoodbye     = "goodbye"
+    flagTrackIKE    = "track-ike-sessions"
+    flagRefresh     = "refresh-policy"
+    flagDiagnose    = "diagnose"
+    flagStateFile   = "state-file"
+    flagResolve     = "resolve-interval"
+    flagDstTimeout  = "destination-timeout"
+    flagCliTimeout  = "client-timeout"
+
+    flagClusterListen   = "cluster-listen"
+    flagClusterPeers    = "cluster-peers"
+    flagClusterInterval = "cluster-interval"
+
+    flagDiscovery         = "discovery"
+    flagDiscoveryInterval = "discovery-interval"
+
+    flagRTT = "rtt-interval"
+
+    flagAccounting         = "accounting"
+    flagAccountingSecret   = "accounting-secret"
+    flagAccountingInterval = "accounting-interval"
+    flagAuditLog           = "audit-log"
+    flagAuditMaxSize       = "audit-log-max-size"
+    flagAuditMaxFiles      = "audit-log-max-files"
+
+    flagOTLP = "otlp-endpoint"
+
+    flagCaptureFile     = "capture-file"
+    flagCaptureRemote   = "capture-remote"
+    flagCaptureClient   = "capture-client"
+    flagCaptureDst      = "capture-destination"
+    flagCaptureMaxSize  = "capture-max-size"
+    flagCaptureMaxFiles = "capture-max-files"
+)
+
+// strategyLatency is the --lb-strategy steering new clients to the fastest
+// destination, and strategyRTT the one steering them to the destination with
+// the lowest round trip time and jitter measured, see --rtt-interval.
+const (
+    strategyLatency = "latency"
+    strategyRTT     = "rtt"
+)
 
 func main() {
     rootCmd := &cobra.Command{
@@ -19,22 +151,910 @@ func main() {
         Short: "ipsecfwd is a IPSEC packets forwarder",
         Long: `forward IPSEC packets like a reverse NAT & supports multiple users`,
         RunE: func(cmd *cobra.Command, args []string) error {
-            dstIPs := viper.GetStringSlice(flagDestination)
-            if len(dstIPs) == 0 {
-               return errors.New("destination IPs required")
+            return run()
+        },
+    }
+    rootCmd.AddCommand(sessionsCommand())
+    rootCmd.AddCommand(healthCommand())
+    rootCmd.AddCommand(drainCommand())
+    rootCmd.AddCommand(benchCommand())
+    rootCmd.AddCommand(checkCommand())
+    rootCmd.AddCommand(statusCommand())
+    rootCmd.Flags().String(flagConfig, "", "Config file (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    rootCmd.Flags().String(flagListen, "0.0.0.0:4500", "Set the address to listen on, e.g. 192.0.2.1, [::]:4500 or :14500, the port defaults to 4500")
+    rootCmd.Flags().Int(flagListeners, 1, "Set the number of sockets receiving on the listen address, more than one requires Linux")
+    rootCmd.Flags().String(flagListenIKE, "", "Also forward IKE from this address, e.g. 0.0.0.0:500, to port 500 of the destinations, the port defaults to 500")
+    rootCmd.Flags().StringSliceP(flagDestination, "d", []string{}, "Set destination IPs to forward to, optionally weighted as IP=weight to receive a proportional share of new clients, and dialed from a local address as IP@source")
+    rootCmd.Flags().Duration(flagTimeout, time.Second*10, "Set the period of inactivity after which clients are disconnected")
+    rootCmd.Flags().Duration(flagExpiry, 0, "Disconnect inactive clients at most this long after their timeout, 0 for 1s or the shortest timeout if less")
+    rootCmd.Flags().StringSlice(flagDstTimeout, []string{}, "Override the timeout for the clients of a destination, as IP=duration")
+    rootCmd.Flags().StringSlice(flagCliTimeout, []string{}, "Override the timeout for clients in a network, as CIDR=duration")
+    rootCmd.Flags().Int(flagMaxClients, 0, "Set the maximum number of clients, 0 means no limit")
+    rootCmd.Flags().Int(flagMaxSockets, 0, "Refuse new clients once this many sockets to the destinations are open, 0 means no limit or the size of --source-ports")
+    rootCmd.Flags().Int(flagNewClients, 0, "Accept at most this many new clients per second, 0 means no limit")
+    rootCmd.Flags().Int(flagSrcClients, 0, "Accept at most this many new clients per second from each IP address or IPv6 /64, 0 means no limit")
+    rootCmd.Flags().StringSlice(flagAllowCIDR, []string{}, "Only accept clients from these networks, e.g. 192.0.2.0/24, default is all")
+    rootCmd.Flags().StringSlice(flagDenyCIDR, []string{}, "Drop packets from clients in these networks, even if allowed")
+    rootCmd.Flags().Int(flagBan, 0, "Ban sources sending this many invalid packets, new clients over the per-source limit or denied packets within --ban-window, 0 disables banning")
+    rootCmd.Flags().Duration(flagBanWindow, ipsec.DefaultBanWindow, "Set the window in which offences of a source are counted")
+    rootCmd.Flags().Duration(flagBanDuration, ipsec.DefaultBanDuration, "Set how long sources are banned")
+    rootCmd.Flags().Int(flagIKECookies, 0, "Answer the IKE_SA_INIT requests of new clients with an IKEv2 cookie once more than this many arrive per second, only forwarding clients that return it, 0 disables cookies")
+    rootCmd.Flags().Bool(flagValidate, false, "Drop packets from clients that are neither IKE, ESP nor NAT-T keepalives, such as those of scanners")
+    rootCmd.Flags().Int(flagMaxPPS, 0, "Limit each client to this many packets per second, 0 means no limit")
+    rootCmd.Flags().Int(flagMaxBW, 0, "Limit each client to this many bytes per second, 0 means no limit")
+    rootCmd.Flags().Int(flagBatchSize, 0, "Read and write up to this many packets per system call on Linux, 0 or 1 uses the portable path")
+    rootCmd.Flags().Bool(flagUDPOffload, false, "Use UDP GRO and GSO on Linux to move several packets per system call, where the kernel supports them")
+    rootCmd.Flags().Int(flagBufferSize, ipsec.DefaultBufferSize, "Set the size of the packet buffers, up to 65536; larger datagrams are dropped")
+    rootCmd.Flags().String(flagOutbound, "", "Set the local IP to connect to destinations from")
+    rootCmd.Flags().Int(flagListenRcvBuf, 0, "Set the kernel receive buffer of the listening sockets in bytes, 0 leaves it to the system")
+    rootCmd.Flags().Int(flagListenSndBuf, 0, "Set the kernel send buffer of the listening sockets in bytes, 0 leaves it to the system")
+    rootCmd.Flags().Int(flagListenTTL, 0, "Set the TTL of the packets sent to clients, 0 leaves it to the system (Linux only)")
+    rootCmd.Flags().String(flagListenDevice, "", "Bind the listening sockets to this network interface (Linux only)")
+    rootCmd.Flags().Int(flagOutboundRcvBuf, 0, "Set the kernel receive buffer of the sockets to destinations in bytes, 0 leaves it to the system")
+    rootCmd.Flags().Int(flagOutboundSndBuf, 0, "Set the kernel send buffer of the sockets to destinations in bytes, 0 leaves it to the system")
+    rootCmd.Flags().Int(flagOutboundTTL, 0, "Set the TTL of the packets sent to destinations, 0 leaves it to the system (Linux only)")
+    rootCmd.Flags().String(flagOutboundDevice, "", "Send to destinations through this network interface whatever the routes (Linux only)")
+    rootCmd.Flags().String(flagSourcePorts, "", "Connect to destinations from local ports in this range, e.g. 40000-40999, or a single port with --pool-size 1")
+    rootCmd.Flags().Int(flagPoolSize, 0, "Share this many sockets per destination among the clients, telling replies apart by their SPIs, 0 gives each client its own")
+    rootCmd.Flags().Bool(flagTransparent, false, "Connect to destinations from the clients' own addresses, requires Linux TPROXY routing and CAP_NET_ADMIN")
+    rootCmd.Flags().Duration(flagEyeballs, 0, "Connect to destinations whose hostname has IPv4 and IPv6 addresses over IPv6 first, falling back to IPv4 after this long without an answer, e.g. 250ms; 0 disables it")
+    rootCmd.Flags().String(flagUpstream, "", "Reach the destinations through an upstream proxy, e.g. socks5://[user:password@]host:port, rather than directly")
+    rootCmd.Flags().Bool(flagProxy, false, "Prepend a PROXY protocol v2 header with the client address to the first packet of each client, for destinations that understand it")
+    rootCmd.Flags().String(flagMirror, "", "Send a copy of the forwarded packets, with a PROXY protocol v2 header, to this UDP address, e.g. an IDS")
+    rootCmd.Flags().String(flagMirrorDir, ipsec.MirrorBoth, "Set which packets are mirrored: both, to-server or to-client")
+    rootCmd.Flags().Float64(flagMirrorRatio, 1, "Set the share of packets mirrored, between 0 and 1")
+    rootCmd.Flags().String(flagMetadata, "", "Announce the address of each client as JSON datagrams to this UDP address, for destinations that cannot take PROXY protocol")
+    rootCmd.Flags().String(flagDSCP, "", "Mark every forwarded packet with this DSCP class, e.g. EF, AF41 or 46, on Linux")
+    rootCmd.Flags().Bool(flagDSCPPass, false, "Copy the DSCP class of received packets onto the forwarded ones, on Linux")
+    rootCmd.Flags().Int(flagMTU, 0, "Drop forwarded packets larger than this MTU instead of fragmenting them, 0 leaves fragmentation to the system")
+    rootCmd.Flags().String(flagImpair, "", "Degrade the forwarded traffic for testing, e.g. loss=1%,delay=20ms±5ms,reorder=0.5%; never in production")
+    rootCmd.Flags().Bool(flagRelayICMP, false, "Answer packets too big for the path onward with ICMP fragmentation needed so path MTU discovery works, requires CAP_NET_RAW")
+    rootCmd.Flags().Bool(flagAnswerKA, false, "Answer NAT-T keepalives from clients instead of forwarding them")
+    rootCmd.Flags().Bool(flagIdleKA, false, "Disconnect clients that only send NAT-T keepalives after the timeout")
+    rootCmd.Flags().String(flagGoodbye, "", "Send this datagram, in hex, to the destination of each client that times out so the gateway can tear down its SAs")
+    rootCmd.Flags().String(flagRefresh, ipsec.RefreshBoth, "Set which packets keep clients from timing out: both, client or server")
+    rootCmd.Flags().Bool(flagTrackIKE, false, "Recognise clients by their IKE SPIs so that sessions survive client address changes")
+    rootCmd.Flags().Duration(flagDialTimeout, 0, "Set the time limit for connecting to a destination, 0 means no limit")
+    rootCmd.Flags().Int(flagDialRetries, 0, "Retry connecting to a destination this many times with exponential backoff")
+    rootCmd.Flags().Bool(flagFallback, false, "Send clients whose destination cannot be connected to to the next healthy destination")
+    rootCmd.Flags().String(flagStrategy, ipsec.StrategyRoundRobin, "Set how new clients are spread over destinations: round-robin, least-connections, source-hash, latency, which sends them to the destination answering ICMP echo fastest and requires CAP_NET_RAW, or rtt, which avoids destinations with a high round trip time or jitter, see --rtt-interval")
+    rootCmd.Flags().Duration(flagRTT, 0, "Measure the round trip time and jitter to the destinations, probing them this often, 0 disables it unless --lb-strategy is rtt")
+    rootCmd.Flags().Duration(flagSteering, ipsec.DefaultSteeringInterval, "Set how often destinations are measured by the latency strategy")
+    rootCmd.Flags().Duration(flagResolve, 0, "Re-resolve destinations given as hostnames this often so new clients follow DNS changes, 0 disables it")
+    rootCmd.Flags().Duration(flagHealth, 0, "Probe destinations this often and stop forwarding to dead ones, 0 disables health checks")
+    rootCmd.Flags().String(flagAdminListen, "", "Serve the admin HTTP API on this address, or on a Unix socket given as unix:path")
+    rootCmd.Flags().String(flagAdminAddr, "", "Serve the admin HTTP API on this address")
+    rootCmd.Flags().MarkDeprecated(flagAdminAddr, "use --admin-listen instead")
+    rootCmd.Flags().String(flagStateFile, "", "Save the destination of each client to this file on shutdown and restore it on start")
+    rootCmd.Flags().Duration(flagShutdown, time.Second*30, "Set how long to wait for clients to go idle when shutting down")
+    rootCmd.Flags().String(flagMetrics, "", "Serve Prometheus metrics at /metrics on this address")
+    rootCmd.Flags().String(flagGRPC, "", "Serve the gRPC control API of control/control.proto on this address")
+    rootCmd.Flags().String(flagCaptureFile, "", "Write the forwarded packets to this pcapng file")
+    rootCmd.Flags().String(flagCaptureRemote, "", "Stream the forwarded packets as pcapng over TCP to this collector")
+    rootCmd.Flags().StringSlice(flagCaptureClient, []string{}, "Only capture the packets of clients in these networks")
+    rootCmd.Flags().StringSlice(flagCaptureDst, []string{}, "Only capture the packets of these destinations, as host:port")
+    rootCmd.Flags().Int(flagCaptureMaxSize, 100, "Rotate the capture file once it reaches this many megabytes, 0 never rotates")
+    rootCmd.Flags().Int(flagCaptureMaxFiles, 5, "Keep this many rotated capture files")
+    rootCmd.Flags().String(flagDebug, "", "Serve pprof profiles, a goroutine dump and the session table under /debug/ on this address, keep it private")
+    rootCmd.Flags().Bool(flagDiagnose, false, "Log a timeline of the IKEv2 handshake of each client, telling whether the client or the gateway stopped answering")
+    rootCmd.Flags().String(flagLogLevel, "info", "Set the minimum level of messages logged: debug, info, warn or error")
+    rootCmd.Flags().String(flagLogFormat, "text", "Set the format of log messages: text or json")
+    rootCmd.Flags().Bool(flagESP, false, "Also forward native ESP (IP protocol 50) packets to the destination of each client's IKE, requires CAP_NET_RAW")
+    rootCmd.Flags().StringSlice(flagXDP, []string{}, "Forward the ESP-in-UDP packets of connected clients in the kernel with XDP on these interfaces, IPv4 only")
+    rootCmd.Flags().String(flagXDPMode, "auto", "Attach the XDP program in native or generic mode, or auto to let the driver decide")
+    rootCmd.Flags().String(flagClusterListen, "", "Receive the clients of cluster peers on this TCP address")
+    rootCmd.Flags().StringSlice(flagClusterPeers, []string{}, "Send the clients to these cluster peers, e.g. 10.0.0.2:4501")
+    rootCmd.Flags().Duration(flagClusterInterval, cluster.DefaultInterval, "Set how often the clients are sent to the cluster peers")
+    rootCmd.Flags().String(flagDiscovery, "", "Discover the destinations from a JSON file, an http(s) URL or kubernetes:namespace/service:port")
+    rootCmd.Flags().Duration(flagDiscoveryInterval, discovery.DefaultInterval, "Set how often the discovered destinations are refreshed")
+    rootCmd.Flags().String(flagAccounting, "", "Export a record of each client session to radius:host[:port], an http(s) webhook or a CSV file")
+    rootCmd.Flags().String(flagAccountingSecret, "", "Set the secret shared with the RADIUS accounting server")
+    rootCmd.Flags().Duration(flagAccountingInterval, 0, "Also export interim records of the connected clients this often, 0 disables them")
+    rootCmd.Flags().String(flagAuditLog, "", "Append a JSON line for each client session start and stop to this file, for compliance records")
+    rootCmd.Flags().Int(flagAuditMaxSize, 100, "Rotate the audit log once it reaches this many megabytes, 0 never rotates")
+    rootCmd.Flags().Int(flagAuditMaxFiles, 10, "Keep this many rotated audit logs")
+    rootCmd.Flags().String(flagOTLP, "", "Export spans of the client sessions to this OTLP/HTTP collector, e.g. http://localhost:4318")
+    viper.BindPFlags(rootCmd.Flags())
+    // The cluster settings form a section of the config file.
+    viper.BindPFlag("cluster.listen", rootCmd.Flags().Lookup(flagClusterListen))
+    viper.BindPFlag("cluster.peers", rootCmd.Flags().Lookup(flagClusterPeers))
+    viper.BindPFlag("cluster.interval", rootCmd.Flags().Lookup(flagClusterInterval))
+
+    if err := rootCmd.Execute(); err != nil {
+        os.Exit(1)
+    }
+}
+
+func run() error {
+    if err := readConfig(viper.GetString(flagConfig)); err != nil {
+        return err
+    }
+
+    source, err := discoverySource()
+    if err != nil {
+        return err
+    }
+    var dsts []ipsec.WeightedDest
+    if source != nil && len(viper.GetStringSlice(flagDestination)) == 0 {
+        dsts, err = discoveredDestinations(source)
+    } else {
+        dsts, err = destinations()
+    }
+    if err != nil {
+        return err
+    }
+
+    logger, err := newLogger()
+    if err != nil {
+        return err
+    }
+    cfg, err := config(dsts)
+    if err != nil {
+        return err
+    }
+    cfg.Logger = logger
+    accounter, err := accounter()
+    if err != nil {
+        return err
+    }
+    if accounter != nil {
+        if closer, ok := accounter.(io.Closer); ok {
+            defer closer.Close()
+        }
+        cfg.Accounting = accounter
+        cfg.AccountingInterval = viper.GetDuration(flagAccountingInterval)
+    }
+    if endpoint := viper.GetString(flagOTLP); endpoint != "" {
+        exporter, err := otlp.Start(otlp.Config{Endpoint: endpoint, Logger: logger})
+        if err != nil {
+            return err
+        }
+        defer exporter.Close()
+        cfg.Tracer = exporter
+    }
+    activated, err := systemd.Listeners()
+    if err != nil {
+        return err
+    }
+    cfg.ListenConns, cfg.ListenIKEConns = splitActivated(activated, cfg.ListenIKE)
+    var forwarder, ikeForwarder *ipsec.Forwarder
+    var pair *ipsec.Pair
+    if cfg.ListenIKE != "" {
+        cfg.Destinations = hostsOf(dsts)
+        pair, err = ipsec.ForwardPairContext(context.Background(), cfg)
+        if err != nil {
+            return err
+        }
+        forwarder, ikeForwarder = pair.NATT, pair.IKE
+        defer ikeForwarder.Close()
+    } else {
+        forwarder, err = ipsec.New(cfg)
+        if err != nil {
+            return err
+        }
+    }
+    defer forwarder.Close()
+    forwarders := []*ipsec.Forwarder{forwarder}
+    if ikeForwarder != nil {
+        forwarders = append(forwarders, ikeForwarder)
+    }
+
+    // Other protocols of the profiles section run alongside.
+    manager := ipsec.NewManager()
+    defer manager.Close()
+    manager.SetLogger(logger)
+    profiles, err := profiles(logger)
+    if err != nil {
+        return err
+    }
+    if err := manager.Apply(profiles); err != nil {
+        return err
+    }
+    all := append(append([]*ipsec.Forwarder(nil), forwarders...), manager.Forwarders()...)
+
+    c, err := startCapture()
+    if err != nil {
+        return err
+    }
+    if c != nil {
+        defer c.Close()
+        for _, f := range all {
+            f.SetTap(c.Tap)
+        }
+    }
+
+    var store persistent = forwarder
+    if pair != nil {
+        store = pair
+    }
+    statePath := viper.GetString(flagStateFile)
+    if statePath != "" {
+        if err := loadState(statePath, store); err != nil {
+            logger.Log(ipsec.LevelError, "failed to restore clients", "file", statePath, "err", err)
+        } else {
+            logger.Log(ipsec.LevelInfo, "restored clients", "file", statePath, "clients", len(forwarder.Connected()))
+        }
+    }
+
+    if viper.GetString("cluster.listen") != "" || len(viper.GetStringSlice("cluster.peers")) > 0 {
+        node, err := cluster.Start(store, cluster.Config{
+            Listen:   viper.GetString("cluster.listen"),
+            Peers:    viper.GetStringSlice("cluster.peers"),
+            Interval: viper.GetDuration("cluster.interval"),
+            Logger:   logger,
+        })
+        if err != nil {
+            return err
+        }
+        defer node.Close()
+    }
+
+    if source != nil {
+        watcher, err := startDiscovery(source, forwarder, pair, logger)
+        if err != nil {
+            return err
+        }
+        defer watcher.Close()
+    }
+
+    adminAddr := viper.GetString(flagAdminListen)
+    if adminAddr == "" {
+        adminAddr = viper.GetString(flagAdminAddr)
+    }
+    if adminAddr != "" {
+        var target admin.Target = forwarder
+        if pair != nil {
+            target = pair
+        }
+        l, err := admin.Listen(adminAddr)
+        if err != nil {
+            return err
+        }
+        defer l.Close()
+        go func() {
+            logger.Log(ipsec.LevelError, "admin API stopped", "err", http.Serve(l, admin.HandlerWithProfiles(target, manager)))
+        }()
+    }
+
+    if metricsAddr := viper.GetString(flagMetrics); metricsAddr != "" {
+        go func() {
+            logger.Log(ipsec.LevelError, "metrics server stopped", "err", metrics.ListenAndServe(metricsAddr, all...))
+        }()
+    }
+
+    if grpcAddr := viper.GetString(flagGRPC); grpcAddr != "" {
+        var target control.Target = forwarder
+        if pair != nil {
+            target = pair
+        }
+        events := make([]<-chan ipsec.Event, len(forwarders))
+        for i, f := range forwarders {
+            events[i] = f.Events()
+        }
+        go func() {
+            logger.Log(ipsec.LevelError, "gRPC control API stopped", "err", control.ListenAndServe(grpcAddr, target, events...))
+        }()
+    }
+
+    if debugAddr := viper.GetString(flagDebug); debugAddr != "" {
+        go func() {
+            logger.Log(ipsec.LevelError, "debug server stopped", "err", debug.ListenAndServe(debugAddr, all...))
+        }()
+    }
+
+    if viper.GetBool(flagESP) {
+        // Native ESP follows the destination of the client's IKE, which
+        // is negotiated on port 500.
+        ike := forwarder
+        if ikeForwarder != nil {
+            ike = ikeForwarder
+        }
+        espForwarder, err := forwardESP(ike, cfg.Listen)
+        if err != nil {
+            return err
+        }
+        defer espForwarder.Close()
+        espForwarder.SetLogger(logger)
+    }
+
+    if ifaces := viper.GetStringSlice(flagXDP); len(ifaces) > 0 {
+        mode, err := xdp.ParseMode(viper.GetString(flagXDPMode))
+        if err != nil {
+            return err
+        }
+        fastPath, err := xdp.Attach(ifaces, mode)
+        if err != nil {
+            return err
+        }
+        defer fastPath.Close()
+        forwarder.SetFastPath(fastPath)
+        logger.Log(ipsec.LevelInfo, "forwarding ESP in the kernel", "interfaces", strings.Join(ifaces, ","), "mode", mode)
+    }
+
+    stopWatchdog := make(chan struct{})
+    defer close(stopWatchdog)
+    if err := systemd.StartWatchdog(stopWatchdog); err != nil {
+        logger.Log(ipsec.LevelWarn, "systemd watchdog disabled", "err", err)
+    }
+    notify(logger, systemd.Ready)
+
+    // A forwarder that gave up on its listener ends the process, so that
+    // the service manager can restart it.
+    failed := make(chan error, 1)
+    for _, f := range all {
+        go func(errc <-chan error) {
+            if err := <-errc; err != nil {
+                select {
+                case failed <- err:
+                default:
+                }
             }
+        }(f.Err())
+    }
 
-            _, err := ipsec.Forward("0.0.0.0:4500", "0.0.0.0:4500", time.Second*10)
-            if err != nil {
-                return err
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+    var sig os.Signal
+    for {
+        select {
+        case sig = <-signals:
+        case err := <-failed:
+            notify(logger, systemd.Stopping)
+            return fmt.Errorf("forwarding stopped: %w", err)
+        }
+        if sig != syscall.SIGHUP {
+            break
+        }
+        notify(logger, systemd.Reloading)
+        if err := reload(forwarders, pair, manager); err != nil {
+            logger.Log(ipsec.LevelError, "failed to reload configuration", "err", err)
+        } else {
+            logger.Log(ipsec.LevelInfo, "reloaded configuration")
+        }
+        notify(logger, systemd.Ready)
+    }
+    notify(logger, systemd.Stopping)
+    logger.Log(ipsec.LevelInfo, "shutting down", "signal", sig, "clients", len(forwarder.Connected()))
+    if statePath != "" {
+        if err := saveState(statePath, store); err != nil {
+            logger.Log(ipsec.LevelError, "failed to save clients", "file", statePath, "err", err)
+        }
+    }
+
+    // Let the clients go idle, unless a second signal asks to hurry up.
+    ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration(flagShutdown))
+    defer cancel()
+    go func() {
+        select {
+        case sig := <-signals:
+            logger.Log(ipsec.LevelInfo, "dropping remaining clients", "signal", sig)
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for _, f := range all {
+        wg.Add(1)
+        go func(f *ipsec.Forwarder) {
+            defer wg.Done()
+            if err := f.Shutdown(ctx); err != nil {
+                logger.Log(ipsec.LevelWarn, "shutdown cut short", "err", err)
             }
-            select {}
+        }(f)
+    }
+    wg.Wait()
+    return nil
+}
+
+// config returns the forwarder configuration given by the flags, config file
+// and environment.
+func config(dsts []ipsec.WeightedDest) (ipsec.Config, error) {
+    listen, err := listenAddr(viper.GetString(flagListen), ipsec.NATTPort)
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    listenIKE, err := listenAddr(viper.GetString(flagListenIKE), ipsec.IKEPort)
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    allow, deny, err := acl()
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    clientTimeouts, err := parseClientTimeouts(viper.GetStringSlice(flagCliTimeout))
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    portMin, portMax, err := parsePortRange(viper.GetString(flagSourcePorts))
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    goodbye, err := hex.DecodeString(viper.GetString(flagGoodbye))
+    if err != nil {
+        return ipsec.Config{}, fmt.Errorf("invalid %s: %w", flagGoodbye, err)
+    }
+    var upstream ipsec.Transport
+    if spec := viper.GetString(flagUpstream); spec != "" {
+        if upstream, err = transport.Parse(spec); err != nil {
+            return ipsec.Config{}, err
+        }
+    }
+    impairment, err := ipsec.ParseImpairment(viper.GetString(flagImpair))
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    strategy, steering := viper.GetString(flagStrategy), ipsec.Steering(nil)
+    rttInterval := viper.GetDuration(flagRTT)
+    switch strategy {
+    case strategyLatency:
+        strategy, steering = "", ipsec.NewLatencySteering(nil)
+    case strategyRTT:
+        strategy, steering = "", ipsec.RTTSteering{}
+        if rttInterval <= 0 {
+            rttInterval = ipsec.DefaultRTTInterval
+        }
+    }
+
+    return ipsec.Config{
+        Listen:         listen,
+        ListenIKE:      listenIKE,
+        Listeners:      viper.GetInt(flagListeners),
+        Destinations:   dsts,
+        Timeout:        viper.GetDuration(flagTimeout),
+        MaxClients:     viper.GetInt(flagMaxClients),
+        SocketLimit:    viper.GetInt(flagMaxSockets),
+        BufferSize:     viper.GetInt(flagBufferSize),
+        BatchSize:      viper.GetInt(flagBatchSize),
+        UDPOffload:     viper.GetBool(flagUDPOffload),
+        RateLimit:      viper.GetInt(flagMaxPPS),
+        RateBurst:      viper.GetInt(flagMaxPPS),
+        Bandwidth:      viper.GetInt(flagMaxBW),
+        DialTimeout:    viper.GetDuration(flagDialTimeout),
+        DialRetries:    viper.GetInt(flagDialRetries),
+        DialFallback:   viper.GetBool(flagFallback),
+        OutboundAddr:   viper.GetString(flagOutbound),
+        SourcePortMin:  portMin,
+        SourcePortMax:  portMax,
+        PoolSize:       viper.GetInt(flagPoolSize),
+        Transparent:    viper.GetBool(flagTransparent),
+        Transport:      upstream,
+        HappyEyeballs:  viper.GetDuration(flagEyeballs),
+        ProxyProtocol:  viper.GetBool(flagProxy),
+        MetadataAddr:   viper.GetString(flagMetadata),
+        MirrorAddr:     viper.GetString(flagMirror),
+        Strategy:       strategy,
+        HealthInterval: viper.GetDuration(flagHealth),
+        RTTInterval:    rttInterval,
+        Allow:          allow,
+        Deny:           deny,
+
+        ClientTimeouts:   clientTimeouts,
+        ExpiryResolution: viper.GetDuration(flagExpiry),
+        ListenerOptions: ipsec.SocketOptions{
+            ReceiveBuffer: viper.GetInt(flagListenRcvBuf),
+            SendBuffer:    viper.GetInt(flagListenSndBuf),
+            TTL:           viper.GetInt(flagListenTTL),
+            Device:        viper.GetString(flagListenDevice),
         },
+        OutboundOptions: ipsec.SocketOptions{
+            ReceiveBuffer: viper.GetInt(flagOutboundRcvBuf),
+            SendBuffer:    viper.GetInt(flagOutboundSndBuf),
+            TTL:           viper.GetInt(flagOutboundTTL),
+            Device:        viper.GetString(flagOutboundDevice),
+        },
+        AnswerKeepalives: viper.GetBool(flagAnswerKA),
+        KeepalivesIdle:   viper.GetBool(flagIdleKA),
+        Goodbye:          goodbye,
+        TrackIKESessions: viper.GetBool(flagTrackIKE),
+        RefreshPolicy:    viper.GetString(flagRefresh),
+        Diagnose:         viper.GetBool(flagDiagnose),
+        Validate:         viper.GetBool(flagValidate),
+        MirrorDirection:  viper.GetString(flagMirrorDir),
+        MirrorRatio:      viper.GetFloat64(flagMirrorRatio),
+        ResolveInterval:  viper.GetDuration(flagResolve),
+        DSCP:             viper.GetString(flagDSCP),
+        DSCPPassthrough:  viper.GetBool(flagDSCPPass),
+        MTU:              viper.GetInt(flagMTU),
+        RelayICMP:        viper.GetBool(flagRelayICMP),
+        Impairment:       impairment,
+        Steering:         steering,
+        SteeringInterval: viper.GetDuration(flagSteering),
+
+        NewConnRate:           float64(viper.GetInt(flagNewClients)),
+        NewConnBurst:          viper.GetInt(flagNewClients),
+        NewConnRatePerSource:  float64(viper.GetInt(flagSrcClients)),
+        NewConnBurstPerSource: viper.GetInt(flagSrcClients),
+
+        BanThreshold: viper.GetInt(flagBan),
+        BanWindow:    viper.GetDuration(flagBanWindow),
+        BanDuration:  viper.GetDuration(flagBanDuration),
+
+        IKECookies: viper.GetInt(flagIKECookies),
+    }, nil
+}
+
+// splitActivated splits the sockets passed by systemd socket activation into
+// those to listen on for NAT-T and those on the port of listenIKE, if set, to
+// listen on for IKE.
+func splitActivated(conns []*net.UDPConn, listenIKE string) (natt, ike []*net.UDPConn) {
+    ikePort := -1
+    if listenIKE != "" {
+        if _, port, err := net.SplitHostPort(listenIKE); err == nil {
+            ikePort, _ = strconv.Atoi(port)
+        }
     }
-    rootCmd.Flags().StringSliceP(flagDestination, "d", []string{}, "Set destination IPs to forward to")
-    viper.BindPFlag(flagDestination, rootCmd.Flags().Lookup(flagDestination))
+    for _, conn := range conns {
+        if conn.LocalAddr().(*net.UDPAddr).Port == ikePort {
+            ike = append(ike, conn)
+        } else {
+            natt = append(natt, conn)
+        }
+    }
+    return natt, ike
+}
 
-    if err := rootCmd.Execute(); err != nil {
-        os.Exit(1)
+// notify reports state to systemd, if it started the process.
+func notify(logger ipsec.Logger, state string) {
+    if _, err := systemd.Notify(state); err != nil {
+        logger.Log(ipsec.LevelWarn, "failed to notify systemd", "state", state, "err", err)
+    }
+}
+
+// acl returns the client networks to allow and deny.
+func acl() (allow, deny []net.IPNet, err error) {
+    allow, err = ipsec.ParseCIDRs(viper.GetStringSlice(flagAllowCIDR))
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid %s: %w", flagAllowCIDR, err)
+    }
+    deny, err = ipsec.ParseCIDRs(viper.GetStringSlice(flagDenyCIDR))
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid %s: %w", flagDenyCIDR, err)
+    }
+    return allow, deny, nil
+}
+
+// startCapture returns the packet capture selected by the flags, or nil.
+func startCapture() (*capture.Capture, error) {
+    clients, err := ipsec.ParseCIDRs(viper.GetStringSlice(flagCaptureClient))
+    if err != nil {
+        return nil, fmt.Errorf("invalid %s: %w", flagCaptureClient, err)
+    }
+    filter := capture.Filter{Clients: clients, Destinations: viper.GetStringSlice(flagCaptureDst)}
+
+    if path := viper.GetString(flagCaptureFile); path != "" {
+        maxSize := int64(viper.GetInt(flagCaptureMaxSize)) << 20
+        return capture.Create(path, maxSize, viper.GetInt(flagCaptureMaxFiles), filter)
+    }
+    if addr := viper.GetString(flagCaptureRemote); addr != "" {
+        return capture.Dial(addr, filter)
+    }
+    return nil, nil
+}
+
+// newLogger returns the logger selected by the log level and format.
+func newLogger() (ipsec.Logger, error) {
+    level, err := ipsec.ParseLogLevel(viper.GetString(flagLogLevel))
+    if err != nil {
+        return nil, err
+    }
+    switch format := viper.GetString(flagLogFormat); format {
+    case "text":
+        return ipsec.NewStdLogger(nil, level), nil
+    case "json":
+        return ipsec.NewJSONLogger(os.Stderr, level), nil
+    default:
+        return nil, fmt.Errorf("unknown log format %q", format)
+    }
+}
+
+// accounter returns the exporter of --accounting and --audit-log, or nil if
+// both are unset.
+func accounter() (ipsec.Accounter, error) {
+    var accounters []ipsec.Accounter
+    if path := viper.GetString(flagAuditLog); path != "" {
+        maxSize := int64(viper.GetInt(flagAuditMaxSize)) << 20
+        audit, err := accounting.OpenAuditLog(path, maxSize, viper.GetInt(flagAuditMaxFiles))
+        if err != nil {
+            return nil, err
+        }
+        accounters = append(accounters, audit)
+    }
+    if spec := viper.GetString(flagAccounting); spec != "" {
+        exporter, err := accounting.Parse(spec, viper.GetString(flagAccountingSecret))
+        if err != nil {
+            for _, accounter := range accounters {
+                accounter.(io.Closer).Close()
+            }
+            return nil, err
+        }
+        accounters = append(accounters, exporter)
+    }
+    switch len(accounters) {
+    case 0:
+        return nil, nil
+    case 1:
+        return accounters[0], nil
+    }
+    return accounting.Multi(accounters...), nil
+}
+
+// listenAddr validates a listen address, adding port if addr is only a host.
+// An empty addr stays empty.
+func listenAddr(addr, port string) (string, error) {
+    if addr == "" {
+        return "", nil
+    }
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+        addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+    }
+    if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+        return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+    }
+    return addr, nil
+}
+
+// reload re-reads the configuration and applies the destinations, timeout and
+// client networks to the running forwarders and the profiles to manager.
+// Clients of removed destinations stay with them until they disconnect.
+func reload(forwarders []*ipsec.Forwarder, pair *ipsec.Pair, manager *ipsec.Manager) error {
+    if err := readConfig(viper.GetString(flagConfig)); err != nil {
+        return err
+    }
+    dsts, err := destinations()
+    if err != nil {
+        return err
+    }
+    allow, deny, err := acl()
+    if err != nil {
+        return err
+    }
+    clientTimeouts, err := parseClientTimeouts(viper.GetStringSlice(flagCliTimeout))
+    if err != nil {
+        return err
+    }
+
+    // Discovered destinations are kept.
+    if viper.GetString(flagDiscovery) == "" {
+        if pair != nil {
+            err = pair.SetDestinations(hostsOf(dsts))
+        } else {
+            err = forwarders[0].SetDestinations(dsts)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    for _, forwarder := range forwarders {
+        forwarder.SetTimeout(viper.GetDuration(flagTimeout))
+        forwarder.SetACL(allow, deny)
+        forwarder.SetClientTimeouts(clientTimeouts)
+    }
+
+    logger, err := newLogger()
+    if err != nil {
+        return err
+    }
+    profiles, err := profiles(logger)
+    if err != nil {
+        return err
+    }
+    return manager.Apply(profiles)
+}
+
+// persistent is a forwarder or pair of forwarders whose clients can be saved
+// and restored.
+type persistent interface {
+    SaveState(w io.Writer) error
+    LoadState(r io.Reader) error
+}
+
+// loadState restores the clients saved in the file at path. A missing file is
+// not an error.
+func loadState(path string, p persistent) error {
+    file, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    return p.LoadState(file)
+}
+
+// saveState saves the clients to the file at path, replacing it only once
+// they are all written.
+func saveState(path string, p persistent) error {
+    tmp := path + ".tmp"
+    file, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    err = p.SaveState(file)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// readConfig reads the config file at path, or looks for ipsecfwd.{yaml,toml,...}
+// in the usual places when path is empty. A missing default config file is
+// not an error. Settings are named after the flags, see ipsecfwd.example.yaml,
+// and are overridden by flags and environment variables.
+func readConfig(path string) error {
+    // Every setting can also be given in the environment, e.g. --max-clients
+    // as IPSECFWD_MAX_CLIENTS and cluster.peers as IPSECFWD_CLUSTER_PEERS.
+    viper.SetEnvPrefix("ipsecfwd")
+    viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+    viper.AutomaticEnv()
+
+    if path != "" {
+        viper.SetConfigFile(path)
+        return viper.ReadInConfig()
+    }
+
+    viper.SetConfigName("ipsecfwd")
+    viper.AddConfigPath(".")
+    viper.AddConfigPath("/etc/ipsecfwd")
+    if err := viper.ReadInConfig(); err != nil {
+        var notFound viper.ConfigFileNotFoundError
+        if !errors.As(err, &notFound) {
+            return err
+        }
+    }
+    return nil
+}
+
+// destinations returns the destinations given by the flags, config file and
+// environment, with their timeouts.
+func destinations() ([]ipsec.WeightedDest, error) {
+    dstIPs := viper.GetStringSlice(flagDestination)
+    if len(dstIPs) == 0 {
+        return nil, errors.New("destination IPs required")
+    }
+    dsts, err := parseDestinations(dstIPs)
+    if err != nil {
+        return nil, err
+    }
+    if err := setDestinationTimeouts(dsts, viper.GetStringSlice(flagDstTimeout)); err != nil {
+        return nil, err
+    }
+    return dsts, nil
+}
+
+// setDestinationTimeouts sets the timeouts given as addr=duration on the
+// destinations with the same address.
+func setDestinationTimeouts(dsts []ipsec.WeightedDest, entries []string) error {
+    for _, entry := range entries {
+        addr, timeout, err := splitTimeout(entry)
+        if err != nil {
+            return err
+        }
+        addrs, err := ipsec.ValidateDestinations([]string{addr})
+        if err != nil {
+            return err
+        }
+        found := false
+        for i := range dsts {
+            if dsts[i].Addr == addrs[0] {
+                dsts[i].Timeout, found = timeout, true
+            }
+        }
+        if !found {
+            return fmt.Errorf("timeout given for unknown destination %q", addr)
+        }
+    }
+    return nil
+}
+
+// parseClientTimeouts parses the timeouts of client networks given as
+// cidr=duration.
+func parseClientTimeouts(entries []string) ([]ipsec.ClientTimeout, error) {
+    var rules []ipsec.ClientTimeout
+    for _, entry := range entries {
+        cidr, timeout, err := splitTimeout(entry)
+        if err != nil {
+            return nil, err
+        }
+        nets, err := ipsec.ParseCIDRs([]string{cidr})
+        if err != nil {
+            return nil, fmt.Errorf("invalid network in client timeout %q: %w", entry, err)
+        }
+        rules = append(rules, ipsec.ClientTimeout{Network: nets[0], Timeout: timeout})
+    }
+    return rules, nil
+}
+
+// parsePortRange parses a port range of the form min-max, or a single port.
+// An empty range is zero for both.
+func parsePortRange(s string) (min, max int, err error) {
+    if s == "" {
+        return 0, 0, nil
+    }
+    first, last := s, s
+    if i := strings.Index(s, "-"); i >= 0 {
+        first, last = s[:i], s[i+1:]
+    }
+    min, err = strconv.Atoi(first)
+    if err == nil {
+        max, err = strconv.Atoi(last)
+    }
+    if err != nil {
+        return 0, 0, fmt.Errorf("invalid port range %q", s)
+    }
+    return min, max, nil
+}
+
+// splitTimeout splits an entry of the form key=duration.
+func splitTimeout(entry string) (string, time.Duration, error) {
+    i := strings.LastIndex(entry, "=")
+    if i < 0 {
+        return "", 0, fmt.Errorf("missing timeout in %q", entry)
+    }
+    timeout, err := time.ParseDuration(entry[i+1:])
+    if err != nil || timeout <= 0 {
+        return "", 0, fmt.Errorf("invalid timeout in %q", entry)
+    }
+    return entry[:i], timeout, nil
+}
+
+// parseDestinations parses destinations of the form addr or addr=weight,
+// validating and normalizing the addresses.
+func parseDestinations(entries []string) ([]ipsec.WeightedDest, error) {
+    addrs := make([]string, len(entries))
+    weights := make([]int, len(entries))
+    sources := make([]string, len(entries))
+    for i, entry := range entries {
+        addrs[i], weights[i] = entry, 1
+        if j := strings.LastIndex(entry, "="); j >= 0 {
+            weight, err := strconv.Atoi(entry[j+1:])
+            if err != nil || weight <= 0 {
+                return nil, fmt.Errorf("invalid weight in destination %q", entry)
+            }
+            addrs[i], weights[i] = entry[:j], weight
+        }
+        if j := strings.LastIndex(addrs[i], "@"); j >= 0 {
+            source := strings.Trim(addrs[i][j+1:], "[]")
+            if net.ParseIP(source) == nil {
+                return nil, fmt.Errorf("invalid source address in destination %q", entry)
+            }
+            addrs[i], sources[i] = addrs[i][:j], source
+        }
+    }
+
+    addrs, err := ipsec.ValidateDestinations(addrs)
+    if err != nil {
+        return nil, err
+    }
+
+    dsts := make([]ipsec.WeightedDest, len(addrs))
+    for i := range addrs {
+        dsts[i] = ipsec.WeightedDest{Addr: addrs[i], Weight: weights[i], Source: sources[i]}
+    }
+    return dsts, nil
+}
+
+// hostsOf strips the ports from dsts.
+func hostsOf(dsts []ipsec.WeightedDest) []ipsec.WeightedDest {
+    hosts := make([]ipsec.WeightedDest, len(dsts))
+    for i, dst := range dsts {
+        hosts[i] = dst
+        hosts[i].Addr, _, _ = net.SplitHostPort(dst.Addr)
+    }
+    return hosts
+}
+
+// forwardESP starts forwarding the native ESP of the clients of ike received
+// on the host of the listen address.
+func forwardESP(ike *ipsec.Forwarder, listen string) (*ipsec.ESPForwarder, error) {
+    listenHost, _, err := net.SplitHostPort(listen)
+    if err != nil {
+        return nil, err
     }
+    return ike.ForwardESP(listenHost)
 }
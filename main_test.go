@@ -0,0 +1,102 @@
+package main
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/bytejedi/ipsec-forward/ipsec"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+)
+
+func TestReadConfigFile(t *testing.T) {
+    t.Cleanup(viper.Reset)
+    path := filepath.Join(t.TempDir(), "ipsecfwd.yaml")
+    err := ioutil.WriteFile(path, []byte(`
+listen: 127.0.0.1:4500
+destination:
+  - 192.0.2.10
+  - 192.0.2.11:4501=3
+destination-timeout:
+  - 192.0.2.10=90s
+timeout: 2m
+max-clients: 100
+buffer-size: 9000
+allow-cidr:
+  - 198.51.100.0/24
+`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := readConfig(path); err != nil {
+        t.Fatal(err)
+    }
+
+    dsts, err := destinations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(dsts) != 2 ||
+        dsts[0].Addr != "192.0.2.10:4500" || dsts[0].Weight != 1 || dsts[0].Timeout != 90*time.Second ||
+        dsts[1].Addr != "192.0.2.11:4501" || dsts[1].Weight != 3 || dsts[1].Timeout != 0 {
+        t.Errorf("destinations %+v, want those of the config file", dsts)
+    }
+    cfg, err := config(dsts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Listen != "127.0.0.1:4500" || cfg.Timeout != 2*time.Minute || cfg.MaxClients != 100 {
+        t.Errorf("listen %q, timeout %v and max clients %d, want those of the config file", cfg.Listen, cfg.Timeout, cfg.MaxClients)
+    }
+    if cfg.BufferSize != 9000 {
+        t.Errorf("buffer size %d, want 9000 of the config file", cfg.BufferSize)
+    }
+    if len(cfg.Allow) != 1 || cfg.Allow[0].String() != "198.51.100.0/24" {
+        t.Errorf("allowed networks %v, want those of the config file", cfg.Allow)
+    }
+}
+
+func TestReadConfigFileFlagOverrides(t *testing.T) {
+    t.Cleanup(viper.Reset)
+    path := filepath.Join(t.TempDir(), "ipsecfwd.yaml")
+    err := ioutil.WriteFile(path, []byte(`
+max-clients: 100
+buffer-size: 9000
+`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A flag given on the command line wins over the config file, one left
+    // at its default does not.
+    cmd := &cobra.Command{}
+    cmd.Flags().Int(flagMaxClients, 0, "")
+    cmd.Flags().Int(flagBufferSize, ipsec.DefaultBufferSize, "")
+    viper.BindPFlags(cmd.Flags())
+    if err := cmd.Flags().Set(flagMaxClients, "200"); err != nil {
+        t.Fatal(err)
+    }
+    if err := readConfig(path); err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := config(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.MaxClients != 200 {
+        t.Errorf("max clients %d, want 200 of the flag", cfg.MaxClients)
+    }
+    if cfg.BufferSize != 9000 {
+        t.Errorf("buffer size %d, want 9000 of the config file", cfg.BufferSize)
+    }
+}
+
+func TestReadConfigFileMissing(t *testing.T) {
+    t.Cleanup(viper.Reset)
+    if err := readConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+        t.Error("missing config file given explicitly accepted")
+    }
+}
@@ -0,0 +1,142 @@
+// Package metrics serves the metrics of IPSEC packet forwarders in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// Handler returns an http.Handler serving the metrics of the forwarders,
+// labelled with the address each one listens on.
+func Handler(forwarders ...*ipsec.Forwarder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		Write(bw, forwarders...)
+		bw.Flush()
+	})
+}
+
+// ListenAndServe serves the metrics of the forwarders at /metrics on addr.
+func ListenAndServe(addr string, forwarders ...*ipsec.Forwarder) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(forwarders...))
+	return http.ListenAndServe(addr, mux)
+}
+
+type sample struct {
+	labels []string // alternating names and values
+	value  float64
+}
+
+type family struct {
+	name, help, typ string
+	samples         []sample
+}
+
+// Write writes the metrics of the forwarders to w in the Prometheus text
+// exposition format.
+func Write(w *bufio.Writer, forwarders ...*ipsec.Forwarder) {
+	families := []*family{
+		{name: "ipsecfwd_packets_total", help: "Packets forwarded.", typ: "counter"},
+		{name: "ipsecfwd_bytes_total", help: "Bytes forwarded.", typ: "counter"},
+		{name: "ipsecfwd_clients", help: "Clients currently known.", typ: "gauge"},
+		{name: "ipsecfwd_connects_total", help: "Client sessions started.", typ: "counter"},
+		{name: "ipsecfwd_disconnects_total", help: "Client sessions ended.", typ: "counter"},
+		{name: "ipsecfwd_keepalives_total", help: "NAT-T keepalives received.", typ: "counter"},
+		{name: "ipsecfwd_dropped_packets_total", help: "Packets dropped.", typ: "counter"},
+		{name: "ipsecfwd_destination_bytes_total", help: "Bytes forwarded per destination.", typ: "counter"},
+		{name: "ipsecfwd_destination_clients", help: "Clients currently forwarded to each destination.", typ: "gauge"},
+		{name: "ipsecfwd_destination_up", help: "Whether each destination passes its health checks.", typ: "gauge"},
+		{name: "ipsecfwd_destination_rtt_seconds", help: "Smoothed round trip time to each destination measured.", typ: "gauge"},
+		{name: "ipsecfwd_destination_jitter_seconds", help: "Jitter of the round trip time to each destination measured.", typ: "gauge"},
+		{name: "ipsecfwd_outbound_sockets", help: "Sockets to the destinations open.", typ: "gauge"},
+		{name: "ipsecfwd_outbound_socket_limit", help: "Limit of sockets to the destinations, 0 if unlimited.", typ: "gauge"},
+		{name: "ipsecfwd_errors_total", help: "Errors by operation and class.", typ: "counter"},
+	}
+	packets, bytes, clients, connects, disconnects, keepalives, drops, dstBytes, dstClients, dstUp :=
+		families[0], families[1], families[2], families[3], families[4], families[5], families[6], families[7], families[8], families[9]
+	dstRTT, dstJitter := families[10], families[11]
+	sockets, socketLimit, errs := families[12], families[13], families[14]
+
+	for _, f := range forwarders {
+		listener := f.LocalAddr().String()
+		m := f.Metrics()
+
+		packets.add(m.PacketsToServer, "listener", listener, "direction", "to_server")
+		packets.add(m.PacketsToClient, "listener", listener, "direction", "to_client")
+		bytes.add(m.BytesToServer, "listener", listener, "direction", "to_server")
+		bytes.add(m.BytesToClient, "listener", listener, "direction", "to_client")
+		clients.add(m.Clients, "listener", listener)
+		sockets.add(m.OutboundSockets, "listener", listener)
+		socketLimit.add(m.OutboundSocketLimit, "listener", listener)
+		connects.add(m.Connects, "listener", listener)
+		disconnects.add(m.Disconnects, "listener", listener)
+		keepalives.add(m.KeepalivesFromClient, "listener", listener, "direction", "from_client")
+		keepalives.add(m.KeepalivesFromServer, "listener", listener, "direction", "from_server")
+
+		reasons := make([]string, 0, len(m.Drops))
+		for reason := range m.Drops {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			drops.add(m.Drops[reason], "listener", listener, "reason", reason)
+		}
+		for _, e := range m.Errors {
+			errs.add(e.Count, "listener", listener, "op", e.Op, "class", e.Class.String())
+		}
+
+		for _, dst := range m.Destinations {
+			dstBytes.add(dst.BytesToServer, "listener", listener, "destination", dst.Addr, "direction", "to_server")
+			dstBytes.add(dst.BytesToClient, "listener", listener, "destination", dst.Addr, "direction", "to_client")
+			dstClients.add(dst.Clients, "listener", listener, "destination", dst.Addr)
+			up := int64(0)
+			if dst.Healthy {
+				up = 1
+			}
+			dstUp.add(up, "listener", listener, "destination", dst.Addr)
+			if dst.RTT > 0 {
+				dstRTT.addFloat(dst.RTT.Seconds(), "listener", listener, "destination", dst.Addr)
+				dstJitter.addFloat(dst.Jitter.Seconds(), "listener", listener, "destination", dst.Addr)
+			}
+		}
+	}
+
+	for _, fam := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.typ)
+		for _, s := range fam.samples {
+			w.WriteString(fam.name)
+			w.WriteByte('{')
+			for i := 0; i < len(s.labels); i += 2 {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", s.labels[i], escape(s.labels[i+1]))
+			}
+			fmt.Fprintf(w, "} %s\n", strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+}
+
+func (fam *family) add(value int64, labels ...string) {
+	fam.addFloat(float64(value), labels...)
+}
+
+func (fam *family) addFloat(value float64, labels ...string) {
+	fam.samples = append(fam.samples, sample{labels: labels, value: value})
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes a label value.
+func escape(value string) string {
+	return escaper.Replace(value)
+}
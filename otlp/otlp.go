@@ -0,0 +1,458 @@
+// Package otlp exports the spans of the sessions of IPSEC packet forwarders
+// to an OpenTelemetry collector over OTLP/HTTP, encoded as JSON, so that they
+// can be followed in any tracing backend without linking the OpenTelemetry
+// SDK. An Exporter is the ipsec.Tracer to pass to
+// ipsec.Forwarder.SetTracer.
+//
+// Ended spans are queued and posted in batches to the /v1/traces endpoint of
+// the collector every interval, or as soon as a batch is full. Spans ended
+// while the queue is full are dropped and counted rather than slowing down
+// forwarding.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+const (
+	// DefaultInterval is how often the queued spans are posted unless
+	// configured otherwise.
+	DefaultInterval = 5 * time.Second
+
+	// DefaultService is the service.name of the spans unless configured
+	// otherwise.
+	DefaultService = "ipsec-forward"
+
+	// QueueSize is the number of ended spans queued for posting, beyond
+	// which spans are dropped.
+	QueueSize = 4096
+
+	// MaxBatch is the most spans posted in one request.
+	MaxBatch = 512
+
+	// Timeout bounds each request to the collector.
+	Timeout = 10 * time.Second
+)
+
+// tracesPath is the path of the OTLP/HTTP endpoint receiving spans.
+const tracesPath = "/v1/traces"
+
+// scopeName is the instrumentation scope of the spans, the package creating
+// them.
+const scopeName = "github.com/bytejedi/ipsec-forward/ipsec"
+
+// Config configures an Exporter.
+type Config struct {
+	// Endpoint is the http or https URL of the collector, e.g.
+	// http://localhost:4318, to which /v1/traces is added unless its path
+	// already ends with it.
+	Endpoint string
+	Service  string        // service.name of the spans, DefaultService if empty
+	Interval time.Duration // how often to post spans, DefaultInterval if zero
+	Logger   ipsec.Logger  // defaults to logging to the standard logger
+}
+
+// Exporter is an ipsec.Tracer posting the spans it starts to an OTLP/HTTP
+// collector once they end.
+type Exporter struct {
+	url      string
+	resource resource
+	interval time.Duration
+	logger   ipsec.Logger
+	client   *http.Client
+
+	queue   chan *span
+	dropped int64 // accessed atomically
+	failed  int64 // accessed atomically
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+var _ ipsec.Tracer = (*Exporter)(nil)
+
+// Start returns an Exporter posting to cfg.Endpoint.
+func Start(cfg Config) (*Exporter, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("otlp: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("otlp: endpoint %q is not an http or https URL", cfg.Endpoint)
+	}
+	if !strings.HasSuffix(u.Path, tracesPath) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + tracesPath
+	}
+	if cfg.Service == "" {
+		cfg.Service = DefaultService
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	e := &Exporter{
+		url:      u.String(),
+		resource: resource{Attributes: []keyValue{{Key: "service.name", Value: value(cfg.Service)}}},
+		interval: cfg.Interval,
+		logger:   cfg.Logger,
+		client:   &http.Client{Timeout: Timeout},
+		queue:    make(chan *span, QueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if e.logger == nil {
+		e.logger = ipsec.NewStdLogger(nil, ipsec.LevelInfo)
+	}
+	go e.run()
+	return e, nil
+}
+
+// Close posts the spans ended so far and stops the exporter. Spans ending
+// while or after it closes are dropped.
+func (e *Exporter) Close() error {
+	e.closeOnce.Do(func() { close(e.done) })
+	<-e.stopped
+	return nil
+}
+
+// Dropped returns the number of spans dropped because the queue was full or
+// the exporter closed.
+func (e *Exporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Failed returns the number of spans lost because the collector could not
+// be reached or refused them.
+func (e *Exporter) Failed() int64 {
+	return atomic.LoadInt64(&e.failed)
+}
+
+// spanKey is the context key of the span started by Start.
+type spanKey struct{}
+
+// Start starts a span named name, a child of the span of the exporter in ctx
+// if any, and returns a context holding it.
+func (e *Exporter) Start(ctx context.Context, name string, attrs ...ipsec.Attribute) (context.Context, ipsec.Span) {
+	s := &span{exporter: e, name: name, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID[:]
+	} else {
+		randomID(s.traceID[:])
+	}
+	randomID(s.spanID[:])
+	s.setAttributes(attrs)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// randomID fills id with random bytes, not all zero as OTLP requires.
+func randomID(id []byte) {
+	for {
+		rand.Read(id)
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
+
+// span is an ipsec.Span recording what the forwarder reports until it ends.
+type span struct {
+	exporter *Exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID []byte // nil for a root span
+	name     string
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time // zero until the span ends
+	attrs  []ipsec.Attribute
+	events []event
+	err    string // the last error recorded
+}
+
+type event struct {
+	name  string
+	time  time.Time
+	attrs []ipsec.Attribute
+}
+
+func (s *span) SetAttributes(attrs ...ipsec.Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.setAttributes(attrs)
+	}
+}
+
+// setAttributes adds attrs, replacing those with the same keys.
+func (s *span) setAttributes(attrs []ipsec.Attribute) {
+next:
+	for _, attr := range attrs {
+		for i := range s.attrs {
+			if s.attrs[i].Key == attr.Key {
+				s.attrs[i].Value = attr.Value
+				continue next
+			}
+		}
+		s.attrs = append(s.attrs, attr)
+	}
+}
+
+func (s *span) AddEvent(name string, attrs ...ipsec.Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.events = append(s.events, event{name: name, time: time.Now(), attrs: attrs})
+	}
+}
+
+// RecordError records err as an exception event, as OpenTelemetry does, and
+// sets the status of the span to error.
+func (s *span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.events = append(s.events, event{
+			name: "exception",
+			time: time.Now(),
+			attrs: []ipsec.Attribute{
+				{Key: "exception.type", Value: fmt.Sprintf("%T", err)},
+				{Key: "exception.message", Value: err.Error()},
+			},
+		})
+		s.err = err.Error()
+	}
+}
+
+// End ends the span and queues it for posting. Only the first call has an
+// effect.
+func (s *span) End() {
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	e := s.exporter
+	select {
+	case <-e.done:
+		atomic.AddInt64(&e.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// run posts the queued spans every interval, or once a batch is full, until
+// the exporter is closed, then posts those left.
+func (e *Exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= MaxBatch {
+				e.post(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.post(batch)
+				batch = nil
+			}
+		case <-e.done:
+			for len(e.queue) > 0 {
+				if batch = append(batch, <-e.queue); len(batch) >= MaxBatch {
+					e.post(batch)
+					batch = nil
+				}
+			}
+			if len(batch) > 0 {
+				e.post(batch)
+			}
+			return
+		}
+	}
+}
+
+// post sends spans to the collector, logging and counting them as failed if
+// it does not accept them.
+func (e *Exporter) post(spans []*span) {
+	if err := e.send(spans); err != nil {
+		atomic.AddInt64(&e.failed, int64(len(spans)))
+		e.logger.Log(ipsec.LevelWarn, "failed to export spans", "endpoint", e.url, "spans", len(spans), "err", err)
+	}
+}
+
+func (e *Exporter) send(spans []*span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of ExportTraceServiceRequest, with IDs in hex
+// and 64-bit integers as strings.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []jsonSpan `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	jsonSpan struct {
+		TraceID      string      `json:"traceId"`
+		SpanID       string      `json:"spanId"`
+		ParentSpanID string      `json:"parentSpanId,omitempty"`
+		Name         string      `json:"name"`
+		Kind         int         `json:"kind"`
+		Start        uint64      `json:"startTimeUnixNano,string"`
+		End          uint64      `json:"endTimeUnixNano,string"`
+		Attributes   []keyValue  `json:"attributes,omitempty"`
+		Events       []jsonEvent `json:"events,omitempty"`
+		Status       status      `json:"status"`
+	}
+	jsonEvent struct {
+		Time       uint64     `json:"timeUnixNano,string"`
+		Name       string     `json:"name"`
+		Attributes []keyValue `json:"attributes,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+const (
+	spanKindInternal = 1
+	statusError      = 2
+)
+
+// request returns the request posting spans.
+func (e *Exporter) request(spans []*span) exportRequest {
+	out := make([]jsonSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		out[i] = jsonSpan{
+			TraceID:      hex.EncodeToString(s.traceID[:]),
+			SpanID:       hex.EncodeToString(s.spanID[:]),
+			ParentSpanID: hex.EncodeToString(s.parentID),
+			Name:         s.name,
+			Kind:         spanKindInternal,
+			Start:        uint64(s.start.UnixNano()),
+			End:          uint64(s.end.UnixNano()),
+			Attributes:   keyValues(s.attrs),
+		}
+		for _, ev := range s.events {
+			out[i].Events = append(out[i].Events, jsonEvent{
+				Time:       uint64(ev.time.UnixNano()),
+				Name:       ev.name,
+				Attributes: keyValues(ev.attrs),
+			})
+		}
+		if s.err != "" {
+			out[i].Status = status{Code: statusError, Message: s.err}
+		}
+		s.mu.Unlock()
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: scopeName}, Spans: out}},
+	}}}
+}
+
+func keyValues(attrs []ipsec.Attribute) []keyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]keyValue, len(attrs))
+	for i, attr := range attrs {
+		kvs[i] = keyValue{Key: attr.Key, Value: value(attr.Value)}
+	}
+	return kvs
+}
+
+// value converts the value of an attribute, formatting types OTLP has no
+// value for as strings.
+func value(v interface{}) anyValue {
+	switch v := v.(type) {
+	case string:
+		return anyValue{String: &v}
+	case bool:
+		return anyValue{Bool: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return anyValue{Int: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return anyValue{Int: &s}
+	case float64:
+		return anyValue{Double: &v}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{String: &s}
+	}
+}
@@ -0,0 +1,103 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+func TestExportSpans(t *testing.T) {
+	var mu sync.Mutex
+	var requests []exportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tracesPath || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("posted %s to %s, want application/json to %s", r.Header.Get("Content-Type"), r.URL.Path, tracesPath)
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	e, err := Start(Config{Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, session := e.Start(context.Background(), "ipsec.session",
+		ipsec.Attribute{Key: ipsec.AttrClientAddr, Value: "192.0.2.1:4500"})
+	_, dial := e.Start(ctx, "ipsec.dial", ipsec.Attribute{Key: ipsec.AttrPooled, Value: true})
+	dial.RecordError(errors.New("connection refused"))
+	dial.End()
+	session.AddEvent("failover", ipsec.Attribute{Key: ipsec.AttrBackendAddr, Value: "198.51.100.2:4500"})
+	session.SetAttributes(ipsec.Attribute{Key: ipsec.AttrBytesIn, Value: int64(1500)})
+	session.End()
+	session.End()
+	e.Close()
+
+	if len(requests) != 1 {
+		t.Fatalf("%d requests posted, want 1", len(requests))
+	}
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(spans))
+	}
+	d, s := spans[0], spans[1]
+	if d.Name != "ipsec.dial" || s.Name != "ipsec.session" {
+		t.Fatalf("exported spans %q and %q, want ipsec.dial and ipsec.session", d.Name, s.Name)
+	}
+	if d.TraceID != s.TraceID || d.ParentSpanID != s.SpanID || s.ParentSpanID != "" {
+		t.Errorf("dial span %s/%s under %s, want a child of session span %s/%s", d.TraceID, d.SpanID, d.ParentSpanID, s.TraceID, s.SpanID)
+	}
+	if d.Status.Code != statusError || d.Status.Message != "connection refused" {
+		t.Errorf("dial span status %+v, want the error", d.Status)
+	}
+	if len(s.Attributes) != 2 || *s.Attributes[0].Value.String != "192.0.2.1:4500" || *s.Attributes[1].Value.Int != "1500" {
+		t.Errorf("session span attributes %+v, want the client address and bytes", s.Attributes)
+	}
+	if len(s.Events) != 1 || s.Events[0].Name != "failover" {
+		t.Errorf("session span events %+v, want a failover", s.Events)
+	}
+	if s.End < s.Start || s.Start == 0 {
+		t.Errorf("session span from %d to %d", s.Start, s.End)
+	}
+	if e.Dropped() != 0 || e.Failed() != 0 {
+		t.Errorf("%d spans dropped and %d failed, want none", e.Dropped(), e.Failed())
+	}
+}
+
+func TestStartEndpoint(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://localhost:4318":           "http://localhost:4318/v1/traces",
+		"https://collector/otlp/":         "https://collector/otlp/v1/traces",
+		"http://localhost:4318/v1/traces": "http://localhost:4318/v1/traces",
+		"localhost:4318":                  "",
+		"grpc://localhost:4317":           "",
+	} {
+		e, err := Start(Config{Endpoint: endpoint})
+		if want == "" {
+			if err == nil {
+				e.Close()
+				t.Errorf("endpoint %q accepted", endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("endpoint %q: %v", endpoint, err)
+			continue
+		}
+		if e.url != want {
+			t.Errorf("endpoint %q posts to %s, want %s", endpoint, e.url, want)
+		}
+		e.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/bytejedi/ipsec-forward/ipsec"
+
+    "github.com/spf13/viper"
+)
+
+// profileConfig is an entry of the profiles section of the config file,
+// forwarding another protocol alongside the main forwarder. Settings are
+// named after the flags.
+type profileConfig struct {
+    Name          string        `mapstructure:"name"`
+    Listen        string        `mapstructure:"listen"`
+    ListenIKE     string        `mapstructure:"listen-ike"`
+    ListenDevice  string        `mapstructure:"listen-device"`
+    Destination   []string      `mapstructure:"destination"`
+    Timeout       time.Duration `mapstructure:"timeout"`
+    AllowCIDR     []string      `mapstructure:"allow-cidr"`
+    DenyCIDR      []string      `mapstructure:"deny-cidr"`
+    ClientTimeout []string      `mapstructure:"client-timeout"`
+    Strategy      string        `mapstructure:"lb-strategy"`
+    MaxClients    int           `mapstructure:"max-clients"`
+}
+
+// profiles returns the forwarding profiles of the config file.
+func profiles(logger ipsec.Logger) ([]ipsec.Profile, error) {
+    var entries []profileConfig
+    if err := viper.UnmarshalKey("profiles", &entries); err != nil {
+        return nil, fmt.Errorf("invalid profiles: %w", err)
+    }
+    result := make([]ipsec.Profile, 0, len(entries))
+    for _, entry := range entries {
+        cfg, err := entry.config()
+        if err != nil {
+            return nil, fmt.Errorf("profile %q: %w", entry.Name, err)
+        }
+        cfg.Logger = logger
+        result = append(result, ipsec.Profile{Name: entry.Name, Config: cfg})
+    }
+    return result, nil
+}
+
+// config returns the forwarder configuration of the profile. Destinations
+// given without a port are forwarded to on the port of the listen address.
+func (p profileConfig) config() (ipsec.Config, error) {
+    _, port, err := net.SplitHostPort(p.Listen)
+    if err != nil {
+        return ipsec.Config{}, fmt.Errorf("listen address %q needs a port", p.Listen)
+    }
+    listenIKE, err := listenAddr(p.ListenIKE, ipsec.IKEPort)
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    if len(p.Destination) == 0 {
+        return ipsec.Config{}, errors.New("destination IPs required")
+    }
+    entries := make([]string, len(p.Destination))
+    for i, entry := range p.Destination {
+        entries[i] = withDefaultPort(entry, port)
+    }
+    dsts, err := parseDestinations(entries)
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    if listenIKE != "" {
+        dsts = hostsOf(dsts)
+    }
+    allow, err := ipsec.ParseCIDRs(p.AllowCIDR)
+    if err != nil {
+        return ipsec.Config{}, fmt.Errorf("invalid %s: %w", flagAllowCIDR, err)
+    }
+    deny, err := ipsec.ParseCIDRs(p.DenyCIDR)
+    if err != nil {
+        return ipsec.Config{}, fmt.Errorf("invalid %s: %w", flagDenyCIDR, err)
+    }
+    clientTimeouts, err := parseClientTimeouts(p.ClientTimeout)
+    if err != nil {
+        return ipsec.Config{}, err
+    }
+    timeout := p.Timeout
+    if timeout == 0 {
+        timeout = viper.GetDuration(flagTimeout)
+    }
+    strategy, steering := p.Strategy, ipsec.Steering(nil)
+    var rttInterval time.Duration
+    switch strategy {
+    case strategyLatency:
+        strategy, steering = "", ipsec.NewLatencySteering(nil)
+    case strategyRTT:
+        strategy, steering, rttInterval = "", ipsec.RTTSteering{}, ipsec.DefaultRTTInterval
+    }
+
+    return ipsec.Config{
+        Listen:         p.Listen,
+        ListenIKE:      listenIKE,
+        Destinations:   dsts,
+        Timeout:        timeout,
+        MaxClients:     p.MaxClients,
+        Strategy:       strategy,
+        Steering:       steering,
+        RTTInterval:    rttInterval,
+        Allow:          allow,
+        Deny:           deny,
+        ClientTimeouts: clientTimeouts,
+
+        ListenerOptions: ipsec.SocketOptions{Device: p.ListenDevice},
+    }, nil
+}
+
+// withDefaultPort adds port to the destination entry, of the form addr,
+// addr=weight, addr@source or addr@source=weight, if addr has none.
+func withDefaultPort(entry, port string) string {
+    addr, weight := entry, ""
+    if i := strings.LastIndex(entry, "="); i >= 0 {
+        addr, weight = entry[:i], entry[i:]
+    }
+    source := ""
+    if i := strings.LastIndex(addr, "@"); i >= 0 {
+        addr, source = addr[:i], addr[i:]
+    }
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+        addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+    }
+    return addr + source + weight
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+)
+
+// sessionsCommand returns the command printing the client sessions of a
+// running forwarder, fetched from its admin API.
+func sessionsCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "sessions",
+        Short: "Print the client sessions of a running forwarder in the format of conntrack -L",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            configPath, _ := flags.GetString(flagConfig)
+            if err := readConfig(configPath); err != nil {
+                return err
+            }
+            addr, _ := flags.GetString(flagAdminListen)
+            if addr == "" {
+                addr = viper.GetString(flagAdminListen)
+            }
+            asJSON, _ := flags.GetBool("json")
+            return printSessions(os.Stdout, addr, asJSON)
+        },
+    }
+    cmd.Flags().String(flagConfig, "", "Config file to read the admin API address from (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    cmd.Flags().String(flagAdminListen, "", "Address of the admin API of the forwarder (default is admin-listen of the config file)")
+    cmd.Flags().Bool("json", false, "Print the sessions as JSON instead")
+    return cmd
+}
+
+// printSessions copies the sessions served by the admin API at addr to w.
+func printSessions(w io.Writer, addr string, asJSON bool) error {
+    path := "/sessions"
+    if asJSON {
+        path = "/clients"
+    }
+    return adminGet(w, addr, path)
+}
+
+// adminGet copies the response of the admin API at addr to a GET of path to
+// w, failing unless its status is OK.
+func adminGet(w io.Writer, addr, path string) error {
+    return adminRequest(w, addr, http.MethodGet, path, nil)
+}
+
+// adminRequest copies the response of the admin API at addr to a request of
+// method on path with body to w, failing unless its status is a success.
+func adminRequest(w io.Writer, addr, method, path string, body io.Reader) error {
+    if addr == "" {
+        return errors.New("no admin API address, set --admin-listen")
+    }
+    if strings.HasPrefix(addr, ":") {
+        addr = "127.0.0.1" + addr
+    }
+    client := http.Client{Timeout: 10 * time.Second}
+    if socket := strings.TrimPrefix(addr, "unix:"); socket != addr {
+        // The host of the URL is ignored by the Unix socket dialer.
+        addr = "unix"
+        client.Transport = &http.Transport{
+            DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, "unix", socket)
+            },
+        }
+    }
+
+    req, err := http.NewRequest(method, "http://"+addr+path, body)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        body, _ := ioutil.ReadAll(resp.Body)
+        return fmt.Errorf("admin API: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    _, err = io.Copy(w, resp.Body)
+    return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/viper"
+
+    "github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// statusCommand returns the command printing the status of a running
+// forwarder, fetched from its admin API over TCP or a Unix socket.
+func statusCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:   "status",
+        Short: "Print the uptime, destinations, clients and throughput of a running forwarder",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            flags := cmd.Flags()
+            configPath, _ := flags.GetString(flagConfig)
+            if err := readConfig(configPath); err != nil {
+                return err
+            }
+            addr, _ := flags.GetString(flagAdminListen)
+            if addr == "" {
+                addr = viper.GetString(flagAdminListen)
+            }
+            if asJSON, _ := flags.GetBool("json"); asJSON {
+                return adminGet(os.Stdout, addr, "/status")
+            }
+            return printStatus(os.Stdout, addr)
+        },
+    }
+    cmd.Flags().String(flagConfig, "", "Config file to read the admin API address from (default is ipsecfwd.yaml in . or /etc/ipsecfwd)")
+    cmd.Flags().String(flagAdminListen, "", "Address of the admin API of the forwarder, or unix:path (default is admin-listen of the config file)")
+    cmd.Flags().Bool("json", false, "Print the status as JSON instead")
+    return cmd
+}
+
+// printStatus writes the status served by the admin API at addr to w.
+func printStatus(w io.Writer, addr string) error {
+    var buf bytes.Buffer
+    if err := adminGet(&buf, addr, "/status"); err != nil {
+        return err
+    }
+    var s ipsec.Snapshot
+    if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+        return fmt.Errorf("admin API: %w", err)
+    }
+    if s.Version > ipsec.SnapshotVersion {
+        return fmt.Errorf("admin API: status version %d is newer than %d, use --json", s.Version, ipsec.SnapshotVersion)
+    }
+
+    health := "ok"
+    if !s.Health.OK() {
+        health = "failing"
+    }
+    tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(tw, "Uptime:\t%s (since %s)\n", s.Uptime.Round(time.Second), s.Started.Format(time.RFC3339))
+    fmt.Fprintf(tw, "Listeners:\t%s\n", strings.Join(s.Listeners, ", "))
+    fmt.Fprintf(tw, "Health:\t%s, %d of %d destinations reachable\n", health, s.Health.Reachable, s.Health.Destinations)
+    fmt.Fprintf(tw, "Clients:\t%d connected, %d connects, %d disconnects\n", s.Clients, s.Connects, s.Disconnects)
+    fmt.Fprintf(tw, "Throughput:\t%s to servers, %s to clients\n", rate(s.Throughput.PacketsToServer, s.Throughput.BytesToServer), rate(s.Throughput.PacketsToClient, s.Throughput.BytesToClient))
+    fmt.Fprintf(tw, "Traffic:\t%d packets, %d bytes to servers, %d packets, %d bytes to clients\n", s.Traffic.PacketsToServer, s.Traffic.BytesToServer, s.Traffic.PacketsToClient, s.Traffic.BytesToClient)
+    fmt.Fprintln(tw)
+    fmt.Fprintln(tw, "DESTINATION\tWEIGHT\tSTATE\tCLIENTS\tRTT\tBYTES TO SERVER\tBYTES TO CLIENT")
+    for _, dst := range s.Destinations {
+        state := "up"
+        switch {
+        case dst.Draining:
+            state = "draining"
+        case !dst.Healthy:
+            state = "down"
+        }
+        rtt := "-"
+        if dst.RTT > 0 {
+            rtt = dst.RTT.Round(time.Microsecond).String()
+        }
+        fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\t%d\t%d\n", dst.Addr, dst.Weight, state, dst.Clients, rtt, dst.BytesToServer, dst.BytesToClient)
+    }
+    return tw.Flush()
+}
+
+// rate formats a throughput of packets and bytes per second.
+func rate(packets, octets float64) string {
+    return fmt.Sprintf("%.0f pps, %.1f Mbit/s", packets, octets*8/1e6)
+}
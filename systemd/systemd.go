@@ -0,0 +1,123 @@
+// Package systemd integrates an IPSEC packet forwarder with systemd: it takes
+// over the sockets of socket activation and reports the state of the service
+// with sd_notify. ipsecfwd.service and ipsecfwd.socket are example units.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// States reported with Notify.
+const (
+	Ready     = "READY=1"     // startup or reloading finished
+	Reloading = "RELOADING=1" // the configuration is being reloaded
+	Stopping  = "STOPPING=1"  // shutdown started
+	Watchdog  = "WATCHDOG=1"  // the service is alive, see WatchdogInterval
+)
+
+// Listeners returns the UDP sockets passed to the process by systemd socket
+// activation, or nil if none were. Other kinds of sockets are closed. The
+// environment variables of socket activation are unset so that child
+// processes do not inherit the sockets.
+func Listeners() ([]*net.UDPConn, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var conns []*net.UDPConn
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FilePacketConn duplicates the descriptor, the original can go.
+		conn, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			// Not a datagram socket.
+			continue
+		}
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		conns = append(conns, udpConn)
+	}
+	return conns, nil
+}
+
+// Notify sends state to the service manager. It does nothing and returns
+// false if the process was not started by systemd with a notification
+// socket, as with Type=notify.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	if path[0] == '@' {
+		// An abstract socket.
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often systemd expects the service to send
+// Watchdog, as set by WatchdogSec, or zero if the watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("systemd: invalid WATCHDOG_USEC " + strconv.Quote(usec))
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// StartWatchdog sends Watchdog at half the watchdog interval until stop is
+// closed, if the watchdog is enabled.
+func StartWatchdog(stop <-chan struct{}) error {
+	interval, err := WatchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				Notify(Watchdog)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,268 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion = 5
+
+	methodNone     = 0
+	methodPassword = 2
+
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// socksReplies describes the failures a SOCKS5 proxy replies with.
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// SOCKS5 is a transport relaying through a SOCKS5 proxy with UDP associate.
+// Every connection opens an association of its own, held for as long as its
+// TCP control connection; the proxy ending it closes the connection.
+// Fragmented datagrams are dropped.
+type SOCKS5 struct {
+	Addr string // of the proxy, host:port
+
+	// Username and Password authenticate to the proxy, if set.
+	Username string
+	Password string
+}
+
+// Dial associates with the proxy to relay datagrams to raddr.
+func (s *SOCKS5) Dial(ctx context.Context, raddr *net.UDPAddr) (net.Conn, error) {
+	var dialer net.Dialer
+	control, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline)
+	}
+	relay, err := s.associate(control)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("transport: SOCKS5 proxy %s: %w", s.Addr, err)
+	}
+	control.SetDeadline(time.Time{})
+
+	// Proxies may reply with an unspecified address, meaning their own.
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	udp, err := dialer.DialContext(ctx, "udp", relay.String())
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	conn := &socks5Conn{
+		UDPConn: udp.(*net.UDPConn),
+		control: control,
+		header:  udpHeader(raddr),
+		raddr:   raddr,
+	}
+	go conn.watch()
+	return conn, nil
+}
+
+// associate negotiates a UDP association over control and returns the
+// address of the relay.
+func (s *SOCKS5) associate(control net.Conn) (*net.UDPAddr, error) {
+	method := byte(methodNone)
+	if s.Username != "" {
+		method = methodPassword
+	}
+	if _, err := control.Write([]byte{socksVersion, 1, method}); err != nil {
+		return nil, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(control, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		return nil, fmt.Errorf("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return nil, errors.New("authentication method refused")
+	}
+	if method == methodPassword {
+		if err := s.authenticate(control); err != nil {
+			return nil, err
+		}
+	}
+
+	// The address the datagrams will come from is not known beforehand, as
+	// the socket to the relay is dialed afterwards.
+	request := []byte{socksVersion, cmdUDPAssociate, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := control.Write(request); err != nil {
+		return nil, err
+	}
+	var head [3]byte
+	if _, err := io.ReadFull(control, head[:]); err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		if msg, ok := socksReplies[head[1]]; ok {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("reply %d", head[1])
+	}
+	host, port, err := readAddr(control)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// authenticate authenticates with username and password, see RFC 1929.
+func (s *SOCKS5) authenticate(control net.Conn) error {
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("username or password too long")
+	}
+	request := []byte{1, byte(len(s.Username))}
+	request = append(request, s.Username...)
+	request = append(request, byte(len(s.Password)))
+	request = append(request, s.Password...)
+	if _, err := control.Write(request); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(control, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// readAddr reads an address as ATYP, DST.ADDR and DST.PORT.
+func readAddr(r io.Reader) (host string, port int, err error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case atypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case atypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", 0, err
+	}
+	if atyp[0] == atypDomain {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	return host, int(binary.BigEndian.Uint16(p[:])), nil
+}
+
+// udpHeader returns the header of the datagrams relayed to raddr: RSV, FRAG,
+// ATYP, DST.ADDR and DST.PORT.
+func udpHeader(raddr *net.UDPAddr) []byte {
+	header := []byte{0, 0, 0}
+	if ip := raddr.IP.To4(); ip != nil {
+		header = append(header, atypIPv4)
+		header = append(header, ip...)
+	} else {
+		header = append(header, atypIPv6)
+		header = append(header, raddr.IP.To16()...)
+	}
+	return append(header, byte(raddr.Port>>8), byte(raddr.Port))
+}
+
+// socks5Conn is a connection relayed by a SOCKS5 proxy, adding and removing
+// the header of each datagram.
+type socks5Conn struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte
+	raddr   *net.UDPAddr
+	buf     []byte // of Read
+}
+
+// watch closes the connection once the proxy ends the association.
+func (c *socks5Conn) watch() {
+	io.Copy(ioutil.Discard, c.control)
+	c.UDPConn.Close()
+}
+
+// Read reads a datagram from the destination, skipping fragments and those
+// from any other address. It is not safe for concurrent use.
+func (c *socks5Conn) Read(b []byte) (int, error) {
+	if len(c.buf) < len(b)+262 {
+		// The largest header has a domain of 255 bytes.
+		c.buf = make([]byte, len(b)+262)
+	}
+	for {
+		n, err := c.UDPConn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 3 || c.buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(c.buf[3:n])
+		host, port, err := readAddr(r)
+		if err != nil || port != c.raddr.Port || !net.ParseIP(host).Equal(c.raddr.IP) {
+			continue
+		}
+		return copy(b, c.buf[n-r.Len():n]), nil
+	}
+}
+
+// Write sends b to the destination.
+func (c *socks5Conn) Write(b []byte) (int, error) {
+	if _, err := c.UDPConn.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// RemoteAddr returns the address of the destination.
+func (c *socks5Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Close ends the association.
+func (c *socks5Conn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
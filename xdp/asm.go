@@ -0,0 +1,181 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// eBPF registers. r0 holds return values, r1 to r5 the arguments of helper
+// calls, which clobber them, r6 to r9 are preserved across calls and r10 is
+// the read-only frame pointer.
+const (
+	r0 uint8 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// Sizes of memory accesses.
+const (
+	sizeW  uint8 = 0x00 // 32 bits
+	sizeH  uint8 = 0x08 // 16 bits
+	sizeB  uint8 = 0x10 // 8 bits
+	sizeDW uint8 = 0x18 // 64 bits
+)
+
+// Opcodes and jump conditions.
+const (
+	opLdx    = 0x61 // | size
+	opSt     = 0x62 // | size
+	opStx    = 0x63 // | size
+	opAtomic = 0xc3 // | size
+	opLdImm  = 0x18
+
+	opAdd  = 0x07 // 64-bit ALU, | 0x08 to take src instead of imm
+	opAnd  = 0x57
+	opRsh  = 0x77
+	opXor  = 0xa7
+	opMov  = 0xb7
+	opBE32 = 0xdc // 32-bit byte swap to big endian
+
+	opJa   = 0x05
+	opJeq  = 0x15
+	opJgt  = 0x25
+	opJne  = 0x55
+	opCall = 0x85
+	opExit = 0x95
+
+	srcReg = 0x08
+
+	pseudoMapFD = 1 // src of opLdImm loading the map with the fd in imm
+)
+
+// Helper functions of the kernel.
+const (
+	helperMapLookup = 1
+	helperKtimeNs   = 5
+	helperRedirect  = 23
+	helperFibLookup = 69
+)
+
+// insn is an eBPF instruction.
+type insn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	target   string // label jumped to, if any
+}
+
+// asm assembles an eBPF program, resolving jumps to labels.
+type asm struct {
+	insns  []insn
+	labels map[string]int
+}
+
+func (a *asm) emit(i insn) {
+	a.insns = append(a.insns, i)
+}
+
+// label marks the next instruction as the target of jumps to name.
+func (a *asm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// ldx loads *(size *)(src + off) into dst.
+func (a *asm) ldx(size, dst, src uint8, off int16) {
+	a.emit(insn{op: opLdx | size, dst: dst, src: src, off: off})
+}
+
+// stx stores src into *(size *)(dst + off).
+func (a *asm) stx(size, dst uint8, off int16, src uint8) {
+	a.emit(insn{op: opStx | size, dst: dst, src: src, off: off})
+}
+
+// st stores imm into *(size *)(dst + off).
+func (a *asm) st(size, dst uint8, off int16, imm int32) {
+	a.emit(insn{op: opSt | size, dst: dst, off: off, imm: imm})
+}
+
+// xadd atomically adds src to *(u64 *)(dst + off).
+func (a *asm) xadd(dst uint8, off int16, src uint8) {
+	a.emit(insn{op: opAtomic | sizeDW, dst: dst, src: src, off: off})
+}
+
+// alu applies op to dst with imm.
+func (a *asm) alu(op, dst uint8, imm int32) {
+	a.emit(insn{op: op, dst: dst, imm: imm})
+}
+
+// aluReg applies op to dst with src.
+func (a *asm) aluReg(op, dst, src uint8) {
+	a.emit(insn{op: op | srcReg, dst: dst, src: src})
+}
+
+// be16 converts the 16 bits of dst between network and host byte order.
+func (a *asm) be16(dst uint8) {
+	a.emit(insn{op: opBE32, dst: dst, imm: 16})
+}
+
+// ldMap loads the map with the file descriptor fd into dst.
+func (a *asm) ldMap(dst uint8, fd int) {
+	a.emit(insn{op: opLdImm, dst: dst, src: pseudoMapFD, imm: int32(fd)})
+	a.emit(insn{})
+}
+
+// jmp jumps to target if dst compares to imm with op.
+func (a *asm) jmp(op, dst uint8, imm int32, target string) {
+	a.emit(insn{op: op, dst: dst, imm: imm, target: target})
+}
+
+// jmpReg jumps to target if dst compares to src with op.
+func (a *asm) jmpReg(op, dst, src uint8, target string) {
+	a.emit(insn{op: op | srcReg, dst: dst, src: src, target: target})
+}
+
+// ja jumps to target.
+func (a *asm) ja(target string) {
+	a.emit(insn{op: opJa, target: target})
+}
+
+func (a *asm) call(helper int32) {
+	a.emit(insn{op: opCall, imm: helper})
+}
+
+func (a *asm) exit() {
+	a.emit(insn{op: opExit})
+}
+
+// assemble returns the encoded program.
+func (a *asm) assemble() ([]byte, error) {
+	code := make([]byte, 8*len(a.insns))
+	for i, in := range a.insns {
+		if in.target != "" {
+			target, ok := a.labels[in.target]
+			if !ok {
+				return nil, fmt.Errorf("xdp: undefined label %q", in.target)
+			}
+			in.off = int16(target - i - 1)
+		}
+		b := code[8*i:]
+		b[0] = in.op
+		b[1] = in.dst | in.src<<4
+		binary.LittleEndian.PutUint16(b[2:], uint16(in.off))
+		binary.LittleEndian.PutUint32(b[4:], uint32(in.imm))
+	}
+	return code, nil
+}
@@ -0,0 +1,146 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Commands of the bpf system call.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfProgLoad      = 5
+)
+
+const (
+	bpfMapTypeHash = 1
+	bpfProgTypeXDP = 6
+)
+
+// verifierLogSize is the size of the buffer the verifier explains why it
+// rejected the program in.
+const verifierLogSize = 64 * 1024
+
+// mapCreateAttr is union bpf_attr for bpfMapCreate.
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	innerMapFD uint32
+	numaNode   uint32
+	name       [16]byte
+}
+
+// mapElemAttr is union bpf_attr for the commands on map elements.
+type mapElemAttr struct {
+	fd    uint32
+	_     uint32
+	key   unsafe.Pointer
+	value unsafe.Pointer
+	flags uint64
+}
+
+// progLoadAttr is union bpf_attr for bpfProgLoad.
+type progLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       unsafe.Pointer
+	license     unsafe.Pointer
+	logLevel    uint32
+	logSize     uint32
+	logBuf      unsafe.Pointer
+	kernVersion uint32
+	progFlags   uint32
+	name        [16]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// bpfMap is a BPF map with fixed size keys and values.
+type bpfMap struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+// newHashMap creates a hash map called name.
+func newHashMap(name string, keySize, valueSize, maxEntries int) (*bpfMap, error) {
+	attr := mapCreateAttr{
+		mapType:    bpfMapTypeHash,
+		keySize:    uint32(keySize),
+		valueSize:  uint32(valueSize),
+		maxEntries: uint32(maxEntries),
+	}
+	copy(attr.name[:len(attr.name)-1], name)
+	fd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("xdp: creating map %s: %w", name, err)
+	}
+	return &bpfMap{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+func (m *bpfMap) update(key, value []byte) error {
+	attr := mapElemAttr{fd: uint32(m.fd), key: unsafe.Pointer(&key[0]), value: unsafe.Pointer(&value[0])}
+	_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// lookup returns the value of key, or false if there is none.
+func (m *bpfMap) lookup(key []byte) ([]byte, bool) {
+	value := make([]byte, m.valueSize)
+	attr := mapElemAttr{fd: uint32(m.fd), key: unsafe.Pointer(&key[0]), value: unsafe.Pointer(&value[0])}
+	if _, err := bpf(bpfMapLookupElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (m *bpfMap) delete(key []byte) {
+	attr := mapElemAttr{fd: uint32(m.fd), key: unsafe.Pointer(&key[0])}
+	bpf(bpfMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func (m *bpfMap) close() error {
+	return syscall.Close(m.fd)
+}
+
+// loadXDP loads code as an XDP program called name. If the verifier rejects
+// it, it is loaded again to return the log of the verifier in the error.
+func loadXDP(name string, code []byte) (int, error) {
+	license := []byte("GPL\x00") // bpf_fib_lookup is only for GPL programs
+	attr := progLoadAttr{
+		progType: bpfProgTypeXDP,
+		insnCnt:  uint32(len(code) / 8),
+		insns:    unsafe.Pointer(&code[0]),
+		license:  unsafe.Pointer(&license[0]),
+	}
+	copy(attr.name[:len(attr.name)-1], name)
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+
+	log := make([]byte, verifierLogSize)
+	attr.logLevel, attr.logSize, attr.logBuf = 1, uint32(len(log)), unsafe.Pointer(&log[0])
+	bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if n := bytes.IndexByte(log, 0); n > 0 {
+		return -1, fmt.Errorf("xdp: loading program: %w: %s", err, log[:n])
+	}
+	return -1, fmt.Errorf("xdp: loading program: %w", err)
+}
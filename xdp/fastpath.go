@@ -0,0 +1,240 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// FastPath forwards sessions in the kernel. It implements ipsec.FastPath.
+type FastPath struct {
+	sessions *bpfMap
+	replies  *bpfMap
+	prog     int
+
+	mu     sync.Mutex
+	links  []link // the interfaces the program is attached to
+	closed bool
+}
+
+// link is an interface the program is attached to.
+type link struct {
+	name    string
+	ifindex int
+	flags   uint32
+}
+
+var _ ipsec.FastPath = (*FastPath)(nil)
+
+// Attach loads the XDP program and attaches it to the named interfaces, on
+// which clients and destinations are reached. It must be closed to detach it.
+func Attach(ifaces []string, mode Mode) (*FastPath, error) {
+	if len(ifaces) == 0 {
+		return nil, errors.New("xdp: no interfaces to attach to")
+	}
+	var links []link
+	for _, name := range ifaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("xdp: %w", err)
+		}
+		if err := checkForwarding(name); err != nil {
+			return nil, err
+		}
+		links = append(links, link{name: name, ifindex: iface.Index, flags: modeFlags(mode) | xdpFlagsUpdateIfNoExist})
+	}
+
+	fp := &FastPath{prog: -1}
+	var err error
+	if fp.sessions, err = newHashMap("ipsec_sessions", keySize, valueSize, MaxSessions); err != nil {
+		return nil, err
+	}
+	if fp.replies, err = newHashMap("ipsec_replies", keySize, valueSize, MaxSessions); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	code, err := program(fp.sessions.fd, fp.replies.fd)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if fp.prog, err = loadXDP("ipsec_forward", code); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	for _, l := range links {
+		if err := setXDP(l.ifindex, fp.prog, l.flags); err != nil {
+			fp.Close()
+			return nil, fmt.Errorf("xdp: attaching to %s in %s mode: %w", l.name, mode, err)
+		}
+		fp.links = append(fp.links, l)
+	}
+	return fp, nil
+}
+
+// checkForwarding returns an error unless IPv4 forwarding is enabled on the
+// interface called name, without which the FIB lookup of the program fails.
+func checkForwarding(name string) error {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/" + name + "/forwarding")
+	if err != nil {
+		return fmt.Errorf("xdp: %w", err)
+	}
+	if strings.TrimSpace(string(b)) != "1" {
+		return fmt.Errorf("xdp: IPv4 forwarding is disabled on %s, see sysctl net.ipv4.conf.%s.forwarding", name, name)
+	}
+	return nil
+}
+
+// Add starts forwarding the packets of s in the kernel. Only IPv4 sessions
+// can be added, and no more than MaxSessions.
+func (fp *FastPath) Add(s ipsec.FastSession) error {
+	sessionKey, replyKey, err := keys(s)
+	if err != nil {
+		return err
+	}
+	session := make([]byte, valueSize)
+	copy(session[offSessLocal:], s.Local.IP.To4())
+	copy(session[offSessDst:], s.Destination.IP.To4())
+	binary.BigEndian.PutUint16(session[offSessLocalPort:], uint16(s.Local.Port))
+	binary.BigEndian.PutUint16(session[offSessDstPort:], uint16(s.Destination.Port))
+	if ip := s.Listen.IP.To4(); ip != nil && !ip.IsUnspecified() {
+		copy(session[offSessListen:], ip)
+	}
+	reply := make([]byte, valueSize)
+	copy(reply, sessionKey)
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.closed {
+		return errors.New("xdp: fast path closed")
+	}
+	if err := fp.replies.update(replyKey, reply); err != nil {
+		return fmt.Errorf("xdp: adding session: %w", err)
+	}
+	if err := fp.sessions.update(sessionKey, session); err != nil {
+		fp.replies.delete(replyKey)
+		return fmt.Errorf("xdp: adding session: %w", err)
+	}
+	return nil
+}
+
+// Remove stops forwarding the packets of s in the kernel.
+func (fp *FastPath) Remove(s ipsec.FastSession) {
+	sessionKey, replyKey, err := keys(s)
+	if err != nil {
+		return
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.closed {
+		return
+	}
+	fp.sessions.delete(sessionKey)
+	fp.replies.delete(replyKey)
+}
+
+// Stats returns the counters of s since it was added.
+func (fp *FastPath) Stats(s ipsec.FastSession) (ipsec.FastPathStats, bool) {
+	sessionKey, replyKey, err := keys(s)
+	if err != nil {
+		return ipsec.FastPathStats{}, false
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.closed {
+		return ipsec.FastPathStats{}, false
+	}
+	session, ok := fp.sessions.lookup(sessionKey)
+	if !ok {
+		return ipsec.FastPathStats{}, false
+	}
+	reply, ok := fp.replies.lookup(replyKey)
+	if !ok {
+		return ipsec.FastPathStats{}, false
+	}
+	now, mono := time.Now(), monotonic()
+	var stats ipsec.FastPathStats
+	stats.PacketsToServer, stats.BytesToServer, stats.LastToServer = counters(session, now, mono)
+	stats.PacketsToClient, stats.BytesToClient, stats.LastToClient = counters(reply, now, mono)
+	return stats, true
+}
+
+// Close detaches the program and releases it and its maps.
+func (fp *FastPath) Close() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.closed {
+		return nil
+	}
+	fp.closed = true
+	var err error
+	for _, l := range fp.links {
+		if e := setXDP(l.ifindex, -1, l.flags&^xdpFlagsUpdateIfNoExist); e != nil && err == nil {
+			err = fmt.Errorf("xdp: detaching from %s: %w", l.name, e)
+		}
+	}
+	if fp.prog >= 0 {
+		syscall.Close(fp.prog)
+	}
+	if fp.sessions != nil {
+		fp.sessions.close()
+	}
+	if fp.replies != nil {
+		fp.replies.close()
+	}
+	return err
+}
+
+// keys returns the keys of s in the sessions and replies maps.
+func keys(s ipsec.FastSession) (sessionKey, replyKey []byte, err error) {
+	if s.Client == nil || s.Listen == nil || s.Local == nil || s.Destination == nil {
+		return nil, nil, errors.New("xdp: incomplete session")
+	}
+	client, local, dst := s.Client.IP.To4(), s.Local.IP.To4(), s.Destination.IP.To4()
+	if client == nil || local == nil || dst == nil {
+		return nil, nil, errors.New("xdp: only IPv4 sessions are supported")
+	}
+	sessionKey = make([]byte, keySize)
+	copy(sessionKey, client)
+	binary.BigEndian.PutUint16(sessionKey[4:], uint16(s.Client.Port))
+	binary.BigEndian.PutUint16(sessionKey[6:], uint16(s.Listen.Port))
+	replyKey = make([]byte, keySize)
+	copy(replyKey, dst)
+	binary.BigEndian.PutUint16(replyKey[4:], uint16(s.Destination.Port))
+	binary.BigEndian.PutUint16(replyKey[6:], uint16(s.Local.Port))
+	return sessionKey, replyKey, nil
+}
+
+// counters returns the counters of a map value, converting the time of the
+// last packet from CLOCK_MONOTONIC, which reads mono at now.
+func counters(value []byte, now time.Time, mono int64) (packets, bytes int64, last time.Time) {
+	order := binary.LittleEndian // the byte order of amd64 and arm64
+	packets = int64(order.Uint64(value[offValPackets:]))
+	bytes = int64(order.Uint64(value[offValBytes:]))
+	if ns := int64(order.Uint64(value[offValLast:])); ns != 0 {
+		last = now.Add(-time.Duration(mono - ns))
+	}
+	return packets, bytes, last
+}
+
+// monotonic returns CLOCK_MONOTONIC in nanoseconds, the clock of
+// bpf_ktime_get_ns.
+func monotonic() int64 {
+	const clockMonotonic = 1
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	return ts.Nano()
+}
@@ -0,0 +1,35 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package xdp
+
+import (
+	"errors"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+// FastPath forwards sessions in the kernel. It implements ipsec.FastPath.
+type FastPath struct{}
+
+var _ ipsec.FastPath = (*FastPath)(nil)
+
+// Attach returns an error, as XDP is only supported on Linux on amd64 and
+// arm64.
+func Attach(ifaces []string, mode Mode) (*FastPath, error) {
+	return nil, errors.New("xdp: only supported on Linux on amd64 and arm64")
+}
+
+func (fp *FastPath) Add(s ipsec.FastSession) error {
+	return errors.New("xdp: not supported")
+}
+
+func (fp *FastPath) Remove(s ipsec.FastSession) {}
+
+func (fp *FastPath) Stats(s ipsec.FastSession) (ipsec.FastPathStats, bool) {
+	return ipsec.FastPathStats{}, false
+}
+
+func (fp *FastPath) Close() error {
+	return nil
+}
@@ -0,0 +1,222 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bytejedi/ipsec-forward/ipsec"
+)
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{ModeAuto, ModeNative, ModeGeneric} {
+		if got, err := ParseMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseMode(%q) = %v, %v, want %v", m, got, err, m)
+		}
+	}
+	if _, err := ParseMode("offload"); err == nil {
+		t.Error("ParseMode(offload) succeeded")
+	}
+}
+
+func TestProgramAssembles(t *testing.T) {
+	code, err := program(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) == 0 || len(code)%8 != 0 {
+		t.Fatalf("program is %d bytes long, want a positive multiple of 8", len(code))
+	}
+}
+
+// run runs the ip command with args, failing the test if it fails.
+func run(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %v: %v: %s", args, err, out)
+	}
+}
+
+// listenIn listens on addr in the network namespace called ns.
+func listenIn(t *testing.T, ns, addr string) *net.UDPConn {
+	t.Helper()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	self, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer self.Close()
+	target, err := os.Open("/var/run/netns/" + ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if _, _, errno := syscall.RawSyscall(sysSetns, target.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	defer syscall.RawSyscall(sysSetns, self.Fd(), syscall.CLONE_NEWNET, 0)
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// sysctl sets the sysctl called name to value.
+func sysctl(t *testing.T, name, value string) {
+	t.Helper()
+	path := "/proc/sys/" + string(bytes.ReplaceAll([]byte(name), []byte("."), []byte("/")))
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestForward forwards ESP packets between a client and a destination in
+// network namespaces of their own, routed through the host running the
+// forwarder.
+func TestForward(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs the ip command")
+	}
+
+	// client (xdpcl, 10.99.1.2) <-> xdpc0 (10.99.1.1) host xdpg0 (10.99.2.1) <-> (xdpgw, 10.99.2.2) destination
+	for _, ns := range []string{"xdpcl", "xdpgw"} {
+		exec.Command("ip", "netns", "del", ns).Run()
+		run(t, "netns", "add", ns)
+		defer exec.Command("ip", "netns", "del", ns).Run()
+	}
+	for _, l := range []struct{ host, peer, ns, hostIP, peerIP, gw string }{
+		{"xdpc0", "xdpc1", "xdpcl", "10.99.1.1/24", "10.99.1.2/24", "10.99.1.1"},
+		{"xdpg0", "xdpg1", "xdpgw", "10.99.2.1/24", "10.99.2.2/24", "10.99.2.1"},
+	} {
+		exec.Command("ip", "link", "del", l.host).Run()
+		run(t, "link", "add", l.host, "type", "veth", "peer", "name", l.peer)
+		defer exec.Command("ip", "link", "del", l.host).Run()
+		run(t, "link", "set", l.peer, "netns", l.ns)
+		run(t, "addr", "add", l.hostIP, "dev", l.host)
+		run(t, "link", "set", l.host, "up")
+		run(t, "-n", l.ns, "addr", "add", l.peerIP, "dev", l.peer)
+		run(t, "-n", l.ns, "link", "set", l.peer, "up")
+		run(t, "-n", l.ns, "route", "add", "default", "via", l.gw)
+		sysctl(t, "net.ipv4.conf."+l.host+".forwarding", "1")
+	}
+
+	fp, err := Attach([]string{"xdpc0", "xdpg0"}, ModeGeneric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	echo := listenIn(t, "xdpgw", "10.99.2.2:0")
+	defer echo.Close()
+	locals := make(chan *net.UDPAddr, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			locals <- addr
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	f, err := ipsec.Forward("0.0.0.0:0", echo.LocalAddr().String(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.SetFastPath(fp)
+	listen := f.LocalAddr().(*net.UDPAddr)
+
+	client := listenIn(t, "xdpcl", "10.99.1.2:0")
+	defer client.Close()
+	faddr := &net.UDPAddr{IP: net.IPv4(10, 99, 1, 1), Port: listen.Port}
+	exchange := func(packet []byte) *net.UDPAddr {
+		t.Helper()
+		if _, err := client.WriteToUDP(packet, faddr); err != nil {
+			t.Fatal(err)
+		}
+		var local *net.UDPAddr
+		select {
+		case local = <-locals:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the destination did not receive the packet")
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 2048)
+		n, from, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], packet) || !from.IP.Equal(faddr.IP) || from.Port != faddr.Port {
+			t.Fatalf("received %x from %v, want %x from %v", buf[:n], from, packet, faddr)
+		}
+		return local
+	}
+
+	// The IKE message, with its non-ESP marker, goes through the forwarder
+	// and connects the client.
+	local := exchange([]byte{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8})
+	s := ipsec.FastSession{
+		Client:      client.LocalAddr().(*net.UDPAddr),
+		Listen:      listen,
+		Local:       local,
+		Destination: echo.LocalAddr().(*net.UDPAddr),
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := fp.Stats(s); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the session was not added to the fast path")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const packets = 10
+	for i := 0; i < packets; i++ {
+		esp := []byte{0x12, 0x34, 0x56, 0x78, 0, 0, 0, byte(i + 1), 0xaa, 0xbb}
+		if got := exchange(esp); got.String() != local.String() {
+			t.Fatalf("packet %d sent from %v, want %v", i, got, local)
+		}
+	}
+
+	// ARP may make the first packets take the forwarder.
+	stats, ok := fp.Stats(s)
+	if !ok {
+		t.Fatal("the session is gone from the fast path")
+	}
+	if stats.PacketsToServer < packets-2 || stats.PacketsToClient < packets-2 {
+		t.Errorf("fast path forwarded %d packets to the destination and %d to the client, want about %d", stats.PacketsToServer, stats.PacketsToClient, packets)
+	}
+	if stats.BytesToServer != 10*stats.PacketsToServer {
+		t.Errorf("fast path counted %d bytes for %d packets of 10 bytes", stats.BytesToServer, stats.PacketsToServer)
+	}
+	if since := time.Since(stats.LastToServer); since < 0 || since > time.Minute {
+		t.Errorf("last packet to the destination %v ago", since)
+	}
+	if got := f.Metrics().PacketsToServer; got+stats.PacketsToServer != packets+1 {
+		t.Errorf("forwarder forwarded %d packets to the destination besides the fast path's %d, want %d in all", got, stats.PacketsToServer, packets+1)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Attributes of RTM_SETLINK attaching XDP programs.
+const (
+	iflaXDP      = 43
+	iflaXDPFD    = 1
+	iflaXDPFlags = 3
+	nlaFNested   = 0x8000
+)
+
+// Flags of IFLA_XDP_FLAGS.
+const (
+	xdpFlagsUpdateIfNoExist = 1 << 0
+	xdpFlagsSKBMode         = 1 << 1
+	xdpFlagsDrvMode         = 1 << 2
+)
+
+// modeFlags returns the flags attaching a program in mode.
+func modeFlags(mode Mode) uint32 {
+	switch mode {
+	case ModeNative:
+		return xdpFlagsDrvMode
+	case ModeGeneric:
+		return xdpFlagsSKBMode
+	}
+	return 0
+}
+
+// setXDP attaches the XDP program with the file descriptor fd to the
+// interface with the given index, or detaches its program if fd is -1.
+func setXDP(ifindex, fd int, flags uint32) error {
+	s, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(s)
+	if err := syscall.Bind(s, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofIfInfomsg+4+8+8)
+	order := binary.LittleEndian
+	order.PutUint32(msg[0:], uint32(len(msg)))
+	order.PutUint16(msg[4:], syscall.RTM_SETLINK)
+	order.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	order.PutUint32(msg[8:], 1) // sequence number
+	info := msg[syscall.NLMSG_HDRLEN:]
+	info[0] = syscall.AF_UNSPEC
+	order.PutUint32(info[4:], uint32(ifindex))
+	attr := info[syscall.SizeofIfInfomsg:]
+	order.PutUint16(attr[0:], 4+8+8)
+	order.PutUint16(attr[2:], iflaXDP|nlaFNested)
+	order.PutUint16(attr[4:], 8)
+	order.PutUint16(attr[6:], iflaXDPFD)
+	order.PutUint32(attr[8:], uint32(int32(fd)))
+	order.PutUint16(attr[12:], 8)
+	order.PutUint16(attr[14:], iflaXDPFlags)
+	order.PutUint32(attr[16:], flags)
+	if err := syscall.Sendto(s, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(s, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := -int32(order.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,267 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package xdp
+
+// The program forwards ESP-in-UDP over IPv4 without IP options or fragments.
+// It looks the source of a packet up in the sessions map, keyed by the
+// address of the client and the port of the listener it sent to, and in the
+// replies map, keyed by the address of the destination and the port of the
+// socket of the forwarder it replied to. On a match it rewrites the
+// addresses and ports as the forwarder would, zeroes the UDP checksum, which
+// NAT-T allows (RFC 3948), and redirects the packet to the next hop found by
+// the kernel's FIB. Everything else, such as IKE messages, which start with
+// the non-ESP marker, and packets the FIB cannot route yet, is passed on to
+// the network stack and so to the forwarder.
+
+// Offsets in the packet.
+const (
+	offEthType  = 12
+	offIPVerIHL = 14
+	offIPTOS    = 15
+	offIPLen    = 16
+	offIPFrag   = 20
+	offIPTTL    = 22
+	offIPProto  = 23
+	offIPCsum   = 24
+	offIPSrc    = 26
+	offIPDst    = 30
+	offUDPSrc   = 34
+	offUDPDst   = 36
+	offUDPLen   = 38
+	offUDPCsum  = 40
+	offPayload  = 42
+	minPacket   = offPayload + 8 // the SPI and sequence number of ESP
+)
+
+// Offsets in struct xdp_md.
+const (
+	offData         = 0
+	offDataEnd      = 4
+	offIngressIndex = 12
+)
+
+// Both maps have keys of the address and port of the sender and the port
+// it sent to, and values whose first 16 bytes depend on the map, followed by
+// the counters. All addresses and ports are in network byte order.
+const (
+	keySize   = 8
+	valueSize = 40
+
+	// Values of the sessions map: the address and port of the socket of
+	// the forwarder, the destination and the address the client sent to,
+	// learned from its packets.
+	offSessLocal     = 0
+	offSessDst       = 4
+	offSessLocalPort = 8
+	offSessDstPort   = 10
+	offSessListen    = 12
+
+	// Values of the replies map: the key of the session, that is the
+	// address and port of the client and the port it sent to.
+	offReplyClient     = 0
+	offReplyClientPort = 4
+	offReplyListenPort = 6
+
+	offValPackets = 16
+	offValBytes   = 24
+	offValLast    = 32 // CLOCK_MONOTONIC in nanoseconds
+)
+
+// Offsets on the stack: the key looked up, the addresses and ports the
+// packet is rewritten to and the struct bpf_fib_lookup passed to the FIB.
+const (
+	stKey     = -8
+	stSrc     = -24
+	stDst     = -20
+	stSrcPort = -16
+	stDstPort = -14
+	stFib     = -88
+
+	fibFamily  = stFib + 0
+	fibL4Proto = stFib + 1
+	fibSrcPort = stFib + 2
+	fibDstPort = stFib + 4
+	fibTotLen  = stFib + 6
+	fibIfindex = stFib + 8
+	fibTOS     = stFib + 12
+	fibSrc     = stFib + 16
+	fibDst     = stFib + 32
+	fibSrcMAC  = stFib + 52
+	fibDstMAC  = stFib + 58
+	fibSize    = 64
+)
+
+const (
+	ethPIPBigEndian = 0x0008 // ETH_P_IP as loaded from the packet
+	ipv4NoOptions   = 0x45
+	ipProtoUDP      = 17
+	ipFragMask      = 0xff3f // the more fragments flag and fragment offset
+	afInet          = 2
+	defaultTTL      = 64
+	xdpPass         = 2
+)
+
+// program returns the XDP program using the maps with the file descriptors
+// sessions and replies.
+func program(sessions, replies int) ([]byte, error) {
+	var a asm
+	a.aluReg(opMov, r6, r1)
+	a.loadPacket()
+	a.ldx(sizeH, r4, r2, offEthType)
+	a.jmp(opJne, r4, ethPIPBigEndian, "pass")
+	a.ldx(sizeB, r4, r2, offIPVerIHL)
+	a.jmp(opJne, r4, ipv4NoOptions, "pass")
+	a.ldx(sizeB, r4, r2, offIPProto)
+	a.jmp(opJne, r4, ipProtoUDP, "pass")
+	a.ldx(sizeH, r4, r2, offIPFrag)
+	a.alu(opAnd, r4, ipFragMask)
+	a.jmp(opJne, r4, 0, "pass")
+	a.ldx(sizeW, r4, r2, offPayload)
+	a.jmp(opJeq, r4, 0, "pass") // the non-ESP marker of IKE
+
+	// Both keys are the source address and port and the destination port.
+	a.ldx(sizeW, r4, r2, offIPSrc)
+	a.stx(sizeW, r10, stKey, r4)
+	a.ldx(sizeH, r4, r2, offUDPSrc)
+	a.stx(sizeH, r10, stKey+4, r4)
+	a.ldx(sizeH, r4, r2, offUDPDst)
+	a.stx(sizeH, r10, stKey+6, r4)
+
+	// From a client: learn the address it sent to, which the replies are
+	// sent from, and send it on from the socket to its destination.
+	a.ldMap(r1, sessions)
+	a.aluReg(opMov, r2, r10)
+	a.alu(opAdd, r2, stKey)
+	a.call(helperMapLookup)
+	a.jmp(opJeq, r0, 0, "reply")
+	a.aluReg(opMov, r7, r0)
+	a.loadPacket()
+	a.ldx(sizeW, r4, r2, offIPDst)
+	a.stx(sizeW, r7, offSessListen, r4)
+	a.copy(sizeW, stSrc, r7, offSessLocal)
+	a.copy(sizeW, stDst, r7, offSessDst)
+	a.copy(sizeH, stSrcPort, r7, offSessLocalPort)
+	a.copy(sizeH, stDstPort, r7, offSessDstPort)
+	a.ja("forward")
+
+	// From a destination: send it on to the client from the address the
+	// client sent to, once known.
+	a.label("reply")
+	a.ldMap(r1, replies)
+	a.aluReg(opMov, r2, r10)
+	a.alu(opAdd, r2, stKey)
+	a.call(helperMapLookup)
+	a.jmp(opJeq, r0, 0, "pass")
+	a.aluReg(opMov, r7, r0)
+	a.ldMap(r1, sessions)
+	a.aluReg(opMov, r2, r7) // the value starts with the key of the session
+	a.call(helperMapLookup)
+	a.jmp(opJeq, r0, 0, "pass")
+	a.ldx(sizeW, r4, r0, offSessListen)
+	a.jmp(opJeq, r4, 0, "pass")
+	a.stx(sizeW, r10, stSrc, r4)
+	a.copy(sizeW, stDst, r7, offReplyClient)
+	a.copy(sizeH, stSrcPort, r7, offReplyListenPort)
+	a.copy(sizeH, stDstPort, r7, offReplyClientPort)
+
+	// Find the next hop before touching the packet, so that packets the
+	// FIB cannot route yet reach the forwarder unchanged.
+	a.label("forward")
+	for off := int16(stFib); off < stFib+fibSize; off += 8 {
+		a.st(sizeDW, r10, off, 0)
+	}
+	a.st(sizeB, r10, fibFamily, afInet)
+	a.st(sizeB, r10, fibL4Proto, ipProtoUDP)
+	a.copy(sizeH, fibSrcPort, r10, stSrcPort)
+	a.copy(sizeH, fibDstPort, r10, stDstPort)
+	a.copy(sizeW, fibSrc, r10, stSrc)
+	a.copy(sizeW, fibDst, r10, stDst)
+	a.copy(sizeW, fibIfindex, r6, offIngressIndex)
+	a.loadPacket()
+	a.ldx(sizeH, r1, r2, offIPLen)
+	a.be16(r1)
+	a.stx(sizeH, r10, fibTotLen, r1)
+	a.copy(sizeB, fibTOS, r2, offIPTOS)
+	a.aluReg(opMov, r1, r6)
+	a.aluReg(opMov, r2, r10)
+	a.alu(opAdd, r2, stFib)
+	a.alu(opMov, r3, fibSize)
+	a.alu(opMov, r4, 0)
+	a.call(helperFibLookup)
+	a.jmp(opJne, r0, 0, "pass")
+
+	a.loadPacket()
+	a.copyTo(sizeH, r2, 0, stFib+58)
+	a.copyTo(sizeH, r2, 2, stFib+60)
+	a.copyTo(sizeH, r2, 4, stFib+62)
+	a.copyTo(sizeW, r2, 6, fibSrcMAC)
+	a.copyTo(sizeH, r2, 10, fibSrcMAC+4)
+	a.copyTo(sizeW, r2, offIPSrc, stSrc)
+	a.copyTo(sizeW, r2, offIPDst, stDst)
+	a.copyTo(sizeH, r2, offUDPSrc, stSrcPort)
+	a.copyTo(sizeH, r2, offUDPDst, stDstPort)
+	a.st(sizeH, r2, offUDPCsum, 0)
+	a.st(sizeB, r2, offIPTTL, defaultTTL)
+	a.st(sizeH, r2, offIPCsum, 0)
+
+	// The header checksum is the one's complement of the one's complement
+	// sum of its ten 16-bit words, in either byte order.
+	a.alu(opMov, r1, 0)
+	for off := int16(offIPVerIHL); off < offUDPSrc; off += 2 {
+		a.ldx(sizeH, r3, r2, off)
+		a.aluReg(opAdd, r1, r3)
+	}
+	for i := 0; i < 2; i++ {
+		a.aluReg(opMov, r3, r1)
+		a.alu(opRsh, r3, 16)
+		a.alu(opAnd, r1, 0xffff)
+		a.aluReg(opAdd, r1, r3)
+	}
+	a.alu(opXor, r1, -1)
+	a.alu(opAnd, r1, 0xffff)
+	a.stx(sizeH, r2, offIPCsum, r1)
+
+	a.alu(opMov, r1, 1)
+	a.xadd(r7, offValPackets, r1)
+	a.ldx(sizeH, r1, r2, offUDPLen)
+	a.be16(r1)
+	a.alu(opAdd, r1, -8)
+	a.xadd(r7, offValBytes, r1)
+	a.call(helperKtimeNs)
+	a.stx(sizeDW, r7, offValLast, r0)
+
+	a.ldx(sizeW, r1, r10, fibIfindex)
+	a.alu(opMov, r2, 0)
+	a.call(helperRedirect)
+	a.exit()
+
+	a.label("pass")
+	a.alu(opMov, r0, xdpPass)
+	a.exit()
+	return a.assemble()
+}
+
+// loadPacket loads the start of the packet into r2 and its end into r3, and
+// passes packets too short to be ESP-in-UDP on. It is needed after every
+// helper call, which clobbers r1 to r5.
+func (a *asm) loadPacket() {
+	a.ldx(sizeW, r2, r6, offData)
+	a.ldx(sizeW, r3, r6, offDataEnd)
+	a.aluReg(opMov, r4, r2)
+	a.alu(opAdd, r4, minPacket)
+	a.jmpReg(opJgt, r4, r3, "pass")
+}
+
+// copy copies *(size *)(src + off) to the stack at dst, through r4.
+func (a *asm) copy(size uint8, dst int16, src uint8, off int16) {
+	a.ldx(size, r4, src, off)
+	a.stx(size, r10, dst, r4)
+}
+
+// copyTo copies the stack at src to *(size *)(dst + off), through r1.
+func (a *asm) copyTo(size, dst uint8, off, src int16) {
+	a.ldx(size, r1, r10, src)
+	a.stx(size, dst, off, r1)
+}
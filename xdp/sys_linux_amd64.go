@@ -0,0 +1,7 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+package xdp
+
+// sysBPF is the number of the bpf system call, which package syscall lacks.
+const sysBPF = 321
@@ -0,0 +1,7 @@
+//go:build linux && arm64
+// +build linux,arm64
+
+package xdp
+
+// sysBPF is the number of the bpf system call, which package syscall lacks.
+const sysBPF = 280
@@ -0,0 +1,8 @@
+//go:build linux && arm64
+// +build linux,arm64
+
+package xdp
+
+// sysSetns is the number of the setns system call, which package syscall
+// lacks, to create sockets in network namespaces in tests.
+const sysSetns = 268
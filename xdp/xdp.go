@@ -0,0 +1,51 @@
+// Package xdp forwards the ESP-in-UDP packets of established sessions in the
+// kernel with an XDP program, as the fast path of a forwarder on the NAT-T
+// port, see ipsec.Forwarder.SetFastPath. The program rewrites packets as the
+// forwarder would and sends them straight out of the interface the FIB
+// routes them to, so that only IKE messages, keepalives and the packets of
+// new sessions reach the forwarder.
+//
+// Only IPv4 is forwarded, and IP forwarding must be enabled on the
+// interfaces the program is attached to, as the FIB lookup of XDP requires
+// it. It needs Linux 5.3 or later on amd64 or arm64, CAP_NET_ADMIN and
+// CAP_BPF or CAP_SYS_ADMIN.
+package xdp
+
+import "fmt"
+
+// MaxSessions is the number of sessions the kernel forwards at most. The
+// sessions of further clients stay with the forwarder.
+const MaxSessions = 1 << 16
+
+// Mode is how the program is attached to an interface.
+type Mode int
+
+// Modes of attaching the program.
+const (
+	ModeAuto    Mode = iota // native if the driver supports XDP, generic otherwise
+	ModeNative              // in the driver, before the kernel allocates socket buffers
+	ModeGeneric             // after the kernel allocated socket buffers, on any interface
+)
+
+var modeNames = [...]string{
+	ModeAuto:    "auto",
+	ModeNative:  "native",
+	ModeGeneric: "generic",
+}
+
+func (m Mode) String() string {
+	if m >= 0 && int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return "unknown"
+}
+
+// ParseMode parses the name of a Mode, such as generic.
+func ParseMode(s string) (Mode, error) {
+	for m, name := range modeNames {
+		if s == name {
+			return Mode(m), nil
+		}
+	}
+	return ModeAuto, fmt.Errorf("unknown XDP mode %q, want auto, native or generic", s)
+}